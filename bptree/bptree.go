@@ -4,81 +4,147 @@ package bptree
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 
 	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 // BPTree represents a B+ tree on disk.
 type BPTree struct {
-	fileStorage  *fsm.FileStorage
-	rootAddr     int64
-	height       int
-	leafList     leafList
-	leafCount    int
-	nonLeafCount int
-	recordCount  int
-	payloadSize  int
-}
-
-// Init initializes the B+ tree with the given file storage and returns it.
-func (bpt *BPTree) Init(fileStorage *fsm.FileStorage) *BPTree {
+	fileStorage       *fsm.FileStorage
+	options           options
+	optionsErr        error
+	pageSize          int
+	maxKeySize        int
+	maxValueSize      int
+	rootAddr          int64
+	height            int
+	leafList          leafList
+	leafCount         int
+	nonLeafCount      int
+	recordCount       int
+	payloadSize       int
+	generation        int64
+	snapshots         []*Snapshot
+	pendingSpaces     []pendingSpace
+	modificationCount int64
+}
+
+// Init initializes the B+ tree with the given file storage and options
+// and returns it.
+// If the options are invalid, Create and Load return the error, as
+// CheckOptions does, and leave the file storage untouched.
+func (bpt *BPTree) Init(fileStorage *fsm.FileStorage, options ...Option) *BPTree {
 	bpt.fileStorage = fileStorage
-	bpt.rootAddr = -1
-	bpt.leafList.Set(-1, -1)
+	bpt.options, bpt.optionsErr = makeOptions(options)
+	bpt.reset()
 	return bpt
 }
 
-// Create creates the B+ tree on the file storage.
-func (bpt *BPTree) Create() {
+// Create creates the B+ tree on the file storage, with the page size
+// and the maximum key and value sizes set by the options.
+// If the options are invalid, it returns the error.
+func (bpt *BPTree) Create() error {
+	if bpt.optionsErr != nil {
+		return bpt.optionsErr
+	}
+
 	var rootController leafController
 	bpt.rootAddr, rootController = bpt.createLeaf()
 	bpt.height = 1
 	bpt.leafList.Init(rootController, bpt.rootAddr)
+	bpt.modificationCount++
+	return nil
 }
 
 // Destroy destroys the B+ tree on the file storage.
-func (bpt *BPTree) Destroy() {
+func (bpt *BPTree) Destroy() (err error) {
+	defer corruption.Recover(&err)
 	bpt.destroyLeaf(bpt.rootAddr)
-	*bpt = *new(BPTree).Init(bpt.fileStorage)
+	bpt.reset()
+	return nil
 }
 
 // Store stores the B+ tree to the file storage and then returns
 // the info address.
+// The snapshots of the B+ tree are released.
 func (bpt *BPTree) Store() int64 {
 	buffer := bytes.NewBuffer(nil)
 
 	info := bpTreeInfo{
-		RootAddr:         bpt.rootAddr,
-		Height:           int8(bpt.height),
-		LeafListTailAddr: bpt.leafList.TailAddr(),
-		LeafListHeadAddr: bpt.leafList.HeadAddr(),
-		LeafCount:        int64(bpt.leafCount),
-		NonLeafCount:     int64(bpt.nonLeafCount),
-		RecordCount:      int64(bpt.recordCount),
-		PayloadSize:      int64(bpt.payloadSize),
+		FormatVersion:        formatVersion,
+		RootAddr:             bpt.rootAddr,
+		Height:               int8(bpt.height),
+		LeafListTailAddr:     bpt.leafList.TailAddr(),
+		LeafListHeadAddr:     bpt.leafList.HeadAddr(),
+		LeafCount:            int64(bpt.leafCount),
+		NonLeafCount:         int64(bpt.nonLeafCount),
+		RecordCount:          int64(bpt.recordCount),
+		PayloadSize:          int64(bpt.payloadSize),
+		Generation:           bpt.generation,
+		PendingSpaceListAddr: bpt.storePendingSpaces(),
+		PageSize:             int32(bpt.pageSize),
+		MaxKeySize:           int32(bpt.maxKeySize),
+		MaxValueSize:         int32(bpt.maxValueSize),
+		KeyComparerNameSize:  uint8(len(bpt.options.KeyComparer.Name())),
 	}
 
 	if err := binary.Write(buffer, binary.BigEndian, &info); err != nil {
 		panic(err)
 	}
 
+	buffer.WriteString(bpt.options.KeyComparer.Name())
+
 	infoAddr, buffer2 := bpt.fileStorage.AllocateSpace(buffer.Len())
 	copy(buffer2, buffer.Bytes())
-	*bpt = *new(BPTree).Init(bpt.fileStorage)
+
+	for _, snapshot := range bpt.snapshots {
+		snapshot.isReleased = true
+	}
+
+	bpt.reset()
 	return infoAddr
 }
 
 // Load loads the B+ tree from the file storage with the
 // given info address.
-func (bpt *BPTree) Load(infoAddr int64) {
-	data := bytes.NewReader(bpt.fileStorage.AccessSpace(infoAddr))
-	var info bpTreeInfo
+// The B+ tree keeps the page size and the maximum key and value sizes
+// it was created with, regardless of the ones set by the options.
+// If the options are invalid it returns the error, or if the info
+// is corrupted it returns a CorruptedError, or if the B+ tree was
+// stored in a format of another version it returns
+// ErrUnsupportedFormatVersion, or if the B+ tree was stored with
+// a key comparer of another name it returns ErrKeyComparerMismatch,
+// and the B+ tree is left unloaded.
+func (bpt *BPTree) Load(infoAddr int64) (err error) {
+	if bpt.optionsErr != nil {
+		return bpt.optionsErr
+	}
 
-	if err := binary.Read(data, binary.BigEndian, &info); err != nil {
-		panic(err)
+	defer corruption.Recover(&err)
+	info, keyComparerName, err := bpt.loadInfo(infoAddr)
+
+	if err != nil {
+		return err
+	}
+
+	if keyComparerName != bpt.options.KeyComparer.Name() {
+		return ErrKeyComparerMismatch
+	}
+
+	if pageSize := int(info.PageSize); info.Height == 1 {
+		leafFactory{bpt.fileStorage, pageSize}.GetLeafController(info.RootAddr)
+	} else {
+		nonLeafFactory{bpt.fileStorage, pageSize}.GetNonLeafController(info.RootAddr)
 	}
 
-	bpt.fileStorage.FreeSpace(infoAddr)
+	pendingSpaces := bpt.loadPendingSpaces(info.PendingSpaceListAddr)
+	freeSpace(bpt.fileStorage, infoAddr)
+	bpt.pageSize = int(info.PageSize)
+	bpt.maxKeySize = int(info.MaxKeySize)
+	bpt.maxValueSize = int(info.MaxValueSize)
 	bpt.rootAddr = info.RootAddr
 	bpt.height = int(info.Height)
 	bpt.leafList.Set(info.LeafListTailAddr, info.LeafListHeadAddr)
@@ -86,21 +152,28 @@ func (bpt *BPTree) Load(infoAddr int64) {
 	bpt.nonLeafCount = int(info.NonLeafCount)
 	bpt.recordCount = int(info.RecordCount)
 	bpt.payloadSize = int(info.PayloadSize)
+	bpt.generation = info.Generation
+	bpt.modificationCount++
+	// the spaces pending to be freed were kept for the snapshots,
+	// which don't outlive the B+ tree
+	bpt.freePendingSpaces(pendingSpaces)
+	return nil
 }
 
 // AddRecord adds the given record to the B+ tree.
 // If no record with an identical key exists in the B+ tree,
 // it adds the record and then returns true, otherwise it
 // returns false and the present value (optional) of the record.
-func (bpt *BPTree) AddRecord(key, value []byte, returnPresentValue bool) ([]byte, bool) {
+func (bpt *BPTree) AddRecord(key, value []byte, returnPresentValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	recordPath, ok := bpt.findRecord(key)
 
 	if ok {
-		return bpt.getValue(recordPath, returnPresentValue), false
+		return bpt.getValue(recordPath, returnPresentValue), false, nil
 	}
 
-	bpt.insertRecord(recordPath, bpt.createRecord(key, value))
-	return nil, true
+	bpt.insertRecord(&recordPath, bpt.createRecord(key, value))
+	return nil, true, nil
 }
 
 // UpdateRecord replaces the value of a record with the given
@@ -108,14 +181,15 @@ func (bpt *BPTree) AddRecord(key, value []byte, returnPresentValue bool) ([]byte
 // If a record with an identical key exists in the B+ tree,
 // it updates the record and then returns true and the replaced
 // value (optional) of the record, otherwise it returns flase.
-func (bpt *BPTree) UpdateRecord(key, value []byte, returnReplacedValue bool) ([]byte, bool) {
+func (bpt *BPTree) UpdateRecord(key, value []byte, returnReplacedValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	recordPath, ok := bpt.findRecord(key)
 
 	if !ok {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return bpt.replaceValue(recordPath, value, returnReplacedValue), true
+	return bpt.replaceValue(&recordPath, value, returnReplacedValue), true, nil
 }
 
 // AddOrUpdateRecord adds the given record to the B+ tree or
@@ -125,15 +199,16 @@ func (bpt *BPTree) UpdateRecord(key, value []byte, returnReplacedValue bool) ([]
 // it adds the record and then returns true, otherwise if
 // updates the record and then returns false and the replaced
 // value (optional) of the record.
-func (bpt *BPTree) AddOrUpdateRecord(key, value []byte, returnReplacedValue bool) ([]byte, bool) {
+func (bpt *BPTree) AddOrUpdateRecord(key, value []byte, returnReplacedValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	recordPath, ok := bpt.findRecord(key)
 
 	if ok {
-		return bpt.replaceValue(recordPath, value, returnReplacedValue), false
+		return bpt.replaceValue(&recordPath, value, returnReplacedValue), false, nil
 	}
 
-	bpt.insertRecord(recordPath, bpt.createRecord(key, value))
-	return nil, true
+	bpt.insertRecord(&recordPath, bpt.createRecord(key, value))
+	return nil, true, nil
 }
 
 // DeleteRecord deletes a record with the given key in the
@@ -142,14 +217,15 @@ func (bpt *BPTree) AddOrUpdateRecord(key, value []byte, returnReplacedValue bool
 // it deletes the record then then returns true and the
 // removed value (optional) of the record, otherwise it
 // returns flase.
-func (bpt *BPTree) DeleteRecord(key []byte, returnRemovedValue bool) ([]byte, bool) {
+func (bpt *BPTree) DeleteRecord(key []byte, returnRemovedValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	recordPath, ok := bpt.findRecord(key)
 
 	if !ok {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return bpt.destroyRecord(bpt.removeRecord(recordPath), returnRemovedValue), true
+	return bpt.destroyRecord(bpt.removeRecord(&recordPath), returnRemovedValue), true, nil
 }
 
 // HasRecord checks whether a record with the given key
@@ -157,14 +233,15 @@ func (bpt *BPTree) DeleteRecord(key []byte, returnRemovedValue bool) ([]byte, bo
 // If a record with an identical key exists in the B+ tree,
 // it returns true and the present value (optional) of the
 // record, otherwise it returns flase.
-func (bpt *BPTree) HasRecord(key []byte, returnPresentValue bool) ([]byte, bool) {
+func (bpt *BPTree) HasRecord(key []byte, returnPresentValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	recordPath, ok := bpt.findRecord(key)
 
 	if !ok {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return bpt.getValue(recordPath, returnPresentValue), true
+	return bpt.getValue(recordPath, returnPresentValue), true, nil
 }
 
 // SearchForward searchs the the B+ tree for records with
@@ -172,16 +249,7 @@ func (bpt *BPTree) HasRecord(key []byte, returnPresentValue bool) ([]byte, bool)
 // It returns an iterator to iterate over the records found
 // in ascending order.
 func (bpt *BPTree) SearchForward(minKey []byte, maxKey []byte) Iterator {
-	minLeafAddr, minRecordIndex, maxLeafAddr, maxRecordIndex, ok := bpt.search(minKey, maxKey)
-
-	return new(forwardIterator).Init(
-		bpt.fileStorage,
-		minLeafAddr,
-		minRecordIndex,
-		maxLeafAddr,
-		maxRecordIndex,
-		!ok,
-	)
+	return bpt.SearchRange(makeBound(minKey), makeBound(maxKey), false)
 }
 
 // SearchBackward searchs the the B+ tree for records with
@@ -189,16 +257,52 @@ func (bpt *BPTree) SearchForward(minKey []byte, maxKey []byte) Iterator {
 // It returns an iterator to iterate over the records found
 // in descending order.
 func (bpt *BPTree) SearchBackward(minKey []byte, maxKey []byte) Iterator {
-	minLeafAddr, minRecordIndex, maxLeafAddr, maxRecordIndex, ok := bpt.search(minKey, maxKey)
+	return bpt.SearchRange(makeBound(minKey), makeBound(maxKey), true)
+}
+
+// SearchRange searchs the the B+ tree for records with
+// keys in the range between the given bounds, each of which
+// may be inclusive, exclusive or unbounded.
+// It returns an iterator to iterate over the records found
+// in ascending order, or in descending order if backward
+// is true.
+func (bpt *BPTree) SearchRange(minBound Bound, maxBound Bound, backward bool) Iterator {
+	if backward {
+		return new(backwardIterator).Init(bpt, minBound, maxBound)
+	}
+
+	return new(forwardIterator).Init(bpt, minBound, maxBound)
+}
+
+// SearchPrefix searchs the the B+ tree for records with
+// keys starting with the given prefix.
+// It returns an iterator to iterate over the records found
+// in ascending order, or in descending order if backward
+// is true.
+// With a PrefixKeyComparer, e.g. BytewiseKeyComparer, the keys
+// starting with the prefix are in a range, which is searched only.
+// With any other key comparer, such keys may be scattered, so all
+// the records are searched through and filtered by the prefix,
+// which takes O(n) time however few keys match.
+func (bpt *BPTree) SearchPrefix(prefix []byte, backward bool) Iterator {
+	prefixKeyComparer, ok := bpt.options.KeyComparer.(PrefixKeyComparer)
+
+	if !ok {
+		if backward {
+			return new(backwardIterator).InitWithKeyPrefix(bpt, prefix)
+		}
+
+		return new(forwardIterator).InitWithKeyPrefix(bpt, prefix)
+	}
+
+	minBound, maxBound := prefixKeyComparer.MakePrefixBounds(prefix)
+	return bpt.SearchRange(minBound, maxBound, backward)
+}
 
-	return new(backwardIterator).Init(
-		bpt.fileStorage,
-		maxLeafAddr,
-		maxRecordIndex,
-		minLeafAddr,
-		minRecordIndex,
-		!ok,
-	)
+// NewCursor returns a cursor over the B+ tree, which is not valid
+// until moved to a record.
+func (bpt *BPTree) NewCursor() Cursor {
+	return new(cursor).Init(bpt)
 }
 
 // Height returns the height of the B+ tree.
@@ -226,20 +330,103 @@ func (bpt *BPTree) PayloadSize() int {
 	return bpt.payloadSize
 }
 
-func (bpt *BPTree) insertRecord(recordPath recordPath, record1 record) {
-	_, leafController, recordIndex := bpt.locateRecord(recordPath)
+// PageSize returns the page size of the B+ tree, the size of each
+// leaf and non-leaf.
+func (bpt *BPTree) PageSize() int {
+	return bpt.pageSize
+}
+
+// MaxKeySize returns the maximum key size of the B+ tree, the keys
+// shorter than which are stored in the leaves as is.
+func (bpt *BPTree) MaxKeySize() int {
+	return bpt.maxKeySize
+}
+
+// MaxValueSize returns the maximum value size of the B+ tree, the
+// values shorter than which are stored in the leaves as is.
+func (bpt *BPTree) MaxValueSize() int {
+	return bpt.maxValueSize
+}
+
+// KeyComparer returns the key comparer of the B+ tree.
+func (bpt *BPTree) KeyComparer() KeyComparer {
+	return bpt.options.KeyComparer
+}
+
+func (bpt *BPTree) loadInfo(infoAddr int64) (*bpTreeInfo, string, error) {
+	rawData := accessSpace(bpt.fileStorage, infoAddr)
+
+	// the format version is checked ahead, as the info of another
+	// version may be of another layout
+	if len(rawData) < 4 {
+		corruption.Panic(infoAddr)
+	}
+
+	if binary.BigEndian.Uint32(rawData) != formatVersion {
+		return nil, "", ErrUnsupportedFormatVersion
+	}
+
+	data := bytes.NewReader(rawData)
+	var info bpTreeInfo
+
+	if err := binary.Read(data, binary.BigEndian, &info); err != nil {
+		corruption.Panic(infoAddr)
+	}
+
+	if !info.IsValid() {
+		corruption.Panic(infoAddr)
+	}
+
+	keyComparerName := make([]byte, info.KeyComparerNameSize)
+
+	if _, err := io.ReadFull(data, keyComparerName); err != nil {
+		corruption.Panic(infoAddr)
+	}
+
+	return &info, string(keyComparerName), nil
+}
+
+func (bpt *BPTree) reset() {
+	*bpt = BPTree{
+		fileStorage:       bpt.fileStorage,
+		options:           bpt.options,
+		optionsErr:        bpt.optionsErr,
+		pageSize:          bpt.options.PageSize,
+		maxKeySize:        bpt.options.MaxKeySize,
+		maxValueSize:      bpt.options.MaxValueSize,
+		rootAddr:          -1,
+		modificationCount: bpt.modificationCount + 1,
+	}
+
+	bpt.leafList.Set(-1, -1)
+}
+
+// insertRecord inserts the given record at the position which the
+// given record path refers to, after which the record path refers to
+// the record inserted.
+func (bpt *BPTree) insertRecord(recordPath *recordPath, record1 record) {
+	bpt.copyPathOnWrite(*recordPath)
+	_, leafController, recordIndex := bpt.locateRecord(*recordPath)
 	leafController.InsertRecords(recordIndex, []record{record1})
-	bpt.syncKey(&recordPath)
-	bpt.ensureNotOverloadLeaf(&recordPath)
+	bpt.addRecordCounts(*recordPath, 1)
+	bpt.syncKey(recordPath)
+	bpt.ensureNotOverloadLeaf(recordPath)
 	bpt.recordCount++
+	bpt.modificationCount++
 }
 
-func (bpt *BPTree) removeRecord(recordPath recordPath) record {
-	_, leafController, recordIndex := bpt.locateRecord(recordPath)
+// removeRecord removes the record which the given record path refers
+// to, after which the record path refers to the position of the record
+// removed, where the next record is if any.
+func (bpt *BPTree) removeRecord(recordPath *recordPath) record {
+	bpt.copyPathOnWrite(*recordPath)
+	_, leafController, recordIndex := bpt.locateRecord(*recordPath)
 	record := leafController.RemoveRecords(recordIndex, 1)[0]
-	bpt.syncKey(&recordPath)
-	bpt.ensureNotUnderloadLeaf(&recordPath)
+	bpt.addRecordCounts(*recordPath, -1)
+	bpt.syncKey(recordPath)
+	bpt.ensureNotUnderloadLeaf(recordPath)
 	bpt.recordCount--
+	bpt.modificationCount++
 	return record
 }
 
@@ -250,13 +437,13 @@ func (bpt *BPTree) getValue(recordPath recordPath, do bool) []byte {
 
 	_, leafController, recordIndex := bpt.locateRecord(recordPath)
 	value := leafController.GetValue(recordIndex)
-	return valueFactory{bpt.fileStorage}.ReadValueAll(value)
+	return valueFactory{bpt.fileStorage, bpt.maxValueSize}.ReadValueAll(value)
 }
 
 func (bpt *BPTree) createRecord(key, value []byte) record {
 	record := record{
-		Key:   keyFactory{bpt.fileStorage}.CreateKey(key),
-		Value: valueFactory{bpt.fileStorage}.CreateValue(value),
+		Key:   keyFactory{bpt.fileStorage, bpt.maxKeySize}.CreateKey(key),
+		Value: valueFactory{bpt.fileStorage, bpt.maxValueSize}.CreateValue(value),
 	}
 
 	bpt.payloadSize += len(key) + len(value)
@@ -264,41 +451,43 @@ func (bpt *BPTree) createRecord(key, value []byte) record {
 }
 
 func (bpt *BPTree) destroyRecord(record record, returnValue bool) []byte {
-	keySize := keyFactory{bpt.fileStorage}.DestroyKey(record.Key)
+	keySize := bpt.destroyKey(record.Key)
 	var value []byte
 
 	if returnValue {
-		value = valueFactory{bpt.fileStorage}.ReadValueAll(record.Value)
+		value = valueFactory{bpt.fileStorage, bpt.maxValueSize}.ReadValueAll(record.Value)
 	} else {
 		value = nil
 	}
 
-	valueSize := valueFactory{bpt.fileStorage}.DestroyValue(record.Value)
+	valueSize := bpt.destroyValue(record.Value)
 	bpt.payloadSize -= keySize + valueSize
 	return value
 }
 
-func (bpt *BPTree) replaceValue(recordPath recordPath, newValue []byte, returnOldValue bool) []byte {
-	leafAddr, leafController, recordIndex := bpt.locateRecord(recordPath)
+func (bpt *BPTree) replaceValue(recordPath *recordPath, newValue []byte, returnOldValue bool) []byte {
+	bpt.copyPathOnWrite(*recordPath)
+	leafAddr, leafController, recordIndex := bpt.locateRecord(*recordPath)
 	value := leafController.GetValue(recordIndex)
 	var oldValue []byte
 	var oldValueSize int
 
 	if returnOldValue {
-		oldValue = valueFactory{bpt.fileStorage}.ReadValueAll(value)
+		oldValue = valueFactory{bpt.fileStorage, bpt.maxValueSize}.ReadValueAll(value)
 		oldValueSize = len(oldValue)
 	} else {
 		oldValue = nil
-		oldValueSize = valueFactory{bpt.fileStorage}.GetRawValueSize(value)
+		oldValueSize = valueFactory{bpt.fileStorage, bpt.maxValueSize}.GetRawValueSize(value)
 	}
 
-	valueFactory{bpt.fileStorage}.DestroyValue(value)
-	value = valueFactory{bpt.fileStorage}.CreateValue(newValue)
+	bpt.destroyValue(value)
+	value = valueFactory{bpt.fileStorage, bpt.maxValueSize}.CreateValue(newValue)
 	leafController = bpt.getLeafController(leafAddr)
 	leafController.SetValue(recordIndex, value)
-	bpt.ensureNotUnderloadLeaf(&recordPath)
-	bpt.ensureNotOverloadLeaf(&recordPath)
+	bpt.ensureNotUnderloadLeaf(recordPath)
+	bpt.ensureNotOverloadLeaf(recordPath)
 	bpt.payloadSize += len(newValue) - oldValueSize
+	bpt.modificationCount++
 	return oldValue
 }
 
@@ -313,13 +502,13 @@ func (bpt *BPTree) findRecord(key []byte) (recordPath, bool) {
 	for {
 		if nodeDepth := len(recordPath) + 1; nodeDepth == bpt.height {
 			leafController := bpt.getLeafController(nodeAddr)
-			i, ok := leafController.LocateRecord(key, keyComparer{bpt.fileStorage})
+			i, ok := leafController.LocateRecord(key, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
 			recordPath = append(recordPath, recordPathComponent{nodeAddr, i})
 			return recordPath, ok
 		}
 
 		nonLeafController := bpt.getNonLeafController(nodeAddr)
-		i, ok := nonLeafController.LocateChild(key, keyComparer{bpt.fileStorage})
+		i, ok := nonLeafController.LocateChild(key, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
 
 		if !ok {
 			i--
@@ -330,6 +519,40 @@ func (bpt *BPTree) findRecord(key []byte) (recordPath, bool) {
 	}
 }
 
+// findEndRecord finds the first record, or the last record if
+// isLast is true, the B+ tree must not be empty.
+func (bpt *BPTree) findEndRecord(isLast bool) recordPath {
+	recordPath := recordPath(make([]recordPathComponent, 0, bpt.height))
+	nodeAddr := bpt.rootAddr
+
+	for {
+		if nodeDepth := len(recordPath) + 1; nodeDepth == bpt.height {
+			var i int
+
+			if isLast {
+				i = bpt.getLeafController(nodeAddr).NumberOfRecords() - 1
+			} else {
+				i = 0
+			}
+
+			recordPath = append(recordPath, recordPathComponent{nodeAddr, i})
+			return recordPath
+		}
+
+		nonLeafController := bpt.getNonLeafController(nodeAddr)
+		var i int
+
+		if isLast {
+			i = nonLeafController.NumberOfChildren() - 1
+		} else {
+			i = 0
+		}
+
+		recordPath = append(recordPath, recordPathComponent{nodeAddr, i})
+		nodeAddr = nonLeafController.GetChildAddr(i)
+	}
+}
+
 func (bpt *BPTree) locateRecord(recordPath recordPath) (int64, leafController, int) {
 	leafAddr := recordPath[len(recordPath)-1].NodeAddr
 	leafController := bpt.getLeafController(leafAddr)
@@ -337,6 +560,32 @@ func (bpt *BPTree) locateRecord(recordPath recordPath) (int64, leafController, i
 	return leafAddr, leafController, recordIndex
 }
 
+// addRecordCounts adds the given delta to the record counts of the
+// non-leaf children along the given record path.
+func (bpt *BPTree) addRecordCounts(recordPath recordPath, recordCountDelta int) {
+	for i := len(recordPath) - 2; i >= 0; i-- {
+		nonLeafController := bpt.getNonLeafController(recordPath[i].NodeAddr)
+		nonLeafController.AddChildRecordCount(recordPath[i].RecordOrNonLeafChildIndex, recordCountDelta)
+	}
+}
+
+// countRecords returns the number of the records in the subtree of
+// the node at the given address and depth.
+func (bpt *BPTree) countRecords(nodeAddr int64, nodeDepth int) int {
+	if nodeDepth == bpt.height-1 {
+		return bpt.getLeafController(nodeAddr).NumberOfRecords()
+	}
+
+	nonLeafController := bpt.getNonLeafController(nodeAddr)
+	recordCount := 0
+
+	for i, n := 0, nonLeafController.NumberOfChildren(); i < n; i++ {
+		recordCount += nonLeafController.GetChildRecordCount(i)
+	}
+
+	return recordCount
+}
+
 func (bpt *BPTree) syncKey(recordPath *recordPath) {
 	n := len(*recordPath)
 
@@ -357,7 +606,10 @@ func (bpt *BPTree) syncKey(recordPath *recordPath) {
 
 		if nonLeafChildIndex >= 1 {
 			nonLeafController := bpt.getNonLeafController((*recordPath)[i].NodeAddr)
-			nonLeafController.SetKey(nonLeafChildIndex, leafController.GetKey(0))
+			// the key separates the leaf from the previous one
+			leafPrevController := bpt.getLeafController(leafHeader(leafController).PrevAddr())
+			key := keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize}.MakeSeparator(leafPrevController.GetKey(leafPrevController.NumberOfRecords()-1), leafController.GetKey(0))
+			nonLeafController.SetKey(nonLeafChildIndex, key)
 			bpt.ensureNotUnderloadNonLeaf(recordPath, i)
 			bpt.ensureNotOverloadNonLeaf(recordPath, i)
 			return
@@ -370,7 +622,7 @@ func (bpt *BPTree) ensureNotOverloadLeaf(recordPath *recordPath) {
 	leafAddr := (*recordPath)[i].NodeAddr
 	leafController1 := bpt.getLeafController(leafAddr)
 
-	if leafController1.GetLoadSize() <= leafOverloadThreshold {
+	if leafController1.GetLoadSize() <= leafController1.OverloadThreshold(bpt.maxRecordSize()) {
 		return
 	}
 
@@ -394,12 +646,16 @@ func (bpt *BPTree) ensureNotOverloadLeaf(recordPath *recordPath) {
 	leafIndex := (*recordPath)[i-1].RecordOrNonLeafChildIndex
 
 	if leafIndex < leafParentController.NumberOfChildren()-1 {
-		leafRSiblingAddr := leafParentController.GetChildAddr(leafIndex + 1)
+		leafRSiblingAddr := bpt.copyLeafOnWrite(leafParentAddr, leafIndex+1)
+		// >>> fix node controllers begin
+		leafController1 = bpt.getLeafController(leafAddr)
+		leafParentController = bpt.getNonLeafController(leafParentAddr)
+		// <<< fix node controllers end
 		leafRSiblingController := bpt.getLeafController(leafRSiblingAddr)
 
-		if numberOfRecords := leafController1.CountRecordsForShiftingToRight(leafRSiblingController); numberOfRecords >= 1 {
+		if numberOfRecords := leafController1.CountRecordsForShiftingToRight(leafRSiblingController, bpt.maxRecordSize()); numberOfRecords >= 1 {
 			m := leafController1.NumberOfRecords() - numberOfRecords
-			leafController1.ShiftToRight(numberOfRecords, leafParentController, leafIndex, leafRSiblingController)
+			leafController1.ShiftToRight(numberOfRecords, leafParentController, leafIndex, leafRSiblingController, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
 
 			if recordIndex >= m {
 				// >>> fix record path begin
@@ -416,12 +672,16 @@ func (bpt *BPTree) ensureNotOverloadLeaf(recordPath *recordPath) {
 	}
 
 	if leafIndex >= 1 {
-		leafLSiblingAddr := leafParentController.GetChildAddr(leafIndex - 1)
+		leafLSiblingAddr := bpt.copyLeafOnWrite(leafParentAddr, leafIndex-1)
+		// >>> fix node controllers begin
+		leafController1 = bpt.getLeafController(leafAddr)
+		leafParentController = bpt.getNonLeafController(leafParentAddr)
+		// <<< fix node controllers end
 		leafLSiblingController := bpt.getLeafController(leafLSiblingAddr)
 
-		if numberOfRecords := leafController1.CountRecordsForShiftingToLeft(leafLSiblingController); numberOfRecords >= 1 {
+		if numberOfRecords := leafController1.CountRecordsForShiftingToLeft(leafLSiblingController, bpt.maxRecordSize()); numberOfRecords >= 1 {
 			m := leafLSiblingController.NumberOfRecords()
-			leafController1.ShiftToLeft(numberOfRecords, leafParentController, leafIndex, leafLSiblingController)
+			leafController1.ShiftToLeft(numberOfRecords, leafParentController, leafIndex, leafLSiblingController, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
 
 			if recordIndex < numberOfRecords {
 				// >>> fix record path begin
@@ -441,7 +701,7 @@ func (bpt *BPTree) ensureNotOverloadLeaf(recordPath *recordPath) {
 		}
 	}
 
-	numberOfRecords := leafController1.CountRecordsForSpliting()
+	numberOfRecords := leafController1.CountRecordsForSpliting(bpt.maxRecordSize())
 	m := leafController1.NumberOfRecords() - numberOfRecords
 	leafNSiblingAddr, nodeAccessor := bpt.createLeaf()
 	// >>> fix node controllers begin
@@ -449,8 +709,8 @@ func (bpt *BPTree) ensureNotOverloadLeaf(recordPath *recordPath) {
 	leafParentController = bpt.getNonLeafController(leafParentAddr)
 	// <<< fix node controllers end
 	leafNSiblingController := leafController(nodeAccessor)
-	leafController1.Split(numberOfRecords, leafParentController, leafIndex, leafNSiblingController, leafNSiblingAddr)
-	bpt.leafList.InsertLeafAfter(bpt.fileStorage, leafNSiblingAddr, leafAddr)
+	leafController1.Split(numberOfRecords, leafParentController, leafIndex, leafNSiblingController, leafNSiblingAddr, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
+	bpt.leafList.InsertLeafAfter(leafFactory{bpt.fileStorage, bpt.pageSize}, leafNSiblingAddr, leafAddr)
 
 	if recordIndex >= m {
 		// >>> fix record path begin
@@ -467,7 +727,7 @@ func (bpt *BPTree) ensureNotOverloadNonLeaf(recordPath *recordPath, i int) {
 	nonLeafAddr := (*recordPath)[i].NodeAddr
 	nonLeafController1 := bpt.getNonLeafController(nonLeafAddr)
 
-	if nonLeafController1.GetLoadSize() <= nonLeafOverloadThreshold {
+	if nonLeafController1.GetLoadSize() <= nonLeafController1.OverloadThreshold(bpt.maxNonLeafChildSize()) {
 		return
 	}
 
@@ -491,10 +751,14 @@ func (bpt *BPTree) ensureNotOverloadNonLeaf(recordPath *recordPath, i int) {
 	nonLeafIndex := (*recordPath)[i-1].RecordOrNonLeafChildIndex
 
 	if nonLeafIndex < nonLeafParentController.NumberOfChildren()-1 {
-		nonLeafRSiblingAddr := nonLeafParentController.GetChildAddr(nonLeafIndex + 1)
+		nonLeafRSiblingAddr := bpt.copyNonLeafOnWrite(nonLeafParentAddr, nonLeafIndex+1)
+		// >>> fix node controllers begin
+		nonLeafController1 = bpt.getNonLeafController(nonLeafAddr)
+		nonLeafParentController = bpt.getNonLeafController(nonLeafParentAddr)
+		// <<< fix node controllers end
 		nonLeafRSiblingController := bpt.getNonLeafController(nonLeafRSiblingAddr)
 
-		if numberOfChildren := nonLeafController1.CountChildrenForShiftingToRight(nonLeafRSiblingController); numberOfChildren >= 1 {
+		if numberOfChildren := nonLeafController1.CountChildrenForShiftingToRight(nonLeafParentController, nonLeafIndex, nonLeafRSiblingController, bpt.maxNonLeafChildSize()); numberOfChildren >= 1 {
 			m := nonLeafController1.NumberOfChildren() - numberOfChildren
 			nonLeafController1.ShiftToRight(numberOfChildren, nonLeafParentController, nonLeafIndex, nonLeafRSiblingController)
 
@@ -513,10 +777,14 @@ func (bpt *BPTree) ensureNotOverloadNonLeaf(recordPath *recordPath, i int) {
 	}
 
 	if nonLeafIndex >= 1 {
-		nonLeafLSiblingAddr := nonLeafParentController.GetChildAddr(nonLeafIndex - 1)
+		nonLeafLSiblingAddr := bpt.copyNonLeafOnWrite(nonLeafParentAddr, nonLeafIndex-1)
+		// >>> fix node controllers begin
+		nonLeafController1 = bpt.getNonLeafController(nonLeafAddr)
+		nonLeafParentController = bpt.getNonLeafController(nonLeafParentAddr)
+		// <<< fix node controllers end
 		nonLeafLSiblingController := bpt.getNonLeafController(nonLeafLSiblingAddr)
 
-		if numberOfChildren := nonLeafController1.CountChildrenForShiftingToLeft(nonLeafLSiblingController); numberOfChildren >= 1 {
+		if numberOfChildren := nonLeafController1.CountChildrenForShiftingToLeft(nonLeafParentController, nonLeafIndex, nonLeafLSiblingController, bpt.maxNonLeafChildSize()); numberOfChildren >= 1 {
 			m := nonLeafLSiblingController.NumberOfChildren()
 			nonLeafController1.ShiftToLeft(numberOfChildren, nonLeafParentController, nonLeafIndex, nonLeafLSiblingController)
 
@@ -538,7 +806,7 @@ func (bpt *BPTree) ensureNotOverloadNonLeaf(recordPath *recordPath, i int) {
 		}
 	}
 
-	numberOfChildren := nonLeafController1.CountChildrenForSpliting()
+	numberOfChildren := nonLeafController1.CountChildrenForSpliting(bpt.maxNonLeafChildSize())
 	m := nonLeafController1.NumberOfChildren() - numberOfChildren
 	nonLeafNSiblingAddr, nodeAccessor := bpt.createNonLeaf()
 	// >>> fix node controllers begin
@@ -569,7 +837,7 @@ func (bpt *BPTree) ensureNotUnderloadLeaf(recordPath *recordPath) {
 	leafAddr := (*recordPath)[i].NodeAddr
 	leafController1 := bpt.getLeafController(leafAddr)
 
-	if leafController1.GetLoadSize() >= leafUnderloadThreshold {
+	if leafController1.GetLoadSize() >= leafController1.UnderloadThreshold(bpt.maxRecordSize()) {
 		return
 	}
 
@@ -581,11 +849,15 @@ func (bpt *BPTree) ensureNotUnderloadLeaf(recordPath *recordPath) {
 	var leafRSiblingController, leafLSiblingController leafController
 
 	if leafIndex < leafParentController.NumberOfChildren()-1 {
-		leafRSiblingAddr = leafParentController.GetChildAddr(leafIndex + 1)
+		leafRSiblingAddr = bpt.copyLeafOnWrite(leafParentAddr, leafIndex+1)
+		// >>> fix node controllers begin
+		leafController1 = bpt.getLeafController(leafAddr)
+		leafParentController = bpt.getNonLeafController(leafParentAddr)
+		// <<< fix node controllers end
 		leafRSiblingController = bpt.getLeafController(leafRSiblingAddr)
 
-		if numberOfRecords := leafController1.CountRecordsForUnshiftingFromRight(leafRSiblingController); numberOfRecords >= 1 {
-			leafController1.UnshiftFromRight(numberOfRecords, leafParentController, leafIndex, leafRSiblingController)
+		if numberOfRecords := leafController1.CountRecordsForUnshiftingFromRight(leafRSiblingController, bpt.maxRecordSize()); numberOfRecords >= 1 {
+			leafController1.UnshiftFromRight(numberOfRecords, leafParentController, leafIndex, leafRSiblingController, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
 			bpt.ensureNotUnderloadNonLeaf(recordPath, i-1)
 			bpt.ensureNotOverloadNonLeaf(recordPath, i-1)
 			return
@@ -595,11 +867,19 @@ func (bpt *BPTree) ensureNotUnderloadLeaf(recordPath *recordPath) {
 	}
 
 	if leafIndex >= 1 {
-		leafLSiblingAddr = leafParentController.GetChildAddr(leafIndex - 1)
+		leafLSiblingAddr = bpt.copyLeafOnWrite(leafParentAddr, leafIndex-1)
+		// >>> fix node controllers begin
+		leafController1 = bpt.getLeafController(leafAddr)
+		leafParentController = bpt.getNonLeafController(leafParentAddr)
+
+		if leafRSiblingAddr >= 0 {
+			leafRSiblingController = bpt.getLeafController(leafRSiblingAddr)
+		}
+		// <<< fix node controllers end
 		leafLSiblingController = bpt.getLeafController(leafLSiblingAddr)
 
-		if numberOfRecords := leafController1.CountRecordsForUnshiftingFromLeft(leafLSiblingController); numberOfRecords >= 1 {
-			leafController1.UnshiftFromLeft(numberOfRecords, leafParentController, leafIndex, leafLSiblingController)
+		if numberOfRecords := leafController1.CountRecordsForUnshiftingFromLeft(leafLSiblingController, bpt.maxRecordSize()); numberOfRecords >= 1 {
+			leafController1.UnshiftFromLeft(numberOfRecords, leafParentController, leafIndex, leafLSiblingController, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
 			// >>> fix record path begin
 			(*recordPath)[i].RecordOrNonLeafChildIndex = numberOfRecords + recordIndex
 			// <<< fix record path end
@@ -612,11 +892,11 @@ func (bpt *BPTree) ensureNotUnderloadLeaf(recordPath *recordPath) {
 	}
 
 	if leafRSiblingAddr >= 0 {
-		bpt.leafList.RemoveLeaf(bpt.fileStorage, leafRSiblingAddr)
+		bpt.leafList.RemoveLeaf(leafFactory{bpt.fileStorage, bpt.pageSize}, leafRSiblingAddr)
 		leafController1.MergeFromRight(leafParentController, leafIndex, leafRSiblingController)
 		bpt.destroyLeaf(leafRSiblingAddr)
 	} else {
-		bpt.leafList.RemoveLeaf(bpt.fileStorage, leafAddr)
+		bpt.leafList.RemoveLeaf(leafFactory{bpt.fileStorage, bpt.pageSize}, leafAddr)
 		m := leafLSiblingController.NumberOfRecords()
 		leafController1.MergeToLeft(leafParentController, leafIndex, leafLSiblingController)
 		bpt.destroyLeaf(leafAddr)
@@ -646,7 +926,7 @@ func (bpt *BPTree) ensureNotUnderloadNonLeaf(recordPath *recordPath, i int) {
 		return
 	}
 
-	if nonLeafController1.GetLoadSize() >= nonLeafUnderloadThreshold {
+	if nonLeafController1.GetLoadSize() >= nonLeafController1.UnderloadThreshold(bpt.maxNonLeafChildSize()) {
 		return
 	}
 
@@ -658,10 +938,14 @@ func (bpt *BPTree) ensureNotUnderloadNonLeaf(recordPath *recordPath, i int) {
 	var nonLeafRSiblingController, nonLeafLSiblingController nonLeafController
 
 	if nonLeafIndex < nonLeafParentController.NumberOfChildren()-1 {
-		nonLeafRSiblingAddr = nonLeafParentController.GetChildAddr(nonLeafIndex + 1)
+		nonLeafRSiblingAddr = bpt.copyNonLeafOnWrite(nonLeafParentAddr, nonLeafIndex+1)
+		// >>> fix node controllers begin
+		nonLeafController1 = bpt.getNonLeafController(nonLeafAddr)
+		nonLeafParentController = bpt.getNonLeafController(nonLeafParentAddr)
+		// <<< fix node controllers end
 		nonLeafRSiblingController = bpt.getNonLeafController(nonLeafRSiblingAddr)
 
-		if numberOfChildren := nonLeafController1.CountChildrenForUnshiftingFromRight(nonLeafRSiblingController); numberOfChildren >= 1 {
+		if numberOfChildren := nonLeafController1.CountChildrenForUnshiftingFromRight(nonLeafParentController, nonLeafIndex, nonLeafRSiblingController, bpt.maxNonLeafChildSize()); numberOfChildren >= 1 {
 			nonLeafController1.UnshiftFromRight(numberOfChildren, nonLeafParentController, nonLeafIndex, nonLeafRSiblingController)
 			bpt.ensureNotUnderloadNonLeaf(recordPath, i-1)
 			bpt.ensureNotOverloadNonLeaf(recordPath, i-1)
@@ -672,10 +956,18 @@ func (bpt *BPTree) ensureNotUnderloadNonLeaf(recordPath *recordPath, i int) {
 	}
 
 	if nonLeafIndex >= 1 {
-		nonLeafLSiblingAddr = nonLeafParentController.GetChildAddr(nonLeafIndex - 1)
+		nonLeafLSiblingAddr = bpt.copyNonLeafOnWrite(nonLeafParentAddr, nonLeafIndex-1)
+		// >>> fix node controllers begin
+		nonLeafController1 = bpt.getNonLeafController(nonLeafAddr)
+		nonLeafParentController = bpt.getNonLeafController(nonLeafParentAddr)
+
+		if nonLeafRSiblingAddr >= 0 {
+			nonLeafRSiblingController = bpt.getNonLeafController(nonLeafRSiblingAddr)
+		}
+		// <<< fix node controllers end
 		nonLeafLSiblingController = bpt.getNonLeafController(nonLeafLSiblingAddr)
 
-		if numberOfChildren := nonLeafController1.CountChildrenForUnshiftingFromLeft(nonLeafLSiblingController); numberOfChildren >= 1 {
+		if numberOfChildren := nonLeafController1.CountChildrenForUnshiftingFromLeft(nonLeafParentController, nonLeafIndex, nonLeafLSiblingController, bpt.maxNonLeafChildSize()); numberOfChildren >= 1 {
 			nonLeafController1.UnshiftFromLeft(numberOfChildren, nonLeafParentController, nonLeafIndex, nonLeafLSiblingController)
 			// >>> fix record path begin
 			(*recordPath)[i].RecordOrNonLeafChildIndex = numberOfChildren + nonLeafChildIndex
@@ -706,8 +998,9 @@ func (bpt *BPTree) ensureNotUnderloadNonLeaf(recordPath *recordPath, i int) {
 }
 
 func (bpt *BPTree) increaseHeight() {
+	recordCount := bpt.countRecords(bpt.rootAddr, 0)
 	rootAddr, rootController := bpt.createNonLeaf()
-	rootController.InsertChildren(0, []nonLeafChild{{nil, bpt.rootAddr}})
+	rootController.InsertChildren(0, []nonLeafChild{{nil, bpt.rootAddr, recordCount}})
 	bpt.rootAddr = rootAddr
 	bpt.height++
 }
@@ -720,137 +1013,415 @@ func (bpt *BPTree) decreaseHeight() {
 	bpt.height--
 }
 
-func (bpt *BPTree) search(minKey []byte, maxKey []byte) (int64, int, int64, int, bool) {
+// resolveBound turns the given bound at the minimum or maximum key
+// into the equivalent unbounded or inclusive bound, and makes a copy
+// of other bounds. The B+ tree must not be empty.
+func (bpt *BPTree) resolveBound(bound Bound, isMax bool) Bound {
+	switch bound.kind {
+	case minKeyBound:
+		if !isMax {
+			return Unbounded
+		}
+
+		_, leafController, recordIndex := bpt.locateRecord(bpt.findEndRecord(false))
+		return Inclusive(keyFactory{bpt.fileStorage, bpt.maxKeySize}.ReadKeyAll(leafController.GetKey(recordIndex)))
+	case maxKeyBound:
+		if isMax {
+			return Unbounded
+		}
+
+		_, leafController, recordIndex := bpt.locateRecord(bpt.findEndRecord(true))
+		return Inclusive(keyFactory{bpt.fileStorage, bpt.maxKeySize}.ReadKeyAll(leafController.GetKey(recordIndex)))
+	default:
+		return bound.clone()
+	}
+}
+
+func (bpt *BPTree) trySearchRange(minBound Bound, maxBound Bound) (_ recordPath, _ recordPath, _ bool, err error) {
+	defer corruption.Recover(&err)
+	minRecordPath, maxRecordPath, ok := bpt.searchRange(minBound, maxBound)
+	return minRecordPath, maxRecordPath, ok, nil
+}
+
+func (bpt *BPTree) searchRange(minBound Bound, maxBound Bound) (recordPath, recordPath, bool) {
 	if bpt.recordCount == 0 {
-		return 0, 0, 0, 0, false
+		return nil, nil, false
 	}
 
-	f1 := isMinKey(minKey)
-	f2 := isMinKey(maxKey)
-	f3 := isMaxKey(minKey)
-	f4 := isMaxKey(maxKey)
-	ok1 := f1 || f3
-	ok2 := f2 || f4
-	var d int
+	minRecordPath, ok := bpt.findMinRecord(minBound)
 
-	if ok1 || ok2 {
-		if ok1 && ok2 {
-			if f1 == f2 || bpt.recordCount == 1 {
-				d = 0
-			} else {
-				if !f1 {
-					return 0, 0, 0, 0, false
-				}
+	if !ok {
+		return nil, nil, false
+	}
 
-				d = -1
-			}
-		} else {
-			d = -1
-		}
-	} else {
-		d = bytes.Compare(minKey, maxKey)
+	maxRecordPath, ok := bpt.findMaxRecord(maxBound)
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	if minRecordPath.Compare(maxRecordPath) > 0 {
+		return nil, nil, false
+	}
+
+	return minRecordPath, maxRecordPath, true
+}
 
-		if d > 0 {
-			return 0, 0, 0, 0, false
+func (bpt *BPTree) findMinRecord(minBound Bound) (recordPath, bool) {
+	switch minBound.kind {
+	case unbounded, minKeyBound:
+		return bpt.findEndRecord(false), true
+	case maxKeyBound:
+		return bpt.findEndRecord(true), true
+	}
+
+	recordPath, ok := bpt.findRecord(minBound.key)
+	_, leafController, recordIndex := bpt.locateRecord(recordPath)
+
+	if (ok && minBound.kind == exclusiveBound) || recordIndex == leafController.NumberOfRecords() {
+		if !bpt.moveToNextRecord(recordPath) {
+			return nil, false
 		}
 	}
 
-	minRecordPath, ok3 := bpt.findRecord(minKey)
-	minLeafAddr, minLeafController, minRecordIndex := bpt.locateRecord(minRecordPath)
+	return recordPath, true
+}
 
-	if !ok3 {
-		if minRecordIndex == minLeafController.NumberOfRecords() {
-			if minLeafAddr == bpt.leafList.TailAddr() {
-				return 0, 0, 0, 0, false
-			}
+func (bpt *BPTree) findMaxRecord(maxBound Bound) (recordPath, bool) {
+	switch maxBound.kind {
+	case unbounded, maxKeyBound:
+		return bpt.findEndRecord(true), true
+	case minKeyBound:
+		return bpt.findEndRecord(false), true
+	}
+
+	recordPath, ok := bpt.findRecord(maxBound.key)
 
-			minLeafAddr = leafHeader(minLeafController).NextAddr()
-			minRecordIndex = 0
+	if !ok || maxBound.kind == exclusiveBound {
+		if !bpt.moveToPrevRecord(recordPath) {
+			return nil, false
 		}
 	}
 
-	if d == 0 {
-		return minLeafAddr, minRecordIndex, minLeafAddr, minRecordIndex, true
+	return recordPath, true
+}
+
+func (bpt *BPTree) moveToNextRecord(recordPath recordPath) bool {
+	n := len(recordPath)
+	leafController := bpt.getLeafController(recordPath[n-1].NodeAddr)
+
+	if recordIndex := recordPath[n-1].RecordOrNonLeafChildIndex; recordIndex+1 < leafController.NumberOfRecords() {
+		recordPath[n-1].RecordOrNonLeafChildIndex = recordIndex + 1
+		return true
 	}
 
-	if !(!ok1 && ok3) {
-		minKey = keyFactory{bpt.fileStorage}.ReadKeyAll(minLeafController.GetKey(minRecordIndex))
+	for i := n - 2; i >= 0; i-- {
+		nonLeafController := bpt.getNonLeafController(recordPath[i].NodeAddr)
 
-		if !ok2 {
-			d = bytes.Compare(minKey, maxKey)
+		if nonLeafChildIndex := recordPath[i].RecordOrNonLeafChildIndex; nonLeafChildIndex+1 < nonLeafController.NumberOfChildren() {
+			recordPath[i].RecordOrNonLeafChildIndex = nonLeafChildIndex + 1
 
-			if d > 0 {
-				return 0, 0, 0, 0, false
+			for i++; i < n; i++ {
+				nonLeafController := bpt.getNonLeafController(recordPath[i-1].NodeAddr)
+				recordPath[i] = recordPathComponent{nonLeafController.GetChildAddr(recordPath[i-1].RecordOrNonLeafChildIndex), 0}
 			}
 
-			if d == 0 {
-				return minLeafAddr, minRecordIndex, minLeafAddr, minRecordIndex, true
-			}
+			return true
 		}
 	}
 
-	maxRecordPath, ok4 := bpt.findRecord(maxKey)
-	maxLeafAddr, maxLeafController, maxRecordIndex := bpt.locateRecord(maxRecordPath)
+	return false
+}
+
+func (bpt *BPTree) moveToPrevRecord(recordPath recordPath) bool {
+	n := len(recordPath)
 
-	if !ok4 {
-		maxRecordIndex--
+	if recordIndex := recordPath[n-1].RecordOrNonLeafChildIndex; recordIndex >= 1 {
+		recordPath[n-1].RecordOrNonLeafChildIndex = recordIndex - 1
+		return true
 	}
 
-	if !(!ok2 && ok4) {
-		maxKey = keyFactory{bpt.fileStorage}.ReadKeyAll(maxLeafController.GetKey(maxRecordIndex))
-		d = bytes.Compare(minKey, maxKey)
+	for i := n - 2; i >= 0; i-- {
+		if nonLeafChildIndex := recordPath[i].RecordOrNonLeafChildIndex; nonLeafChildIndex >= 1 {
+			recordPath[i].RecordOrNonLeafChildIndex = nonLeafChildIndex - 1
+
+			for i++; i < n-1; i++ {
+				nonLeafAddr := bpt.getNonLeafController(recordPath[i-1].NodeAddr).GetChildAddr(recordPath[i-1].RecordOrNonLeafChildIndex)
+				nonLeafController := bpt.getNonLeafController(nonLeafAddr)
+				recordPath[i] = recordPathComponent{nonLeafAddr, nonLeafController.NumberOfChildren() - 1}
+			}
 
-		if d > 0 {
-			return 0, 0, 0, 0, false
+			leafAddr := bpt.getNonLeafController(recordPath[n-2].NodeAddr).GetChildAddr(recordPath[n-2].RecordOrNonLeafChildIndex)
+			leafController := bpt.getLeafController(leafAddr)
+			recordPath[n-1] = recordPathComponent{leafAddr, leafController.NumberOfRecords() - 1}
+			return true
 		}
 	}
 
-	return minLeafAddr, minRecordIndex, maxLeafAddr, maxRecordIndex, true
+	return false
+}
+
+// maxRecordSize returns the maximum growth of a leaf when a record is
+// inserted, the key of the next record may be decompressed partly in
+// addition to the record.
+func (bpt *BPTree) maxRecordSize() int {
+	return getMaxRecordSize(bpt.maxKeySize, bpt.maxValueSize) + bpt.maxKeySize
+}
+
+// maxNonLeafChildSize returns the maximum growth of a non-leaf when a
+// child is inserted or a key is replaced, the key of the next child may
+// be decompressed partly in addition to the child or key.
+func (bpt *BPTree) maxNonLeafChildSize() int {
+	return getMaxNonLeafChildSize(bpt.maxKeySize) + bpt.maxKeySize
 }
 
 func (bpt *BPTree) createLeaf() (int64, leafController) {
-	leafAddr, leafController := leafFactory{bpt.fileStorage}.CreateLeaf()
+	leafAddr, leafController := leafFactory{bpt.fileStorage, bpt.pageSize}.CreateLeaf()
+	leafHeader(leafController).SetGeneration(bpt.generation)
+	checksum.Update(leafController)
 	bpt.leafCount++
 	return leafAddr, leafController
 }
 
 func (bpt *BPTree) destroyLeaf(leafAddr int64) {
-	leafFactory{bpt.fileStorage}.DestroyLeaf(leafAddr)
+	leafController := bpt.getLeafController(leafAddr)
+
+	if generation := leafHeader(leafController).Generation(); bpt.isShared(generation) {
+		bpt.addPendingSpace(leafAddr, true, generation)
+	} else {
+		leafFactory{bpt.fileStorage, bpt.pageSize}.DestroyLeaf(leafAddr)
+	}
+
 	bpt.leafCount--
 }
 
 func (bpt *BPTree) getLeafController(leafAddr int64) leafController {
-	return leafFactory{bpt.fileStorage}.GetLeafController(leafAddr)
+	return leafFactory{bpt.fileStorage, bpt.pageSize}.GetLeafController(leafAddr)
 }
 
 func (bpt *BPTree) createNonLeaf() (int64, nonLeafController) {
-	nonLeafAddr, nonLeafController := nonLeafFactory{bpt.fileStorage}.CreateNonLeaf()
+	nonLeafAddr, nonLeafController := nonLeafFactory{bpt.fileStorage, bpt.pageSize}.CreateNonLeaf()
+	nonLeafHeader(nonLeafController).SetGeneration(bpt.generation)
+	checksum.Update(nonLeafController)
 	bpt.nonLeafCount++
 	return nonLeafAddr, nonLeafController
 }
 
 func (bpt *BPTree) destroyNonLeaf(nonLeafAddr int64) {
-	nonLeafFactory{bpt.fileStorage}.DestroyNonLeaf(nonLeafAddr)
+	nonLeafController := bpt.getNonLeafController(nonLeafAddr)
+
+	if generation := nonLeafHeader(nonLeafController).Generation(); bpt.isShared(generation) {
+		bpt.addPendingSpace(nonLeafAddr, true, generation)
+	} else {
+		nonLeafFactory{bpt.fileStorage, bpt.pageSize}.DestroyNonLeaf(nonLeafAddr)
+	}
+
 	bpt.nonLeafCount--
 }
 
 func (bpt *BPTree) getNonLeafController(nonLeafAddr int64) nonLeafController {
-	return nonLeafFactory{bpt.fileStorage}.GetNonLeafController(nonLeafAddr)
+	return nonLeafFactory{bpt.fileStorage, bpt.pageSize}.GetNonLeafController(nonLeafAddr)
+}
+
+// Option represents an option of a B+ tree.
+type Option func(*options)
+
+// CheckOptions checks the given options, and then returns the error
+// if they are invalid, e.g. ErrInvalidPageSize.
+func CheckOptions(options ...Option) error {
+	_, err := makeOptions(options)
+	return err
+}
+
+// WithKeyComparer returns an option which sets the key comparer
+// of a B+ tree, BytewiseKeyComparer by default.
+func WithKeyComparer(keyComparer KeyComparer) Option {
+	return func(options *options) {
+		options.KeyComparer = keyComparer
+	}
+}
+
+// WithPageSize returns an option which sets the page size of a B+ tree,
+// the size of each leaf and non-leaf, DefaultPageSize by default.
+// The page size must be a power of 2 within [MinPageSize, MaxPageSize],
+// otherwise the option is invalid with ErrInvalidPageSize.
+// Larger pages hold more records or children, which keeps the B+ tree
+// lower and favors long scans, while smaller pages cost less to read
+// and write for point accesses.
+// It takes effect when the B+ tree is created, a B+ tree loaded keeps
+// the page size it was created with.
+func WithPageSize(pageSize int) Option {
+	return func(options *options) {
+		options.PageSize = pageSize
+	}
+}
+
+// WithMaxKeySize returns an option which sets the maximum key size of
+// a B+ tree, DefaultMaxKeySize by default.
+// The keys shorter than it are stored in the leaves as is, while each
+// of the others is stored as a prefix in the leaf along with the rest
+// in an overflow space, which costs an extra read to access.
+// It must be at least 16, and a page must hold 8 records of the
+// maximum key and value sizes or 8 children of the maximum key size,
+// otherwise the option is invalid with ErrInvalidMaxKeySize.
+// It takes effect when the B+ tree is created, as WithPageSize does.
+func WithMaxKeySize(maxKeySize int) Option {
+	return func(options *options) {
+		options.MaxKeySize = maxKeySize
+	}
+}
+
+// WithMaxValueSize returns an option which sets the maximum value size
+// of a B+ tree, DefaultMaxValueSize by default.
+// The values shorter than it are stored in the leaves as is, while
+// each of the others is stored as a prefix in the leaf along with the
+// rest in an overflow space, which costs an extra read to access.
+// It must be at least 16, and a page must hold 8 records of the
+// maximum key and value sizes, otherwise the option is invalid with
+// ErrInvalidMaxValueSize.
+// It takes effect when the B+ tree is created, as WithPageSize does.
+func WithMaxValueSize(maxValueSize int) Option {
+	return func(options *options) {
+		options.MaxValueSize = maxValueSize
+	}
 }
 
+const (
+	// MinPageSize is the minimum page size of a B+ tree.
+	MinPageSize = 1 << 12
+
+	// MaxPageSize is the maximum page size of a B+ tree.
+	MaxPageSize = 1 << 16
+
+	// DefaultPageSize is the default page size of a B+ tree.
+	DefaultPageSize = 1 << 13
+
+	// DefaultMaxKeySize is the default maximum key size of a B+ tree.
+	DefaultMaxKeySize = 257
+
+	// DefaultMaxValueSize is the default maximum value size of a B+ tree.
+	DefaultMaxValueSize = 129
+)
+
+const minMaxKeyOrValueSize = 16
+
+type options struct {
+	KeyComparer  KeyComparer
+	PageSize     int
+	MaxKeySize   int
+	MaxValueSize int
+}
+
+func makeOptions(options1 []Option) (options, error) {
+	options := options{
+		KeyComparer:  BytewiseKeyComparer,
+		PageSize:     DefaultPageSize,
+		MaxKeySize:   DefaultMaxKeySize,
+		MaxValueSize: DefaultMaxValueSize,
+	}
+
+	for _, option := range options1 {
+		option(&options)
+	}
+
+	if len(options.KeyComparer.Name()) > maxKeyComparerNameSize {
+		return options, ErrKeyComparerNameTooLong
+	}
+
+	if !isValidPageSize(options.PageSize) {
+		return options, ErrInvalidPageSize
+	}
+
+	if !isValidMaxKeySize(options.MaxKeySize, options.PageSize) {
+		return options, ErrInvalidMaxKeySize
+	}
+
+	if !isValidMaxValueSize(options.MaxValueSize, options.MaxKeySize, options.PageSize) {
+		return options, ErrInvalidMaxValueSize
+	}
+
+	return options, nil
+}
+
+func isValidPageSize(pageSize int) bool {
+	return pageSize >= MinPageSize && pageSize <= MaxPageSize && pageSize&(pageSize-1) == 0
+}
+
+func isValidMaxKeySize(maxKeySize int, pageSize int) bool {
+	return maxKeySize >= minMaxKeyOrValueSize && 8*getMaxNonLeafChildSize(maxKeySize) <= pageSize-nonLeafHeaderSize
+}
+
+func isValidMaxValueSize(maxValueSize int, maxKeySize int, pageSize int) bool {
+	return maxValueSize >= minMaxKeyOrValueSize && 8*getMaxRecordSize(maxKeySize, maxValueSize) <= pageSize-leafHeaderSize
+}
+
+func getMaxRecordSize(maxKeySize int, maxValueSize int) int {
+	return recordHeaderSize + maxKeySize + maxValueSize
+}
+
+func getMaxNonLeafChildSize(maxKeySize int) int {
+	return nonLeafChildHeaderSize + maxKeySize
+}
+
+// formatVersion is the version of the format in which a B+ tree is
+// stored, which is bumped whenever the layout of the info, pages or
+// overflow spaces changes.
+const formatVersion = 1
+
 type bpTreeInfo struct {
-	RootAddr         int64
-	Height           int8
-	LeafListTailAddr int64
-	LeafListHeadAddr int64
-	LeafCount        int64
-	NonLeafCount     int64
-	RecordCount      int64
-	PayloadSize      int64
+	FormatVersion        uint32
+	RootAddr             int64
+	Height               int8
+	LeafListTailAddr     int64
+	LeafListHeadAddr     int64
+	LeafCount            int64
+	NonLeafCount         int64
+	RecordCount          int64
+	PayloadSize          int64
+	Generation           int64
+	PendingSpaceListAddr int64
+	PageSize             int32
+	MaxKeySize           int32
+	MaxValueSize         int32
+	KeyComparerNameSize  uint8
+	// followed by the key comparer name
+}
+
+func (bpti *bpTreeInfo) IsValid() bool {
+	return bpti.RootAddr >= 0 &&
+		bpti.Height >= 1 &&
+		bpti.LeafListTailAddr >= 0 &&
+		bpti.LeafListHeadAddr >= 0 &&
+		bpti.LeafCount >= 1 &&
+		bpti.NonLeafCount >= int64(bpti.Height)-1 &&
+		bpti.RecordCount >= 0 &&
+		bpti.PayloadSize >= 0 &&
+		bpti.Generation >= 0 &&
+		bpti.PendingSpaceListAddr >= -1 &&
+		isValidPageSize(int(bpti.PageSize)) &&
+		isValidMaxKeySize(int(bpti.MaxKeySize), int(bpti.PageSize)) &&
+		isValidMaxValueSize(int(bpti.MaxValueSize), int(bpti.MaxKeySize), int(bpti.PageSize))
 }
 
 type recordPath []recordPathComponent
 
+func (rp recordPath) LastComponent() (int64, int) {
+	lastComponent := &rp[len(rp)-1]
+	return lastComponent.NodeAddr, lastComponent.RecordOrNonLeafChildIndex
+}
+
+// Compare compares the positions of the records which the record
+// paths lead to, the record paths must be in the same B+ tree.
+func (rp recordPath) Compare(other recordPath) int {
+	for i := range rp {
+		if d := rp[i].RecordOrNonLeafChildIndex - other[i].RecordOrNonLeafChildIndex; d != 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
 type recordPathComponent struct {
 	NodeAddr                  int64
 	RecordOrNonLeafChildIndex int
@@ -2,11 +2,17 @@ package bptree_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/roy2220/fsm"
@@ -20,22 +26,22 @@ func TestBPTreeAddOrUpdateAndHasRecord(t *testing.T) {
 
 	for i, k := range Keywords {
 		v := []byte(strconv.Itoa(i))
-		k2, ok := bpt.AddOrUpdateRecord(k, v, true)
+		k2, ok, _ := bpt.AddOrUpdateRecord(k, v, true)
 
 		if assert.False(t, ok) {
 			assert.Equal(t, k, k2)
 		}
 	}
 
-	_, ok := bpt.AddOrUpdateRecord([]byte("K4cM,b/PaY;4Hb[A]"), nil, false)
+	_, ok, _ := bpt.AddOrUpdateRecord([]byte("K4cM,b/PaY;4Hb[A]"), nil, false)
 	assert.True(t, ok)
-	_, ok = bpt.AddRecord([]byte("K4cM,b/PaY;4Hb[A]"), nil, true)
+	_, ok, _ = bpt.AddRecord([]byte("K4cM,b/PaY;4Hb[A]"), nil, true)
 	assert.False(t, ok)
-	_, ok = bpt.AddOrUpdateRecord([]byte("K4cM,b/PaY;4Hb[A]"), make([]byte, fs.Stats().MappedSpaceSize/2), false)
+	_, ok, _ = bpt.AddOrUpdateRecord([]byte("K4cM,b/PaY;4Hb[A]"), make([]byte, fs.Stats().MappedSpaceSize/2), false)
 	assert.False(t, ok)
 
 	for i, k := range Keywords {
-		v, ok := bpt.HasRecord(k, true)
+		v, ok, _ := bpt.HasRecord(k, true)
 
 		if assert.True(t, ok) {
 			v2 := []byte(strconv.Itoa(i))
@@ -43,7 +49,7 @@ func TestBPTreeAddOrUpdateAndHasRecord(t *testing.T) {
 		}
 	}
 
-	_, ok = bpt.HasRecord([]byte("K8=JT6!xcH@m;9tf"), false)
+	_, ok, _ = bpt.HasRecord([]byte("K8=JT6!xcH@m;9tf"), false)
 	assert.False(t, ok)
 }
 
@@ -53,7 +59,7 @@ func TestBPTreeUpdateAndDeleteRecord(t *testing.T) {
 
 	for i, k := range Keywords {
 		v := []byte(strconv.Itoa(i))
-		k2, ok := bpt.UpdateRecord(k, v, true)
+		k2, ok, _ := bpt.UpdateRecord(k, v, true)
 
 		if assert.True(t, ok) {
 			if !assert.Equal(t, k, k2) {
@@ -64,11 +70,11 @@ func TestBPTreeUpdateAndDeleteRecord(t *testing.T) {
 		}
 	}
 
-	_, ok := bpt.UpdateRecord([]byte("K4cM,b/PaY;4Hb[A]"), nil, false)
+	_, ok, _ := bpt.UpdateRecord([]byte("K4cM,b/PaY;4Hb[A]"), nil, false)
 	assert.False(t, ok)
 
 	for i, k := range Keywords {
-		v, ok := bpt.DeleteRecord(k, true)
+		v, ok, _ := bpt.DeleteRecord(k, true)
 
 		if assert.True(t, ok) {
 			v2 := []byte(strconv.Itoa(i))
@@ -80,7 +86,7 @@ func TestBPTreeUpdateAndDeleteRecord(t *testing.T) {
 		}
 	}
 
-	_, ok = bpt.DeleteRecord([]byte("K8=JT6!xcH@m;9tf"), false)
+	_, ok, _ = bpt.DeleteRecord([]byte("K8=JT6!xcH@m;9tf"), false)
 	t.Logf("height=%d, num_leafs=%d num_non_leafs=%d payload_size=%d fs_stats=%#v",
 		bpt.Height(), bpt.NumberOfLeafs(), bpt.NumberOfNonLeafs(), bpt.PayloadSize(), fs.Stats())
 	assert.Equal(t, 0, bpt.PayloadSize())
@@ -91,6 +97,112 @@ func TestBPTreeUpdateAndDeleteRecord(t *testing.T) {
 	bpt.Create()
 }
 
+func TestBPTreeDeleteRange(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	var keys []string
+
+	addRecords := func(n int) {
+		for len(keys) < n {
+			k := fmt.Sprintf("%08d", rand.Intn(100000000))
+
+			if rand.Intn(100) == 0 {
+				k = strings.Repeat(k, 40) // overflowed
+			}
+
+			var v []byte
+
+			if rand.Intn(10) == 0 {
+				v = bytes.Repeat([]byte(k), 100) // overflowed
+			}
+
+			if _, ok, _ := bpt.AddRecord([]byte(k), v, false); ok {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+	}
+
+	deleteRange := func(minBound, maxBound bptree.Bound, i, j int) {
+		n, err := bpt.DeleteRange(minBound, maxBound)
+
+		if !assert.NoError(t, err) || !assert.Equal(t, j-i, n) {
+			t.FailNow()
+		}
+
+		keys = append(keys[:i], keys[j:]...)
+
+		if !assert.NoError(t, bpt.Verify()) || !assert.Equal(t, len(keys), bpt.NumberOfRecords()) {
+			t.FailNow()
+		}
+	}
+
+	addRecords(50000)
+	snapshot := bpt.TakeSnapshot()
+	snapshotKeys := append([]string(nil), keys...)
+
+	for r, n := 0, ScaleDown(200); r < n; r++ {
+		if len(keys) < 1000 {
+			addRecords(50000)
+		}
+
+		i := rand.Intn(len(keys))
+		j := i + rand.Intn(len(keys)-i)
+
+		switch r % 4 {
+		case 0:
+			// [keys[i], keys[j]]
+			deleteRange(bptree.Inclusive([]byte(keys[i])), bptree.Inclusive([]byte(keys[j])), i, j+1)
+		case 1:
+			if rand.Intn(2) == 0 || j == i {
+				// (keys[i], keys[j]], with bounds not in the tree
+				deleteRange(bptree.Inclusive([]byte(keys[i]+"\x00")), bptree.Inclusive([]byte(keys[j]+"\x00")), i+1, j+1)
+			} else {
+				// (keys[i], keys[j])
+				deleteRange(bptree.Exclusive([]byte(keys[i])), bptree.Exclusive([]byte(keys[j])), i+1, j)
+			}
+		case 2:
+			// a few records
+			j = i + rand.Intn(3)
+
+			if j >= len(keys) {
+				j = len(keys) - 1
+			}
+
+			deleteRange(bptree.Inclusive([]byte(keys[i])), bptree.Inclusive([]byte(keys[j])), i, j+1)
+		case 3:
+			if rand.Intn(2) == 0 {
+				deleteRange(bptree.Unbounded, bptree.Inclusive([]byte(keys[j])), 0, j+1)
+			} else {
+				deleteRange(bptree.Inclusive([]byte(keys[i])), bptree.Unbounded, i, len(keys))
+			}
+		}
+	}
+
+	n, err := bpt.DeleteRange(bptree.Inclusive([]byte("b")), bptree.Inclusive([]byte("a")))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	deleteRange(bptree.Unbounded, bptree.Unbounded, 0, len(keys))
+	assert.Equal(t, 1, bpt.Height())
+	addRecords(1000)
+
+	if !assert.NoError(t, bpt.Verify()) {
+		t.FailNow()
+	}
+
+	keys2 := make([]string, 0, len(snapshotKeys))
+
+	for it := snapshot.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+		k, _ := it.ReadKeyAll()
+		keys2 = append(keys2, string(k))
+	}
+
+	assert.Equal(t, snapshotKeys, keys2)
+	snapshot.Release()
+	deleteRange(bptree.Unbounded, bptree.Unbounded, 0, len(keys))
+}
+
 func TestBPTreeSearchForwardAndBackward(t *testing.T) {
 	bpt, _, cleanup := MakeBPTree(t)
 	defer cleanup()
@@ -173,100 +285,1255 @@ func TestBPTreeSearchForwardAndBackward(t *testing.T) {
 	}
 }
 
-func TestBPTreeStoreAndLoad(t *testing.T) {
-	bpt, _, cleanup := MakeBPTree(t)
+func TestBPTreeSearchRange(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
 	defer cleanup()
-	bpt.Load(bpt.Store())
-	i := 0
+	var keys []string
 
-	for it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
-		k := Keywords[SortedKeywordIndexes[i]]
-		i++
-		k2, _ := it.ReadKeyAll()
-		if !assert.Equal(t, k2, k) {
-			t.FailNow()
+	for i := 0; i < 20000; i += 2 {
+		k := strconv.Itoa(i)
+		bpt.AddRecord([]byte(k), nil, false)
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	makeBound := func(kind int, k string) bptree.Bound {
+		switch kind {
+		case 0:
+			return bptree.Inclusive([]byte(k))
+		case 1:
+			return bptree.Exclusive([]byte(k))
+		default:
+			return bptree.Unbounded
 		}
 	}
 
-	assert.Equal(t, len(Keywords), i)
+	inRange := func(k string, minKind int, minKey string, maxKind int, maxKey string) bool {
+		return (minKind == 2 || k > minKey || (minKind == 0 && k == minKey)) &&
+			(maxKind == 2 || k < maxKey || (maxKind == 0 && k == maxKey))
+	}
+
+	for n := 0; n < ScaleDown(500); n++ {
+		minKey, maxKey := strconv.Itoa(rand.Intn(20010)), strconv.Itoa(rand.Intn(20010))
+
+		if n%3 == 0 {
+			minKey = keys[rand.Intn(len(keys))]
+			maxKey = minKey
+		}
+
+		minKind, maxKind := n%3, (n/3)%3
+		var keys2 []string
+
+		for _, k := range keys {
+			if inRange(k, minKind, minKey, maxKind, maxKey) {
+				keys2 = append(keys2, k)
+			}
+		}
+
+		var keys3, keys4 []string
+
+		for it := bpt.SearchRange(makeBound(minKind, minKey), makeBound(maxKind, maxKey), false); !it.IsAtEnd(); it.Advance() {
+			k, _ := it.ReadKeyAll()
+			keys3 = append(keys3, string(k))
+		}
+
+		for it := bpt.SearchRange(makeBound(minKind, minKey), makeBound(maxKind, maxKey), true); !it.IsAtEnd(); it.Advance() {
+			k, _ := it.ReadKeyAll()
+			keys4 = append(keys4, string(k))
+		}
+
+		for i, j := 0, len(keys4)-1; i < j; i, j = i+1, j-1 {
+			keys4[i], keys4[j] = keys4[j], keys4[i]
+		}
+
+		if !assert.Equal(t, keys2, keys3, "%d %q %d %q", minKind, minKey, maxKind, maxKey) ||
+			!assert.Equal(t, keys2, keys4, "%d %q %d %q", minKind, minKey, maxKind, maxKey) {
+			t.FailNow()
+		}
+	}
 }
 
-func _TestBPTreeFprint(t *testing.T) {
-	bpt, _, cleanup := MakeBPTree(t)
+func TestBPTreeRankAndSelect(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
 	defer cleanup()
-	bpt.Fprint(os.Stdout)
-}
+	var keys []string
 
-var Keywords [][]byte
-var SortedKeywordIndexes []int
-var SortedKeywordRIndexes []int
+	for i := 0; i < 20000; i += 2 {
+		k := strconv.Itoa(i)
+		bpt.AddRecord([]byte(k), nil, false)
+		keys = append(keys, k)
+	}
 
-func MakeBPTree(t *testing.T) (*bptree.BPTree, *fsm.FileStorage, func()) {
-	const fn = "../testdata/bptree.tmp"
-	fs := new(fsm.FileStorage).Init()
-	err := fs.Open(fn, true)
+	for i := 0; i < 5000; i++ {
+		j := rand.Intn(len(keys))
 
-	if !assert.NoError(t, err) {
+		if _, ok, _ := bpt.DeleteRecord([]byte(keys[j]), false); !assert.True(t, ok) {
+			t.FailNow()
+		}
+
+		keys = append(keys[:j], keys[j+1:]...)
+	}
+
+	sort.Strings(keys)
+
+	if !assert.NoError(t, bpt.Verify()) {
 		t.FailNow()
 	}
 
-	bpt := new(bptree.BPTree).Init(fs)
-	bpt.Create()
-	deletedKeywordIndexes := make(map[int]struct{}, len(Keywords)/2)
+	for i, k := range keys {
+		r, ok, err := bpt.Rank([]byte(k))
 
-	for i, k := range Keywords {
-		k2, ok := bpt.AddRecord(k, k, true)
+		if !assert.NoError(t, err) || !assert.True(t, ok) || !assert.Equal(t, i, r) {
+			t.FailNow()
+		}
 
-		if !assert.True(t, ok, string(k), string(k2)) {
+		k2, ok, err := bpt.Select(i)
+
+		if !assert.NoError(t, err) || !assert.True(t, ok) || !assert.Equal(t, k, string(k2)) {
 			t.FailNow()
 		}
+	}
 
-		j := rand.Intn(i*2 + 1)
+	for n := 0; n < 500; n++ {
+		k := strconv.Itoa(rand.Intn(20010))
+		i := sort.SearchStrings(keys, k)
+		r, ok, err := bpt.Rank([]byte(k))
 
-		if j <= i {
-			if _, ok := deletedKeywordIndexes[j]; !ok {
-				k := Keywords[j]
-				k2, ok2 := bpt.DeleteRecord(k, true)
+		if !assert.NoError(t, err) || !assert.Equal(t, i < len(keys) && keys[i] == k, ok) || !assert.Equal(t, i, r) {
+			t.FailNow()
+		}
+	}
 
-				if !assert.True(t, ok2, "%v %s", j, k) {
-					t.FailNow()
-				}
+	for _, i := range []int{-1, len(keys)} {
+		_, ok, err := bpt.Select(i)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
 
-				assert.Equal(t, k, k2)
-				deletedKeywordIndexes[j] = struct{}{}
+	for n := 0; n < 500; n++ {
+		minKey, maxKey := strconv.Itoa(rand.Intn(20010)), strconv.Itoa(rand.Intn(20010))
+		minBound, maxBound := bptree.Inclusive([]byte(minKey)), bptree.Exclusive([]byte(maxKey))
+
+		if n%4 == 0 {
+			minBound = bptree.Unbounded
+		} else if n%4 == 1 {
+			maxBound = bptree.Unbounded
+		}
+
+		i := 0
+
+		for it := bpt.SearchRange(minBound, maxBound, false); !it.IsAtEnd(); it.Advance() {
+			i++
+		}
+
+		c, err := bpt.CountRange(minBound, maxBound)
+
+		if !assert.NoError(t, err) || !assert.Equal(t, i, c, "%q %q", minKey, maxKey) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestBPTreeBuild(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+
+	makeRecords := func(n int) *RecordSlice {
+		rs := new(RecordSlice)
+
+		for i := 0; i < n; i++ {
+			k := fmt.Sprintf("%08d", i)
+
+			if rand.Intn(100) == 0 {
+				k += strings.Repeat("k", 300) // overflowed
+			}
+
+			v := k
+
+			if rand.Intn(10) == 0 {
+				v = strings.Repeat(k, 100) // overflowed
 			}
+
+			rs.Keys = append(rs.Keys, []byte(k))
+			rs.Values = append(rs.Values, []byte(v))
 		}
+
+		return rs
 	}
 
-	for j := range deletedKeywordIndexes {
-		k := Keywords[j]
-		_, ok := bpt.AddRecord(k, k, false)
+	checkRecords := func(rs *RecordSlice) {
+		if !assert.NoError(t, bpt.Verify()) || !assert.Equal(t, len(rs.Keys), bpt.NumberOfRecords()) {
+			t.FailNow()
+		}
 
-		if !assert.True(t, ok, "%v %s", j, k) {
+		i := 0
+
+		for it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+			k, v, err := it.ReadRecordAll()
+
+			if !assert.NoError(t, err) || !assert.Equal(t, rs.Keys[i], k) || !assert.Equal(t, rs.Values[i], v) {
+				t.FailNow()
+			}
+
+			i++
+		}
+	}
+
+	for _, n := range []int{0, 1, 100, 1000, ScaleDown(100000)} {
+		rs := makeRecords(n)
+		m, err := bpt.Build(rs)
+
+		if !assert.NoError(t, err) || !assert.Equal(t, n, m) {
 			t.FailNow()
 		}
+
+		checkRecords(rs)
+		_, err = bpt.DeleteRange(bptree.Unbounded, bptree.Unbounded)
+		assert.NoError(t, err)
 	}
 
-	t.Logf("height=%d, num_leafs=%d num_non_leafs=%d payload_size=%d fs_stats=%#v",
-		bpt.Height(), bpt.NumberOfLeafs(), bpt.NumberOfNonLeafs(), bpt.PayloadSize(), fs.Stats())
+	rs := makeRecords(ScaleDown(100000))
+	_, err := bpt.Build(rs)
+	assert.NoError(t, err)
+	numberOfLeafs := bpt.NumberOfLeafs()
+	_, err = bpt.Build(makeRecords(1))
+	assert.Equal(t, bptree.ErrNotEmpty, err)
+	snapshot := bpt.TakeSnapshot()
+	_, err = bpt.DeleteRange(bptree.Unbounded, bptree.Unbounded)
+	assert.NoError(t, err)
 
-	return bpt, fs, func() {
-		bpt.Destroy()
-		fs.Close()
-		os.Remove(fn)
+	// the leaves are packed, rather than partly full after splits
+	for _, i := range rand.Perm(len(rs.Keys)) {
+		bpt.AddRecord(rs.Keys[i], rs.Values[i], false)
+	}
+
+	assert.Less(t, numberOfLeafs, bpt.NumberOfLeafs())
+	_, err = bpt.DeleteRange(bptree.Unbounded, bptree.Unbounded)
+	assert.NoError(t, err)
+
+	rs2 := makeRecords(10000)
+	rs2.Keys[5000], rs2.Keys[5001] = rs2.Keys[5001], rs2.Keys[5000]
+	_, err = bpt.Build(rs2)
+	assert.Equal(t, bptree.ErrKeyOutOfOrder, err)
+	checkRecords(new(RecordSlice))
+
+	i := 0
+
+	for it := snapshot.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+		k, _ := it.ReadKeyAll()
+
+		if !assert.Equal(t, rs.Keys[i], k) {
+			t.FailNow()
+		}
+
+		i++
 	}
+
+	assert.Equal(t, len(rs.Keys), i)
+	snapshot.Release()
 }
 
-func TestMain(m *testing.M) {
-	data, err := ioutil.ReadFile("../testdata/10-million-password-list-top-1000000.txt")
+func TestBPTreeIngest(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	state := map[string]string{}
 
-	if err != nil {
-		panic(err)
+	makeRecords := func(minKey, maxKey, n int, tag string) *RecordSlice {
+		rs := new(RecordSlice)
+		ks := map[int]struct{}{}
+
+		for len(ks) < n {
+			ks[minKey+rand.Intn(maxKey-minKey)] = struct{}{}
+		}
+
+		is := make([]int, 0, n)
+
+		for i := range ks {
+			is = append(is, i)
+		}
+
+		sort.Ints(is)
+
+		for _, i := range is {
+			k := fmt.Sprintf("%08d", i)
+
+			if i%100 == 0 {
+				k += strings.Repeat("k", 300) // overflowed
+			}
+
+			v := tag + k
+
+			if rand.Intn(10) == 0 {
+				v = strings.Repeat(v, 100) // overflowed
+			}
+
+			rs.Keys = append(rs.Keys, []byte(k))
+			rs.Values = append(rs.Values, []byte(v))
+		}
+
+		return rs
 	}
 
-	Keywords = bytes.Split(data, []byte("\n"))
-	Keywords = Keywords[:len(Keywords)-1]
-	Keywords = Keywords[:1000000]
+	ingest := func(rs *RecordSlice) {
+		n := 0
+
+		for i := range rs.Keys {
+			if _, ok := state[string(rs.Keys[i])]; !ok {
+				n++
+			}
+
+			state[string(rs.Keys[i])] = string(rs.Values[i])
+		}
+
+		m, err := bpt.Ingest(rs)
+
+		if !assert.NoError(t, err) || !assert.Equal(t, n, m) {
+			t.FailNow()
+		}
+
+		if !assert.NoError(t, bpt.Verify()) || !assert.Equal(t, len(state), bpt.NumberOfRecords()) {
+			t.FailNow()
+		}
+	}
+
+	checkRecords := func(it bptree.Iterator, state map[string]string) {
+		n := 0
+
+		for ; !it.IsAtEnd(); it.Advance() {
+			k, v, err := it.ReadRecordAll()
+
+			if !assert.NoError(t, err) || !assert.Equal(t, state[string(k)], string(v), string(k)) {
+				t.FailNow()
+			}
+
+			n++
+		}
+
+		assert.Equal(t, len(state), n)
+	}
+
+	ingest(makeRecords(0, 1000000, 1000, "a"))
+	ingest(makeRecords(0, 1000000, ScaleDown(50000), "b"))
+	snapshot := bpt.TakeSnapshot()
+	snapshotState := CopyState(state)
+
+	for r := 0; r < 20; r++ {
+		// narrow ranges
+		minKey := rand.Intn(1000000 - 10000)
+		ingest(makeRecords(minKey, minKey+10000, 1+rand.Intn(ScaleDown(5000)), "c"))
+	}
+
+	ingest(makeRecords(1000000, 1100000, ScaleDown(50000), "d")) // after the last key
+	ingest(makeRecords(0, 1100000, 100, "e"))                    // sparse
+	checkRecords(bpt.SearchForward(bptree.MinKey, bptree.MaxKey), state)
+	checkRecords(snapshot.SearchForward(bptree.MinKey, bptree.MaxKey), snapshotState)
+	snapshot.Release()
+
+	rs := makeRecords(0, 1000, 10, "f")
+	rs.Keys[5], rs.Keys[6] = rs.Keys[6], rs.Keys[5]
+	_, err := bpt.Ingest(rs)
+	assert.Equal(t, bptree.ErrKeyOutOfOrder, err)
+	assert.NoError(t, bpt.Verify())
+}
+
+func TestBPTreeSentinelKeys(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+
+	for _, k := range []string{"A", "MAX_KEY", "MIN_KEY", "Z"} {
+		bpt.AddRecord([]byte(k), nil, false)
+	}
+
+	_, ok, _ := bpt.AddRecord(bptree.MaxKey, nil, false)
+	assert.False(t, ok)
+	_, ok, _ = bpt.HasRecord(bptree.MinKey, false)
+	assert.True(t, ok)
+	keys := func(it bptree.Iterator) (keys []string) {
+		for ; !it.IsAtEnd(); it.Advance() {
+			k, _ := it.ReadKeyAll()
+			keys = append(keys, string(k))
+		}
+
+		return
+	}
+
+	maxKey := append([]byte(nil), bptree.MaxKey...)
+	minKey := append([]byte(nil), bptree.MinKey...)
+	assert.Equal(t, []string{"A", "MAX_KEY", "MIN_KEY", "Z"}, keys(bpt.SearchForward(bptree.MinKey, bptree.MaxKey)))
+	assert.Equal(t, []string{"MAX_KEY", "MIN_KEY"}, keys(bpt.SearchForward(maxKey, minKey)))
+	assert.Equal(t, []string{"MIN_KEY", "Z"}, keys(bpt.SearchForward(minKey, bptree.MaxKey)))
+	assert.Equal(t, []string{"Z"}, keys(bpt.SearchForward(bptree.MaxKey, bptree.MaxKey)))
+	assert.Equal(t, []string{"A"}, keys(bpt.SearchBackward(bptree.MinKey, bptree.MinKey)))
+	assert.Nil(t, keys(bpt.SearchForward(bptree.MaxKey, bptree.MinKey)))
+	assert.Nil(t, keys(bpt.SearchForward([]byte("B"), []byte("B"))))
+	assert.Equal(t, []string{"MAX_KEY", "MIN_KEY", "Z"}, keys(bpt.SearchRange(bptree.Inclusive(bptree.MaxKey), bptree.Unbounded, false)))
+}
+
+func TestBPTreeSearchPrefix(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	longKey := string(bytes.Repeat([]byte("ab"), 300))
+
+	keys := []string{
+		"", "a", "ab", "abc", "ab\xff", "ab\xff\xff", "ac", "b", "\xff", "\xff\xff", "\xff\xffa",
+		longKey, longKey + "c", longKey[:len(longKey)-1] + "c",
+	}
+
+	for i, n := 0, ScaleDown(20000); i < n; i++ {
+		keys = append(keys, "n"+strconv.Itoa(i))
+	}
+
+	for _, k := range keys {
+		bpt.AddRecord([]byte(k), nil, false)
+	}
+
+	sort.Strings(keys)
+
+	for _, prefix := range []string{
+		"", "a", "ab", "ab\xff", "ab\xff\xff\xff", "\xff", "\xff\xff", "n", "n1", "n19", "n20000", "z",
+		longKey[:400], longKey, longKey + "c",
+	} {
+		var keys2 []string
+
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				keys2 = append(keys2, k)
+			}
+		}
+
+		var keys3 []string
+
+		for it := bpt.SearchPrefix([]byte(prefix), false); !it.IsAtEnd(); it.Advance() {
+			k, _ := it.ReadKeyAll()
+			keys3 = append(keys3, string(k))
+		}
+
+		if !assert.Equal(t, keys2, keys3, "%q", prefix) {
+			t.FailNow()
+		}
+
+		keys3 = keys3[:0]
+
+		for it := bpt.SearchPrefix([]byte(prefix), true); !it.IsAtEnd(); it.Advance() {
+			k, _ := it.ReadKeyAll()
+			keys3 = append([]string{string(k)}, keys3...)
+		}
+
+		if len(keys3) == 0 {
+			keys3 = nil
+		}
+
+		if !assert.Equal(t, keys2, keys3, "%q", prefix) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestBPTreeCursor(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	c := bpt.NewCursor()
+	assert.False(t, c.IsValid())
+	assert.False(t, c.First().IsValid())
+	assert.False(t, c.Last().IsValid())
+	assert.False(t, c.Seek([]byte("a")).IsValid())
+	var keys []string
+
+	for i := 0; i < 20000; i++ {
+		k := "k" + strconv.Itoa(i)
+		bpt.AddRecord([]byte(k), []byte(k), false)
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	if !assert.Greater(t, bpt.NumberOfLeafs(), 1) {
+		t.FailNow()
+	}
+
+	i := 0
+
+	for c.First(); c.IsValid(); c.Next() {
+		k, v, err := c.ReadRecordAll()
+
+		if !assert.NoError(t, err) || !assert.Equal(t, keys[i], string(k)) || !assert.Equal(t, k, v) {
+			t.FailNow()
+		}
+
+		i++
+	}
+
+	assert.Equal(t, len(keys), i)
+
+	for c.Last(); c.IsValid(); c.Prev() {
+		i--
+		k, err := c.ReadKeyAll()
+
+		if !assert.NoError(t, err) || !assert.Equal(t, keys[i], string(k)) {
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, 0, i)
+	_, err := c.ReadKeyAll()
+	assert.Error(t, err)
+	assert.False(t, c.Next().IsValid())
+	assert.False(t, c.Prev().IsValid())
+
+	for _, tc := range []struct {
+		Key string
+		I   int
+	}{
+		{"", 0},
+		{"k", 0},
+		{"k0", 0},
+		{"k10000", sort.SearchStrings(keys, "k10000")},
+		{"k10000a", sort.SearchStrings(keys, "k10000") + 1},
+		{"k9999", len(keys) - 1},
+		{"l", len(keys)},
+	} {
+		c.Seek([]byte(tc.Key))
+
+		if tc.I == len(keys) {
+			assert.False(t, c.IsValid(), tc.Key)
+			continue
+		}
+
+		k, _ := c.ReadKeyAll()
+
+		if !assert.Equal(t, keys[tc.I], string(k), tc.Key) {
+			t.FailNow()
+		}
+
+		// walk back and forth across the leaves
+		for j := 0; j < 100 && c.IsValid(); j++ {
+			c.Prev()
+		}
+
+		for j := 0; j < 100 && c.IsValid(); j++ {
+			c.Next()
+		}
+
+		if tc.I >= 100 {
+			k, _ = c.ReadKeyAll()
+			assert.Equal(t, keys[tc.I], string(k), tc.Key)
+		} else {
+			assert.False(t, c.IsValid(), tc.Key)
+		}
+	}
+}
+
+func TestBPTreeResync(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	var keys []string
+	value := bytes.Repeat([]byte("v"), 100)
+
+	add := func(k string) {
+		if _, ok, _ := bpt.AddRecord([]byte(k), value, false); ok {
+			i := sort.SearchStrings(keys, k)
+			keys = append(keys, "")
+			copy(keys[i+1:], keys[i:])
+			keys[i] = k
+		}
+	}
+
+	remove := func(k string) {
+		if _, ok, _ := bpt.DeleteRecord([]byte(k), false); ok {
+			i := sort.SearchStrings(keys, k)
+			keys = append(keys[:i], keys[i+1:]...)
+		}
+	}
+
+	mutate := func() {
+		for j := 0; j < 3; j++ {
+			add(fmt.Sprintf("k%05d", rand.Intn(5000)))
+			remove(fmt.Sprintf("k%05d", rand.Intn(5000)))
+		}
+	}
+
+	// nextKey returns the first key after the given key, or the last
+	// key before it if backward is true.
+	nextKey := func(k string, backward bool) string {
+		if backward {
+			if i := sort.SearchStrings(keys, k) - 1; i >= 0 {
+				return keys[i]
+			}
+		} else {
+			if i := sort.Search(len(keys), func(i int) bool { return keys[i] > k }); i < len(keys) {
+				return keys[i]
+			}
+		}
+
+		return ""
+	}
+
+	for i := 0; i < 5000; i += 2 {
+		add(fmt.Sprintf("k%05d", i))
+	}
+
+	for _, backward := range []bool{false, true} {
+		var k string
+
+		if backward {
+			k = "l"
+		}
+
+		n := 0
+
+		for it := bpt.SearchRange(bptree.Unbounded, bptree.Unbounded, backward); !it.IsAtEnd(); it.Advance() {
+			k2, err := it.ReadKeyAll()
+
+			if !assert.NoError(t, err) || !assert.Equal(t, nextKey(k, backward), string(k2)) {
+				t.FailNow()
+			}
+
+			k = string(k2)
+			mutate()
+
+			if rand.Intn(4) == 0 {
+				// the iteration gets to the next key if the current key is deleted
+				remove(k)
+				k2, _ = it.ReadKeyAll()
+
+				if !assert.Equal(t, nextKey(k, backward), string(k2)) {
+					t.FailNow()
+				}
+
+				if len(k2) >= 1 {
+					k = string(k2)
+				}
+			}
+
+			n++
+		}
+
+		assert.Equal(t, "", nextKey(k, backward))
+		assert.Greater(t, n, 1000)
+
+		if !assert.NoError(t, bpt.Verify()) {
+			t.FailNow()
+		}
+	}
+
+	c := bpt.NewCursor()
+	k := ""
+
+	for c.Seek([]byte("k02500")); c.IsValid(); {
+		k2, err := c.ReadKeyAll()
+
+		if !assert.NoError(t, err) || !assert.True(t, k == "" || k == string(k2), "%q %q", k, k2) {
+			t.FailNow()
+		}
+
+		k = string(k2)
+		mutate()
+		backward := rand.Intn(3) == 0
+
+		if backward {
+			c.Prev()
+		} else {
+			c.Next()
+		}
+
+		k = nextKey(k, backward)
+	}
+
+	assert.Equal(t, "", k)
+}
+
+func TestBPTreeIteratorDeleteAndSetValue(t *testing.T) {
+	bpt, _, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	state := map[string]string{}
+
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("k%05d", i)
+		bpt.AddRecord([]byte(k), []byte(k), false)
+		state[k] = k
+	}
+
+	snapshot := bpt.TakeSnapshot()
+	defer snapshot.Release()
+	it := snapshot.SearchForward(bptree.MinKey, bptree.MaxKey)
+	assert.Equal(t, bptree.ErrIteratorReadOnly, it.Delete())
+	assert.Equal(t, bptree.ErrIteratorReadOnly, it.SetValue(nil))
+
+	for _, backward := range []bool{false, true} {
+		minKey, maxKey := "k02000", "k10000"
+
+		if backward {
+			minKey, maxKey = "k10000", "k18000"
+		}
+
+		n := 0
+
+		for it := bpt.SearchRange(bptree.Inclusive([]byte(minKey)), bptree.Exclusive([]byte(maxKey)), backward); !it.IsAtEnd(); it.Advance() {
+			k, err := it.ReadKeyAll()
+
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			if n%3 == 0 {
+				v := strings.Repeat("v", n%1000)
+
+				if !assert.NoError(t, it.SetValue([]byte(v))) {
+					t.FailNow()
+				}
+
+				state[string(k)] = v
+			} else {
+				if !assert.NoError(t, it.Delete()) {
+					t.FailNow()
+				}
+
+				delete(state, string(k))
+
+				if n%7 == 0 {
+					// reading after deleting gets to the next record
+					k2, _ := it.ReadKeyAll()
+
+					if len(k2) >= 1 && !assert.True(t, (string(k2) > string(k)) != backward, "%q %q", k, k2) {
+						t.FailNow()
+					}
+				}
+			}
+
+			n++
+		}
+
+		if !assert.NoError(t, bpt.Verify()) {
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, len(state), bpt.NumberOfRecords())
+
+	for it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+		k, v, _ := it.ReadRecordAll()
+
+		if !assert.Equal(t, state[string(k)], string(v), string(k)) {
+			t.FailNow()
+		}
+	}
+
+	n := 0
+
+	for it := snapshot.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+		k, v, _ := it.ReadRecordAll()
+
+		if !assert.Equal(t, k, v) {
+			t.FailNow()
+		}
+
+		n++
+	}
+
+	assert.Equal(t, 20000, n)
+	it = bpt.SearchRange(bptree.Exclusive([]byte("z")), bptree.Unbounded, false)
+	assert.Error(t, it.Delete())
+	assert.Error(t, it.SetValue(nil))
+}
+
+func TestBPTreeStoreAndLoad(t *testing.T) {
+	bpt, _, cleanup := MakeBPTree(t)
+	defer cleanup()
+	bpt.Load(bpt.Store())
+	i := 0
+
+	for it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+		k := Keywords[SortedKeywordIndexes[i]]
+		i++
+		k2, _ := it.ReadKeyAll()
+		if !assert.Equal(t, k2, k) {
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, len(Keywords), i)
+}
+
+func TestBPTreeCorrupted(t *testing.T) {
+	bpt, fs, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	_, _, err := bpt.AddRecord([]byte("foo"), []byte("bar"), false)
+	assert.NoError(t, err)
+	infoAddr := bpt.Store()
+	info := fs.AccessSpace(infoAddr)
+	rootAddr := int64(binary.BigEndian.Uint64(info[4:]))
+	info[12] = 0 // height
+	err = bpt.Load(infoAddr)
+
+	if assert.True(t, errors.Is(err, bptree.ErrCorrupted)) {
+		assert.Equal(t, &bptree.CorruptedError{Addr: infoAddr}, err)
+	}
+
+	info[12] = 1
+	info[3] = 0 // format version
+	assert.Equal(t, bptree.ErrUnsupportedFormatVersion, bpt.Load(infoAddr))
+	info[3] = 1
+
+	if !assert.NoError(t, bpt.Load(infoAddr)) {
+		t.FailNow()
+	}
+
+	root := fs.AccessAlignedSpace(rootAddr)
+	root[len(root)-1] ^= 1 // bit rot in the value of the record
+	_, _, err = bpt.HasRecord([]byte("foo"), true)
+	assert.Equal(t, &bptree.CorruptedError{Addr: rootAddr}, err)
+	it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey)
+	assert.True(t, it.IsAtEnd())
+	_, err = it.ReadKeyAll()
+	assert.Equal(t, &bptree.CorruptedError{Addr: rootAddr}, err)
+	root[len(root)-1] ^= 1
+	v, ok, err := bpt.HasRecord([]byte("foo"), true)
+
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, []byte("bar"), v)
+	}
+}
+
+func TestBPTreeVerify(t *testing.T) {
+	bpt, fs, cleanup := MakeBPTree(t)
+	defer cleanup()
+
+	if !assert.NoError(t, bpt.Verify()) {
+		t.FailNow()
+	}
+
+	for i, k := range Keywords {
+		if i%3 != 0 {
+			bpt.DeleteRecord(k, false)
+		}
+	}
+
+	if !assert.NoError(t, bpt.Verify()) {
+		t.FailNow()
+	}
+
+	it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey)
+	k, _ := it.ReadKeyAll()
+	_, _, err := bpt.AddRecord(append(k, 'x'), nil, false)
+	assert.NoError(t, err)
+	infoAddr := bpt.Store()
+	info := fs.AccessSpace(infoAddr)
+	leafAddr := int64(binary.BigEndian.Uint64(info[13:])) // the tail of the leaf list
+	assert.NoError(t, bpt.Load(infoAddr))
+	leaf := fs.AccessAlignedSpace(leafAddr)
+	binary.BigEndian.PutUint64(leaf[12:], uint64(leafAddr)) // the next leaf
+	binary.BigEndian.PutUint32(leaf, crc32.Checksum(leaf[4:], crc32.MakeTable(crc32.Castagnoli)))
+	err = bpt.Verify()
+
+	if assert.True(t, errors.Is(err, bptree.ErrCorrupted)) {
+		assert.Equal(t, &bptree.CorruptedError{Addr: leafAddr, Reason: "leaf with wrong next leaf"}, err)
+	}
+}
+
+func TestBPTreeKeyComparer(t *testing.T) {
+	const fn = "../testdata/bptree_keycomparer.tmp"
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	defer func() {
+		fs.Close()
+		os.Remove(fn)
+	}()
+
+	bpt := new(bptree.BPTree).Init(fs, bptree.WithKeyComparer(ReversedKeyComparer{}))
+	bpt.Create()
+	keys := make([]string, 0, ScaleDown(20000))
+
+	for _, k := range Keywords[:ScaleDown(20000)] {
+		if len(keys)%100 == 0 {
+			k = bytes.Repeat(k, 400/len(k)+1) // overflowed
+		}
+
+		if _, ok, _ := bpt.AddRecord(k, nil, false); ok {
+			keys = append(keys, string(k))
+		}
+	}
+
+	for _, k := range []string{"ab", "abc", "abd"} {
+		if _, ok, _ := bpt.AddRecord([]byte(k), nil, false); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	keys2 := make([]string, 0, len(keys))
+
+	for it := bpt.SearchForward(bptree.MinKey, bptree.MaxKey); !it.IsAtEnd(); it.Advance() {
+		k, _ := it.ReadKeyAll()
+		keys2 = append(keys2, string(k))
+	}
+
+	if !assert.Equal(t, keys, keys2) {
+		t.FailNow()
+	}
+
+	keys2 = keys2[:0]
+
+	for it := bpt.SearchBackward([]byte(keys[100]), []byte(keys[200])); !it.IsAtEnd(); it.Advance() {
+		k, _ := it.ReadKeyAll()
+		keys2 = append(keys2, string(k))
+	}
+
+	assert.Equal(t, len(keys[100:201]), len(keys2))
+	assert.Equal(t, keys[200], keys2[0])
+
+	checkPrefixes := func(bpt *bptree.BPTree) {
+		for _, prefix := range []string{"", "a", "ab", "abc", "s", "zzzzz"} {
+			keys3 := []string{}
+
+			for _, k := range keys {
+				if strings.HasPrefix(k, prefix) {
+					keys3 = append(keys3, k)
+				}
+			}
+
+			keys4 := []string{}
+
+			for it := bpt.SearchPrefix([]byte(prefix), false); !it.IsAtEnd(); it.Advance() {
+				k, _ := it.ReadKeyAll()
+				keys4 = append(keys4, string(k))
+			}
+
+			if !assert.Equal(t, keys3, keys4, "%q", prefix) {
+				t.FailNow()
+			}
+
+			keys4 = []string{}
+
+			for it := bpt.SearchPrefix([]byte(prefix), true); !it.IsAtEnd(); it.Advance() {
+				k, _ := it.ReadKeyAll()
+				keys4 = append([]string{string(k)}, keys4...)
+			}
+
+			if !assert.Equal(t, keys3, keys4, "%q", prefix) {
+				t.FailNow()
+			}
+		}
+	}
+
+	checkPrefixes(bpt)
+	assert.NoError(t, bpt.Verify())
+	infoAddr := bpt.Store()
+	bpt = new(bptree.BPTree).Init(fs)
+	assert.Equal(t, bptree.ErrKeyComparerMismatch, bpt.Load(infoAddr))
+	bpt = new(bptree.BPTree).Init(fs, bptree.WithKeyComparer(PrefixReversedKeyComparer{}))
+
+	if !assert.NoError(t, bpt.Load(infoAddr)) {
+		t.FailNow()
+	}
+
+	checkPrefixes(bpt)
+
+	for _, k := range keys {
+		_, ok, _ := bpt.DeleteRecord([]byte(k), false)
+
+		if !assert.True(t, ok) {
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, 0, bpt.NumberOfRecords())
+	bpt.Destroy()
+}
+
+func TestBPTreePageSize(t *testing.T) {
+	const fn = "../testdata/bptree_pagesize.tmp"
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	defer func() {
+		fs.Close()
+		os.Remove(fn)
+	}()
+
+	for _, pageSize := range []int{1000, bptree.MinPageSize - 1, bptree.MinPageSize + 1, bptree.MaxPageSize * 2} {
+		assert.Equal(t, bptree.ErrInvalidPageSize, bptree.CheckOptions(bptree.WithPageSize(pageSize)))
+		assert.Equal(t, bptree.ErrInvalidPageSize, new(bptree.BPTree).Init(fs, bptree.WithPageSize(pageSize)).Create())
+	}
+
+	numberOfLeafs := 0
+
+	for _, pageSize := range []int{bptree.MinPageSize, bptree.DefaultPageSize, bptree.MaxPageSize} {
+		bpt := new(bptree.BPTree).Init(fs, bptree.WithPageSize(pageSize))
+		bpt.Create()
+		assert.Equal(t, pageSize, bpt.PageSize())
+
+		for i, k := range Keywords[:ScaleDown(20000)] {
+			if i%100 == 0 {
+				k = bytes.Repeat(k, 400/len(k)+1) // overflowed
+			}
+
+			bpt.AddOrUpdateRecord(k, k, false)
+		}
+
+		if !assert.NoError(t, bpt.Verify()) {
+			t.FailNow()
+		}
+
+		if numberOfLeafs >= 1 {
+			assert.Less(t, bpt.NumberOfLeafs(), numberOfLeafs)
+		}
+
+		numberOfLeafs = bpt.NumberOfLeafs()
+		infoAddr := bpt.Store()
+		// the page size set isn't the one the B+ tree was created with
+		bpt = new(bptree.BPTree).Init(fs, bptree.WithPageSize(bptree.DefaultPageSize*2))
+
+		if !assert.NoError(t, bpt.Load(infoAddr)) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, pageSize, bpt.PageSize())
+		assert.Equal(t, numberOfLeafs, bpt.NumberOfLeafs())
+
+		for i, k := range Keywords[:ScaleDown(20000)] {
+			if i%100 == 0 {
+				k = bytes.Repeat(k, 400/len(k)+1) // overflowed
+			}
+
+			bpt.DeleteRecord(k, false)
+		}
+
+		if !assert.NoError(t, bpt.Verify()) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, 0, bpt.NumberOfRecords())
+		bpt.Destroy()
+	}
+}
+
+func TestBPTreeMaxKeyAndValueSizes(t *testing.T) {
+	const fn = "../testdata/bptree_maxkeyandvaluesizes.tmp"
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	defer func() {
+		fs.Close()
+		os.Remove(fn)
+	}()
+
+	for _, r := range []struct {
+		Options []bptree.Option
+		Err     error
+	}{
+		{[]bptree.Option{bptree.WithMaxKeySize(15)}, bptree.ErrInvalidMaxKeySize},
+		{[]bptree.Option{bptree.WithMaxValueSize(15)}, bptree.ErrInvalidMaxValueSize},
+		{[]bptree.Option{bptree.WithPageSize(bptree.MinPageSize), bptree.WithMaxKeySize(1024)}, bptree.ErrInvalidMaxKeySize},
+		{[]bptree.Option{bptree.WithPageSize(bptree.MinPageSize), bptree.WithMaxValueSize(1024)}, bptree.ErrInvalidMaxValueSize},
+	} {
+		assert.Equal(t, r.Err, bptree.CheckOptions(r.Options...))
+		assert.Equal(t, r.Err, new(bptree.BPTree).Init(fs, r.Options...).Create())
+	}
+
+	bpt := new(bptree.BPTree).Init(fs, bptree.WithMaxKeySize(64), bptree.WithMaxValueSize(513))
+	bpt.Create()
+	assert.Equal(t, 64, bpt.MaxKeySize())
+	assert.Equal(t, 513, bpt.MaxValueSize())
+	keys := make([]string, 0, 20000)
+
+	for i, k := range Keywords[:20000] {
+		if i%100 == 0 {
+			k = bytes.Repeat(k, 100/len(k)+1) // overflowed
+		}
+
+		v := bytes.Repeat(k, 200/len(k)+1+i%2) // not overflowed
+
+		if _, ok, _ := bpt.AddRecord(k, v, false); ok {
+			keys = append(keys, string(k))
+		}
+	}
+
+	if !assert.NoError(t, bpt.Verify()) {
+		t.FailNow()
+	}
+
+	infoAddr := bpt.Store()
+	bpt = new(bptree.BPTree).Init(fs)
+
+	if !assert.NoError(t, bpt.Load(infoAddr)) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, 64, bpt.MaxKeySize())
+	assert.Equal(t, 513, bpt.MaxValueSize())
+	sort.Strings(keys)
+	keys2 := make([]string, 0, len(keys))
+
+	for it := bpt.SearchRange(bptree.Unbounded, bptree.Unbounded, false); !it.IsAtEnd(); it.Advance() {
+		k, v, _ := it.ReadRecordAll()
+
+		if !assert.True(t, bytes.HasPrefix(v, k)) {
+			t.FailNow()
+		}
+
+		keys2 = append(keys2, string(k))
+	}
+
+	if !assert.Equal(t, keys, keys2) {
+		t.FailNow()
+	}
+
+	for _, k := range keys {
+		_, ok, _ := bpt.DeleteRecord([]byte(k), false)
+
+		if !assert.True(t, ok) {
+			t.FailNow()
+		}
+	}
+
+	if !assert.NoError(t, bpt.Verify()) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, 0, bpt.NumberOfRecords())
+	bpt.Destroy()
+}
+
+type ReversedKeyComparer struct{}
+
+func (ReversedKeyComparer) Name() string {
+	return "reversed"
+}
+
+func (ReversedKeyComparer) CompareKeys(key1 []byte, key2 []byte) int {
+	return bytes.Compare(key2, key1)
+}
+
+type PrefixReversedKeyComparer struct {
+	ReversedKeyComparer
+}
+
+func (PrefixReversedKeyComparer) MakePrefixBounds(prefix []byte) (bptree.Bound, bptree.Bound) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			prefixSuccessor := append([]byte(nil), prefix[:i+1]...)
+			prefixSuccessor[i]++
+			return bptree.Exclusive(prefixSuccessor), bptree.Inclusive(prefix)
+		}
+	}
+
+	return bptree.Unbounded, bptree.Inclusive(prefix)
+}
+
+func _TestBPTreeFprint(t *testing.T) {
+	bpt, _, cleanup := MakeBPTree(t)
+	defer cleanup()
+	bpt.Fprint(os.Stdout)
+}
+
+var Keywords [][]byte
+var SortedKeywordIndexes []int
+var SortedKeywordRIndexes []int
+
+type RecordSlice struct {
+	Keys   [][]byte
+	Values [][]byte
+	i      int
+}
+
+func (rs *RecordSlice) ReadRecord() ([]byte, []byte, bool, error) {
+	if rs.i == len(rs.Keys) {
+		return nil, nil, false, nil
+	}
+
+	rs.i++
+	return rs.Keys[rs.i-1], rs.Values[rs.i-1], true, nil
+}
+
+func MakeBPTree(t *testing.T) (*bptree.BPTree, *fsm.FileStorage, func()) {
+	const fn = "../testdata/bptree.tmp"
+	fs := new(fsm.FileStorage).Init()
+	err := fs.Open(fn, true)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	bpt := new(bptree.BPTree).Init(fs)
+	bpt.Create()
+	deletedKeywordIndexes := make(map[int]struct{}, len(Keywords)/2)
+
+	for i, k := range Keywords {
+		k2, ok, _ := bpt.AddRecord(k, k, true)
+
+		if !assert.True(t, ok, string(k), string(k2)) {
+			t.FailNow()
+		}
+
+		j := rand.Intn(i*2 + 1)
+
+		if j <= i {
+			if _, ok := deletedKeywordIndexes[j]; !ok {
+				k := Keywords[j]
+				k2, ok2, _ := bpt.DeleteRecord(k, true)
+
+				if !assert.True(t, ok2, "%v %s", j, k) {
+					t.FailNow()
+				}
+
+				assert.Equal(t, k, k2)
+				deletedKeywordIndexes[j] = struct{}{}
+			}
+		}
+	}
+
+	for j := range deletedKeywordIndexes {
+		k := Keywords[j]
+		_, ok, _ := bpt.AddRecord(k, k, false)
+
+		if !assert.True(t, ok, "%v %s", j, k) {
+			t.FailNow()
+		}
+	}
+
+	t.Logf("height=%d, num_leafs=%d num_non_leafs=%d payload_size=%d fs_stats=%#v",
+		bpt.Height(), bpt.NumberOfLeafs(), bpt.NumberOfNonLeafs(), bpt.PayloadSize(), fs.Stats())
+
+	return bpt, fs, func() {
+		bpt.Destroy()
+		fs.Close()
+		os.Remove(fn)
+	}
+}
+
+// ScaleDown returns the given size of a test, which is scaled down
+// with -short or the race detector, which slows the tests down a lot.
+func ScaleDown(n int) int {
+	if testing.Short() || RaceEnabled {
+		return n / 20
+	}
+
+	return n
+}
+
+func TestMain(m *testing.M) {
+	data, err := ioutil.ReadFile("../testdata/10-million-password-list-top-1000000.txt")
+
+	if err != nil {
+		panic(err)
+	}
+
+	Keywords = bytes.Split(data, []byte("\n"))
+	Keywords = Keywords[:len(Keywords)-1]
+	flag.Parse()
+	Keywords = Keywords[:ScaleDown(1000000)]
+
 	SortedKeywordIndexes = make([]int, len(Keywords))
 
 	for i := range Keywords {
@@ -0,0 +1,166 @@
+package bptree
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// RecordSource represents a source of records in ascending order of
+// keys, to build a B+ tree from.
+type RecordSource interface {
+	// ReadRecord reads and returns the next record in the source.
+	// If the source has no more records it returns false.
+	// The key and the value returned are copied before the next read,
+	// so they can be reused by the source.
+	ReadRecord() (key, value []byte, ok bool, err error)
+}
+
+// Build builds the B+ tree, which must be empty, from the records in
+// the given source and then returns the number of the records added.
+// Rather than adding the records one by one, it fills the leaves with
+// the records in order and creates the non-leaves over them bottom-up,
+// so all the nodes are packed except those on the right edge, which
+// are rebalanced at last.
+// If the B+ tree isn't empty it returns ErrNotEmpty, and if the keys
+// of the records aren't in strictly ascending order it returns
+// ErrKeyOutOfOrder. On such an error or an error from the source, the
+// records added are deleted.
+func (bpt *BPTree) Build(recordSource RecordSource) (_ int, err error) {
+	defer corruption.Recover(&err)
+
+	if bpt.recordCount != 0 {
+		return 0, ErrNotEmpty
+	}
+
+	builder := new(builder).Init(bpt)
+	err = builder.Run(recordSource)
+	builder.Finish()
+	bpt.modificationCount++
+
+	if err != nil {
+		bpt.deleteRange(Unbounded, Unbounded)
+		return 0, err
+	}
+
+	return bpt.recordCount, nil
+}
+
+// builder builds a B+ tree bottom-up, it keeps the last node at each
+// level of the B+ tree, to which the records or children are appended.
+type builder struct {
+	bpTree  *BPTree
+	levels  []builderLevel
+	lastKey []byte
+}
+
+func (b *builder) Init(bpTree *BPTree) *builder {
+	b.bpTree = bpTree
+	// the empty root leaf becomes the first leaf
+	leafAddr := bpTree.copyLeafOnWrite(-1, 0)
+	b.levels = []builderLevel{{leafAddr, nil, 0}}
+	return b
+}
+
+// Run adds the records in the given source to the leaves.
+func (b *builder) Run(recordSource RecordSource) error {
+	bpt := b.bpTree
+
+	for {
+		key, value, ok, err := recordSource.ReadRecord()
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return nil
+		}
+
+		if bpt.recordCount >= 1 && bpt.options.KeyComparer.CompareKeys(b.lastKey, key) >= 0 {
+			return ErrKeyOutOfOrder
+		}
+
+		b.lastKey = append(b.lastKey[:0], key...)
+		b.addRecord(bpt.createRecord(key, value))
+	}
+}
+
+// Finish adds the last node at each level to the upper level, makes
+// the top node the root, and then rebalances the nodes on the right
+// edge of the B+ tree.
+func (b *builder) Finish() {
+	bpt := b.bpTree
+
+	for i := 0; i < len(b.levels)-1; i++ {
+		b.addNode(i)
+	}
+
+	bpt.rootAddr = b.levels[len(b.levels)-1].NodeAddr
+	bpt.height = len(b.levels)
+
+	for {
+		for bpt.height >= 2 && bpt.getNonLeafController(bpt.rootAddr).NumberOfChildren() == 1 {
+			bpt.decreaseHeight()
+		}
+
+		if bpt.recordCount == 0 || !bpt.fixFirstBadNode(bpt.findEndRecord(true)) {
+			return
+		}
+	}
+}
+
+func (b *builder) addRecord(record1 record) {
+	bpt := b.bpTree
+	level := &b.levels[0]
+	recordSize := recordHeaderSize + len(record1.Key) + len(record1.Value)
+
+	if leafController := bpt.getLeafController(level.NodeAddr); level.RecordCount >= 1 && leafController.GetLoadSize()+recordSize > leafController.OverloadThreshold(bpt.maxRecordSize()) {
+		// the key of the new leaf separates it from the last one
+		firstKey := copyBytes(keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize}.MakeSeparator(leafController.GetKey(level.RecordCount-1), record1.Key))
+		b.addNode(0)
+		level = &b.levels[0] // b.levels may have grown
+		leafAddr, _ := bpt.createLeaf()
+		bpt.leafList.InsertLeafAfter(leafFactory{bpt.fileStorage, bpt.pageSize}, leafAddr, level.NodeAddr)
+		*level = builderLevel{leafAddr, firstKey, 0}
+	}
+
+	leafController := bpt.getLeafController(level.NodeAddr)
+	leafController.InsertRecords(level.RecordCount, []record{record1})
+	level.RecordCount++
+	bpt.recordCount++
+}
+
+// addNode adds the last node at the given level as a child to the
+// last node at the upper level, which is created if full or missing.
+func (b *builder) addNode(i int) {
+	bpt := b.bpTree
+	level := b.levels[i]
+	child := nonLeafChild{level.FirstKey, level.NodeAddr, level.RecordCount}
+
+	if i == len(b.levels)-1 {
+		nonLeafAddr, _ := bpt.createNonLeaf()
+		b.levels = append(b.levels, builderLevel{nonLeafAddr, nil, 0})
+	} else if nonLeafController := bpt.getNonLeafController(b.levels[i+1].NodeAddr); nonLeafController.GetLoadSize()+nonLeafChildHeaderSize+len(child.Key) > nonLeafController.OverloadThreshold(bpt.maxNonLeafChildSize()) {
+		b.addNode(i + 1)
+		nonLeafAddr, _ := bpt.createNonLeaf()
+		b.levels[i+1] = builderLevel{nonLeafAddr, nil, 0}
+	}
+
+	upperLevel := &b.levels[i+1]
+	nonLeafController := bpt.getNonLeafController(upperLevel.NodeAddr)
+	n := nonLeafController.NumberOfChildren()
+
+	if n == 0 {
+		// the key of the first child goes to the upper level
+		upperLevel.FirstKey = child.Key
+		child.Key = nil
+	}
+
+	nonLeafController.InsertChildren(n, []nonLeafChild{child})
+	upperLevel.RecordCount += child.RecordCount
+}
+
+type builderLevel struct {
+	NodeAddr    int64
+	FirstKey    key
+	RecordCount int
+}
@@ -1,12 +1,85 @@
 package bptree
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv/internal/corruption"
+	"github.com/roy2220/plainkv/internal/format"
+)
 
 var (
-	errCorrupted  = errors.New("bptree: corrupted")
-	errOutOfRange = errors.New("bptree: out of range")
+	// ErrCorrupted is the error which CorruptedError wraps, so
+	// errors.Is(err, ErrCorrupted) reports a corrupted B+ tree.
+	ErrCorrupted = corruption.ErrCorrupted
+
+	// ErrUnsupportedFormatVersion is returned when loading a B+ tree
+	// stored in a format of another version, e.g. by an older release.
+	ErrUnsupportedFormatVersion = format.ErrUnsupportedVersion
+
+	// ErrKeyComparerMismatch is returned when loading a B+ tree
+	// stored with a key comparer of another name.
+	ErrKeyComparerMismatch = errors.New("plainkv: key comparer mismatch")
+
+	// ErrKeyComparerNameTooLong is returned when creating or loading
+	// a B+ tree with a key comparer whose name is over 255 bytes.
+	ErrKeyComparerNameTooLong = errors.New("plainkv: key comparer name too long")
+
+	// ErrIteratorReadOnly is returned when deleting or updating a
+	// record through an iterator which can't modify the records,
+	// e.g. an iterator over a snapshot.
+	ErrIteratorReadOnly = errors.New("plainkv: iterator read-only")
+
+	// ErrNotEmpty is returned when building a B+ tree which isn't
+	// empty.
+	ErrNotEmpty = errors.New("plainkv: not empty")
+
+	// ErrKeyOutOfOrder is returned when building a B+ tree from
+	// records whose keys aren't in strictly ascending order.
+	ErrKeyOutOfOrder = errors.New("plainkv: key out of order")
+
+	// ErrInvalidPageSize is returned when creating or loading a
+	// B+ tree with the page size set to an invalid one.
+	ErrInvalidPageSize = errors.New("plainkv: invalid page size")
+
+	// ErrInvalidMaxKeySize is returned when creating or loading a
+	// B+ tree with the maximum key size set to an invalid one.
+	ErrInvalidMaxKeySize = errors.New("plainkv: invalid max key size")
+
+	// ErrInvalidMaxValueSize is returned when creating or loading a
+	// B+ tree with the maximum value size set to an invalid one.
+	ErrInvalidMaxValueSize = errors.New("plainkv: invalid max value size")
+
+	errOutOfRange       = errors.New("bptree: out of range")
+	errSnapshotReleased = errors.New("bptree: snapshot released")
 )
 
+// CorruptedError is returned when corrupted data is found in a
+// B+ tree on the file storage, it holds the address of the space
+// where the corrupted data is.
+// The B+ tree may be left inconsistent by the operation failed.
+type CorruptedError = corruption.Error
+
+func accessSpace(fileStorage *fsm.FileStorage, addr int64) []byte {
+	defer corruption.Guard(addr)
+	return fileStorage.AccessSpace(addr)
+}
+
+func freeSpace(fileStorage *fsm.FileStorage, addr int64) {
+	defer corruption.Guard(addr)
+	fileStorage.FreeSpace(addr)
+}
+
+func accessAlignedSpace(fileStorage *fsm.FileStorage, addr int64) []byte {
+	defer corruption.Guard(addr)
+	return fileStorage.AccessAlignedSpace(addr)
+}
+
+func freeAlignedSpace(fileStorage *fsm.FileStorage, addr int64) {
+	defer corruption.Guard(addr)
+	fileStorage.FreeAlignedSpace(addr)
+}
+
 func copyBytes(data []byte) []byte {
 	buffer := make([]byte, len(data))
 	copy(buffer, data)
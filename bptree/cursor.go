@@ -0,0 +1,258 @@
+package bptree
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Cursor represents a position at a record in a B+ tree, which can
+// be moved to anywhere and then along the records in either direction.
+// The cursor is not valid initially, nor after being moved past the
+// first or the last record, it can be moved to anywhere again then.
+// If corrupted data is found, the cursor is no longer valid and the
+// reads return a CorruptedError until it's moved to anywhere again.
+type Cursor interface {
+	// IsValid indicates if the cursor is at a record.
+	IsValid() (isAtRecord bool)
+
+	// First moves the cursor to the first record and returns the cursor
+	// self.
+	// If the B+ tree is empty the cursor is no longer valid.
+	First() Cursor
+
+	// Last moves the cursor to the last record and returns the cursor
+	// self.
+	// If the B+ tree is empty the cursor is no longer valid.
+	Last() Cursor
+
+	// Seek moves the cursor to the first record with a key not less
+	// than the given key and returns the cursor self.
+	// If there is no such record the cursor is no longer valid.
+	Seek(key []byte) Cursor
+
+	// Next moves the cursor to the next record and returns the cursor
+	// self.
+	// If the cursor is at the last record it is no longer valid, and
+	// if the cursor is not valid it does nothing.
+	Next() Cursor
+
+	// Prev moves the cursor to the previous record and returns the
+	// cursor self.
+	// If the cursor is at the first record it is no longer valid, and
+	// if the cursor is not valid it does nothing.
+	Prev() Cursor
+
+	// GetKeySize returns the key size of the record at the cursor.
+	GetKeySize() (keySize int, err error)
+
+	// ReadKey reads data of the key of the record at the cursor at the
+	// given offset into the given buffer and then returns the number
+	// of bytes read.
+	// If the cursor is not valid it returns an error.
+	ReadKey(dataOffset int, buffer []byte) (numberOfBytesRead int, err error)
+
+	// ReadKeyAll reads and returns all data of the key of the record
+	// at the cursor.
+	// If the cursor is not valid it returns an error.
+	ReadKeyAll() (key []byte, err error)
+
+	// GetValueSize returns the value size of the record at the cursor.
+	GetValueSize() (valueSize int, err error)
+
+	// ReadValue reads data of the value of the record at the cursor at
+	// the given offset into the given buffer and then returns the number
+	// of bytes read.
+	// If the cursor is not valid it returns an error.
+	ReadValue(dataOffset int, buffer []byte) (numberOfBytesRead int, err error)
+
+	// ReadValueAll reads and returns all data of the value of the record
+	// at the cursor.
+	// If the cursor is not valid it returns an error.
+	ReadValueAll() (value []byte, err error)
+
+	// ReadRecordAll reads and returns all data of the key and all data of
+	// the value of the record at the cursor.
+	// If the cursor is not valid it returns an error.
+	ReadRecordAll() (key, value []byte, err error)
+}
+
+// cursor walks through the tree along the leaf list, hence there is
+// no cursor over a snapshot. As a live iteration does, the cursor seeks
+// the current key again once the tree has been modified.
+type cursor struct {
+	iterator
+	bpTree            *BPTree
+	modificationCount int64
+	currentKey        []byte
+}
+
+var _ = Cursor((*cursor)(nil))
+
+func (c *cursor) Init(bpTree *BPTree) *cursor {
+	c.bpTree = bpTree
+	c.reset()
+	return c
+}
+
+func (c *cursor) IsValid() bool {
+	c.resync(false, false)
+	return !c.IsAtEnd()
+}
+
+func (c *cursor) First() Cursor {
+	c.reset()
+	c.seek(Unbounded, false)
+	return c
+}
+
+func (c *cursor) Last() Cursor {
+	c.reset()
+	c.seek(Unbounded, true)
+	return c
+}
+
+func (c *cursor) Seek(key []byte) Cursor {
+	c.reset()
+	c.seek(Inclusive(key), false)
+	return c
+}
+
+func (c *cursor) Next() Cursor {
+	if c.iterator.IsAtEnd() || c.resync(true, false) {
+		return c
+	}
+
+	defer corruption.Recover(&c.err)
+	leafController := c.makeCurrentLeafController()
+
+	if c.currentRecordIndex < leafController.NumberOfRecords()-1 {
+		c.currentRecordIndex++
+	} else if c.currentLeafAddr == c.bpTree.leafList.TailAddr() {
+		c.reset()
+		return c
+	} else {
+		c.currentLeafAddr = leafHeader(leafController).NextAddr()
+		c.currentRecordIndex = 0
+	}
+
+	c.saveCurrentKey()
+	return c
+}
+
+func (c *cursor) Prev() Cursor {
+	if c.iterator.IsAtEnd() || c.resync(true, true) {
+		return c
+	}
+
+	defer corruption.Recover(&c.err)
+
+	if c.currentRecordIndex >= 1 {
+		c.currentRecordIndex--
+	} else if c.currentLeafAddr == c.bpTree.leafList.HeadAddr() {
+		c.reset()
+		return c
+	} else {
+		leafController := c.makeCurrentLeafController()
+		c.currentLeafAddr = leafHeader(leafController).PrevAddr()
+		leafController = c.makeCurrentLeafController()
+		c.currentRecordIndex = leafController.NumberOfRecords() - 1
+	}
+
+	c.saveCurrentKey()
+	return c
+}
+
+func (c *cursor) GetKeySize() (int, error) {
+	c.resync(false, false)
+	return c.iterator.GetKeySize()
+}
+
+func (c *cursor) ReadKey(dataOffset int, buffer []byte) (int, error) {
+	c.resync(false, false)
+	return c.iterator.ReadKey(dataOffset, buffer)
+}
+
+func (c *cursor) ReadKeyAll() ([]byte, error) {
+	c.resync(false, false)
+	return c.iterator.ReadKeyAll()
+}
+
+func (c *cursor) GetValueSize() (int, error) {
+	c.resync(false, false)
+	return c.iterator.GetValueSize()
+}
+
+func (c *cursor) ReadValue(dataOffset int, buffer []byte) (int, error) {
+	c.resync(false, false)
+	return c.iterator.ReadValue(dataOffset, buffer)
+}
+
+func (c *cursor) ReadValueAll() ([]byte, error) {
+	c.resync(false, false)
+	return c.iterator.ReadValueAll()
+}
+
+func (c *cursor) ReadRecordAll() ([]byte, []byte, error) {
+	c.resync(false, false)
+	return c.iterator.ReadRecordAll()
+}
+
+// resync seeks the current key again if the tree has been modified
+// since the cursor got to the key, and then returns true.
+// If the record with the key has been deleted, the cursor gets to
+// the next record. If isMoving is true, the cursor gets to the next
+// record, or the previous record if isBackward is true, anyway.
+func (c *cursor) resync(isMoving bool, isBackward bool) bool {
+	if c.err != nil || c.isAtEnd || c.modificationCount == c.bpTree.modificationCount {
+		return false
+	}
+
+	var bound Bound
+
+	if isMoving {
+		bound = Exclusive(c.currentKey)
+	} else {
+		bound = Inclusive(c.currentKey)
+	}
+
+	c.reset()
+	c.seek(bound, isBackward)
+	return true
+}
+
+func (c *cursor) reset() {
+	c.iterator.init(c.bpTree, 0, 0, 0, 0, true)
+	c.err = nil
+	c.modificationCount = c.bpTree.modificationCount
+}
+
+// seek moves the cursor to the first record in the given bound, or
+// the last record if isBackward is true.
+func (c *cursor) seek(bound Bound, isBackward bool) {
+	defer corruption.Recover(&c.err)
+	bpt := c.bpTree
+
+	if bpt.recordCount == 0 {
+		return
+	}
+
+	var recordPath recordPath
+	var ok bool
+
+	if isBackward {
+		recordPath, ok = bpt.findMaxRecord(bound)
+	} else {
+		recordPath, ok = bpt.findMinRecord(bound)
+	}
+
+	if !ok {
+		return
+	}
+
+	c.currentLeafAddr, c.currentRecordIndex = recordPath.LastComponent()
+	c.isAtEnd = false
+	c.saveCurrentKey()
+}
+
+func (c *cursor) saveCurrentKey() {
+	c.currentKey = c.readCurrentKey(c.currentKey)
+}
@@ -0,0 +1,381 @@
+package bptree
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// DeleteRange deletes the records with keys in the range between
+// the given bounds in the B+ tree, each of which may be inclusive,
+// exclusive or unbounded, and then returns the number of the records
+// deleted.
+// Rather than deleting the records one by one, it drops the leaves
+// and the subtrees within the range as a whole, and then rebalances
+// the nodes along the boundaries of the range.
+func (bpt *BPTree) DeleteRange(minBound Bound, maxBound Bound) (_ int, err error) {
+	defer corruption.Recover(&err)
+	return bpt.deleteRange(minBound, maxBound), nil
+}
+
+func (bpt *BPTree) deleteRange(minBound Bound, maxBound Bound) int {
+	if bpt.recordCount == 0 {
+		return 0
+	}
+
+	minBound = bpt.resolveBound(minBound, false)
+	maxBound = bpt.resolveBound(maxBound, true)
+	firstRecordPath, lastRecordPath, ok := bpt.searchRange(minBound, maxBound)
+
+	if !ok {
+		return 0
+	}
+
+	// all the nodes modified while cutting the range off are on the
+	// boundaries, copy them in advance, so no more leaves are replaced
+	// in the leaf list once leaves start getting destroyed
+	bpt.copyPathOnWrite(firstRecordPath)
+	bpt.copyPathOnWrite(lastRecordPath)
+	recordCount := bpt.recordCount
+	new(rangeDeleter).Init(bpt).Run(firstRecordPath, lastRecordPath)
+	bpt.rebalanceBoundaries(minBound, maxBound)
+	bpt.modificationCount++
+	return recordCount - bpt.recordCount
+}
+
+// rebalanceBoundaries rebalances the nodes on the paths to the last
+// record before the given range and to the first record after the
+// range, after the range has been cut off.
+// The nodes on a path are fixed from the top down, so the parent of
+// a node to fix is always in good shape, which means the node has
+// siblings.
+func (bpt *BPTree) rebalanceBoundaries(minBound Bound, maxBound Bound) {
+	lowerBound, hasLowerBound := complementBound(minBound)
+	upperBound, hasUpperBound := complementBound(maxBound)
+
+	for {
+		for bpt.height >= 2 && bpt.getNonLeafController(bpt.rootAddr).NumberOfChildren() == 1 {
+			bpt.decreaseHeight()
+		}
+
+		if bpt.recordCount == 0 {
+			return
+		}
+
+		if hasLowerBound {
+			if recordPath, ok := bpt.findMaxRecord(lowerBound); ok && bpt.fixFirstBadNode(recordPath) {
+				continue
+			}
+		}
+
+		if hasUpperBound {
+			if recordPath, ok := bpt.findMinRecord(upperBound); ok && bpt.fixFirstBadNode(recordPath) {
+				continue
+			}
+		}
+
+		return
+	}
+}
+
+// fixFirstBadNode fixes the first overloaded or underloaded node on
+// the given record path, and then returns true. If all the nodes are
+// in good shape, it returns false.
+func (bpt *BPTree) fixFirstBadNode(recordPath recordPath) bool {
+	bpt.copyPathOnWrite(recordPath)
+	n := len(recordPath)
+
+	for i := 0; i < n-1; i++ {
+		nonLeafController := bpt.getNonLeafController(recordPath[i].NodeAddr)
+		loadSize := nonLeafController.GetLoadSize()
+
+		if loadSize > nonLeafController.OverloadThreshold(bpt.maxNonLeafChildSize()) {
+			bpt.ensureNotOverloadNonLeaf(&recordPath, i)
+			return true
+		}
+
+		if i >= 1 && loadSize < nonLeafController.UnderloadThreshold(bpt.maxNonLeafChildSize()) {
+			bpt.ensureNotUnderloadNonLeaf(&recordPath, i)
+			return true
+		}
+	}
+
+	if leafController := bpt.getLeafController(recordPath[n-1].NodeAddr); n >= 2 && leafController.GetLoadSize() < leafController.UnderloadThreshold(bpt.maxRecordSize()) {
+		bpt.ensureNotUnderloadLeaf(&recordPath)
+		return true
+	}
+
+	return false
+}
+
+// complementBound returns the bound complementing the given bound,
+// which covers the keys on the other side. If the given bound is
+// unbounded, it returns false.
+func complementBound(bound Bound) (Bound, bool) {
+	switch bound.kind {
+	case inclusiveBound:
+		return Exclusive(bound.key), true
+	case exclusiveBound:
+		return Inclusive(bound.key), true
+	default:
+		return Bound{}, false
+	}
+}
+
+// rangeDeleter cuts a range of records off a B+ tree, leaving the
+// nodes on the boundaries of the range possibly overloaded (with keys
+// replaced) or underloaded, even non-leaves with only one child, to be
+// rebalanced.
+type rangeDeleter struct {
+	bpTree            *BPTree
+	leafCount         int
+	firstLeafAddr     int64
+	lastLeafAddr      int64
+	firstLeafPrevAddr int64
+	lastLeafNextAddr  int64
+}
+
+func (rd *rangeDeleter) Init(bpTree *BPTree) *rangeDeleter {
+	rd.bpTree = bpTree
+	return rd
+}
+
+// Run deletes the records from the one which the first record path
+// leads to, to the one which the last record path leads to.
+func (rd *rangeDeleter) Run(firstRecordPath recordPath, lastRecordPath recordPath) {
+	bpt := rd.bpTree
+
+	if isEmpty, _ := rd.deleteRecords(0, bpt.rootAddr, firstRecordPath, lastRecordPath); isEmpty {
+		if bpt.height == 1 {
+			return
+		}
+
+		bpt.destroyNonLeaf(bpt.rootAddr)
+		var rootController leafController
+		bpt.rootAddr, rootController = bpt.createLeaf()
+		bpt.height = 1
+		bpt.leafList.Init(rootController, bpt.rootAddr)
+		return
+	}
+
+	if rd.leafCount >= 1 {
+		// the leaves destroyed are consecutive
+		bpt.leafList.RemoveLeafs(leafFactory{bpt.fileStorage, bpt.pageSize}, rd.firstLeafAddr, rd.lastLeafAddr, rd.firstLeafPrevAddr, rd.lastLeafNextAddr)
+	}
+}
+
+// deleteRecords deletes the records from the one which the first
+// record path leads to, to the one which the last record path leads
+// to, in the subtree of the node at the given index of the record
+// paths. A nil record path stands for the first or last record of the
+// subtree.
+// It returns true if the subtree becomes empty, otherwise false and
+// whether the first record of the subtree has been deleted, in which
+// case the key of the subtree in the parent is to be replaced.
+func (rd *rangeDeleter) deleteRecords(i int, nodeAddr int64, firstRecordPath recordPath, lastRecordPath recordPath) (bool, bool) {
+	bpt := rd.bpTree
+
+	if nodeDepth := i + 1; nodeDepth == bpt.height {
+		return rd.deleteLeafRecords(i, nodeAddr, firstRecordPath, lastRecordPath)
+	}
+
+	nonLeafController := bpt.getNonLeafController(nodeAddr)
+	firstChildIndex, lastChildIndex := 0, nonLeafController.NumberOfChildren()-1
+
+	if firstRecordPath != nil {
+		firstChildIndex = firstRecordPath[i].RecordOrNonLeafChildIndex
+	}
+
+	if lastRecordPath != nil {
+		lastChildIndex = lastRecordPath[i].RecordOrNonLeafChildIndex
+	}
+
+	childAddrs := make([]int64, lastChildIndex-firstChildIndex+1)
+
+	for j := range childAddrs {
+		childAddrs[j] = nonLeafController.GetChildAddr(firstChildIndex + j)
+	}
+
+	// the children in [i1, i2] are to be removed
+	i1, i2 := firstChildIndex+1, lastChildIndex-1
+	cutChildIndex := -1
+
+	if firstChildIndex == lastChildIndex {
+		if isEmpty, isCut := rd.deleteRecords(i+1, childAddrs[0], firstRecordPath, lastRecordPath); isEmpty {
+			rd.destroyNode(i+1, childAddrs[0])
+			i1, i2 = firstChildIndex, lastChildIndex
+		} else if isCut {
+			cutChildIndex = firstChildIndex
+		}
+	} else {
+		// the children off the record paths are within the range as a
+		// whole, they are destroyed rather than cut, as they haven't
+		// been copied on write
+		if firstRecordPath == nil {
+			rd.destroySubtree(i+1, childAddrs[0])
+			i1 = firstChildIndex
+		} else if isEmpty, _ := rd.deleteRecords(i+1, childAddrs[0], firstRecordPath, nil); isEmpty {
+			// the first child has records deleted from a record to the end,
+			// if its first record is deleted, it becomes empty
+			rd.destroyNode(i+1, childAddrs[0])
+			i1 = firstChildIndex
+		}
+
+		for _, childAddr := range childAddrs[1 : len(childAddrs)-1] {
+			rd.destroySubtree(i+1, childAddr)
+		}
+
+		if lastRecordPath == nil {
+			rd.destroySubtree(i+1, childAddrs[len(childAddrs)-1])
+			i2 = lastChildIndex
+		} else if isEmpty, isCut := rd.deleteRecords(i+1, childAddrs[len(childAddrs)-1], nil, lastRecordPath); isEmpty {
+			rd.destroyNode(i+1, childAddrs[len(childAddrs)-1])
+			i2 = lastChildIndex
+		} else if isCut {
+			cutChildIndex = lastChildIndex
+		}
+	}
+
+	// >>> fix node controllers begin
+	nonLeafController = bpt.getNonLeafController(nodeAddr)
+	// <<< fix node controllers end
+
+	numberOfRemainingChildren := lastChildIndex - firstChildIndex + 1
+
+	if numberOfChildren := i2 - i1 + 1; numberOfChildren >= 1 {
+		nonLeafController.RemoveChildren(i1, numberOfChildren)
+		numberOfRemainingChildren -= numberOfChildren
+
+		if nonLeafController.NumberOfChildren() == 0 {
+			return true, false
+		}
+
+		if i1 == 0 {
+			nonLeafController.SetKey(0, nil)
+			cutChildIndex = 0
+		} else if cutChildIndex > i2 {
+			cutChildIndex -= numberOfChildren
+		}
+	}
+
+	// the children remaining on the boundaries have lost records
+	for j := firstChildIndex; j < firstChildIndex+numberOfRemainingChildren; j++ {
+		childAddr := nonLeafController.GetChildAddr(j)
+		nonLeafController.SetChildRecordCount(j, bpt.countRecords(childAddr, i+1))
+	}
+
+	if cutChildIndex >= 1 {
+		childAddr := nonLeafController.GetChildAddr(cutChildIndex)
+		prevChildAddr := nonLeafController.GetChildAddr(cutChildIndex - 1)
+		key := keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize}.MakeSeparator(rd.getLastKey(i+1, prevChildAddr), rd.getFirstKey(i+1, childAddr))
+		nonLeafController.SetKey(cutChildIndex, key)
+	}
+
+	return false, cutChildIndex == 0
+}
+
+func (rd *rangeDeleter) deleteLeafRecords(i int, leafAddr int64, firstRecordPath recordPath, lastRecordPath recordPath) (bool, bool) {
+	bpt := rd.bpTree
+	leafController := bpt.getLeafController(leafAddr)
+	firstRecordIndex, lastRecordIndex := 0, leafController.NumberOfRecords()-1
+
+	if firstRecordPath != nil {
+		firstRecordIndex = firstRecordPath[i].RecordOrNonLeafChildIndex
+	}
+
+	if lastRecordPath != nil {
+		lastRecordIndex = lastRecordPath[i].RecordOrNonLeafChildIndex
+	}
+
+	records := leafController.RemoveRecords(firstRecordIndex, lastRecordIndex-firstRecordIndex+1)
+	isEmpty := leafController.NumberOfRecords() == 0
+
+	for _, record := range records {
+		bpt.destroyRecord(record, false)
+	}
+
+	bpt.recordCount -= len(records)
+	return isEmpty, firstRecordIndex == 0
+}
+
+// destroySubtree destroys the subtree of the node at the given index
+// of record paths along with all the records in it.
+func (rd *rangeDeleter) destroySubtree(i int, nodeAddr int64) {
+	bpt := rd.bpTree
+
+	if nodeDepth := i + 1; nodeDepth == bpt.height {
+		leafController := bpt.getLeafController(nodeAddr)
+		n := leafController.NumberOfRecords()
+
+		for j := 0; j < n; j++ {
+			// >>> fix node controllers begin
+			leafController = leafFactory{bpt.fileStorage, bpt.pageSize}.GetCheckedLeafController(nodeAddr)
+			// <<< fix node controllers end
+			// the leaf may be shared, so the records are destroyed in place
+			bpt.destroyRecord(record{leafController.GetKey(j), leafController.GetValue(j)}, false)
+		}
+
+		bpt.recordCount -= n
+		rd.destroyNode(i, nodeAddr)
+		return
+	}
+
+	nonLeafController := bpt.getNonLeafController(nodeAddr)
+	childAddrs := make([]int64, nonLeafController.NumberOfChildren())
+
+	for j := range childAddrs {
+		childAddrs[j] = nonLeafController.GetChildAddr(j)
+	}
+
+	for _, childAddr := range childAddrs {
+		rd.destroySubtree(i+1, childAddr)
+	}
+
+	rd.destroyNode(i, nodeAddr)
+}
+
+// destroyNode destroys the node at the given index of record paths,
+// which has no records or children left.
+func (rd *rangeDeleter) destroyNode(i int, nodeAddr int64) {
+	bpt := rd.bpTree
+
+	if nodeDepth := i + 1; nodeDepth < bpt.height {
+		bpt.destroyNonLeaf(nodeAddr)
+		return
+	}
+
+	leafHeader := leafHeader(bpt.getLeafController(nodeAddr))
+
+	if rd.leafCount == 0 {
+		rd.firstLeafAddr = nodeAddr
+		rd.firstLeafPrevAddr = leafHeader.PrevAddr()
+	}
+
+	rd.lastLeafAddr = nodeAddr
+	rd.lastLeafNextAddr = leafHeader.NextAddr()
+	rd.leafCount++
+	bpt.destroyLeaf(nodeAddr)
+}
+
+// getFirstKey returns the first key of the subtree of the node at
+// the given index of record paths.
+func (rd *rangeDeleter) getFirstKey(i int, nodeAddr int64) key {
+	bpt := rd.bpTree
+
+	for nodeDepth := i + 1; nodeDepth < bpt.height; nodeDepth++ {
+		nodeAddr = bpt.getNonLeafController(nodeAddr).GetChildAddr(0)
+	}
+
+	return bpt.getLeafController(nodeAddr).GetKey(0)
+}
+
+// getLastKey is the last key version of getFirstKey.
+func (rd *rangeDeleter) getLastKey(i int, nodeAddr int64) key {
+	bpt := rd.bpTree
+
+	for nodeDepth := i + 1; nodeDepth < bpt.height; nodeDepth++ {
+		nonLeafController := bpt.getNonLeafController(nodeAddr)
+		nodeAddr = nonLeafController.GetChildAddr(nonLeafController.NumberOfChildren() - 1)
+	}
+
+	leafController := bpt.getLeafController(nodeAddr)
+	return leafController.GetKey(leafController.NumberOfRecords() - 1)
+}
@@ -3,10 +3,13 @@ package bptree
 import (
 	"fmt"
 	"io"
+
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 // Fprint dumps the B+ tree as plain text for debugging purposes.
-func (bpt *BPTree) Fprint(writer io.Writer) error {
+func (bpt *BPTree) Fprint(writer io.Writer) (err error) {
+	defer corruption.Recover(&err)
 	return bpt.doFprint(writer, bpt.rootAddr, 1, "", "\n")
 }
 
@@ -16,8 +19,8 @@ func (bpt *BPTree) doFprint(writer io.Writer, nodeAddr int64, nodeDepth int, pre
 		n := leafController.NumberOfRecords()
 
 		for i := 0; i < n; i++ {
-			key := keyFactory{bpt.fileStorage}.ReadKeyAll(leafController.GetKey(i))
-			value := valueFactory{bpt.fileStorage}.ReadValueAll(leafController.GetValue(i))
+			key := keyFactory{bpt.fileStorage, bpt.maxKeySize}.ReadKeyAll(leafController.GetKey(i))
+			value := valueFactory{bpt.fileStorage, bpt.maxValueSize}.ReadValueAll(leafController.GetValue(i))
 			var err error
 
 			switch i {
@@ -47,7 +50,7 @@ func (bpt *BPTree) doFprint(writer io.Writer, nodeAddr int64, nodeDepth int, pre
 		n := nonLeafController.NumberOfChildren()
 
 		for i := 1; i < n; i++ {
-			key := keyFactory{bpt.fileStorage}.ReadKeyAll(nonLeafController.GetKey(i))
+			key := keyFactory{bpt.fileStorage, bpt.maxKeySize}.ReadKeyAll(nonLeafController.GetKey(i))
 
 			if _, err := fmt.Fprintf(writer, "%s├─● %q", newLine, key); err != nil {
 				return err
@@ -0,0 +1,92 @@
+package bptree
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Ingest adds the records in the given source, in strictly ascending
+// order of keys, to the B+ tree, or replaces the values of the records
+// with identical keys in the B+ tree, and then returns the number of
+// the records added.
+// Rather than looking up each record from the root, it merges the
+// records into the leaves in order: the records going to the same leaf
+// are put one after another at the positions found within the leaf,
+// and then the next leaf is reached along the record path. Only when
+// the keys skip over leaves it looks up a record from the root again.
+// If the keys of the records aren't in strictly ascending order it
+// returns ErrKeyOutOfOrder. On such an error or an error from the
+// source, the records before are kept ingested.
+func (bpt *BPTree) Ingest(recordSource RecordSource) (_ int, err error) {
+	defer corruption.Recover(&err)
+	recordCount := bpt.recordCount
+	var recordPath recordPath
+	var lastKey []byte
+
+	for {
+		key, value, ok, err2 := recordSource.ReadRecord()
+
+		if err2 != nil {
+			return bpt.recordCount - recordCount, err2
+		}
+
+		if !ok {
+			return bpt.recordCount - recordCount, nil
+		}
+
+		if recordPath != nil && bpt.options.KeyComparer.CompareKeys(lastKey, key) >= 0 {
+			return bpt.recordCount - recordCount, ErrKeyOutOfOrder
+		}
+
+		lastKey = append(lastKey[:0], key...)
+
+		if recordPath, ok = bpt.seekRecord(recordPath, key); ok {
+			bpt.replaceValue(&recordPath, value, false)
+		} else {
+			bpt.insertRecord(&recordPath, bpt.createRecord(key, value))
+		}
+	}
+}
+
+// seekRecord moves the given record path, which refers to a record
+// with a key less than the given key, forward to the position of the
+// given key, in the same leaf or the next one, otherwise it finds the
+// record from the root, as it does if the record path is nil.
+// It returns the record path and whether a record with an identical
+// key exists in the B+ tree.
+func (bpt *BPTree) seekRecord(recordPath recordPath, key []byte) (recordPath, bool) {
+	if recordPath == nil {
+		return bpt.findRecord(key)
+	}
+
+	n := len(recordPath)
+
+	if !bpt.isBeforeNextLeaf(recordPath, key) {
+		leafController := bpt.getLeafController(recordPath[n-1].NodeAddr)
+		recordPath[n-1].RecordOrNonLeafChildIndex = leafController.NumberOfRecords() - 1
+
+		if !bpt.moveToNextRecord(recordPath) || !bpt.isBeforeNextLeaf(recordPath, key) {
+			return bpt.findRecord(key)
+		}
+	}
+
+	leafController := bpt.getLeafController(recordPath[n-1].NodeAddr)
+	recordIndex, ok := leafController.LocateRecord(key, keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize})
+	recordPath[n-1].RecordOrNonLeafChildIndex = recordIndex
+	return recordPath, ok
+}
+
+// isBeforeNextLeaf indicates if the given key is less than the key
+// separating the leaf which the given record path leads to from the
+// next leaf. If the leaf is the last one, it returns true.
+func (bpt *BPTree) isBeforeNextLeaf(recordPath recordPath, key []byte) bool {
+	for i := len(recordPath) - 2; i >= 0; i-- {
+		nonLeafController := bpt.getNonLeafController(recordPath[i].NodeAddr)
+
+		// the key of the next child at the lowest level separates the leaf from the next leaf
+		if nonLeafChildIndex := recordPath[i].RecordOrNonLeafChildIndex; nonLeafChildIndex+1 < nonLeafController.NumberOfChildren() {
+			return keyComparer{bpt.fileStorage, bpt.options.KeyComparer, bpt.maxKeySize}.CompareKey(nonLeafController.GetKey(nonLeafChildIndex+1), key) > 0
+		}
+	}
+
+	return true
+}
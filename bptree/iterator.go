@@ -1,12 +1,19 @@
 package bptree
 
 import (
+	"bytes"
 	"errors"
 
-	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 // Iterator represents an iteration over records in a B+ Tree.
+// An iteration over the B+ tree itself, rather than a snapshot, remains
+// valid across modifications to the B+ tree: it goes on from the key
+// of the current record, or from the next record if the current record
+// has been deleted.
+// If corrupted data is found, the iteration has no more records and
+// the reads return a CorruptedError.
 type Iterator interface {
 	// IsAtEnd indicates if the iteration has no more records.
 	IsAtEnd() (hasNoMoreRecords bool)
@@ -48,172 +55,600 @@ type Iterator interface {
 	// value of the current record in the iteration.
 	// If the iteration has no more records it returns an error.
 	ReadRecordAll() (key, value []byte, err error)
+
+	// Delete deletes the current record in the iteration, without looking
+	// up the record from the root again. Then the iteration is between the
+	// deleted record and the next record, both advancing and reading get
+	// to the next record.
+	// If the iteration has no more records it returns an error, or if the
+	// iteration is over a snapshot it returns ErrIteratorReadOnly.
+	Delete() (err error)
+
+	// SetValue replaces the value of the current record in the iteration
+	// to the given value, without looking up the record from the root again.
+	// If the iteration has no more records it returns an error, or if the
+	// iteration is over a snapshot it returns ErrIteratorReadOnly.
+	SetValue(value []byte) (err error)
 }
 
-type forwardIterator struct{ iterator }
+type forwardIterator struct{ liveIterator }
 
 var _ = Iterator((*forwardIterator)(nil))
 
-func (fi *forwardIterator) Init(
-	fileStorage *fsm.FileStorage,
-	firstLeafAddr int64,
-	firstRecordIndex int,
+func (fi *forwardIterator) Init(bpTree *BPTree, minBound Bound, maxBound Bound) *forwardIterator {
+	fi.init(bpTree, minBound, maxBound, false)
+	return fi
+}
+
+func (fi *forwardIterator) InitWithKeyPrefix(bpTree *BPTree, keyPrefix []byte) *forwardIterator {
+	fi.keyPrefix, fi.hasKeyPrefix = copyBytes(keyPrefix), true
+	fi.init(bpTree, Unbounded, Unbounded, false)
+	return fi
+}
+
+func (fi *forwardIterator) Advance() Iterator {
+	fi.advance()
+	return fi
+}
+
+type backwardIterator struct{ liveIterator }
+
+var _ = Iterator((*backwardIterator)(nil))
+
+func (bi *backwardIterator) Init(bpTree *BPTree, minBound Bound, maxBound Bound) *backwardIterator {
+	bi.init(bpTree, minBound, maxBound, true)
+	return bi
+}
+
+func (bi *backwardIterator) InitWithKeyPrefix(bpTree *BPTree, keyPrefix []byte) *backwardIterator {
+	bi.keyPrefix, bi.hasKeyPrefix = copyBytes(keyPrefix), true
+	bi.init(bpTree, Unbounded, Unbounded, true)
+	return bi
+}
+
+func (bi *backwardIterator) Advance() Iterator {
+	bi.advance()
+	return bi
+}
+
+type snapshotForwardIterator struct{ snapshotIterator }
+
+var _ = Iterator((*snapshotForwardIterator)(nil))
+
+func (sfi *snapshotForwardIterator) Init(
+	bpTree *BPTree,
+	firstRecordPath recordPath,
 	lastLeafAddr int64,
 	lastRecordIndex int,
 	isAtEnd bool,
-) *forwardIterator {
-	fi.init(fileStorage, firstLeafAddr, firstRecordIndex, lastLeafAddr, lastRecordIndex, isAtEnd)
-	return fi
+) *snapshotForwardIterator {
+	sfi.init(bpTree, firstRecordPath, lastLeafAddr, lastRecordIndex, isAtEnd)
+	return sfi
 }
 
-func (fi *forwardIterator) Advance() Iterator {
-	fi.preAdvance()
+func (sfi *snapshotForwardIterator) Advance() Iterator {
+	if sfi.err != nil {
+		return sfi
+	}
 
-	if !fi.isAtEnd {
-		leafController := fi.makeCurrentLeafController()
+	defer corruption.Recover(&sfi.err)
+	sfi.preAdvance()
 
-		if fi.currentRecordIndex < leafController.NumberOfRecords()-1 {
-			fi.currentRecordIndex++
+	if !sfi.isAtEnd {
+		if leafController := sfi.makeCurrentLeafController(); sfi.currentRecordIndex < leafController.NumberOfRecords()-1 {
+			sfi.currentRecordIndex++
+			sfi.recordPath[len(sfi.recordPath)-1].RecordOrNonLeafChildIndex = sfi.currentRecordIndex
 		} else {
-			fi.currentLeafAddr = leafHeader(leafController).NextAddr()
-			fi.currentRecordIndex = 0
+			sfi.bpTree.moveToNextRecord(sfi.recordPath)
+			sfi.currentLeafAddr, sfi.currentRecordIndex = sfi.recordPath.LastComponent()
 		}
 	}
 
-	return fi
+	return sfi
 }
 
-type backwardIterator struct{ iterator }
+type snapshotBackwardIterator struct{ snapshotIterator }
 
-var _ = Iterator((*backwardIterator)(nil))
+var _ = Iterator((*snapshotBackwardIterator)(nil))
 
-func (bi *backwardIterator) Init(
-	fileStorage *fsm.FileStorage,
-	firstLeafAddr int64,
-	firstRecordIndex int,
+func (sbi *snapshotBackwardIterator) Init(
+	bpTree *BPTree,
+	firstRecordPath recordPath,
 	lastLeafAddr int64,
 	lastRecordIndex int,
 	isAtEnd bool,
-) *backwardIterator {
-	bi.init(fileStorage, firstLeafAddr, firstRecordIndex, lastLeafAddr, lastRecordIndex, isAtEnd)
-	return bi
+) *snapshotBackwardIterator {
+	sbi.init(bpTree, firstRecordPath, lastLeafAddr, lastRecordIndex, isAtEnd)
+	return sbi
 }
 
-func (bi *backwardIterator) Advance() Iterator {
-	bi.preAdvance()
+func (sbi *snapshotBackwardIterator) Advance() Iterator {
+	if sbi.err != nil {
+		return sbi
+	}
+
+	defer corruption.Recover(&sbi.err)
+	sbi.preAdvance()
+
+	if !sbi.isAtEnd {
+		sbi.bpTree.moveToPrevRecord(sbi.recordPath)
+		sbi.currentLeafAddr, sbi.currentRecordIndex = sbi.recordPath.LastComponent()
+	}
+
+	return sbi
+}
+
+// snapshotIterator walks through the tree by a record path rather
+// than along the leaf list, as the links between the leaves visible
+// to a snapshot may have been changed since the snapshot was taken.
+type snapshotIterator struct {
+	iterator
+	bpTree     *BPTree
+	recordPath recordPath
+}
+
+func (si *snapshotIterator) init(
+	bpTree *BPTree,
+	firstRecordPath recordPath,
+	lastLeafAddr int64,
+	lastRecordIndex int,
+	isAtEnd bool,
+) {
+	var firstLeafAddr int64
+	var firstRecordIndex int
+
+	if !isAtEnd {
+		firstLeafAddr, firstRecordIndex = firstRecordPath.LastComponent()
+	}
+
+	si.iterator.init(bpTree, firstLeafAddr, firstRecordIndex, lastLeafAddr, lastRecordIndex, isAtEnd)
+	si.bpTree = bpTree
+	si.recordPath = firstRecordPath
+}
+
+func (si *snapshotIterator) Delete() error {
+	return ErrIteratorReadOnly
+}
+
+func (si *snapshotIterator) SetValue([]byte) error {
+	return ErrIteratorReadOnly
+}
+
+// liveIterator walks through the tree itself rather than a snapshot
+// by a record path, which is kept right while the tree is modified
+// through the iteration, so the current record can be deleted or
+// updated in place. Once the tree has been modified otherwise, the
+// leaves may have been split, merged, moved or freed, so the iteration
+// seeks the current key again in the range, which is why the key is
+// kept.
+// With a key prefix, the iteration skips the records with keys not
+// starting with the prefix.
+type liveIterator struct {
+	iterator
+	bpTree            *BPTree
+	minBound          Bound
+	maxBound          Bound
+	keyPrefix         []byte
+	hasKeyPrefix      bool
+	isBackward        bool
+	modificationCount int64
+	recordPath        recordPath
+	currentKey        []byte
+	isDeleted         bool
+}
+
+func (li *liveIterator) init(bpTree *BPTree, minBound Bound, maxBound Bound, isBackward bool) {
+	li.iterator.init(bpTree, 0, 0, 0, 0, true)
+	li.bpTree = bpTree
+	li.isBackward = isBackward
+	li.modificationCount = bpTree.modificationCount
+	defer corruption.Recover(&li.err)
+
+	if bpTree.recordCount == 0 {
+		return
+	}
+
+	li.minBound = bpTree.resolveBound(minBound, false)
+	li.maxBound = bpTree.resolveBound(maxBound, true)
+
+	if isBackward {
+		li.seek(li.maxBound)
+	} else {
+		li.seek(li.minBound)
+	}
+}
+
+func (li *liveIterator) IsAtEnd() bool {
+	li.sync()
+	return li.iterator.IsAtEnd()
+}
+
+func (li *liveIterator) GetKeySize() (int, error) {
+	li.sync()
+	return li.iterator.GetKeySize()
+}
+
+func (li *liveIterator) ReadKey(dataOffset int, buffer []byte) (int, error) {
+	li.sync()
+	return li.iterator.ReadKey(dataOffset, buffer)
+}
+
+func (li *liveIterator) ReadKeyAll() ([]byte, error) {
+	li.sync()
+	return li.iterator.ReadKeyAll()
+}
+
+func (li *liveIterator) GetValueSize() (int, error) {
+	li.sync()
+	return li.iterator.GetValueSize()
+}
+
+func (li *liveIterator) ReadValue(dataOffset int, buffer []byte) (int, error) {
+	li.sync()
+	return li.iterator.ReadValue(dataOffset, buffer)
+}
+
+func (li *liveIterator) ReadValueAll() ([]byte, error) {
+	li.sync()
+	return li.iterator.ReadValueAll()
+}
+
+func (li *liveIterator) ReadRecordAll() ([]byte, []byte, error) {
+	li.sync()
+	return li.iterator.ReadRecordAll()
+}
+
+func (li *liveIterator) Delete() error {
+	li.sync()
+
+	if li.err != nil {
+		return li.err
+	}
+
+	if li.isAtEnd {
+		return errEndOfIteration
+	}
+
+	li.delete()
+	return li.err
+}
+
+func (li *liveIterator) SetValue(value []byte) error {
+	li.sync()
+
+	if li.err != nil {
+		return li.err
+	}
+
+	if li.isAtEnd {
+		return errEndOfIteration
+	}
+
+	li.setValue(value)
+	return li.err
+}
+
+func (li *liveIterator) advance() {
+	if li.err != nil || li.isAtEnd || li.resync(true) {
+		return
+	}
+
+	defer corruption.Recover(&li.err)
+	li.moveOn()
+}
+
+// sync gets the iteration to a record which is present before reading.
+func (li *liveIterator) sync() {
+	if li.err != nil || li.isAtEnd || li.resync(false) || !li.isDeleted {
+		return
+	}
+
+	defer corruption.Recover(&li.err)
+	li.moveOn()
+}
+
+// resync seeks the current key again if the tree has been modified
+// otherwise since the iteration got to the key, and then returns true.
+// If the record with the key has been deleted, the iteration gets to
+// the next record in the range. If isAdvancing is true, the iteration
+// gets to the next record anyway.
+func (li *liveIterator) resync(isAdvancing bool) bool {
+	if li.modificationCount == li.bpTree.modificationCount {
+		return false
+	}
 
-	if !bi.isAtEnd {
-		if bi.currentRecordIndex >= 1 {
-			bi.currentRecordIndex--
+	defer corruption.Recover(&li.err)
+	var bound Bound
+
+	if isAdvancing || li.isDeleted {
+		bound = Exclusive(li.currentKey)
+	} else {
+		bound = Inclusive(li.currentKey)
+	}
+
+	li.seek(bound)
+	return true
+}
+
+// seek gets the iteration to the first record from the given bound
+// on in the range, or the last record up to the bound if the iteration
+// is backward.
+func (li *liveIterator) seek(bound Bound) {
+	bpt := li.bpTree
+	li.modificationCount = bpt.modificationCount
+	li.isDeleted = false
+
+	if bpt.recordCount == 0 {
+		li.end()
+		return
+	}
+
+	var ok bool
+
+	if li.isBackward {
+		li.recordPath, ok = bpt.findMaxRecord(bound)
+	} else {
+		li.recordPath, ok = bpt.findMinRecord(bound)
+	}
+
+	if !ok {
+		li.end()
+		return
+	}
+
+	li.arrive()
+	li.skipUnmatchedKeys()
+}
+
+// moveOn gets the iteration to the next record in the range.
+func (li *liveIterator) moveOn() {
+	li.step()
+	li.skipUnmatchedKeys()
+}
+
+// skipUnmatchedKeys gets the iteration past the records with keys not
+// starting with the key prefix, if any.
+func (li *liveIterator) skipUnmatchedKeys() {
+	for li.hasKeyPrefix && !li.isAtEnd && !bytes.HasPrefix(li.currentKey, li.keyPrefix) {
+		li.step()
+	}
+}
+
+// step gets the iteration to the next record in the range, whether
+// the key of the record matches or not.
+func (li *liveIterator) step() {
+	n := len(li.recordPath)
+	var ok bool
+
+	if li.isBackward {
+		// the record path of a deleted record refers to the next record
+		// in ascending order
+		ok = li.bpTree.moveToPrevRecord(li.recordPath)
+	} else {
+		leafController := li.makeCurrentLeafController()
+
+		if li.isDeleted && li.currentRecordIndex < leafController.NumberOfRecords() {
+			ok = true
+		} else if !li.isDeleted && li.currentRecordIndex < leafController.NumberOfRecords()-1 {
+			li.recordPath[n-1].RecordOrNonLeafChildIndex++
+			ok = true
 		} else {
-			leafController := bi.makeCurrentLeafController()
-			bi.currentLeafAddr = leafHeader(leafController).PrevAddr()
-			leafController = bi.makeCurrentLeafController()
-			bi.currentRecordIndex = leafController.NumberOfRecords() - 1
+			ok = li.bpTree.moveToNextRecord(li.recordPath)
 		}
 	}
 
-	return bi
+	li.isDeleted = false
+
+	if !ok {
+		li.end()
+		return
+	}
+
+	li.arrive()
+}
+
+// arrive makes the record which the record path refers to current, or
+// ends the iteration if the record is out of the range.
+func (li *liveIterator) arrive() {
+	li.currentLeafAddr, li.currentRecordIndex = li.recordPath.LastComponent()
+	li.isAtEnd = false
+	li.currentKey = li.readCurrentKey(li.currentKey)
+
+	if !li.isInRange() {
+		li.end()
+	}
+}
+
+func (li *liveIterator) end() {
+	li.iterator.init(li.bpTree, 0, 0, 0, 0, true)
+	li.recordPath = nil
+}
+
+// isInRange indicates if the current key is within the bound which
+// the iteration goes towards.
+func (li *liveIterator) isInRange() bool {
+	var bound Bound
+	var sign int
+
+	if li.isBackward {
+		bound, sign = li.minBound, -1
+	} else {
+		bound, sign = li.maxBound, 1
+	}
+
+	switch bound.kind {
+	case inclusiveBound:
+		return sign*li.bpTree.options.KeyComparer.CompareKeys(li.currentKey, bound.key) <= 0
+	case exclusiveBound:
+		return sign*li.bpTree.options.KeyComparer.CompareKeys(li.currentKey, bound.key) < 0
+	default:
+		return true
+	}
+}
+
+func (li *liveIterator) delete() {
+	defer corruption.Recover(&li.err)
+	bpt := li.bpTree
+	bpt.destroyRecord(bpt.removeRecord(&li.recordPath), false)
+	li.modificationCount = bpt.modificationCount
+	li.currentLeafAddr, li.currentRecordIndex = li.recordPath.LastComponent()
+	li.isDeleted = true
+}
+
+func (li *liveIterator) setValue(value []byte) {
+	defer corruption.Recover(&li.err)
+	bpt := li.bpTree
+	bpt.replaceValue(&li.recordPath, value, false)
+	li.modificationCount = bpt.modificationCount
+	li.currentLeafAddr, li.currentRecordIndex = li.recordPath.LastComponent()
 }
 
 type iterator struct {
-	fileStorage        *fsm.FileStorage
+	leafFactory        leafFactory
+	keyFactory         keyFactory
+	valueFactory       valueFactory
 	currentLeafAddr    int64
 	currentRecordIndex int
 	lastLeafAddr       int64
 	lastRecordIndex    int
 	isAtEnd            bool
+	err                error
+
+	// the leaf checked last and the modification count of the tree
+	// at that time
+	checkedLeafAddr          int64
+	checkedModificationCount int64
+	modificationCount        *int64
 }
 
-func (i *iterator) GetKeySize() (int, error) {
+func (i *iterator) GetKeySize() (_ int, err error) {
+	if i.err != nil {
+		return 0, i.err
+	}
+
 	if i.isAtEnd {
 		return 0, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	key := leafController.GetKey(i.currentRecordIndex)
-	return keyFactory{i.fileStorage}.GetRawKeySize(key), nil
+	return i.keyFactory.GetRawKeySize(key), nil
 }
 
-func (i *iterator) ReadKey(dataOffset int, buffer []byte) (int, error) {
+func (i *iterator) ReadKey(dataOffset int, buffer []byte) (_ int, err error) {
+	if i.err != nil {
+		return 0, i.err
+	}
+
 	if i.isAtEnd {
 		return 0, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	key := leafController.GetKey(i.currentRecordIndex)
-	return keyFactory{i.fileStorage}.ReadKey(key, dataOffset, buffer), nil
+	return i.keyFactory.ReadKey(key, dataOffset, buffer), nil
 }
 
-func (i *iterator) ReadKeyAll() ([]byte, error) {
+func (i *iterator) ReadKeyAll() (_ []byte, err error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+
 	if i.isAtEnd {
 		return nil, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	key := leafController.GetKey(i.currentRecordIndex)
-	return keyFactory{i.fileStorage}.ReadKeyAll(key), nil
+	return i.keyFactory.ReadKeyAll(key), nil
 }
 
-func (i *iterator) GetValueSize() (int, error) {
+func (i *iterator) GetValueSize() (_ int, err error) {
+	if i.err != nil {
+		return 0, i.err
+	}
+
 	if i.isAtEnd {
 		return 0, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	value := leafController.GetValue(i.currentRecordIndex)
-	return valueFactory{i.fileStorage}.GetRawValueSize(value), nil
+	return i.valueFactory.GetRawValueSize(value), nil
 }
 
-func (i *iterator) ReadValue(dataOffset int, buffer []byte) (int, error) {
+func (i *iterator) ReadValue(dataOffset int, buffer []byte) (_ int, err error) {
+	if i.err != nil {
+		return 0, i.err
+	}
+
 	if i.isAtEnd {
 		return 0, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	value := leafController.GetValue(i.currentRecordIndex)
-	return valueFactory{i.fileStorage}.ReadValue(value, dataOffset, buffer), nil
+	return i.valueFactory.ReadValue(value, dataOffset, buffer), nil
 }
 
-func (i *iterator) ReadValueAll() ([]byte, error) {
+func (i *iterator) ReadValueAll() (_ []byte, err error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+
 	if i.isAtEnd {
 		return nil, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	value := leafController.GetValue(i.currentRecordIndex)
-	return valueFactory{i.fileStorage}.ReadValueAll(value), nil
+	return i.valueFactory.ReadValueAll(value), nil
 }
 
-func (i *iterator) ReadRecordAll() ([]byte, []byte, error) {
+func (i *iterator) ReadRecordAll() (_ []byte, _ []byte, err error) {
+	if i.err != nil {
+		return nil, nil, i.err
+	}
+
 	if i.isAtEnd {
 		return nil, nil, errEndOfIteration
 	}
 
+	defer corruption.Recover(&err)
 	leafController := i.makeCurrentLeafController()
 	key := leafController.GetKey(i.currentRecordIndex)
 	value := leafController.GetValue(i.currentRecordIndex)
-	return keyFactory{i.fileStorage}.ReadKeyAll(key), valueFactory{i.fileStorage}.ReadValueAll(value), nil
+	return i.keyFactory.ReadKeyAll(key), i.valueFactory.ReadValueAll(value), nil
 }
 
 func (i *iterator) IsAtEnd() bool {
-	return i.isAtEnd
+	return i.isAtEnd || i.err != nil
 }
 
 func (i *iterator) init(
-	fileStorage *fsm.FileStorage,
+	bpTree *BPTree,
 	firstLeafAddr int64,
 	firstRecordIndex int,
 	lastLeafAddr int64,
 	lastRecordIndex int,
 	isAtEnd bool,
 ) {
-	i.fileStorage = fileStorage
+	i.leafFactory = leafFactory{bpTree.fileStorage, bpTree.pageSize}
+	i.keyFactory = keyFactory{bpTree.fileStorage, bpTree.maxKeySize}
+	i.valueFactory = valueFactory{bpTree.fileStorage, bpTree.maxValueSize}
 	i.currentLeafAddr = firstLeafAddr
 	i.currentRecordIndex = firstRecordIndex
 	i.lastLeafAddr = lastLeafAddr
 	i.lastRecordIndex = lastRecordIndex
 	i.isAtEnd = isAtEnd
+	i.checkedLeafAddr = -1
+	i.modificationCount = &bpTree.modificationCount
 }
 
 func (i *iterator) preAdvance() {
@@ -222,8 +657,35 @@ func (i *iterator) preAdvance() {
 	}
 }
 
+// readCurrentKey reads all data of the key of the current record into
+// the given buffer, which is grown if needed, and then returns the data.
+func (i *iterator) readCurrentKey(buffer []byte) []byte {
+	leafController := i.makeCurrentLeafController()
+	key := leafController.GetKey(i.currentRecordIndex)
+	keySize := i.keyFactory.GetRawKeySize(key)
+
+	if cap(buffer) < keySize {
+		buffer = make([]byte, keySize)
+	} else {
+		buffer = buffer[:keySize]
+	}
+
+	i.keyFactory.ReadKey(key, 0, buffer)
+	return buffer
+}
+
 func (i *iterator) makeCurrentLeafController() leafController {
-	return leafFactory{i.fileStorage}.GetLeafController(i.currentLeafAddr)
+	// the current leaf is checked once rather than on every read, and
+	// again once the tree has been modified, as the leaf may have been
+	// changed or even freed since
+	if i.currentLeafAddr == i.checkedLeafAddr && *i.modificationCount == i.checkedModificationCount {
+		return i.leafFactory.GetCheckedLeafController(i.currentLeafAddr)
+	}
+
+	leafController := i.leafFactory.GetLeafController(i.currentLeafAddr)
+	i.checkedLeafAddr = i.currentLeafAddr
+	i.checkedModificationCount = *i.modificationCount
+	return leafController
 }
 
 var errEndOfIteration = errors.New("bptree: end of iteration")
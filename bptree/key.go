@@ -3,33 +3,170 @@ package bptree
 import (
 	"bytes"
 	"encoding/binary"
-	"reflect"
-	"unsafe"
 
 	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 var (
-	// MinKey presents the minimum key in a B+ tree.
+	// MinKey presents the minimum key in a B+ tree, when passed to
+	// SearchForward or SearchBackward as is. It's told apart from the
+	// key "MIN_KEY" by identity, so it must not be copied.
+	//
+	// Deprecated: Use SearchRange with Unbounded instead.
 	MinKey = []byte("MIN_KEY")
 
-	// MaxKey presents the maximum key in a B+ tree.
+	// MaxKey presents the maximum key in a B+ tree, when passed to
+	// SearchForward or SearchBackward as is. It's told apart from the
+	// key "MAX_KEY" by identity, so it must not be copied.
+	//
+	// Deprecated: Use SearchRange with Unbounded instead.
 	MaxKey = []byte("MAX_KEY")
 )
 
+// Bound represents a bound of a range of keys in a B+ tree,
+// which is either inclusive, exclusive or unbounded.
+type Bound struct {
+	key  []byte
+	kind boundKind
+}
+
+// Unbounded presents the bound not limiting the range of keys.
+var Unbounded = Bound{}
+
+// Inclusive returns the bound at the given key, which includes
+// the key in the range.
+func Inclusive(key []byte) Bound {
+	return Bound{key, inclusiveBound}
+}
+
+// Exclusive returns the bound at the given key, which excludes
+// the key from the range.
+func Exclusive(key []byte) Bound {
+	return Bound{key, exclusiveBound}
+}
+
+// Key returns the key at the bound, or nil if the bound is
+// unbounded.
+func (b Bound) Key() []byte {
+	return b.key
+}
+
+// IsInclusive returns true if the bound includes its key in the
+// range.
+func (b Bound) IsInclusive() bool {
+	return b.kind == inclusiveBound
+}
+
+// IsExclusive returns true if the bound excludes its key from the
+// range.
+func (b Bound) IsExclusive() bool {
+	return b.kind == exclusiveBound
+}
+
+// clone returns a copy of the bound, which doesn't refer to the
+// key of the bound.
+func (b Bound) clone() Bound {
+	if b.key != nil {
+		b.key = copyBytes(b.key)
+	}
+
+	return b
+}
+
+type boundKind int8
+
 const (
-	maxKeySize    = 257
-	keyPrefixSize = maxKeySize - 8
+	unbounded boundKind = iota
+	inclusiveBound
+	exclusiveBound
+	minKeyBound
+	maxKeyBound
 )
 
+// makeBound makes the inclusive bound at the given key, or the bound
+// at the minimum or maximum key for MinKey or MaxKey.
+func makeBound(key []byte) Bound {
+	switch {
+	case isSameBytes(key, MinKey):
+		return Bound{nil, minKeyBound}
+	case isSameBytes(key, MaxKey):
+		return Bound{nil, maxKeyBound}
+	default:
+		return Inclusive(key)
+	}
+}
+
+// KeyComparer defines the order of the keys in a B+ tree.
+// The name of the key comparer is stored along with the B+ tree,
+// a B+ tree can only be loaded with a key comparer of the same name.
+type KeyComparer interface {
+	// Name returns the name of the key comparer, which should be
+	// changed whenever the order changes and be at most 255 bytes,
+	// otherwise ErrKeyComparerNameTooLong is returned.
+	Name() string
+
+	// CompareKeys returns an integer comparing two keys. The result
+	// will be 0 if key1 == key2, negative if key1 < key2, and positive
+	// if key1 > key2.
+	CompareKeys(key1 []byte, key2 []byte) int
+}
+
+// PrefixKeyComparer is a KeyComparer which orders the keys starting
+// with any prefix in a row, so that they can be searched for as a range.
+// SearchPrefix searches through all the records with a key comparer
+// which isn't a PrefixKeyComparer.
+type PrefixKeyComparer interface {
+	KeyComparer
+
+	// MakePrefixBounds returns the bounds of the range of the keys
+	// starting with the given prefix, which covers no other keys.
+	MakePrefixBounds(prefix []byte) (minBound Bound, maxBound Bound)
+}
+
+// BytewiseKeyComparer orders the keys lexicographically by bytes,
+// as bytes.Compare does, which is the default key comparer.
+var BytewiseKeyComparer KeyComparer = bytewiseKeyComparer{}
+
+const maxKeyComparerNameSize = 255
+
+type bytewiseKeyComparer struct{}
+
+func (bytewiseKeyComparer) Name() string {
+	return "bytewise"
+}
+
+func (bytewiseKeyComparer) CompareKeys(key1 []byte, key2 []byte) int {
+	return bytes.Compare(key1, key2)
+}
+
+func (bytewiseKeyComparer) MakePrefixBounds(prefix []byte) (Bound, Bound) {
+	return makePrefixBounds(prefix)
+}
+
 type key []byte
 
 type keyComparer struct {
 	FileStorage *fsm.FileStorage
+	KeyComparer KeyComparer
+	MaxKeySize  int
 }
 
 func (kc keyComparer) CompareKey(key key, rawKey []byte) int {
-	if len(key) < maxKeySize || len(rawKey) <= keyPrefixSize {
+	keyFactory := keyFactory{kc.FileStorage, kc.MaxKeySize}
+
+	if kc.KeyComparer != BytewiseKeyComparer {
+		if len(key) < kc.MaxKeySize {
+			return kc.KeyComparer.CompareKeys(key, rawKey)
+		}
+
+		return kc.KeyComparer.CompareKeys(keyFactory.ReadKeyAll(key), rawKey)
+	}
+
+	keyPrefixSize := keyFactory.keyPrefixSize()
+
+	if len(key) < kc.MaxKeySize || len(rawKey) <= keyPrefixSize {
 		return bytes.Compare(key, rawKey)
 	}
 
@@ -37,29 +174,58 @@ func (kc keyComparer) CompareKey(key key, rawKey []byte) int {
 		return d
 	}
 
-	keyOverflowAddr := int64(binary.BigEndian.Uint64(key[keyPrefixSize:]))
-	data := kc.FileStorage.AccessSpace(keyOverflowAddr)
-	n, i := binary.Uvarint(data)
+	_, keyOverflow := keyFactory.getKeyOverflow(key)
+	return bytes.Compare(keyOverflow, rawKey[keyPrefixSize:])
+}
 
-	if i <= 0 {
-		panic(errCorrupted)
+// MakeSeparator returns the shortest key greater than the given key1
+// and not greater than the given key2, which separates a node ending
+// with key1 from the next node starting with key2 in the non-leaves.
+// The separator is a prefix of key2 which is never overflowed. If the
+// keys aren't in bytewise order, or don't differ within the prefixes
+// stored along with the key overflows, it returns key2 as is, which
+// must be kept the first key of the next node to keep the key overflow
+// alive.
+func (kc keyComparer) MakeSeparator(key1 key, key2 key) key {
+	if kc.KeyComparer != BytewiseKeyComparer {
+		return key2
 	}
 
-	keyOverflowSize := int(n)
-	keyOverflow := data[i : i+keyOverflowSize]
-	return bytes.Compare(keyOverflow, rawKey[keyPrefixSize:])
+	keyPrefixSize := keyFactory{kc.FileStorage, kc.MaxKeySize}.keyPrefixSize()
+	rawKeyPrefix1, rawKeyPrefix2 := []byte(key1), []byte(key2)
+
+	if len(key1) >= kc.MaxKeySize {
+		rawKeyPrefix1 = key1[:keyPrefixSize]
+	}
+
+	if len(key2) >= kc.MaxKeySize {
+		rawKeyPrefix2 = key2[:keyPrefixSize]
+	}
+
+	n := getSharedPrefixSize(rawKeyPrefix1, rawKeyPrefix2)
+
+	if n == len(rawKeyPrefix2) || (n == len(rawKeyPrefix1) && len(key1) >= kc.MaxKeySize) {
+		return key2
+	}
+
+	return key2[:n+1]
 }
 
+// keyFactory creates and reads keys. A key shorter than MaxKeySize is
+// stored as is, otherwise it's stored as its prefix followed by the
+// address of the rest, aka the key overflow, in MaxKeySize bytes.
 type keyFactory struct {
 	FileStorage *fsm.FileStorage
+	MaxKeySize  int
 }
 
 func (kf keyFactory) CreateKey(rawKey []byte) key {
-	if len(rawKey) < maxKeySize {
+	if len(rawKey) < kf.MaxKeySize {
 		return rawKey
 	}
 
-	key := key(make([]byte, maxKeySize))
+	keyPrefixSize := kf.keyPrefixSize()
+	key := key(make([]byte, kf.MaxKeySize))
 	copy(key, rawKey[:keyPrefixSize])
 	keyOverflowAddr := kf.allocateKeyOverflow(rawKey[keyPrefixSize:])
 	binary.BigEndian.PutUint64(key[keyPrefixSize:], uint64(keyOverflowAddr))
@@ -67,18 +233,18 @@ func (kf keyFactory) CreateKey(rawKey []byte) key {
 }
 
 func (kf keyFactory) DestroyKey(key []byte) int {
-	if n := len(key); n < maxKeySize {
+	if n := len(key); n < kf.MaxKeySize {
 		return n
 	}
 
 	keyOverflowAddr, keyOverflow := kf.getKeyOverflow(key)
 	kf.destroyKeyOverflow(keyOverflowAddr)
-	keySize := keyPrefixSize + len(keyOverflow)
+	keySize := kf.keyPrefixSize() + len(keyOverflow)
 	return keySize
 }
 
 func (kf keyFactory) ReadKey(key key, dataOffset int, buffer []byte) int {
-	if n := len(key); n < maxKeySize {
+	if n := len(key); n < kf.MaxKeySize {
 		if dataOffset >= n {
 			return 0
 		}
@@ -86,6 +252,8 @@ func (kf keyFactory) ReadKey(key key, dataOffset int, buffer []byte) int {
 		return copy(buffer, key[dataOffset:])
 	}
 
+	keyPrefixSize := kf.keyPrefixSize()
+
 	if dataOffset+len(buffer) <= keyPrefixSize {
 		return copy(buffer, key[dataOffset:])
 	}
@@ -109,10 +277,11 @@ func (kf keyFactory) ReadKey(key key, dataOffset int, buffer []byte) int {
 }
 
 func (kf keyFactory) ReadKeyAll(key key) []byte {
-	if len(key) < maxKeySize {
+	if len(key) < kf.MaxKeySize {
 		return copyBytes(key)
 	}
 
+	keyPrefixSize := kf.keyPrefixSize()
 	_, keyOverflow := kf.getKeyOverflow(key)
 	rawKey := make([]byte, keyPrefixSize+len(keyOverflow))
 	copy(rawKey, key[:keyPrefixSize])
@@ -121,47 +290,152 @@ func (kf keyFactory) ReadKeyAll(key key) []byte {
 }
 
 func (kf keyFactory) GetRawKeySize(key []byte) int {
-	if n := len(key); n < maxKeySize {
+	if n := len(key); n < kf.MaxKeySize {
 		return n
 	}
 
 	_, keyOverflow := kf.getKeyOverflow(key)
-	keySize := keyPrefixSize + len(keyOverflow)
+	keySize := kf.keyPrefixSize() + len(keyOverflow)
 	return keySize
 }
 
+func (kf keyFactory) GetKeyOverflowAddr(key key) (int64, bool) {
+	if len(key) < kf.MaxKeySize {
+		return 0, false
+	}
+
+	return int64(binary.BigEndian.Uint64(key[kf.keyPrefixSize():])), true
+}
+
+// keyPrefixSize returns the size of the prefix of a key stored along
+// with the address of the key overflow.
+func (kf keyFactory) keyPrefixSize() int {
+	return kf.MaxKeySize - 8
+}
+
 func (kf keyFactory) allocateKeyOverflow(keyOverflow []byte) int64 {
 	keyOverflowRawSize := make([]byte, binary.MaxVarintLen64)
 	keyOverflowRawSize = keyOverflowRawSize[:binary.PutUvarint(keyOverflowRawSize, uint64(len(keyOverflow)))]
-	keyOverflowAddr, buffer := kf.FileStorage.AllocateSpace(len(keyOverflowRawSize) + len(keyOverflow))
-	i := copy(buffer, keyOverflowRawSize)
-	copy(buffer[i:], keyOverflow)
+	keyOverflowAddr, buffer := kf.FileStorage.AllocateSpace(checksum.Size + len(keyOverflowRawSize) + len(keyOverflow))
+	i := checksum.Size
+	i += copy(buffer[i:], keyOverflowRawSize)
+	i += copy(buffer[i:], keyOverflow)
+	checksum.Update(buffer[:i])
 	return keyOverflowAddr
 }
 
 func (kf keyFactory) destroyKeyOverflow(keyOverflowAddr int64) {
-	kf.FileStorage.FreeSpace(keyOverflowAddr)
+	freeSpace(kf.FileStorage, keyOverflowAddr)
 }
 
 func (kf keyFactory) getKeyOverflow(key key) (int64, []byte) {
-	keyOverflowAddr := int64(binary.BigEndian.Uint64(key[keyPrefixSize:]))
-	data := kf.FileStorage.AccessSpace(keyOverflowAddr)
-	n, i := binary.Uvarint(data)
+	keyOverflowAddr := int64(binary.BigEndian.Uint64(key[kf.keyPrefixSize():]))
+	data := accessSpace(kf.FileStorage, keyOverflowAddr)
 
-	if i <= 0 {
-		panic(errCorrupted)
+	if len(data) < checksum.Size {
+		corruption.Panic(keyOverflowAddr)
 	}
 
+	n, i := binary.Uvarint(data[checksum.Size:])
+
+	if i <= 0 || n > uint64(len(data)-checksum.Size-i) {
+		corruption.Panic(keyOverflowAddr)
+	}
+
+	i += checksum.Size
 	keyOverflowSize := int(n)
+
+	if !checksum.Verify(data[:i+keyOverflowSize]) {
+		corruption.Panic(keyOverflowAddr)
+	}
+
 	return keyOverflowAddr, data[i : i+keyOverflowSize]
 }
 
-func isMaxKey(rawKey []byte) bool {
-	return unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&rawKey)).Data) ==
-		unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&MaxKey)).Data)
+// makePrefixBounds makes the bounds of the range of the keys starting
+// with the given prefix.
+func makePrefixBounds(prefix []byte) (Bound, Bound) {
+	if prefixSuccessor := makePrefixSuccessor(prefix); prefixSuccessor != nil {
+		return Inclusive(prefix), Exclusive(prefixSuccessor)
+	}
+
+	return Inclusive(prefix), Unbounded
+}
+
+// makePrefixSuccessor returns the least key greater than all the
+// keys starting with the given prefix, or nil if there is no such
+// key, i.e. the prefix consists of 0xFF only.
+func makePrefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			prefixSuccessor := make([]byte, i+1)
+			copy(prefixSuccessor, prefix)
+			prefixSuccessor[i]++
+			return prefixSuccessor
+		}
+	}
+
+	return nil
+}
+
+func isSameBytes(data1 []byte, data2 []byte) bool {
+	return len(data1) >= 1 && len(data2) >= 1 && &data1[0] == &data2[0]
+}
+
+// keyRestartInterval is the maximum number of the keys in a run in a
+// leaf or non-leaf. Each key in a run except the first one, aka the
+// restart key, is compressed: only the suffix following the prefix it
+// shares with the previous key is stored, so a key is decompressed
+// within keyRestartInterval steps from the restart key.
+const keyRestartInterval = 16
+
+// compressKeys returns the sizes of the prefixes, to be elided, which
+// the given keys share with the keys before them. The keys are put
+// after the given previous key, which ends a run of the given length,
+// and before the given number of the compressed keys remaining in the
+// run. A key sharing nothing is a restart key, as is a key which would
+// make the run longer than keyRestartInterval.
+func compressKeys(prevKey key, runLength int, keys []key, numberOfNextCompressedKeys int) []int {
+	sharedKeySizes := make([]int, len(keys))
+
+	for i, key := range keys {
+		sharedKeySize := 0
+
+		if newRunLength := runLength + 1; runLength >= 1 {
+			if i == len(keys)-1 {
+				newRunLength += numberOfNextCompressedKeys
+			}
+
+			if newRunLength <= keyRestartInterval {
+				sharedKeySize = getSharedPrefixSize(prevKey, key)
+			}
+		}
+
+		if sharedKeySize == 0 {
+			runLength = 1
+		} else {
+			runLength++
+		}
+
+		sharedKeySizes[i] = sharedKeySize
+		prevKey = key
+	}
+
+	return sharedKeySizes
 }
 
-func isMinKey(rawKey []byte) bool {
-	return unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&rawKey)).Data) ==
-		unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&MinKey)).Data)
+func getSharedPrefixSize(data1 []byte, data2 []byte) int {
+	n := len(data1)
+
+	if n > len(data2) {
+		n = len(data2)
+	}
+
+	for i := 0; i < n; i++ {
+		if data1[i] != data2[i] {
+			return i
+		}
+	}
+
+	return n
 }
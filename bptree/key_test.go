@@ -8,6 +8,8 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+const maxKeySize = DefaultMaxKeySize
+
 func TestKeyComparerAndFactory(t *testing.T) {
 	const fn = "../testdata/bptree_key.tmp"
 
@@ -23,68 +25,141 @@ func TestKeyComparerAndFactory(t *testing.T) {
 		os.Remove(fn)
 	}()
 
-	buf := make([]byte, leafSize)
+	buf := make([]byte, DefaultPageSize)
 	for i := range buf {
 		buf[i] = '0' + byte(i%10)
 	}
 
 	{
-		k := keyFactory{fs}.CreateKey(buf[:maxKeySize-1])
-		d := keyComparer{fs}.CompareKey(k, buf[:maxKeySize-8])
+		k := keyFactory{fs, maxKeySize}.CreateKey(buf[:maxKeySize-1])
+		d := keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:maxKeySize-8])
 		assert.Greater(t, d, 0)
-		d = keyComparer{fs}.CompareKey(k, buf[:maxKeySize-1])
+		d = keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:maxKeySize-1])
 		assert.Equal(t, d, 0)
-		k2 := keyFactory{fs}.ReadKeyAll(k)
+		k2 := keyFactory{fs, maxKeySize}.ReadKeyAll(k)
 		assert.Equal(t, buf[:maxKeySize-1], k2)
-		d = keyComparer{fs}.CompareKey(k, buf[:maxKeySize])
+		d = keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:maxKeySize])
 		assert.Less(t, d, 0)
 
-		ks := keyFactory{fs}.GetRawKeySize(k)
+		ks := keyFactory{fs, maxKeySize}.GetRawKeySize(k)
 		assert.Equal(t, len(k2), ks)
 
 		buf2 := make([]byte, maxKeySize-1)
-		n := keyFactory{fs}.ReadKey(k, 0, buf2)
+		n := keyFactory{fs, maxKeySize}.ReadKey(k, 0, buf2)
 		assert.Equal(t, len(buf2), n)
 
 		assert.Equal(t, 0, fs.Stats().AllocatedSpaceSize)
-		keyFactory{fs}.DestroyKey(k)
+		keyFactory{fs, maxKeySize}.DestroyKey(k)
 	}
 
 	{
-		k := keyFactory{fs}.CreateKey(buf[:2*maxKeySize])
-		d := keyComparer{fs}.CompareKey(k, buf[:maxKeySize-8])
+		k := keyFactory{fs, maxKeySize}.CreateKey(buf[:2*maxKeySize])
+		d := keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:maxKeySize-8])
 		assert.Greater(t, d, 0)
-		d = keyComparer{fs}.CompareKey(k, buf[:2*maxKeySize-1])
+		d = keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:2*maxKeySize-1])
 		assert.Greater(t, d, 0)
-		d = keyComparer{fs}.CompareKey(k, buf[:2*maxKeySize])
+		d = keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:2*maxKeySize])
 		assert.Equal(t, d, 0)
-		k2 := keyFactory{fs}.ReadKeyAll(k)
+		k2 := keyFactory{fs, maxKeySize}.ReadKeyAll(k)
 		assert.Equal(t, buf[:2*maxKeySize], k2)
-		d = keyComparer{fs}.CompareKey(k, buf[:2*maxKeySize+1])
+		d = keyComparer{fs, BytewiseKeyComparer, maxKeySize}.CompareKey(k, buf[:2*maxKeySize+1])
 		assert.Less(t, d, 0)
 
-		ks := keyFactory{fs}.GetRawKeySize(k)
+		ks := keyFactory{fs, maxKeySize}.GetRawKeySize(k)
 		assert.Equal(t, len(k2), ks)
 
 		buf2 := make([]byte, maxKeySize-8)
-		n := keyFactory{fs}.ReadKey(k, 0, buf2)
+		n := keyFactory{fs, maxKeySize}.ReadKey(k, 0, buf2)
 		assert.Equal(t, len(buf2), n)
 		assert.Equal(t, buf[:maxKeySize-8], []byte(buf2))
 		buf2 = make([]byte, maxKeySize)
-		n = keyFactory{fs}.ReadKey(k, maxKeySize/2, buf2)
+		n = keyFactory{fs, maxKeySize}.ReadKey(k, maxKeySize/2, buf2)
 		assert.Equal(t, len(buf2), n)
 		assert.Equal(t, buf[maxKeySize/2:maxKeySize/2+maxKeySize], []byte(buf2))
 
 		assert.Less(t, 0, fs.Stats().AllocatedSpaceSize)
-		keyFactory{fs}.DestroyKey(k)
+		keyFactory{fs, maxKeySize}.DestroyKey(k)
 		assert.Equal(t, 0, fs.Stats().AllocatedSpaceSize)
 	}
 
 	{
-		k := keyFactory{fs}.CreateKey(buf[:2*maxKeySize])
+		k := keyFactory{fs, maxKeySize}.CreateKey(buf[:2*maxKeySize])
 		buf2 := make([]byte, maxKeySize)
-		n := keyFactory{fs}.ReadKey(k, maxKeySize/2, buf2)
+		n := keyFactory{fs, maxKeySize}.ReadKey(k, maxKeySize/2, buf2)
 		assert.Equal(t, len(buf2), n)
 		assert.Equal(t, buf[maxKeySize/2:maxKeySize/2+maxKeySize], []byte(buf2))
 	}
 }
+
+func TestKeyComparerMakeSeparator(t *testing.T) {
+	const fn = "../testdata/bptree_key.tmp"
+
+	fs := new(fsm.FileStorage).Init()
+	err := fs.Open(fn, true)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	defer func() {
+		fs.Close()
+		os.Remove(fn)
+	}()
+
+	kf := keyFactory{fs, maxKeySize}
+	kc := keyComparer{fs, BytewiseKeyComparer, maxKeySize}
+	longKey1 := make([]byte, 2*maxKeySize)
+	longKey2 := make([]byte, 2*maxKeySize)
+	longKey2[maxKeySize] = 1
+
+	for _, tc := range []struct {
+		Key1, Key2 []byte
+		Separator  []byte
+	}{
+		{[]byte("abc"), []byte("abd"), []byte("abd")},
+		{[]byte("abc"), []byte("abdef"), []byte("abd")},
+		{[]byte("ab"), []byte("abcd"), []byte("abc")},
+		{[]byte(""), []byte("abc"), []byte("a")},
+		{[]byte("\x00\x00"), longKey2, longKey2[:3]},
+		{longKey1, append([]byte("\x00\x01"), longKey1...), []byte("\x00\x01")},
+		{longKey1, longKey2, longKey2}, // not differing within the prefixes
+	} {
+		k1, k2 := kf.CreateKey(tc.Key1), kf.CreateKey(tc.Key2)
+		s := kc.MakeSeparator(k1, k2)
+		assert.Equal(t, tc.Separator, kf.ReadKeyAll(s))
+		assert.Greater(t, kc.CompareKey(s, tc.Key1), 0)
+		assert.LessOrEqual(t, kc.CompareKey(s, tc.Key2), 0)
+		kf.DestroyKey(k1)
+		kf.DestroyKey(k2)
+	}
+}
+
+func TestKeyCorrupted(t *testing.T) {
+	const fn = "../testdata/bptree_key.tmp"
+
+	fs := new(fsm.FileStorage).Init()
+	err := fs.Open(fn, true)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	defer func() {
+		fs.Close()
+		os.Remove(fn)
+	}()
+
+	k := keyFactory{fs, maxKeySize}.CreateKey(make([]byte, maxKeySize))
+	keyOverflowAddr, _ := keyFactory{fs, maxKeySize}.GetKeyOverflowAddr(k)
+	keyOverflow := fs.AccessSpace(keyOverflowAddr)
+
+	for i := range keyOverflow {
+		keyOverflow[i] = 0xff
+	}
+
+	defer func() {
+		assert.Equal(t, &CorruptedError{Addr: keyOverflowAddr}, recover())
+	}()
+
+	keyFactory{fs, maxKeySize}.ReadKeyAll(k)
+}
@@ -4,58 +4,64 @@ import (
 	"encoding/binary"
 
 	"github.com/roy2220/fsm"
-)
-
-const (
-	leafSize               = 1 << 13
-	maxLeafFreeSpaceSize   = leafSize - leafHeaderSize
-	maxRecordSize          = recordHeaderSize + maxKeySize + maxValueSize
-	leafOverloadThreshold  = maxLeafFreeSpaceSize - maxRecordSize
-	leafUnderloadThreshold = (leafOverloadThreshold-maxRecordSize)*3/8 + 1
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 type leafFactory struct {
 	FileStorage *fsm.FileStorage
+	LeafSize    int
 }
 
 func (lf leafFactory) CreateLeaf() (int64, leafController) {
-	leafAddr, leafAccessor := lf.FileStorage.AllocateAlignedSpace(leafSize)
+	leafAddr, leafAccessor := lf.FileStorage.AllocateAlignedSpace(lf.LeafSize)
 
 	for i := 0; i < leafHeaderSize; i++ {
 		leafAccessor[i] = 0
 	}
 
+	checksum.Update(leafAccessor)
 	return leafAddr, leafController(leafAccessor)
 }
 
 func (lf leafFactory) DestroyLeaf(leafAddr int64) {
-	lf.FileStorage.FreeAlignedSpace(leafAddr)
+	freeAlignedSpace(lf.FileStorage, leafAddr)
 }
 
 func (lf leafFactory) GetLeafController(leafAddr int64) leafController {
-	return leafController(lf.FileStorage.AccessAlignedSpace(leafAddr))
-}
+	leafController := leafController(accessAlignedSpace(lf.FileStorage, leafAddr))
 
-type leafController []byte
+	if len(leafController) != lf.LeafSize || !checksum.Verify(leafController) {
+		corruption.Panic(leafAddr)
+	}
 
-func (lc leafController) LocateRecord(key []byte, keyComparer keyComparer) (int, bool) {
-	if isMinKey(key) {
-		return 0, true
+	if n := int(leafHeader(leafController).RecordCount()); n < 0 || n > (lf.LeafSize-leafHeaderSize)/recordHeaderSize {
+		corruption.Panic(leafAddr)
 	}
 
-	n := lc.NumberOfRecords()
+	return leafController
+}
 
-	if isMaxKey(key) {
-		return n - 1, true
-	}
+// GetCheckedLeafController is the version of GetLeafController which
+// skips checking the leaf, the leaf must have been checked by
+// GetLeafController and not been modified since.
+func (lf leafFactory) GetCheckedLeafController(leafAddr int64) leafController {
+	return leafController(accessAlignedSpace(lf.FileStorage, leafAddr))
+}
+
+type leafController []byte
 
+func (lc leafController) LocateRecord(key []byte, keyComparer keyComparer) (int, bool) {
+	n := lc.NumberOfRecords()
 	i, j := 0, n-1
+	var buffer []byte
 
 	for i < j {
 		k := (i + j) / 2
 		// i <= k < j
+		buffer = lc.decompressKey(k, buffer)
 
-		if keyComparer.CompareKey(lc.GetKey(k), key) < 0 {
+		if keyComparer.CompareKey(buffer, key) < 0 {
 			i = k + 1
 			// i <= j
 		} else {
@@ -65,7 +71,7 @@ func (lc leafController) LocateRecord(key []byte, keyComparer keyComparer) (int,
 	}
 	// i == j
 
-	d := keyComparer.CompareKey(lc.GetKey(i), key)
+	d := keyComparer.CompareKey(lc.decompressKey(i, buffer), key)
 
 	if d == 0 {
 		return i, true
@@ -79,43 +85,41 @@ func (lc leafController) LocateRecord(key []byte, keyComparer keyComparer) (int,
 }
 
 func (lc leafController) InsertRecords(firstRecordIndex int, records []record) {
-	numberOfRecordsX := lc.checkRecordIndex(firstRecordIndex)
-	recordHeadersOffset := leafHeaderSize + firstRecordIndex*recordHeaderSize
-	recordHeadersEndOffsetX := leafHeaderSize + numberOfRecordsX*recordHeaderSize
-	recordHeadersSize := len(records) * recordHeaderSize
-	var kvsOffsetX int
+	lc.checkRecordIndex(firstRecordIndex)
+	var prevKey key
+	runLength := 0
 
-	if numberOfRecordsX == 0 {
-		kvsOffsetX = leafSize
-	} else {
-		kvsOffsetX = int(recordHeader(lc[leafHeaderSize:]).KeyOffset())
+	if firstRecordIndex >= 1 {
+		prevKey = lc.GetKey(firstRecordIndex - 1)
+		runLength = firstRecordIndex - lc.getRestartRecordIndex(firstRecordIndex-1)
 	}
 
-	var kvsEndOffset int
+	keys := make([]key, len(records))
 
-	if recordHeadersOffset == recordHeadersEndOffsetX {
-		kvsEndOffset = leafSize
-	} else {
-		kvsEndOffset = int(recordHeader(lc[recordHeadersOffset:]).KeyOffset())
+	for i := range records {
+		keys[i] = records[i].Key
 	}
 
-	kvsSize := 0
+	numberOfNextCompressedKeys := lc.countCompressedKeys(firstRecordIndex)
+	sharedKeySizes := compressKeys(prevKey, runLength, keys, numberOfNextCompressedKeys)
+	compressedRecords := make([]compressedRecord, len(records))
 
-	for _, record := range records {
-		kvsSize += len(record.Key) + len(record.Value)
+	for i, record := range records {
+		compressedRecords[i] = compressedRecord{sharedKeySizes[i], record.Key[sharedKeySizes[i]:], record.Value}
 	}
 
-	lc.doInsertRecords(
-		recordHeadersOffset,
-		recordHeadersEndOffsetX,
-		recordHeadersSize,
-		kvsOffsetX,
-		kvsEndOffset,
-		kvsSize,
-		records,
-	)
+	var nextKey key
+
+	if numberOfNextCompressedKeys >= 1 {
+		nextKey = lc.decompressKey(firstRecordIndex, nil)
+	}
+
+	lc.insertCompressedRecords(firstRecordIndex, compressedRecords)
 
-	leafHeader(lc).SetRecordCount(int32(numberOfRecordsX + len(records)))
+	if nextKey != nil {
+		// the key of the next record is compressed against the key of the last record inserted instead
+		lc.setCompressedKey(firstRecordIndex+len(records), nextKey, getSharedPrefixSize(keys[len(keys)-1], nextKey))
+	}
 }
 
 func (lc leafController) RemoveRecords(firstRecordIndex int, numberOfRecords int) []record {
@@ -125,53 +129,52 @@ func (lc leafController) RemoveRecords(firstRecordIndex int, numberOfRecords int
 		panic(errOutOfRange)
 	}
 
-	recordHeadersOffset := leafHeaderSize + firstRecordIndex*recordHeaderSize
-	recordHeadersSize := numberOfRecords * recordHeaderSize
-	recordHeadersEndOffset := recordHeadersOffset + recordHeadersSize
-	recordHeadersEndOffsetX := leafHeaderSize + numberOfRecordsX*recordHeaderSize
-	kvsOffsetX := int(recordHeader(lc[leafHeaderSize:]).KeyOffset())
-	kvsOffset := int(recordHeader(lc[recordHeadersOffset:]).KeyOffset())
-	var kvsEndOffset int
+	if numberOfRecords == 0 {
+		return nil
+	}
 
-	if recordHeadersEndOffset == recordHeadersEndOffsetX {
-		kvsEndOffset = leafSize
-	} else {
-		kvsEndOffset = int(recordHeader(lc[recordHeadersEndOffset:]).KeyOffset())
+	firstKey := lc.decompressKey(firstRecordIndex, nil)
+	nextRecordIndex := firstRecordIndex + numberOfRecords
+	var nextKey key
+	nextSharedKeySize := 0
+
+	if nextRecordIndex < numberOfRecordsX && lc.getSharedKeySize(nextRecordIndex) >= 1 {
+		nextKey = lc.decompressKey(nextRecordIndex, nil)
+
+		// the key of the next record is compressed against the key of the record before the records
+		// removed instead, unless the restart key of the run is removed, which the key replaces then
+		if lc.getRestartRecordIndex(nextRecordIndex) < firstRecordIndex {
+			nextSharedKeySize = getSharedPrefixSize(lc.GetKey(firstRecordIndex-1), nextKey)
+		}
 	}
 
-	kvsSize := kvsEndOffset - kvsOffset
+	compressedRecords := lc.removeCompressedRecords(firstRecordIndex, numberOfRecords)
 
-	records := lc.doRemoveRecords(
-		numberOfRecords,
-		recordHeadersEndOffset,
-		recordHeadersEndOffsetX,
-		recordHeadersSize,
-		kvsOffsetX,
-		kvsOffset,
-		kvsSize,
-	)
+	if nextKey != nil {
+		lc.setCompressedKey(firstRecordIndex, nextKey, nextSharedKeySize)
+	}
 
-	leafHeader(lc).SetRecordCount(int32(numberOfRecordsX - numberOfRecords))
-	return records
+	return decompressRecords(firstKey, compressedRecords)
 }
 
-func (lc leafController) CountRecordsForSpliting() int {
+func (lc leafController) CountRecordsForSpliting(maxRecordSize int) int {
 	loadSize1 := lc.GetLoadSize()
 	loadSize2 := 0
 	recordCount := 0
 
 	for i := lc.NumberOfRecords() - 1; ; i-- {
-		recordSize := recordHeaderSize + len(lc.GetKey(i)) + len(lc.GetValue(i))
+		recordSize := lc.getRecordSize(i)
 		loadSize1 -= recordSize
 		loadSize2 += recordSize
 
-		if loadSize1 < leafUnderloadThreshold {
+		if loadSize1 < lc.UnderloadThreshold(maxRecordSize) {
 			break
 		}
 
 		recordCount++
 
-		if loadSize1 <= loadSize2 {
+		// the key of the first record moved is decompressed
+		if loadSize1 <= loadSize2+lc.getSharedKeySize(i) {
 			break
 		}
 	}
@@ -179,10 +182,12 @@ func (lc leafController) CountRecordsForSpliting() int {
 	return recordCount
 }
 
-func (lc leafController) Split(numberOfRecords int, parent nonLeafController, index int, newSibling leafController, newSiblingAddr int64) {
-	records := lc.RemoveRecords(lc.NumberOfRecords()-numberOfRecords, numberOfRecords)
-	newSibling.InsertRecords(0, records)
-	parent.InsertChildren(index+1, []nonLeafChild{{records[0].Key, newSiblingAddr}})
+func (lc leafController) Split(numberOfRecords int, parent nonLeafController, index int, newSibling leafController, newSiblingAddr int64, keyComparer keyComparer) {
+	compressedRecords := lc.moveOutRecords(lc.NumberOfRecords()-numberOfRecords, numberOfRecords)
+	key := keyComparer.MakeSeparator(lc.GetKey(lc.NumberOfRecords()-1), compressedRecords[0].KeySuffix)
+	newSibling.insertCompressedRecords(0, compressedRecords)
+	parent.AddChildRecordCount(index, -numberOfRecords)
+	parent.InsertChildren(index+1, []nonLeafChild{{key, newSiblingAddr, numberOfRecords}})
 }
 
 func (lc leafController) MergeToLeft(parent nonLeafController, index int, leftSibling leafController) {
@@ -191,92 +196,117 @@ func (lc leafController) MergeToLeft(parent nonLeafController, index int, leftSi
 
 func (lc leafController) MergeFromRight(parent nonLeafController, index int, rightSibling leafController) {
 	parent.RemoveChildren(index+1, 1)
-	records := rightSibling.RemoveRecords(0, rightSibling.NumberOfRecords())
-	lc.InsertRecords(lc.NumberOfRecords(), records)
+	compressedRecords := rightSibling.moveOutRecords(0, rightSibling.NumberOfRecords())
+	lc.insertCompressedRecords(lc.NumberOfRecords(), compressedRecords)
+	parent.AddChildRecordCount(index, len(compressedRecords))
 }
 
-func (lc leafController) CountRecordsForShiftingToLeft(leftSibling leafController) int {
+func (lc leafController) CountRecordsForShiftingToLeft(leftSibling leafController, maxRecordSize int) int {
+	n := lc.NumberOfRecords()
 	loadSize1 := lc.GetLoadSize()
 	loadSize2 := leftSibling.GetLoadSize()
 	recordCount := 0
 
 	for i := 0; ; i++ {
-		recordSize := recordHeaderSize + len(lc.GetKey(i)) + len(lc.GetValue(i))
+		recordSize := lc.getRecordSize(i)
 		loadSize1 -= recordSize
 		loadSize2 += recordSize
+		// the key of the new first record is decompressed
+		sharedKeySize := 0
 
-		if loadSize1 < leafUnderloadThreshold || loadSize2 > leafOverloadThreshold {
+		if i+1 < n {
+			sharedKeySize = lc.getSharedKeySize(i + 1)
+		}
+
+		if loadSize1+sharedKeySize < lc.UnderloadThreshold(maxRecordSize) || loadSize2 > lc.OverloadThreshold(maxRecordSize) {
+			loadSize1 += recordSize
+			loadSize2 -= recordSize
 			break
 		}
 
 		recordCount++
 
-		if loadSize1 <= loadSize2 {
+		if loadSize1+sharedKeySize <= loadSize2 {
 			break
 		}
 	}
 
-	if loadSize1 > leafOverloadThreshold || loadSize2 < leafUnderloadThreshold {
+	loadSize1 += lc.getSharedKeySize(recordCount)
+
+	if loadSize1 > lc.OverloadThreshold(maxRecordSize) || loadSize2 < lc.UnderloadThreshold(maxRecordSize) {
 		return 0
 	}
 
 	return recordCount
 }
 
-func (lc leafController) ShiftToLeft(numberOfRecords int, parent nonLeafController, index int, leftSibling leafController) {
-	records := lc.RemoveRecords(0, numberOfRecords)
-	parent.SetKey(index, lc.GetKey(0))
-	leftSibling.InsertRecords(leftSibling.NumberOfRecords(), records)
+func (lc leafController) ShiftToLeft(numberOfRecords int, parent nonLeafController, index int, leftSibling leafController, keyComparer keyComparer) {
+	compressedRecords := lc.moveOutRecords(0, numberOfRecords)
+	leftSibling.insertCompressedRecords(leftSibling.NumberOfRecords(), compressedRecords)
+	parent.SetKey(index, keyComparer.MakeSeparator(leftSibling.GetKey(leftSibling.NumberOfRecords()-1), lc.GetKey(0)))
+	parent.AddChildRecordCount(index, -numberOfRecords)
+	parent.AddChildRecordCount(index-1, numberOfRecords)
 }
 
-func (lc leafController) CountRecordsForShiftingToRight(rightSibling leafController) int {
+func (lc leafController) CountRecordsForShiftingToRight(rightSibling leafController, maxRecordSize int) int {
+	n := lc.NumberOfRecords()
 	loadSize1 := lc.GetLoadSize()
 	loadSize2 := rightSibling.GetLoadSize()
 	recordCount := 0
 
-	for i := lc.NumberOfRecords() - 1; ; i-- {
-		recordSize := recordHeaderSize + len(lc.GetKey(i)) + len(lc.GetValue(i))
+	for i := n - 1; ; i-- {
+		recordSize := lc.getRecordSize(i)
 		loadSize1 -= recordSize
 		loadSize2 += recordSize
+		// the key of the first record shifted is decompressed
+		sharedKeySize := lc.getSharedKeySize(i)
 
-		if loadSize1 < leafUnderloadThreshold || loadSize2 > leafOverloadThreshold {
+		if loadSize1 < lc.UnderloadThreshold(maxRecordSize) || loadSize2+sharedKeySize > lc.OverloadThreshold(maxRecordSize) {
+			loadSize1 += recordSize
+			loadSize2 -= recordSize
 			break
 		}
 
 		recordCount++
 
-		if loadSize1 <= loadSize2 {
+		if loadSize1 <= loadSize2+sharedKeySize {
 			break
 		}
 	}
 
-	if loadSize1 > leafOverloadThreshold || loadSize2 < leafUnderloadThreshold {
+	if recordCount >= 1 {
+		loadSize2 += lc.getSharedKeySize(n - recordCount)
+	}
+
+	if loadSize1 > lc.OverloadThreshold(maxRecordSize) || loadSize2 < lc.UnderloadThreshold(maxRecordSize) {
 		return 0
 	}
 
 	return recordCount
 }
 
-func (lc leafController) ShiftToRight(numberOfRecords int, parent nonLeafController, index int, rightSibling leafController) {
-	records := lc.RemoveRecords(lc.NumberOfRecords()-numberOfRecords, numberOfRecords)
-	parent.SetKey(index+1, records[0].Key)
-	rightSibling.InsertRecords(0, records)
+func (lc leafController) ShiftToRight(numberOfRecords int, parent nonLeafController, index int, rightSibling leafController, keyComparer keyComparer) {
+	compressedRecords := lc.moveOutRecords(lc.NumberOfRecords()-numberOfRecords, numberOfRecords)
+	parent.SetKey(index+1, keyComparer.MakeSeparator(lc.GetKey(lc.NumberOfRecords()-1), compressedRecords[0].KeySuffix))
+	rightSibling.insertCompressedRecords(0, compressedRecords)
+	parent.AddChildRecordCount(index, -numberOfRecords)
+	parent.AddChildRecordCount(index+1, numberOfRecords)
 }
 
-func (lc leafController) CountRecordsForUnshiftingFromLeft(leftSibling leafController) int {
-	return leftSibling.CountRecordsForShiftingToRight(lc)
+func (lc leafController) CountRecordsForUnshiftingFromLeft(leftSibling leafController, maxRecordSize int) int {
+	return leftSibling.CountRecordsForShiftingToRight(lc, maxRecordSize)
 }
 
-func (lc leafController) UnshiftFromLeft(numberOfRecords int, parent nonLeafController, index int, leftSibling leafController) {
-	leftSibling.ShiftToRight(numberOfRecords, parent, index-1, lc)
+func (lc leafController) UnshiftFromLeft(numberOfRecords int, parent nonLeafController, index int, leftSibling leafController, keyComparer keyComparer) {
+	leftSibling.ShiftToRight(numberOfRecords, parent, index-1, lc, keyComparer)
 }
 
-func (lc leafController) CountRecordsForUnshiftingFromRight(rightSibling leafController) int {
-	return rightSibling.CountRecordsForShiftingToLeft(lc)
+func (lc leafController) CountRecordsForUnshiftingFromRight(rightSibling leafController, maxRecordSize int) int {
+	return rightSibling.CountRecordsForShiftingToLeft(lc, maxRecordSize)
 }
 
-func (lc leafController) UnshiftFromRight(numberOfRecords int, parent nonLeafController, index int, rightSibling leafController) {
-	rightSibling.ShiftToLeft(numberOfRecords, parent, index+1, lc)
+func (lc leafController) UnshiftFromRight(numberOfRecords int, parent nonLeafController, index int, rightSibling leafController, keyComparer keyComparer) {
+	rightSibling.ShiftToLeft(numberOfRecords, parent, index+1, lc, keyComparer)
 }
 
 func (lc leafController) GetLoadSize() int {
@@ -284,14 +314,26 @@ func (lc leafController) GetLoadSize() int {
 	var kvsOffsetX int
 
 	if numberOfRecordsX == 0 {
-		kvsOffsetX = leafSize
+		kvsOffsetX = len(lc)
 	} else {
 		kvsOffsetX = int(recordHeader(lc[leafHeaderSize:]).KeyOffset())
 	}
 
 	recordHeadersEndOffsetX := leafHeaderSize + numberOfRecordsX*recordHeaderSize
 	freeSpaceSize := kvsOffsetX - recordHeadersEndOffsetX
-	return maxLeafFreeSpaceSize - freeSpaceSize
+	return len(lc) - leafHeaderSize - freeSpaceSize
+}
+
+// OverloadThreshold returns the load size above which the leaf is
+// overloaded, the room for a record of the given maximum size is left.
+func (lc leafController) OverloadThreshold(maxRecordSize int) int {
+	return len(lc) - leafHeaderSize - maxRecordSize
+}
+
+// UnderloadThreshold returns the load size below which the leaf is
+// underloaded.
+func (lc leafController) UnderloadThreshold(maxRecordSize int) int {
+	return (lc.OverloadThreshold(maxRecordSize)-maxRecordSize)*3/8 + 1
 }
 
 func (lc leafController) SetValue(recordIndex int, value value) {
@@ -303,7 +345,7 @@ func (lc leafController) SetValue(recordIndex int, value value) {
 	var valueEndOffset int
 
 	if recordIndex+1 == numberOfRecords {
-		valueEndOffset = leafSize
+		valueEndOffset = len(lc)
 	} else {
 		valueEndOffset = int(recordHeader(lc[recordHeaderOffset+recordHeaderSize:]).KeyOffset())
 	}
@@ -317,14 +359,21 @@ func (lc leafController) SetValue(recordIndex int, value value) {
 		value,
 		recordHeaderOffset,
 	)
+
+	checksum.Update(lc)
 }
 
+// GetKey returns the key of the record at the given index. A restart
+// key refers to the leaf, while a compressed key is decompressed into
+// a new buffer.
 func (lc leafController) GetKey(recordIndex int) key {
 	lc.checkRecordIndex(recordIndex)
-	recordHeader1 := recordHeader(lc[leafHeaderSize+recordIndex*recordHeaderSize:])
-	keyOffset := int(recordHeader1.KeyOffset())
-	keyEndOffset := int(recordHeader1.ValueOffset())
-	return key(lc[keyOffset:keyEndOffset])
+
+	if lc.getSharedKeySize(recordIndex) == 0 {
+		return lc.getKeySuffix(recordIndex)
+	}
+
+	return lc.decompressKey(recordIndex, nil)
 }
 
 func (lc leafController) GetValue(recordIndex int) value {
@@ -335,7 +384,7 @@ func (lc leafController) GetValue(recordIndex int) value {
 	var valueEndOffset int
 
 	if recordIndex+1 == numberOfRecords {
-		valueEndOffset = leafSize
+		valueEndOffset = len(lc)
 	} else {
 		valueEndOffset = int(recordHeader(lc[recordHeaderOffset+recordHeaderSize:]).KeyOffset())
 	}
@@ -343,6 +392,40 @@ func (lc leafController) GetValue(recordIndex int) value {
 	return value(lc[valueOffset:valueEndOffset])
 }
 
+// IsValid reports whether the offsets of the keys and values, and the
+// sizes of the shared key prefixes, in the leaf are well-formed.
+func (lc leafController) IsValid() bool {
+	numberOfRecords := lc.NumberOfRecords()
+	kvsOffset := leafHeaderSize + numberOfRecords*recordHeaderSize
+	keySize := 0
+	runLength := 0
+
+	for i := 0; i < numberOfRecords; i++ {
+		recordHeader1 := recordHeader(lc[leafHeaderSize+i*recordHeaderSize:])
+		keyOffset := int(recordHeader1.KeyOffset())
+		valueOffset := int(recordHeader1.ValueOffset())
+
+		if keyOffset < kvsOffset || valueOffset < keyOffset {
+			return false
+		}
+
+		if sharedKeySize := int(recordHeader1.SharedKeySize()); sharedKeySize == 0 {
+			runLength = 1
+		} else {
+			if sharedKeySize > keySize || runLength == keyRestartInterval {
+				return false
+			}
+
+			runLength++
+		}
+
+		keySize = int(recordHeader1.SharedKeySize()) + valueOffset - keyOffset
+		kvsOffset = valueOffset
+	}
+
+	return kvsOffset <= len(lc)
+}
+
 func (lc leafController) NumberOfRecords() int {
 	return int(leafHeader(lc).RecordCount())
 }
@@ -357,6 +440,198 @@ func (lc leafController) checkRecordIndex(recordIndex int) int {
 	return numberOfRecords
 }
 
+// insertCompressedRecords inserts the given records, with the keys
+// compressed already, at the given index, leaving the key of the next
+// record as is.
+func (lc leafController) insertCompressedRecords(firstRecordIndex int, compressedRecords []compressedRecord) {
+	numberOfRecordsX := lc.checkRecordIndex(firstRecordIndex)
+	recordHeadersOffset := leafHeaderSize + firstRecordIndex*recordHeaderSize
+	recordHeadersEndOffsetX := leafHeaderSize + numberOfRecordsX*recordHeaderSize
+	recordHeadersSize := len(compressedRecords) * recordHeaderSize
+	var kvsOffsetX int
+
+	if numberOfRecordsX == 0 {
+		kvsOffsetX = len(lc)
+	} else {
+		kvsOffsetX = int(recordHeader(lc[leafHeaderSize:]).KeyOffset())
+	}
+
+	var kvsEndOffset int
+
+	if recordHeadersOffset == recordHeadersEndOffsetX {
+		kvsEndOffset = len(lc)
+	} else {
+		kvsEndOffset = int(recordHeader(lc[recordHeadersOffset:]).KeyOffset())
+	}
+
+	kvsSize := 0
+
+	for _, compressedRecord := range compressedRecords {
+		kvsSize += len(compressedRecord.KeySuffix) + len(compressedRecord.Value)
+	}
+
+	lc.doInsertRecords(
+		recordHeadersOffset,
+		recordHeadersEndOffsetX,
+		recordHeadersSize,
+		kvsOffsetX,
+		kvsEndOffset,
+		kvsSize,
+		compressedRecords,
+	)
+
+	leafHeader(lc).SetRecordCount(int32(numberOfRecordsX + len(compressedRecords)))
+	checksum.Update(lc)
+}
+
+// removeCompressedRecords removes the given number of the records at
+// the given index and then returns them, with the keys compressed,
+// leaving the key of the next record as is.
+func (lc leafController) removeCompressedRecords(firstRecordIndex int, numberOfRecords int) []compressedRecord {
+	numberOfRecordsX := lc.NumberOfRecords()
+	recordHeadersOffset := leafHeaderSize + firstRecordIndex*recordHeaderSize
+	recordHeadersSize := numberOfRecords * recordHeaderSize
+	recordHeadersEndOffset := recordHeadersOffset + recordHeadersSize
+	recordHeadersEndOffsetX := leafHeaderSize + numberOfRecordsX*recordHeaderSize
+	kvsOffsetX := int(recordHeader(lc[leafHeaderSize:]).KeyOffset())
+	kvsOffset := int(recordHeader(lc[recordHeadersOffset:]).KeyOffset())
+	var kvsEndOffset int
+
+	if recordHeadersEndOffset == recordHeadersEndOffsetX {
+		kvsEndOffset = len(lc)
+	} else {
+		kvsEndOffset = int(recordHeader(lc[recordHeadersEndOffset:]).KeyOffset())
+	}
+
+	kvsSize := kvsEndOffset - kvsOffset
+
+	compressedRecords := lc.doRemoveRecords(
+		numberOfRecords,
+		recordHeadersEndOffset,
+		recordHeadersEndOffsetX,
+		recordHeadersSize,
+		kvsOffsetX,
+		kvsOffset,
+		kvsSize,
+	)
+
+	leafHeader(lc).SetRecordCount(int32(numberOfRecordsX - numberOfRecords))
+	checksum.Update(lc)
+	return compressedRecords
+}
+
+// moveOutRecords removes the given number of the records at the given
+// index, which are the first or last records, and then returns them
+// with the key of the first one decompressed, so that the records can
+// be inserted into a sibling as is. The key of the new first record is
+// decompressed as well.
+func (lc leafController) moveOutRecords(firstRecordIndex int, numberOfRecords int) []compressedRecord {
+	firstKey := lc.decompressKey(firstRecordIndex, nil)
+	var nextKey key
+
+	if firstRecordIndex == 0 && numberOfRecords < lc.NumberOfRecords() && lc.getSharedKeySize(numberOfRecords) >= 1 {
+		nextKey = lc.decompressKey(numberOfRecords, nil)
+	}
+
+	compressedRecords := lc.removeCompressedRecords(firstRecordIndex, numberOfRecords)
+	compressedRecords[0] = compressedRecord{0, firstKey, compressedRecords[0].Value}
+
+	if nextKey != nil {
+		lc.setCompressedKey(0, nextKey, 0)
+	}
+
+	return compressedRecords
+}
+
+// decompressKey decompresses the key of the record at the given index
+// into the given buffer, from the restart key of the run, and returns
+// the key.
+func (lc leafController) decompressKey(recordIndex int, buffer []byte) key {
+	restartRecordIndex := lc.getRestartRecordIndex(recordIndex)
+	buffer = append(buffer[:0], lc.getKeySuffix(restartRecordIndex)...)
+
+	for i := restartRecordIndex + 1; i <= recordIndex; i++ {
+		buffer = append(buffer[:lc.getSharedKeySize(i)], lc.getKeySuffix(i)...)
+	}
+
+	return buffer
+}
+
+// setCompressedKey replaces the key of the record at the given index
+// with the given key, of which the prefix of the given size is shared
+// with the previous key.
+func (lc leafController) setCompressedKey(recordIndex int, key key, sharedKeySize int) {
+	kvsOffsetX := int(recordHeader(lc[leafHeaderSize:]).KeyOffset())
+	recordHeaderOffset := leafHeaderSize + recordIndex*recordHeaderSize
+	recordHeader1 := recordHeader(lc[recordHeaderOffset:])
+	keyOffset := int(recordHeader1.KeyOffset())
+	keySuffix := key[sharedKeySize:]
+	keySuffixSizeDelta := len(keySuffix) - (int(recordHeader1.ValueOffset()) - keyOffset)
+	copy(lc[kvsOffsetX-keySuffixSizeDelta:], lc[kvsOffsetX:keyOffset])
+	copy(lc[keyOffset-keySuffixSizeDelta:], keySuffix)
+
+	for i := leafHeaderSize; i < recordHeaderOffset; i += recordHeaderSize {
+		recordHeader := recordHeader(lc[i:])
+		keyOffset := int(recordHeader.KeyOffset())
+		recordHeader.SetKeyOffset(int32(keyOffset - keySuffixSizeDelta))
+		valueOffset := int(recordHeader.ValueOffset())
+		recordHeader.SetValueOffset(int32(valueOffset - keySuffixSizeDelta))
+	}
+
+	recordHeader1.SetKeyOffset(int32(keyOffset - keySuffixSizeDelta))
+	recordHeader1.SetSharedKeySize(uint16(sharedKeySize))
+	checksum.Update(lc)
+}
+
+func (lc leafController) getKeySuffix(recordIndex int) key {
+	lc.checkRecordIndex(recordIndex)
+	recordHeader1 := recordHeader(lc[leafHeaderSize+recordIndex*recordHeaderSize:])
+	keyOffset := int(recordHeader1.KeyOffset())
+	keyEndOffset := int(recordHeader1.ValueOffset())
+	return key(lc[keyOffset:keyEndOffset])
+}
+
+func (lc leafController) getSharedKeySize(recordIndex int) int {
+	return int(recordHeader(lc[leafHeaderSize+recordIndex*recordHeaderSize:]).SharedKeySize())
+}
+
+func (lc leafController) getRecordSize(recordIndex int) int {
+	recordHeaderOffset := leafHeaderSize + recordIndex*recordHeaderSize
+	keyOffset := int(recordHeader(lc[recordHeaderOffset:]).KeyOffset())
+	var valueEndOffset int
+
+	if recordIndex+1 == lc.NumberOfRecords() {
+		valueEndOffset = len(lc)
+	} else {
+		valueEndOffset = int(recordHeader(lc[recordHeaderOffset+recordHeaderSize:]).KeyOffset())
+	}
+
+	return recordHeaderSize + valueEndOffset - keyOffset
+}
+
+// getRestartRecordIndex returns the index of the record with the
+// restart key of the run which the record at the given index is in.
+func (lc leafController) getRestartRecordIndex(recordIndex int) int {
+	for recordIndex >= 1 && lc.getSharedKeySize(recordIndex) >= 1 {
+		recordIndex--
+	}
+
+	return recordIndex
+}
+
+// countCompressedKeys returns the number of the compressed keys of the
+// records from the given index to the end of the run.
+func (lc leafController) countCompressedKeys(recordIndex int) int {
+	n := lc.NumberOfRecords()
+	i := recordIndex
+
+	for i < n && lc.getSharedKeySize(i) >= 1 {
+		i++
+	}
+
+	return i - recordIndex
+}
+
 func (lc leafController) doInsertRecords(
 	recordHeadersOffset int,
 	recordHeadersEndOffsetX int,
@@ -364,7 +639,7 @@ func (lc leafController) doInsertRecords(
 	kvsOffsetX int,
 	kvsEndOffset int,
 	kvsSize int,
-	records []record,
+	compressedRecords []compressedRecord,
 ) {
 	copy(lc[recordHeadersOffset+recordHeadersSize:], lc[recordHeadersOffset:recordHeadersEndOffsetX])
 	copy(lc[kvsOffsetX-kvsSize:], lc[kvsOffsetX:kvsEndOffset])
@@ -379,16 +654,17 @@ func (lc leafController) doInsertRecords(
 
 	kvsOffset := kvsEndOffset - kvsSize
 
-	for _, record := range records {
+	for _, compressedRecord := range compressedRecords {
 		keyOffset := kvsOffset
-		kvsOffset += copy(lc[kvsOffset:], record.Key)
+		kvsOffset += copy(lc[kvsOffset:], compressedRecord.KeySuffix)
 		valueOffset := kvsOffset
-		kvsOffset += copy(lc[kvsOffset:], record.Value)
+		kvsOffset += copy(lc[kvsOffset:], compressedRecord.Value)
 		recordHeaderOffset := recordHeadersOffset
 		recordHeadersOffset += recordHeaderSize
 		recordHeader := recordHeader(lc[recordHeaderOffset:])
 		recordHeader.SetKeyOffset(int32(keyOffset))
 		recordHeader.SetValueOffset(int32(valueOffset))
+		recordHeader.SetSharedKeySize(uint16(compressedRecord.SharedKeySize))
 	}
 }
 
@@ -400,23 +676,23 @@ func (lc leafController) doRemoveRecords(
 	kvsOffsetX int,
 	kvsOffset int,
 	kvsSize int,
-) []record {
+) []compressedRecord {
 	recordHeadersOffset := recordHeadersEndOffset - recordHeadersSize
 	kvs := make([]byte, kvsSize)
-	records := make([]record, 0, numberOfRecords)
+	compressedRecords := make([]compressedRecord, 0, numberOfRecords)
 
 	for i := recordHeadersOffset; i < recordHeadersEndOffset; i += recordHeaderSize {
 		recordHeader1 := recordHeader(lc[i:])
 		keyOffset := int(recordHeader1.KeyOffset())
 		keyEndOffset := int(recordHeader1.ValueOffset())
-		key := kvs[:keyEndOffset-keyOffset]
-		kvs = kvs[len(key):]
-		copy(key, lc[keyOffset:])
+		keySuffix := kvs[:keyEndOffset-keyOffset]
+		kvs = kvs[len(keySuffix):]
+		copy(keySuffix, lc[keyOffset:])
 		valueOffset := keyEndOffset
 		var valueEndOffset int
 
 		if j := i + recordHeaderSize; j == recordHeadersEndOffsetX {
-			valueEndOffset = leafSize
+			valueEndOffset = len(lc)
 		} else {
 			valueEndOffset = int(recordHeader(lc[j:]).KeyOffset())
 		}
@@ -424,7 +700,7 @@ func (lc leafController) doRemoveRecords(
 		value := kvs[:valueEndOffset-valueOffset]
 		kvs = kvs[len(value):]
 		copy(value, lc[valueOffset:])
-		records = append(records, record{key, value})
+		compressedRecords = append(compressedRecords, compressedRecord{int(recordHeader1.SharedKeySize()), keySuffix, value})
 	}
 
 	copy(lc[recordHeadersEndOffset-recordHeadersSize:], lc[recordHeadersEndOffset:recordHeadersEndOffsetX])
@@ -438,7 +714,7 @@ func (lc leafController) doRemoveRecords(
 		recordHeader.SetValueOffset(int32(valueOffset + kvsSize))
 	}
 
-	return records
+	return compressedRecords
 }
 
 func (lc leafController) doSetValue(
@@ -465,33 +741,68 @@ type record struct {
 	Value value
 }
 
+// compressedRecord represents a record with the key compressed, of
+// which only the suffix following the shared prefix is kept.
+type compressedRecord struct {
+	SharedKeySize int
+	KeySuffix     key
+	Value         value
+}
+
+// decompressRecords returns the given records with the keys
+// decompressed, the key of the first record is given as is.
+func decompressRecords(firstKey key, compressedRecords []compressedRecord) []record {
+	records := make([]record, len(compressedRecords))
+	key := firstKey
+
+	for i, compressedRecord := range compressedRecords {
+		if i >= 1 {
+			sharedKeySize := compressedRecord.SharedKeySize
+			key = append(key[:sharedKeySize:sharedKeySize], compressedRecord.KeySuffix...)
+		}
+
+		records[i] = record{key, compressedRecord.Value}
+	}
+
+	return records
+}
+
+// leafHeader starts with the checksum of the leaf (see package checksum).
 type leafHeader []byte
 
 func (lh leafHeader) SetPrevAddr(value int64) {
-	binary.BigEndian.PutUint64(lh[0:], uint64(value))
+	binary.BigEndian.PutUint64(lh[4:], uint64(value))
 }
 
 func (lh leafHeader) PrevAddr() int64 {
-	return int64(binary.BigEndian.Uint64(lh[0:]))
+	return int64(binary.BigEndian.Uint64(lh[4:]))
 }
 
 func (lh leafHeader) SetNextAddr(value int64) {
-	binary.BigEndian.PutUint64(lh[8:], uint64(value))
+	binary.BigEndian.PutUint64(lh[12:], uint64(value))
 }
 
 func (lh leafHeader) NextAddr() int64 {
-	return int64(binary.BigEndian.Uint64(lh[8:]))
+	return int64(binary.BigEndian.Uint64(lh[12:]))
 }
 
 func (lh leafHeader) SetRecordCount(value int32) {
-	binary.BigEndian.PutUint32(lh[16:], uint32(value))
+	binary.BigEndian.PutUint32(lh[20:], uint32(value))
 }
 
 func (lh leafHeader) RecordCount() int32 {
-	return int32(binary.BigEndian.Uint32(lh[16:]))
+	return int32(binary.BigEndian.Uint32(lh[20:]))
+}
+
+func (lh leafHeader) SetGeneration(value int64) {
+	binary.BigEndian.PutUint64(lh[24:], uint64(value))
+}
+
+func (lh leafHeader) Generation() int64 {
+	return int64(binary.BigEndian.Uint64(lh[24:]))
 }
 
-const leafHeaderSize = 20
+const leafHeaderSize = 32
 
 type recordHeader []byte
 
@@ -511,4 +822,14 @@ func (rh recordHeader) ValueOffset() int32 {
 	return int32(binary.BigEndian.Uint32(rh[4:]))
 }
 
-const recordHeaderSize = 8
+func (rh recordHeader) SetSharedKeySize(value uint16) {
+	binary.BigEndian.PutUint16(rh[8:], value)
+}
+
+// SharedKeySize returns the size of the prefix the key shares with
+// the previous key, which is elided, 0 for a restart key.
+func (rh recordHeader) SharedKeySize() uint16 {
+	return binary.BigEndian.Uint16(rh[8:])
+}
+
+const recordHeaderSize = 10
@@ -9,7 +9,7 @@ import (
 )
 
 func TestLeafInsertRecords(t *testing.T) {
-	lc := leafController(make([]byte, leafSize))
+	lc := leafController(make([]byte, DefaultPageSize))
 	kvs := [][2][]byte{
 		{[]byte("a"), []byte("1")},
 		{[]byte("bb"), []byte("22")},
@@ -37,7 +37,7 @@ func TestLeafInsertRecords(t *testing.T) {
 }
 
 func TestLeafDeleteRecords(t *testing.T) {
-	lc := leafController(make([]byte, leafSize))
+	lc := leafController(make([]byte, DefaultPageSize))
 	kvs := [][2][]byte{
 		{[]byte("a"), []byte("1")},
 		{[]byte("bb"), []byte("22")},
@@ -73,7 +73,7 @@ func TestLeafDeleteRecords(t *testing.T) {
 }
 
 func TestLeafLocateRecord(t *testing.T) {
-	lc := leafController(make([]byte, leafSize))
+	lc := leafController(make([]byte, DefaultPageSize))
 	kvs := [][2][]byte{
 		{[]byte("a"), []byte("1")},
 		{[]byte("bb"), []byte("22")},
@@ -90,21 +90,21 @@ func TestLeafLocateRecord(t *testing.T) {
 
 	for _, kv := range kvs {
 		k, v := kv[0], kv[1]
-		i, ok := lc.LocateRecord(k, keyComparer{})
+		i, ok := lc.LocateRecord(k, keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 		if assert.True(t, ok) {
 			assert.Equal(t, int(v[0]-'1'), i)
 		}
 	}
 	for _, kv := range kvs {
 		k, v := kv[0], kv[1]
-		i, ok := lc.LocateRecord(k[:len(k)-1], keyComparer{})
+		i, ok := lc.LocateRecord(k[:len(k)-1], keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 		if assert.False(t, ok) {
 			assert.Equal(t, int(v[0]-'1'), i)
 		}
 	}
 	for _, kv := range kvs {
 		k, v := kv[0], kv[1]
-		i, ok := lc.LocateRecord(key(string(k)+string(k[len(k)-1:])), keyComparer{})
+		i, ok := lc.LocateRecord(key(string(k)+string(k[len(k)-1:])), keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 		if assert.False(t, ok) {
 			assert.Equal(t, int(v[0]-'0'), i)
 		}
@@ -112,7 +112,7 @@ func TestLeafLocateRecord(t *testing.T) {
 }
 
 func TestLeafSetValue(t *testing.T) {
-	lc := leafController(make([]byte, leafSize))
+	lc := leafController(make([]byte, DefaultPageSize))
 	kvs := [][2][]byte{
 		{[]byte("a"), []byte("1")},
 		{[]byte("bb"), []byte("22")},
@@ -134,7 +134,7 @@ func TestLeafSetValue(t *testing.T) {
 }
 
 func TestLeafGetLoadSize(t *testing.T) {
-	lc := leafController(make([]byte, leafSize))
+	lc := leafController(make([]byte, DefaultPageSize))
 	assert.Equal(t, 0, lc.GetLoadSize())
 	lc.InsertRecords(0, []record{
 		{key("123"), value("4567")},
@@ -144,6 +144,47 @@ func TestLeafGetLoadSize(t *testing.T) {
 	assert.Equal(t, 0, lc.GetLoadSize())
 }
 
+func TestLeafCompressKeys(t *testing.T) {
+	lc := leafController(make([]byte, DefaultPageSize))
+	lc.InsertRecords(0, []record{
+		{key("tenant-1/a"), value("1")},
+		{key("tenant-1/c"), value("3")},
+	})
+	lc.InsertRecords(1, []record{
+		{key("tenant-1/b"), value("2")},
+	})
+	lc.InsertRecords(0, []record{
+		{key("tenant-0/z"), value("0")},
+	})
+	assert.Equal(t, "tenant-0/z:0,tenant-1/a:1,tenant-1/b:2,tenant-1/c:3", dumpLeaf(lc))
+	assert.Equal(t, 4*recordHeaderSize+(10+1)+(10+1)+(1+1)+(1+1), lc.GetLoadSize())
+	assert.True(t, lc.IsValid())
+
+	rs := lc.RemoveRecords(0, 2)
+	assert.Equal(t, "tenant-0/z:0,tenant-1/a:1", dumpRecords(rs))
+	assert.Equal(t, "tenant-1/b:2,tenant-1/c:3", dumpLeaf(lc))
+	assert.Equal(t, 2*recordHeaderSize+(10+1)+(1+1), lc.GetLoadSize())
+	assert.True(t, lc.IsValid())
+
+	lc.RemoveRecords(0, 2)
+	for i := 0; i < 2*keyRestartInterval; i++ {
+		lc.InsertRecords(i, []record{
+			{key(fmt.Sprintf("tenant-1/%02d", i)), value("")},
+		})
+	}
+	for i := 0; i < 2*keyRestartInterval; i++ {
+		assert.Equal(t, i%keyRestartInterval == 0, lc.getSharedKeySize(i) == 0)
+		j, ok := lc.LocateRecord(key(fmt.Sprintf("tenant-1/%02d", i)), keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
+		if assert.True(t, ok) {
+			assert.Equal(t, i, j)
+		}
+	}
+	assert.True(t, lc.IsValid())
+
+	recordHeader(lc[leafHeaderSize+keyRestartInterval*recordHeaderSize:]).SetSharedKeySize(1)
+	assert.False(t, lc.IsValid())
+}
+
 func dumpLeaf(lc leafController) string {
 	b := bytes.NewBuffer(nil)
 	n := lc.NumberOfRecords()
@@ -1,6 +1,8 @@
 package bptree
 
-import "github.com/roy2220/fsm"
+import (
+	"github.com/roy2220/plainkv/internal/checksum"
+)
 
 type leafList struct {
 	tailAddr int64
@@ -11,6 +13,7 @@ func (ll *leafList) Init(leafAccessor []byte, leafAddr int64) *leafList {
 	leafHeader1 := leafHeader(leafAccessor)
 	leafHeader1.SetPrevAddr(leafAddr)
 	leafHeader1.SetNextAddr(leafAddr)
+	checksum.Update(leafAccessor)
 	ll.tailAddr = leafAddr
 	ll.headAddr = leafAddr
 	return ll
@@ -21,31 +24,31 @@ func (ll *leafList) Set(tailAddr int64, headAddr int64) {
 	ll.headAddr = headAddr
 }
 
-func (ll *leafList) InsertLeafAfter(fileStorage *fsm.FileStorage, leafAddr int64, leafPrevAddr int64) {
-	leafFactory := leafFactory{fileStorage}
-	leafHeader1 := leafHeader(leafFactory.GetLeafController(leafAddr))
-	leafPrevHeader := leafHeader(leafFactory.GetLeafController(leafPrevAddr))
-	leafNextAddr := leafPrevHeader.NextAddr()
-	leafNextHeader := leafHeader(leafFactory.GetLeafController(leafNextAddr))
-	leafHeader1.SetPrevAddr(leafPrevAddr)
-	leafPrevHeader.SetNextAddr(leafAddr)
-	leafHeader1.SetNextAddr(leafNextAddr)
-	leafNextHeader.SetPrevAddr(leafAddr)
+func (ll *leafList) InsertLeafAfter(leafFactory leafFactory, leafAddr int64, leafPrevAddr int64) {
+	leafController := leafFactory.GetLeafController(leafAddr)
+	leafPrevController := leafFactory.GetLeafController(leafPrevAddr)
+	leafNextAddr := leafHeader(leafPrevController).NextAddr()
+	leafNextController := leafFactory.GetLeafController(leafNextAddr)
+	leafHeader(leafController).SetPrevAddr(leafPrevAddr)
+	leafHeader(leafPrevController).SetNextAddr(leafAddr)
+	leafHeader(leafController).SetNextAddr(leafNextAddr)
+	leafHeader(leafNextController).SetPrevAddr(leafAddr)
+	updateChecksums(leafController, leafPrevController, leafNextController)
 
 	if leafPrevAddr == ll.tailAddr {
 		ll.tailAddr = leafAddr
 	}
 }
 
-func (ll *leafList) RemoveLeaf(fileStorage *fsm.FileStorage, leafAddr int64) {
-	leafFactory := leafFactory{fileStorage}
+func (ll *leafList) RemoveLeaf(leafFactory leafFactory, leafAddr int64) {
 	leafHeader1 := leafHeader(leafFactory.GetLeafController(leafAddr))
 	leafPrevAddr := leafHeader1.PrevAddr()
-	leafPrevHeader := leafHeader(leafFactory.GetLeafController(leafPrevAddr))
+	leafPrevController := leafFactory.GetLeafController(leafPrevAddr)
 	leafNextAddr := leafHeader1.NextAddr()
-	leafNextHeader := leafHeader(leafFactory.GetLeafController(leafNextAddr))
-	leafPrevHeader.SetNextAddr(leafNextAddr)
-	leafNextHeader.SetPrevAddr(leafPrevAddr)
+	leafNextController := leafFactory.GetLeafController(leafNextAddr)
+	leafHeader(leafPrevController).SetNextAddr(leafNextAddr)
+	leafHeader(leafNextController).SetPrevAddr(leafPrevAddr)
+	updateChecksums(leafPrevController, leafNextController)
 
 	if leafAddr == ll.headAddr {
 		ll.headAddr = leafNextAddr
@@ -54,6 +57,51 @@ func (ll *leafList) RemoveLeaf(fileStorage *fsm.FileStorage, leafAddr int64) {
 	}
 }
 
+// RemoveLeafs removes the consecutive leaves from the given first leaf
+// to the given last leaf, which are between the given previous leaf
+// and next leaf. The leaves removed aren't accessed, so they may have
+// been destroyed.
+func (ll *leafList) RemoveLeafs(leafFactory leafFactory, firstLeafAddr int64, lastLeafAddr int64, leafPrevAddr int64, leafNextAddr int64) {
+	leafPrevController := leafFactory.GetLeafController(leafPrevAddr)
+	leafNextController := leafFactory.GetLeafController(leafNextAddr)
+	leafHeader(leafPrevController).SetNextAddr(leafNextAddr)
+	leafHeader(leafNextController).SetPrevAddr(leafPrevAddr)
+	updateChecksums(leafPrevController, leafNextController)
+
+	if firstLeafAddr == ll.headAddr {
+		ll.headAddr = leafNextAddr
+	}
+
+	if lastLeafAddr == ll.tailAddr {
+		ll.tailAddr = leafPrevAddr
+	}
+}
+
+func (ll *leafList) ReplaceLeaf(leafFactory leafFactory, leafAddr int64, oldLeafAddr int64) {
+	leafController := leafFactory.GetLeafController(leafAddr)
+	leafHeader1 := leafHeader(leafController)
+
+	if leafHeader1.NextAddr() == oldLeafAddr {
+		leafHeader1.SetPrevAddr(leafAddr)
+		leafHeader1.SetNextAddr(leafAddr)
+		updateChecksums(leafController)
+	} else {
+		leafPrevController := leafFactory.GetLeafController(leafHeader1.PrevAddr())
+		leafNextController := leafFactory.GetLeafController(leafHeader1.NextAddr())
+		leafHeader(leafPrevController).SetNextAddr(leafAddr)
+		leafHeader(leafNextController).SetPrevAddr(leafAddr)
+		updateChecksums(leafPrevController, leafNextController)
+	}
+
+	if oldLeafAddr == ll.headAddr {
+		ll.headAddr = leafAddr
+	}
+
+	if oldLeafAddr == ll.tailAddr {
+		ll.tailAddr = leafAddr
+	}
+}
+
 func (ll *leafList) TailAddr() int64 {
 	return ll.tailAddr
 }
@@ -61,3 +109,11 @@ func (ll *leafList) TailAddr() int64 {
 func (ll *leafList) HeadAddr() int64 {
 	return ll.headAddr
 }
+
+func updateChecksums(leafControllers ...leafController) {
+	// the leaves may be identical, so their checksums can't be updated
+	// until all of them are modified
+	for _, leafController := range leafControllers {
+		checksum.Update(leafController)
+	}
+}
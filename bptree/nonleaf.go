@@ -4,58 +4,63 @@ import (
 	"encoding/binary"
 
 	"github.com/roy2220/fsm"
-)
-
-const (
-	nonLeafSize               = 1 << 13
-	maxNonLeafFreeSpaceSize   = nonLeafSize - nonLeafHeaderSize
-	maxNonLeafChildSize       = nonLeafChildHeaderSize + maxKeySize
-	nonLeafOverloadThreshold  = maxNonLeafFreeSpaceSize - maxNonLeafChildSize
-	nonLeafUnderloadThreshold = (nonLeafOverloadThreshold-maxNonLeafChildSize)*3/8 + 1
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 type nonLeafFactory struct {
 	FileStorage *fsm.FileStorage
+	NonLeafSize int
 }
 
 func (nlf nonLeafFactory) CreateNonLeaf() (int64, nonLeafController) {
-	nonLeafAddr, nonLeafAccessor := nlf.FileStorage.AllocateAlignedSpace(nonLeafSize)
+	nonLeafAddr, nonLeafAccessor := nlf.FileStorage.AllocateAlignedSpace(nlf.NonLeafSize)
 
 	for i := 0; i < nonLeafHeaderSize; i++ {
 		nonLeafAccessor[i] = 0
 	}
 
+	checksum.Update(nonLeafAccessor)
 	return nonLeafAddr, nonLeafController(nonLeafAccessor)
 }
 
 func (nlf nonLeafFactory) DestroyNonLeaf(nonLeafAddr int64) {
-	nlf.FileStorage.FreeAlignedSpace(nonLeafAddr)
+	freeAlignedSpace(nlf.FileStorage, nonLeafAddr)
 }
 
 func (nlf nonLeafFactory) GetNonLeafController(nonLeafAddr int64) nonLeafController {
-	return nonLeafController(nlf.FileStorage.AccessAlignedSpace(nonLeafAddr))
+	nonLeafController := nonLeafController(accessAlignedSpace(nlf.FileStorage, nonLeafAddr))
+
+	if len(nonLeafController) != nlf.NonLeafSize || !checksum.Verify(nonLeafController) {
+		corruption.Panic(nonLeafAddr)
+	}
+
+	if n := int(nonLeafHeader(nonLeafController).ChildCount()); n < 0 || n > (nlf.NonLeafSize-nonLeafHeaderSize)/nonLeafChildHeaderSize {
+		corruption.Panic(nonLeafAddr)
+	}
+
+	return nonLeafController
 }
 
 type nonLeafController []byte
 
 func (nlc nonLeafController) LocateChild(key []byte, keyComparer keyComparer) (int, bool) {
-	if isMinKey(key) {
-		return 0, true
-	}
-
 	n := nlc.NumberOfChildren()
 
-	if isMaxKey(key) {
-		return n - 1, true
+	if n == 1 {
+		// a non-leaf may be left with only one child while being rebalanced
+		return 1, false
 	}
 
 	i, j := 1 /* skip the first child whose key is dummy */, n-1
+	var buffer []byte
 
 	for i < j {
 		k := (i + j) / 2
 		// i <= k < j
+		buffer = nlc.decompressKey(k, buffer)
 
-		if keyComparer.CompareKey(nlc.GetKey(k), key) < 0 {
+		if keyComparer.CompareKey(buffer, key) < 0 {
 			i = k + 1
 			// i <= j
 		} else {
@@ -65,7 +70,7 @@ func (nlc nonLeafController) LocateChild(key []byte, keyComparer keyComparer) (i
 	}
 	// i == j
 
-	d := keyComparer.CompareKey(nlc.GetKey(i), key)
+	d := keyComparer.CompareKey(nlc.decompressKey(i, buffer), key)
 
 	if d == 0 {
 		return i, true
@@ -79,43 +84,41 @@ func (nlc nonLeafController) LocateChild(key []byte, keyComparer keyComparer) (i
 }
 
 func (nlc nonLeafController) InsertChildren(firstChildIndex int, children []nonLeafChild) {
-	numberOfChildrenX := nlc.checkChildIndex(firstChildIndex)
-	childHeadersOffset := nonLeafHeaderSize + firstChildIndex*nonLeafChildHeaderSize
-	childHeadersEndOffsetX := nonLeafHeaderSize + numberOfChildrenX*nonLeafChildHeaderSize
-	childHeadersSize := len(children) * nonLeafChildHeaderSize
-	var keysOffsetX int
+	nlc.checkChildIndex(firstChildIndex)
+	var prevKey key
+	runLength := 0
 
-	if numberOfChildrenX == 0 {
-		keysOffsetX = nonLeafSize
-	} else {
-		keysOffsetX = int(nonLeafChildHeader(nlc[nonLeafHeaderSize:]).KeyOffset())
+	if firstChildIndex >= 1 {
+		prevKey = nlc.GetKey(firstChildIndex - 1)
+		runLength = firstChildIndex - nlc.getRestartChildIndex(firstChildIndex-1)
 	}
 
-	var keysEndOffset int
+	keys := make([]key, len(children))
 
-	if childHeadersOffset == childHeadersEndOffsetX {
-		keysEndOffset = nonLeafSize
-	} else {
-		keysEndOffset = int(nonLeafChildHeader(nlc[childHeadersOffset:]).KeyOffset())
+	for i := range children {
+		keys[i] = children[i].Key
 	}
 
-	keysSize := 0
+	numberOfNextCompressedKeys := nlc.countCompressedKeys(firstChildIndex)
+	sharedKeySizes := compressKeys(prevKey, runLength, keys, numberOfNextCompressedKeys)
+	compressedChildren := make([]compressedNonLeafChild, len(children))
 
-	for _, child := range children {
-		keysSize += len(child.Key)
+	for i, child := range children {
+		compressedChildren[i] = compressedNonLeafChild{sharedKeySizes[i], child.Key[sharedKeySizes[i]:], child.Addr, child.RecordCount}
 	}
 
-	nlc.doInsertChildren(
-		childHeadersOffset,
-		childHeadersEndOffsetX,
-		childHeadersSize,
-		keysOffsetX,
-		keysEndOffset,
-		keysSize,
-		children,
-	)
+	var nextKey key
+
+	if numberOfNextCompressedKeys >= 1 {
+		nextKey = nlc.decompressKey(firstChildIndex, nil)
+	}
+
+	nlc.insertCompressedChildren(firstChildIndex, compressedChildren)
 
-	nonLeafHeader(nlc).SetChildCount(int32(numberOfChildrenX + len(children)))
+	if nextKey != nil {
+		// the key of the next child is compressed against the key of the last child inserted instead
+		nlc.setCompressedKey(firstChildIndex+len(children), nextKey, getSharedPrefixSize(keys[len(keys)-1], nextKey))
+	}
 }
 
 func (nlc nonLeafController) RemoveChildren(firstChildIndex int, numberOfChildren int) []nonLeafChild {
@@ -125,70 +128,69 @@ func (nlc nonLeafController) RemoveChildren(firstChildIndex int, numberOfChildre
 		panic(errOutOfRange)
 	}
 
-	childHeadersOffset := nonLeafHeaderSize + firstChildIndex*nonLeafChildHeaderSize
-	childHeadersSize := numberOfChildren * nonLeafChildHeaderSize
-	childHeadersEndOffset := childHeadersOffset + childHeadersSize
-	childHeadersEndOffsetX := nonLeafHeaderSize + numberOfChildrenX*nonLeafChildHeaderSize
-	keysOffsetX := int(nonLeafChildHeader(nlc[nonLeafHeaderSize:]).KeyOffset())
-	keysOffset := int(nonLeafChildHeader(nlc[childHeadersOffset:]).KeyOffset())
-	var keysEndOffset int
+	if numberOfChildren == 0 {
+		return nil
+	}
 
-	if childHeadersEndOffset == childHeadersEndOffsetX {
-		keysEndOffset = nonLeafSize
-	} else {
-		keysEndOffset = int(nonLeafChildHeader(nlc[childHeadersEndOffset:]).KeyOffset())
+	firstKey := nlc.decompressKey(firstChildIndex, nil)
+	nextChildIndex := firstChildIndex + numberOfChildren
+	var nextKey key
+	nextSharedKeySize := 0
+
+	if nextChildIndex < numberOfChildrenX && nlc.getSharedKeySize(nextChildIndex) >= 1 {
+		nextKey = nlc.decompressKey(nextChildIndex, nil)
+
+		// the key of the next child is compressed against the key of the child before the children
+		// removed instead, unless the restart key of the run is removed, which the key replaces then
+		if nlc.getRestartChildIndex(nextChildIndex) < firstChildIndex {
+			nextSharedKeySize = getSharedPrefixSize(nlc.GetKey(firstChildIndex-1), nextKey)
+		}
 	}
 
-	keysSize := keysEndOffset - keysOffset
+	compressedChildren := nlc.removeCompressedChildren(firstChildIndex, numberOfChildren)
 
-	children := nlc.doRemoveChildren(
-		numberOfChildren,
-		childHeadersEndOffset,
-		childHeadersEndOffsetX,
-		childHeadersSize,
-		keysOffsetX,
-		keysOffset,
-		keysSize,
-	)
+	if nextKey != nil {
+		nlc.setCompressedKey(firstChildIndex, nextKey, nextSharedKeySize)
+	}
 
-	nonLeafHeader(nlc).SetChildCount(int32(numberOfChildrenX - numberOfChildren))
-	return children
+	return decompressChildren(firstKey, compressedChildren)
 }
 
-func (nlc nonLeafController) CountChildrenForSpliting() int {
+func (nlc nonLeafController) CountChildrenForSpliting(maxChildSize int) int {
 	n := nlc.NumberOfChildren()
-	lastChildSize := nonLeafChildHeaderSize + len(nlc.GetKey(n-1))
-	loadSize1 := nlc.GetLoadSize() - lastChildSize
-	loadSize2 := nonLeafChildHeaderSize
+	loadSize1 := nlc.GetLoadSize()
+	loadSize2 := 0
 	childCount := 0
 
-	for i := n - 2; ; i-- {
-		if loadSize1 < nonLeafUnderloadThreshold {
+	for i := n - 1; ; i-- {
+		childSize := nlc.getChildSize(i)
+		loadSize1 -= childSize
+
+		if loadSize1 < nlc.UnderloadThreshold(maxChildSize) {
 			break
 		}
 
 		childCount++
 
-		if loadSize1 <= loadSize2 {
+		// the key of the first child moved goes to the parent, and the key of the second one is decompressed
+		if loadSize1 <= nonLeafChildHeaderSize+loadSize2+nlc.getNextSharedKeySize(i) {
 			break
 		}
 
-		childSize := nonLeafChildHeaderSize + len(nlc.GetKey(i))
-		loadSize1 -= childSize
-		loadSize2 += lastChildSize
-		lastChildSize = childSize
-
+		loadSize2 += childSize
 	}
 
 	return childCount
 }
 
 func (nlc nonLeafController) Split(numberOfChildren int, parent nonLeafController, index int, newSibling nonLeafController, newSiblingAddr int64) {
-	children := nlc.RemoveChildren(nlc.NumberOfChildren()-numberOfChildren, numberOfChildren)
-	key := children[0].Key
-	children[0].Key = nil
-	newSibling.InsertChildren(0, children)
-	parent.InsertChildren(index+1, []nonLeafChild{{key, newSiblingAddr}})
+	compressedChildren := nlc.moveOutChildren(nlc.NumberOfChildren()-numberOfChildren, numberOfChildren)
+	key := compressedChildren[0].KeySuffix
+	compressedChildren[0].KeySuffix = nil
+	newSibling.insertCompressedChildren(0, compressedChildren)
+	recordCount := sumCompressedRecordCounts(compressedChildren)
+	parent.AddChildRecordCount(index, -recordCount)
+	parent.InsertChildren(index+1, []nonLeafChild{{key, newSiblingAddr, recordCount}})
 }
 
 func (nlc nonLeafController) MergeToLeft(parent nonLeafController, index int, leftSibling nonLeafController) {
@@ -196,34 +198,46 @@ func (nlc nonLeafController) MergeToLeft(parent nonLeafController, index int, le
 }
 
 func (nlc nonLeafController) MergeFromRight(parent nonLeafController, index int, rightSibling nonLeafController) {
-	key := parent.RemoveChildren(index+1, 1)[0].Key
-	children := rightSibling.RemoveChildren(0, rightSibling.NumberOfChildren())
-	children[0].Key = key
-	nlc.InsertChildren(nlc.NumberOfChildren(), children)
+	child := parent.RemoveChildren(index+1, 1)[0]
+	parent.AddChildRecordCount(index, child.RecordCount)
+	compressedChildren := rightSibling.moveOutChildren(0, rightSibling.NumberOfChildren())
+	compressedChildren[0].KeySuffix = child.Key
+	nlc.insertCompressedChildren(nlc.NumberOfChildren(), compressedChildren)
 }
 
-func (nlc nonLeafController) CountChildrenForShiftingToLeft(leftSibling nonLeafController) int {
-	loadSize1 := nlc.GetLoadSize() - (nonLeafChildHeaderSize + len(nlc.GetKey(0)))
-	loadSize2 := leftSibling.GetLoadSize() + nonLeafChildHeaderSize
+func (nlc nonLeafController) CountChildrenForShiftingToLeft(parent nonLeafController, index int, leftSibling nonLeafController, maxChildSize int) int {
+	n := nlc.NumberOfChildren()
+	loadSize1 := nlc.GetLoadSize()
+	// the key in the parent is moved to the first child shifted
+	loadSize2 := leftSibling.GetLoadSize() + len(parent.GetKey(index))
 	childCount := 0
+	keySizeDelta := 0
+
+	for i := 0; i < n-1; i++ {
+		childSize := nlc.getChildSize(i)
+		loadSize1 -= childSize
+		loadSize2 += childSize
+		// the key of the new first child is moved to the parent, and the key of the new second child
+		// is decompressed
+		keySizeDelta2 := nlc.getChildSize(i+1) - nonLeafChildHeaderSize - nlc.getNextSharedKeySize(i+1)
 
-	for i := 1; ; i++ {
-		if loadSize1 < nonLeafUnderloadThreshold || loadSize2 > nonLeafOverloadThreshold {
+		if loadSize1-keySizeDelta2 < nlc.UnderloadThreshold(maxChildSize) || loadSize2 > nlc.OverloadThreshold(maxChildSize) {
+			loadSize1 += childSize
+			loadSize2 -= childSize
 			break
 		}
 
 		childCount++
+		keySizeDelta = keySizeDelta2
 
-		if loadSize1 <= loadSize2 {
+		if loadSize1-keySizeDelta <= loadSize2 {
 			break
 		}
-
-		childSize := nonLeafChildHeaderSize + len(nlc.GetKey(i))
-		loadSize1 -= childSize
-		loadSize2 += childSize
 	}
 
-	if loadSize1 > nonLeafOverloadThreshold || loadSize2 < nonLeafUnderloadThreshold {
+	loadSize1 -= keySizeDelta
+
+	if loadSize1 > nlc.OverloadThreshold(maxChildSize) || loadSize2 < nlc.UnderloadThreshold(maxChildSize) {
 		return 0
 	}
 
@@ -231,38 +245,49 @@ func (nlc nonLeafController) CountChildrenForShiftingToLeft(leftSibling nonLeafC
 }
 
 func (nlc nonLeafController) ShiftToLeft(numberOfChildren int, parent nonLeafController, index int, leftSibling nonLeafController) {
-	children := nlc.RemoveChildren(0, numberOfChildren)
-	children[0].Key = copyBytes(parent.GetKey(index))
+	compressedChildren := nlc.moveOutChildren(0, numberOfChildren)
+	compressedChildren[0].KeySuffix = copyBytes(parent.GetKey(index))
 	parent.SetKey(index, nlc.GetKey(0))
 	nlc.SetKey(0, nil)
-	leftSibling.InsertChildren(leftSibling.NumberOfChildren(), children)
+	leftSibling.insertCompressedChildren(leftSibling.NumberOfChildren(), compressedChildren)
+	recordCount := sumCompressedRecordCounts(compressedChildren)
+	parent.AddChildRecordCount(index, -recordCount)
+	parent.AddChildRecordCount(index-1, recordCount)
 }
 
-func (nlc nonLeafController) CountChildrenForShiftingToRight(rightSibling nonLeafController) int {
+func (nlc nonLeafController) CountChildrenForShiftingToRight(parent nonLeafController, index int, rightSibling nonLeafController, maxChildSize int) int {
 	n := nlc.NumberOfChildren()
-	lastChildSize := nonLeafChildHeaderSize + len(nlc.GetKey(n-1))
-	loadSize1 := nlc.GetLoadSize() - lastChildSize
-	loadSize2 := rightSibling.GetLoadSize() + nonLeafChildHeaderSize
+	loadSize1 := nlc.GetLoadSize()
+	// the key in the parent is moved to the first child of the right sibling
+	loadSize2 := rightSibling.GetLoadSize() + len(parent.GetKey(index+1))
 	childCount := 0
+	keySizeDelta := 0
 
-	for i := n - 2; ; i-- {
-		if loadSize1 < nonLeafUnderloadThreshold || loadSize2 > nonLeafOverloadThreshold {
+	for i := n - 1; i >= 1; i-- {
+		childSize := nlc.getChildSize(i)
+		loadSize1 -= childSize
+		loadSize2 += childSize
+		// the key of the first child shifted is moved to the parent, and the key of the second child
+		// shifted is decompressed
+		keySizeDelta2 := childSize - nonLeafChildHeaderSize - nlc.getNextSharedKeySize(i)
+
+		if loadSize1 < nlc.UnderloadThreshold(maxChildSize) || loadSize2-keySizeDelta2 > nlc.OverloadThreshold(maxChildSize) {
+			loadSize1 += childSize
+			loadSize2 -= childSize
 			break
 		}
 
 		childCount++
+		keySizeDelta = keySizeDelta2
 
-		if loadSize1 <= loadSize2 {
+		if loadSize1 <= loadSize2-keySizeDelta {
 			break
 		}
-
-		childSize := nonLeafChildHeaderSize + len(nlc.GetKey(i))
-		loadSize1 -= childSize
-		loadSize2 += lastChildSize
-		lastChildSize = childSize
 	}
 
-	if loadSize1 > nonLeafOverloadThreshold || loadSize2 < nonLeafUnderloadThreshold {
+	loadSize2 -= keySizeDelta
+
+	if loadSize1 > nlc.OverloadThreshold(maxChildSize) || loadSize2 < nlc.UnderloadThreshold(maxChildSize) {
 		return 0
 	}
 
@@ -270,23 +295,26 @@ func (nlc nonLeafController) CountChildrenForShiftingToRight(rightSibling nonLea
 }
 
 func (nlc nonLeafController) ShiftToRight(numberOfChildren int, parent nonLeafController, index int, rightSibling nonLeafController) {
-	children := nlc.RemoveChildren(nlc.NumberOfChildren()-numberOfChildren, numberOfChildren)
+	compressedChildren := nlc.moveOutChildren(nlc.NumberOfChildren()-numberOfChildren, numberOfChildren)
 	rightSibling.SetKey(0, parent.GetKey(index+1))
-	parent.SetKey(index+1, children[0].Key)
-	children[0].Key = nil
-	rightSibling.InsertChildren(0, children)
+	parent.SetKey(index+1, compressedChildren[0].KeySuffix)
+	compressedChildren[0].KeySuffix = nil
+	rightSibling.insertCompressedChildren(0, compressedChildren)
+	recordCount := sumCompressedRecordCounts(compressedChildren)
+	parent.AddChildRecordCount(index, -recordCount)
+	parent.AddChildRecordCount(index+1, recordCount)
 }
 
-func (nlc nonLeafController) CountChildrenForUnshiftingFromLeft(leftSibling nonLeafController) int {
-	return leftSibling.CountChildrenForShiftingToRight(nlc)
+func (nlc nonLeafController) CountChildrenForUnshiftingFromLeft(parent nonLeafController, index int, leftSibling nonLeafController, maxChildSize int) int {
+	return leftSibling.CountChildrenForShiftingToRight(parent, index-1, nlc, maxChildSize)
 }
 
 func (nlc nonLeafController) UnshiftFromLeft(numberOfChildren int, parent nonLeafController, index int, leftSibling nonLeafController) {
 	leftSibling.ShiftToRight(numberOfChildren, parent, index-1, nlc)
 }
 
-func (nlc nonLeafController) CountChildrenForUnshiftingFromRight(rightSibling nonLeafController) int {
-	return rightSibling.CountChildrenForShiftingToLeft(nlc)
+func (nlc nonLeafController) CountChildrenForUnshiftingFromRight(parent nonLeafController, index int, rightSibling nonLeafController, maxChildSize int) int {
+	return rightSibling.CountChildrenForShiftingToLeft(parent, index+1, nlc, maxChildSize)
 }
 
 func (nlc nonLeafController) UnshiftFromRight(numberOfChildren int, parent nonLeafController, index int, rightSibling nonLeafController) {
@@ -298,42 +326,308 @@ func (nlc nonLeafController) GetLoadSize() int {
 	var keysOffsetX int
 
 	if numberOfChildrenX == 0 {
-		keysOffsetX = nonLeafSize
+		keysOffsetX = len(nlc)
 	} else {
 		keysOffsetX = int(nonLeafChildHeader(nlc[nonLeafHeaderSize:]).KeyOffset())
 	}
 
 	childHeadersEndOffsetX := nonLeafHeaderSize + numberOfChildrenX*nonLeafChildHeaderSize
 	freeSpaceSize := keysOffsetX - childHeadersEndOffsetX
-	return maxNonLeafFreeSpaceSize - freeSpaceSize
+	return len(nlc) - nonLeafHeaderSize - freeSpaceSize
+}
+
+// OverloadThreshold returns the load size above which the non-leaf is
+// overloaded, the room for a child of the given maximum size is left.
+func (nlc nonLeafController) OverloadThreshold(maxChildSize int) int {
+	return len(nlc) - nonLeafHeaderSize - maxChildSize
 }
 
+// UnderloadThreshold returns the load size below which the non-leaf is
+// underloaded.
+func (nlc nonLeafController) UnderloadThreshold(maxChildSize int) int {
+	return (nlc.OverloadThreshold(maxChildSize)-maxChildSize)*3/8 + 1
+}
+
+// SetKey replaces the key of the child at the given index with the
+// given key, which is compressed against the previous key unless it's
+// a restart key. The key of the next child is compressed against the
+// given key instead.
 func (nlc nonLeafController) SetKey(childIndex int, key key) {
 	numberOfChildren := nlc.checkChildIndex(childIndex)
+	sharedKeySize := 0
+
+	if nlc.getSharedKeySize(childIndex) >= 1 {
+		sharedKeySize = getSharedPrefixSize(nlc.GetKey(childIndex-1), key)
+	}
+
+	var nextKey []byte
+
+	if childIndex+1 < numberOfChildren && nlc.getSharedKeySize(childIndex+1) >= 1 {
+		nextKey = nlc.decompressKey(childIndex+1, nil)
+	}
+
+	nlc.setCompressedKey(childIndex, key, sharedKeySize)
+
+	if nextKey != nil {
+		nlc.setCompressedKey(childIndex+1, nextKey, getSharedPrefixSize(key, nextKey))
+	}
+}
+
+// GetKey returns the key of the child at the given index. A restart
+// key refers to the non-leaf, while a compressed key is decompressed
+// into a new buffer.
+func (nlc nonLeafController) GetKey(childIndex int) key {
+	nlc.checkChildIndex(childIndex)
+
+	if nlc.getSharedKeySize(childIndex) == 0 {
+		return nlc.getKeySuffix(childIndex)
+	}
+
+	return nlc.decompressKey(childIndex, nil)
+}
+
+func (nlc nonLeafController) GetChildAddr(childIndex int) int64 {
+	nlc.checkChildIndex(childIndex)
+	childHeader := nonLeafChildHeader(nlc[nonLeafHeaderSize+childIndex*nonLeafChildHeaderSize:])
+	return childHeader.Addr()
+}
+
+func (nlc nonLeafController) SetChildAddr(childIndex int, childAddr int64) {
+	nlc.checkChildIndex(childIndex)
+	childHeader := nonLeafChildHeader(nlc[nonLeafHeaderSize+childIndex*nonLeafChildHeaderSize:])
+	childHeader.SetAddr(childAddr)
+	checksum.Update(nlc)
+}
+
+// GetChildRecordCount returns the number of the records in the subtree
+// of the child at the given index.
+func (nlc nonLeafController) GetChildRecordCount(childIndex int) int {
+	nlc.checkChildIndex(childIndex)
+	childHeader := nonLeafChildHeader(nlc[nonLeafHeaderSize+childIndex*nonLeafChildHeaderSize:])
+	return int(childHeader.RecordCount())
+}
+
+func (nlc nonLeafController) SetChildRecordCount(childIndex int, recordCount int) {
+	nlc.checkChildIndex(childIndex)
+	childHeader := nonLeafChildHeader(nlc[nonLeafHeaderSize+childIndex*nonLeafChildHeaderSize:])
+	childHeader.SetRecordCount(int64(recordCount))
+	checksum.Update(nlc)
+}
+
+func (nlc nonLeafController) AddChildRecordCount(childIndex int, recordCountDelta int) {
+	nlc.SetChildRecordCount(childIndex, nlc.GetChildRecordCount(childIndex)+recordCountDelta)
+}
+
+// IsValid reports whether the offsets of the keys, and the sizes of
+// the shared key prefixes, in the non-leaf are well-formed.
+func (nlc nonLeafController) IsValid() bool {
+	numberOfChildren := nlc.NumberOfChildren()
+	keysOffset := nonLeafHeaderSize + numberOfChildren*nonLeafChildHeaderSize
+	keySize := 0
+	runLength := 0
+
+	for i := 0; i < numberOfChildren; i++ {
+		childHeader := nonLeafChildHeader(nlc[nonLeafHeaderSize+i*nonLeafChildHeaderSize:])
+		keyOffset := int(childHeader.KeyOffset())
+
+		if keyOffset < keysOffset {
+			return false
+		}
+
+		if i >= 1 {
+			keySize = nlc.getSharedKeySize(i-1) + keyOffset - keysOffset
+		}
+
+		if sharedKeySize := int(childHeader.SharedKeySize()); sharedKeySize == 0 {
+			runLength = 1
+		} else {
+			if sharedKeySize > keySize || runLength == keyRestartInterval {
+				return false
+			}
+
+			runLength++
+		}
+
+		keysOffset = keyOffset
+	}
+
+	return keysOffset <= len(nlc)
+}
+
+func (nlc nonLeafController) NumberOfChildren() int {
+	return int(nonLeafHeader(nlc).ChildCount())
+}
+
+func (nlc nonLeafController) checkChildIndex(childIndex int) int {
+	numberOfChildren := nlc.NumberOfChildren()
+
+	if childIndex < 0 || childIndex > numberOfChildren {
+		panic(errOutOfRange)
+	}
+
+	return numberOfChildren
+}
+
+// insertCompressedChildren inserts the given children, with the keys
+// compressed already, at the given index, leaving the key of the next
+// child as is.
+func (nlc nonLeafController) insertCompressedChildren(firstChildIndex int, compressedChildren []compressedNonLeafChild) {
+	numberOfChildrenX := nlc.checkChildIndex(firstChildIndex)
+	childHeadersOffset := nonLeafHeaderSize + firstChildIndex*nonLeafChildHeaderSize
+	childHeadersEndOffsetX := nonLeafHeaderSize + numberOfChildrenX*nonLeafChildHeaderSize
+	childHeadersSize := len(compressedChildren) * nonLeafChildHeaderSize
+	var keysOffsetX int
+
+	if numberOfChildrenX == 0 {
+		keysOffsetX = len(nlc)
+	} else {
+		keysOffsetX = int(nonLeafChildHeader(nlc[nonLeafHeaderSize:]).KeyOffset())
+	}
+
+	var keysEndOffset int
+
+	if childHeadersOffset == childHeadersEndOffsetX {
+		keysEndOffset = len(nlc)
+	} else {
+		keysEndOffset = int(nonLeafChildHeader(nlc[childHeadersOffset:]).KeyOffset())
+	}
+
+	keysSize := 0
+
+	for _, compressedChild := range compressedChildren {
+		keysSize += len(compressedChild.KeySuffix)
+	}
+
+	nlc.doInsertChildren(
+		childHeadersOffset,
+		childHeadersEndOffsetX,
+		childHeadersSize,
+		keysOffsetX,
+		keysEndOffset,
+		keysSize,
+		compressedChildren,
+	)
+
+	nonLeafHeader(nlc).SetChildCount(int32(numberOfChildrenX + len(compressedChildren)))
+	checksum.Update(nlc)
+}
+
+// removeCompressedChildren removes the given number of the children at
+// the given index and then returns them, with the keys compressed,
+// leaving the key of the next child as is.
+func (nlc nonLeafController) removeCompressedChildren(firstChildIndex int, numberOfChildren int) []compressedNonLeafChild {
+	numberOfChildrenX := nlc.NumberOfChildren()
+	childHeadersOffset := nonLeafHeaderSize + firstChildIndex*nonLeafChildHeaderSize
+	childHeadersSize := numberOfChildren * nonLeafChildHeaderSize
+	childHeadersEndOffset := childHeadersOffset + childHeadersSize
+	childHeadersEndOffsetX := nonLeafHeaderSize + numberOfChildrenX*nonLeafChildHeaderSize
 	keysOffsetX := int(nonLeafChildHeader(nlc[nonLeafHeaderSize:]).KeyOffset())
-	childHeaderOffset := nonLeafHeaderSize + childIndex*nonLeafChildHeaderSize
-	childHeader := nonLeafChildHeader(nlc[childHeaderOffset:])
-	keyOffset := int(childHeader.KeyOffset())
-	var keyEndOffset int
+	keysOffset := int(nonLeafChildHeader(nlc[childHeadersOffset:]).KeyOffset())
+	var keysEndOffset int
 
-	if childIndex+1 == numberOfChildren {
-		keyEndOffset = nonLeafSize
+	if childHeadersEndOffset == childHeadersEndOffsetX {
+		keysEndOffset = len(nlc)
 	} else {
-		keyEndOffset = int(nonLeafChildHeader(nlc[childHeaderOffset+nonLeafChildHeaderSize:]).KeyOffset())
+		keysEndOffset = int(nonLeafChildHeader(nlc[childHeadersEndOffset:]).KeyOffset())
+	}
+
+	keysSize := keysEndOffset - keysOffset
+
+	compressedChildren := nlc.doRemoveChildren(
+		numberOfChildren,
+		childHeadersEndOffset,
+		childHeadersEndOffsetX,
+		childHeadersSize,
+		keysOffsetX,
+		keysOffset,
+		keysSize,
+	)
+
+	nonLeafHeader(nlc).SetChildCount(int32(numberOfChildrenX - numberOfChildren))
+	checksum.Update(nlc)
+	return compressedChildren
+}
+
+// moveOutChildren removes the given number of the children at the
+// given index, which are the first or last children, and then returns
+// them with the keys of the first two decompressed, so that the key of
+// the first child can be moved to the parent and the children can be
+// inserted into a sibling as is. The keys of the new first two children
+// are decompressed as well.
+func (nlc nonLeafController) moveOutChildren(firstChildIndex int, numberOfChildren int) []compressedNonLeafChild {
+	n := nlc.NumberOfChildren()
+	key1 := nlc.decompressKey(firstChildIndex, nil)
+	var key2 key
+
+	if numberOfChildren >= 2 {
+		key2 = nlc.decompressKey(firstChildIndex+1, nil)
+	}
+
+	var nextKey1, nextKey2 key
+
+	if firstChildIndex == 0 && numberOfChildren < n {
+		nextKey1 = nlc.decompressKey(numberOfChildren, nil)
+
+		if numberOfChildren+1 < n {
+			nextKey2 = nlc.decompressKey(numberOfChildren+1, nil)
+		}
+	}
+
+	compressedChildren := nlc.removeCompressedChildren(firstChildIndex, numberOfChildren)
+	compressedChildren[0].SharedKeySize, compressedChildren[0].KeySuffix = 0, key1
+
+	if numberOfChildren >= 2 {
+		compressedChildren[1].SharedKeySize, compressedChildren[1].KeySuffix = 0, key2
 	}
 
-	keySizeDelta := len(key) - (keyEndOffset - keyOffset)
+	if firstChildIndex == 0 && numberOfChildren < n {
+		nlc.setCompressedKey(0, nextKey1, 0)
+
+		if numberOfChildren+1 < n {
+			nlc.setCompressedKey(1, nextKey2, 0)
+		}
+	}
+
+	return compressedChildren
+}
+
+// decompressKey decompresses the key of the child at the given index
+// into the given buffer, from the restart key of the run, and returns
+// the key.
+func (nlc nonLeafController) decompressKey(childIndex int, buffer []byte) key {
+	restartChildIndex := nlc.getRestartChildIndex(childIndex)
+	buffer = append(buffer[:0], nlc.getKeySuffix(restartChildIndex)...)
+
+	for i := restartChildIndex + 1; i <= childIndex; i++ {
+		buffer = append(buffer[:nlc.getSharedKeySize(i)], nlc.getKeySuffix(i)...)
+	}
+
+	return buffer
+}
+
+// setCompressedKey replaces the key of the child at the given index
+// with the given key, of which the prefix of the given size is shared
+// with the previous key.
+func (nlc nonLeafController) setCompressedKey(childIndex int, key key, sharedKeySize int) {
+	keysOffsetX := int(nonLeafChildHeader(nlc[nonLeafHeaderSize:]).KeyOffset())
+	childHeaderOffset := nonLeafHeaderSize + childIndex*nonLeafChildHeaderSize
+	keyOffset := int(nonLeafChildHeader(nlc[childHeaderOffset:]).KeyOffset())
+	keySuffix := key[sharedKeySize:]
+	keySuffixSizeDelta := len(keySuffix) - len(nlc.getKeySuffix(childIndex))
 
 	nlc.doSetKey(
 		keysOffsetX,
 		keyOffset,
-		keySizeDelta,
-		key,
+		keySuffixSizeDelta,
+		keySuffix,
 		childHeaderOffset,
 	)
+
+	nonLeafChildHeader(nlc[childHeaderOffset:]).SetSharedKeySize(uint16(sharedKeySize))
+	checksum.Update(nlc)
 }
 
-func (nlc nonLeafController) GetKey(childIndex int) key {
+func (nlc nonLeafController) getKeySuffix(childIndex int) key {
 	numberOfChildren := nlc.checkChildIndex(childIndex)
 	childHeaderOffset := nonLeafHeaderSize + childIndex*nonLeafChildHeaderSize
 	childHeader := nonLeafChildHeader(nlc[childHeaderOffset:])
@@ -341,7 +635,7 @@ func (nlc nonLeafController) GetKey(childIndex int) key {
 	var keyEndOffset int
 
 	if childIndex+1 == numberOfChildren {
-		keyEndOffset = nonLeafSize
+		keyEndOffset = len(nlc)
 	} else {
 		keyEndOffset = int(nonLeafChildHeader(nlc[childHeaderOffset+nonLeafChildHeaderSize:]).KeyOffset())
 	}
@@ -349,24 +643,46 @@ func (nlc nonLeafController) GetKey(childIndex int) key {
 	return key(nlc[keyOffset:keyEndOffset])
 }
 
-func (nlc nonLeafController) GetChildAddr(childIndex int) int64 {
-	nlc.checkChildIndex(childIndex)
-	childHeader := nonLeafChildHeader(nlc[nonLeafHeaderSize+childIndex*nonLeafChildHeaderSize:])
-	return childHeader.Addr()
+func (nlc nonLeafController) getSharedKeySize(childIndex int) int {
+	return int(nonLeafChildHeader(nlc[nonLeafHeaderSize+childIndex*nonLeafChildHeaderSize:]).SharedKeySize())
 }
 
-func (nlc nonLeafController) NumberOfChildren() int {
-	return int(nonLeafHeader(nlc).ChildCount())
+// getNextSharedKeySize returns the size of the prefix which the key
+// of the child after the child at the given index shares, 0 for the
+// last child.
+func (nlc nonLeafController) getNextSharedKeySize(childIndex int) int {
+	if childIndex+1 == nlc.NumberOfChildren() {
+		return 0
+	}
+
+	return nlc.getSharedKeySize(childIndex + 1)
 }
 
-func (nlc nonLeafController) checkChildIndex(childIndex int) int {
-	numberOfChildren := nlc.NumberOfChildren()
+func (nlc nonLeafController) getChildSize(childIndex int) int {
+	return nonLeafChildHeaderSize + len(nlc.getKeySuffix(childIndex))
+}
 
-	if childIndex < 0 || childIndex > numberOfChildren {
-		panic(errOutOfRange)
+// getRestartChildIndex returns the index of the child with the restart
+// key of the run which the child at the given index is in.
+func (nlc nonLeafController) getRestartChildIndex(childIndex int) int {
+	for childIndex >= 1 && nlc.getSharedKeySize(childIndex) >= 1 {
+		childIndex--
 	}
 
-	return numberOfChildren
+	return childIndex
+}
+
+// countCompressedKeys returns the number of the compressed keys of the
+// children from the given index to the end of the run.
+func (nlc nonLeafController) countCompressedKeys(childIndex int) int {
+	n := nlc.NumberOfChildren()
+	i := childIndex
+
+	for i < n && nlc.getSharedKeySize(i) >= 1 {
+		i++
+	}
+
+	return i - childIndex
 }
 
 func (nlc nonLeafController) doInsertChildren(
@@ -376,7 +692,7 @@ func (nlc nonLeafController) doInsertChildren(
 	keysOffsetX int,
 	keysEndOffset int,
 	keysSize int,
-	children []nonLeafChild,
+	compressedChildren []compressedNonLeafChild,
 ) {
 	copy(nlc[childHeadersOffset+childHeadersSize:], nlc[childHeadersOffset:childHeadersEndOffsetX])
 	copy(nlc[keysOffsetX-keysSize:], nlc[keysOffsetX:keysEndOffset])
@@ -389,14 +705,16 @@ func (nlc nonLeafController) doInsertChildren(
 
 	keysOffset := keysEndOffset - keysSize
 
-	for _, child := range children {
+	for _, compressedChild := range compressedChildren {
 		keyOffset := keysOffset
-		keysOffset += copy(nlc[keysOffset:], child.Key)
+		keysOffset += copy(nlc[keysOffset:], compressedChild.KeySuffix)
 		childHeaderOffset := childHeadersOffset
 		childHeadersOffset += nonLeafChildHeaderSize
 		childHeader := nonLeafChildHeader(nlc[childHeaderOffset:])
 		childHeader.SetKeyOffset(int32(keyOffset))
-		childHeader.SetAddr(child.Addr)
+		childHeader.SetAddr(compressedChild.Addr)
+		childHeader.SetRecordCount(int64(compressedChild.RecordCount))
+		childHeader.SetSharedKeySize(uint16(compressedChild.SharedKeySize))
 	}
 }
 
@@ -408,10 +726,10 @@ func (nlc nonLeafController) doRemoveChildren(
 	keysOffsetX int,
 	keysOffset int,
 	keysSize int,
-) []nonLeafChild {
+) []compressedNonLeafChild {
 	childHeadersOffset := childHeadersEndOffset - childHeadersSize
 	keys := make([]byte, keysSize)
-	children := make([]nonLeafChild, 0, numberOfChildren)
+	compressedChildren := make([]compressedNonLeafChild, 0, numberOfChildren)
 
 	for i := childHeadersOffset; i < childHeadersEndOffset; i += nonLeafChildHeaderSize {
 		childHeader := nonLeafChildHeader(nlc[i:])
@@ -419,15 +737,15 @@ func (nlc nonLeafController) doRemoveChildren(
 		var keyEndOffset int
 
 		if j := i + nonLeafChildHeaderSize; j == childHeadersEndOffsetX {
-			keyEndOffset = nonLeafSize
+			keyEndOffset = len(nlc)
 		} else {
 			keyEndOffset = int(nonLeafChildHeader(nlc[j:]).KeyOffset())
 		}
 
-		key := keys[:keyEndOffset-keyOffset]
-		keys = keys[len(key):]
-		copy(key, nlc[keyOffset:])
-		children = append(children, nonLeafChild{key, childHeader.Addr()})
+		keySuffix := keys[:keyEndOffset-keyOffset]
+		keys = keys[len(keySuffix):]
+		copy(keySuffix, nlc[keyOffset:])
+		compressedChildren = append(compressedChildren, compressedNonLeafChild{int(childHeader.SharedKeySize()), keySuffix, childHeader.Addr(), int(childHeader.RecordCount())})
 	}
 
 	copy(nlc[childHeadersEndOffset-childHeadersSize:], nlc[childHeadersEndOffset:childHeadersEndOffsetX])
@@ -439,7 +757,7 @@ func (nlc nonLeafController) doRemoveChildren(
 		childHeader.SetKeyOffset(int32(keyOffset + keysSize))
 	}
 
-	return children
+	return compressedChildren
 }
 
 func (nlc nonLeafController) doSetKey(
@@ -460,21 +778,68 @@ func (nlc nonLeafController) doSetKey(
 }
 
 type nonLeafChild struct {
-	Key  key
-	Addr int64
+	Key         key
+	Addr        int64
+	RecordCount int
+}
+
+// compressedNonLeafChild represents a child with the key compressed,
+// of which only the suffix following the shared prefix is kept.
+type compressedNonLeafChild struct {
+	SharedKeySize int
+	KeySuffix     key
+	Addr          int64
+	RecordCount   int
+}
+
+// decompressChildren returns the given children with the keys
+// decompressed, the key of the first child is given as is.
+func decompressChildren(firstKey key, compressedChildren []compressedNonLeafChild) []nonLeafChild {
+	children := make([]nonLeafChild, len(compressedChildren))
+	key := firstKey
+
+	for i, compressedChild := range compressedChildren {
+		if i >= 1 {
+			sharedKeySize := compressedChild.SharedKeySize
+			key = append(key[:sharedKeySize:sharedKeySize], compressedChild.KeySuffix...)
+		}
+
+		children[i] = nonLeafChild{key, compressedChild.Addr, compressedChild.RecordCount}
+	}
+
+	return children
 }
 
+func sumCompressedRecordCounts(compressedChildren []compressedNonLeafChild) int {
+	recordCount := 0
+
+	for i := range compressedChildren {
+		recordCount += compressedChildren[i].RecordCount
+	}
+
+	return recordCount
+}
+
+// nonLeafHeader starts with the checksum of the non-leaf (see package checksum).
 type nonLeafHeader []byte
 
 func (nlh nonLeafHeader) SetChildCount(value int32) {
-	binary.BigEndian.PutUint32(nlh[0:], uint32(value))
+	binary.BigEndian.PutUint32(nlh[4:], uint32(value))
 }
 
 func (nlh nonLeafHeader) ChildCount() int32 {
-	return int32(binary.BigEndian.Uint32(nlh[0:]))
+	return int32(binary.BigEndian.Uint32(nlh[4:]))
+}
+
+func (nlh nonLeafHeader) SetGeneration(value int64) {
+	binary.BigEndian.PutUint64(nlh[8:], uint64(value))
+}
+
+func (nlh nonLeafHeader) Generation() int64 {
+	return int64(binary.BigEndian.Uint64(nlh[8:]))
 }
 
-const nonLeafHeaderSize = 4
+const nonLeafHeaderSize = 16
 
 type nonLeafChildHeader []byte
 
@@ -494,4 +859,22 @@ func (nlch nonLeafChildHeader) Addr() int64 {
 	return int64(binary.BigEndian.Uint64(nlch[4:]))
 }
 
-const nonLeafChildHeaderSize = 12
+func (nlch nonLeafChildHeader) SetRecordCount(value int64) {
+	binary.BigEndian.PutUint64(nlch[12:], uint64(value))
+}
+
+func (nlch nonLeafChildHeader) RecordCount() int64 {
+	return int64(binary.BigEndian.Uint64(nlch[12:]))
+}
+
+func (nlch nonLeafChildHeader) SetSharedKeySize(value uint16) {
+	binary.BigEndian.PutUint16(nlch[20:], value)
+}
+
+// SharedKeySize returns the size of the prefix the key shares with
+// the previous key, which is elided, 0 for a restart key.
+func (nlch nonLeafChildHeader) SharedKeySize() uint16 {
+	return binary.BigEndian.Uint16(nlch[20:])
+}
+
+const nonLeafChildHeaderSize = 22
@@ -9,7 +9,7 @@ import (
 )
 
 func TestNonLeafInsertChildren(t *testing.T) {
-	nlc := nonLeafController(make([]byte, nonLeafSize))
+	nlc := nonLeafController(make([]byte, DefaultPageSize))
 	v2k := [...]key{
 		[]byte("a"),
 		[]byte("bb"),
@@ -21,23 +21,28 @@ func TestNonLeafInsertChildren(t *testing.T) {
 
 	assert.Equal(t, "", dumpNonLeaf(nlc))
 	nlc.InsertChildren(0, []nonLeafChild{
-		{v2k[0], 0},
+		{v2k[0], 0, 0},
 	})
 	nlc.InsertChildren(1, []nonLeafChild{
-		{v2k[3], 3},
-		{v2k[4], 4},
-		{v2k[5], 5},
+		{v2k[3], 3, 3},
+		{v2k[4], 4, 4},
+		{v2k[5], 5, 5},
 	})
 	nlc.InsertChildren(1, []nonLeafChild{
-		{v2k[1], 1},
-		{v2k[2], 2},
+		{v2k[1], 1, 1},
+		{v2k[2], 2, 2},
 	})
 	assert.Equal(t, len(v2k), nlc.NumberOfChildren())
 	assert.Equal(t, "a:0,bb:1,ccc:2,dddd:3,eeeee:4,ffffff:5", dumpNonLeaf(nlc))
+	for i := 0; i < len(v2k); i++ {
+		assert.Equal(t, i, nlc.GetChildRecordCount(i))
+	}
+	nlc.AddChildRecordCount(2, 10)
+	assert.Equal(t, 12, nlc.GetChildRecordCount(2))
 }
 
 func TestNonLeafDeleteChildren(t *testing.T) {
-	nlc := nonLeafController(make([]byte, nonLeafSize))
+	nlc := nonLeafController(make([]byte, DefaultPageSize))
 	v2k := [...]key{
 		[]byte("a"),
 		[]byte("bb"),
@@ -48,7 +53,7 @@ func TestNonLeafDeleteChildren(t *testing.T) {
 	}
 	for v, k := range v2k {
 		nlc.InsertChildren(v, []nonLeafChild{
-			{k, int64(v)},
+			{k, int64(v), v},
 		})
 	}
 
@@ -61,6 +66,8 @@ func TestNonLeafDeleteChildren(t *testing.T) {
 
 	c = nlc.RemoveChildren(1, 2)
 	assert.Equal(t, "ccc:2,dddd:3", dumpNonLeafChildren(c))
+	assert.Equal(t, 2, c[0].RecordCount)
+	assert.Equal(t, 3, c[1].RecordCount)
 	assert.Equal(t, "bb:1,eeeee:4,ffffff:5", dumpNonLeaf(nlc))
 
 	c = nlc.RemoveChildren(2, 1)
@@ -73,7 +80,7 @@ func TestNonLeafDeleteChildren(t *testing.T) {
 }
 
 func TestNonLeafLocateChild(t *testing.T) {
-	nlc := nonLeafController(make([]byte, nonLeafSize))
+	nlc := nonLeafController(make([]byte, DefaultPageSize))
 	v2k := [...]key{
 		[]byte("a"),
 		[]byte("bb"),
@@ -84,16 +91,16 @@ func TestNonLeafLocateChild(t *testing.T) {
 	}
 	for v, k := range v2k {
 		nlc.InsertChildren(v, []nonLeafChild{
-			{k, int64(v)},
+			{k, int64(v), v},
 		})
 	}
-	_, ok := nlc.LocateChild([]byte("a"), keyComparer{})
+	_, ok := nlc.LocateChild([]byte("a"), keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 	assert.False(t, ok)
 	for v, k := range v2k {
 		if v == 0 {
 			continue
 		}
-		i, ok := nlc.LocateChild(k, keyComparer{})
+		i, ok := nlc.LocateChild(k, keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 		if assert.True(t, ok) {
 			assert.Equal(t, v, i)
 		}
@@ -102,7 +109,7 @@ func TestNonLeafLocateChild(t *testing.T) {
 		if v == 0 {
 			continue
 		}
-		i, ok := nlc.LocateChild(k[:len(k)-1], keyComparer{})
+		i, ok := nlc.LocateChild(k[:len(k)-1], keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 		if assert.False(t, ok) {
 			assert.Equal(t, v, i)
 		}
@@ -111,7 +118,7 @@ func TestNonLeafLocateChild(t *testing.T) {
 		if v == 0 {
 			continue
 		}
-		i, ok := nlc.LocateChild(key(string(k)+string(k[len(k)-1:])), keyComparer{})
+		i, ok := nlc.LocateChild(key(string(k)+string(k[len(k)-1:])), keyComparer{KeyComparer: BytewiseKeyComparer, MaxKeySize: maxKeySize})
 		if assert.False(t, ok) {
 			assert.Equal(t, v+1, i)
 		}
@@ -119,7 +126,7 @@ func TestNonLeafLocateChild(t *testing.T) {
 }
 
 func TestLeafSetKey(t *testing.T) {
-	nlc := nonLeafController(make([]byte, nonLeafSize))
+	nlc := nonLeafController(make([]byte, DefaultPageSize))
 	v2k := [...]key{
 		[]byte("a"),
 		[]byte("bb"),
@@ -130,7 +137,7 @@ func TestLeafSetKey(t *testing.T) {
 	}
 	for v, k := range v2k {
 		nlc.InsertChildren(v, []nonLeafChild{
-			{k, int64(v)},
+			{k, int64(v), v},
 		})
 	}
 	for v, k := range v2k {
@@ -139,11 +146,40 @@ func TestLeafSetKey(t *testing.T) {
 	assert.Equal(t, "aa:0,bbbb:1,cccccc:2,dddddddd:3,eeeeeeeeee:4,ffffffffffff:5", dumpNonLeaf(nlc))
 }
 
+func TestNonLeafCompressKeys(t *testing.T) {
+	nlc := nonLeafController(make([]byte, DefaultPageSize))
+	nlc.InsertChildren(0, []nonLeafChild{
+		{nil, 0, 0},
+		{key("tenant-1/a"), 1, 1},
+		{key("tenant-1/c"), 3, 3},
+	})
+	nlc.InsertChildren(2, []nonLeafChild{
+		{key("tenant-1/b"), 2, 2},
+	})
+	assert.Equal(t, ":0,tenant-1/a:1,tenant-1/b:2,tenant-1/c:3", dumpNonLeaf(nlc))
+	assert.Equal(t, 4*nonLeafChildHeaderSize+10+1+1, nlc.GetLoadSize())
+	assert.True(t, nlc.IsValid())
+
+	nlc.SetKey(2, key("tenant-1/bb"))
+	assert.Equal(t, ":0,tenant-1/a:1,tenant-1/bb:2,tenant-1/c:3", dumpNonLeaf(nlc))
+	assert.Equal(t, 4*nonLeafChildHeaderSize+10+2+1, nlc.GetLoadSize())
+	nlc.SetKey(1, key("tenant-0/z"))
+	assert.Equal(t, ":0,tenant-0/z:1,tenant-1/bb:2,tenant-1/c:3", dumpNonLeaf(nlc))
+	assert.Equal(t, 4*nonLeafChildHeaderSize+10+4+1, nlc.GetLoadSize())
+	assert.True(t, nlc.IsValid())
+
+	c := nlc.RemoveChildren(1, 2)
+	assert.Equal(t, "tenant-0/z:1,tenant-1/bb:2", dumpNonLeafChildren(c))
+	assert.Equal(t, ":0,tenant-1/c:3", dumpNonLeaf(nlc))
+	assert.Equal(t, 2*nonLeafChildHeaderSize+10, nlc.GetLoadSize())
+	assert.True(t, nlc.IsValid())
+}
+
 func TestNonLeafGetLoadSize(t *testing.T) {
-	nlc := nonLeafController(make([]byte, nonLeafSize))
+	nlc := nonLeafController(make([]byte, DefaultPageSize))
 	assert.Equal(t, 0, nlc.GetLoadSize())
 	nlc.InsertChildren(0, []nonLeafChild{
-		{[]byte("123"), int64(123)},
+		{[]byte("123"), int64(123), 123},
 	})
 	assert.Equal(t, nonLeafChildHeaderSize+3, nlc.GetLoadSize())
 	nlc.RemoveChildren(0, 1)
@@ -0,0 +1,6 @@
+//go:build race
+// +build race
+
+package bptree_test
+
+const RaceEnabled = true
@@ -0,0 +1,98 @@
+package bptree
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Rank returns the number of the records with keys less than the
+// given key in the B+ tree, and whether a record with an identical
+// key exists in the B+ tree, in which case the number is the rank of
+// the record (starting from 0).
+// It takes O(log n) time, with the record counts of the subtrees kept
+// in the non-leaves.
+func (bpt *BPTree) Rank(key []byte) (_ int, _ bool, err error) {
+	defer corruption.Recover(&err)
+	recordPath, ok := bpt.findRecord(key)
+	return bpt.rankRecord(recordPath), ok, nil
+}
+
+// Select returns the key of the record with the given rank (starting
+// from 0) in the B+ tree.
+// If the rank is within [0, n) where n is the number of the records,
+// it returns the key and true, otherwise it returns false.
+// It takes O(log n) time, with the record counts of the subtrees kept
+// in the non-leaves.
+func (bpt *BPTree) Select(rank int) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
+
+	if rank < 0 || rank >= bpt.recordCount {
+		return nil, false, nil
+	}
+
+	nodeAddr := bpt.rootAddr
+
+	for nodeDepth := 1; nodeDepth < bpt.height; nodeDepth++ {
+		nonLeafController := bpt.getNonLeafController(nodeAddr)
+		i, n := 0, nonLeafController.NumberOfChildren()
+
+		for ; i < n-1; i++ {
+			recordCount := nonLeafController.GetChildRecordCount(i)
+
+			if rank < recordCount {
+				break
+			}
+
+			rank -= recordCount
+		}
+
+		nodeAddr = nonLeafController.GetChildAddr(i)
+	}
+
+	leafController := bpt.getLeafController(nodeAddr)
+
+	if rank >= leafController.NumberOfRecords() {
+		corruption.Panicf(nodeAddr, "record #%d not found", rank)
+	}
+
+	return keyFactory{bpt.fileStorage, bpt.maxKeySize}.ReadKeyAll(leafController.GetKey(rank)), true, nil
+}
+
+// CountRange returns the number of the records with keys in the range
+// between the given bounds in the B+ tree, each of which may be
+// inclusive, exclusive or unbounded.
+// Rather than iterating over the records, it takes the ranks of the
+// first and last records in the range, in O(log n) time.
+func (bpt *BPTree) CountRange(minBound Bound, maxBound Bound) (_ int, err error) {
+	defer corruption.Recover(&err)
+
+	if bpt.recordCount == 0 {
+		return 0, nil
+	}
+
+	minBound = bpt.resolveBound(minBound, false)
+	maxBound = bpt.resolveBound(maxBound, true)
+	firstRecordPath, lastRecordPath, ok := bpt.searchRange(minBound, maxBound)
+
+	if !ok {
+		return 0, nil
+	}
+
+	return bpt.rankRecord(lastRecordPath) - bpt.rankRecord(firstRecordPath) + 1, nil
+}
+
+// rankRecord returns the number of the records before the position
+// which the given record path refers to.
+func (bpt *BPTree) rankRecord(recordPath recordPath) int {
+	n := len(recordPath)
+	rank := recordPath[n-1].RecordOrNonLeafChildIndex
+
+	for i := 0; i < n-1; i++ {
+		nonLeafController := bpt.getNonLeafController(recordPath[i].NodeAddr)
+
+		for j := 0; j < recordPath[i].RecordOrNonLeafChildIndex; j++ {
+			rank += nonLeafController.GetChildRecordCount(j)
+		}
+	}
+
+	return rank
+}
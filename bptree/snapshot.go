@@ -0,0 +1,388 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Snapshot represents a read-only view of a B+ tree at a point in time.
+// The B+ tree can be modified while the snapshot lives, the nodes visible
+// to the snapshot are copied on write, and the spaces visible to the
+// snapshot are freed only once the snapshot is released.
+type Snapshot struct {
+	bpTree     *BPTree
+	view       BPTree
+	generation int64
+	isReleased bool
+}
+
+// TakeSnapshot takes a snapshot of the B+ tree.
+// The snapshot should be released once it's no longer needed.
+func (bpt *BPTree) TakeSnapshot() *Snapshot {
+	snapshot := &Snapshot{
+		bpTree: bpt,
+
+		view: BPTree{
+			fileStorage:  bpt.fileStorage,
+			options:      bpt.options,
+			pageSize:     bpt.pageSize,
+			maxKeySize:   bpt.maxKeySize,
+			maxValueSize: bpt.maxValueSize,
+			rootAddr:     bpt.rootAddr,
+			height:       bpt.height,
+			leafList:     bpt.leafList,
+			leafCount:    bpt.leafCount,
+			nonLeafCount: bpt.nonLeafCount,
+			recordCount:  bpt.recordCount,
+			payloadSize:  bpt.payloadSize,
+		},
+
+		generation: bpt.generation,
+	}
+
+	bpt.generation++
+	bpt.snapshots = append(bpt.snapshots, snapshot)
+	return snapshot
+}
+
+// Release releases the snapshot, the spaces no longer visible to any
+// snapshot are freed.
+// If the snapshot has been released it does nothing.
+func (s *Snapshot) Release() {
+	if s.isReleased {
+		return
+	}
+
+	s.isReleased = true
+	s.bpTree.removeSnapshot(s)
+}
+
+// IsReleased indicates if the snapshot has been released, either by
+// Release or by storing the B+ tree.
+func (s *Snapshot) IsReleased() bool {
+	return s.isReleased
+}
+
+// HasRecord checks whether a record with the given key
+// in the snapshot.
+// If a record with an identical key exists in the snapshot,
+// it returns true and the present value (optional) of the
+// record, otherwise it returns flase.
+func (s *Snapshot) HasRecord(key []byte, returnPresentValue bool) ([]byte, bool, error) {
+	s.checkReleased()
+	return s.view.HasRecord(key, returnPresentValue)
+}
+
+// SearchForward searchs the the snapshot for records with
+// keys in the given range [minKey...maxKey].
+// It returns an iterator to iterate over the records found
+// in ascending order.
+func (s *Snapshot) SearchForward(minKey []byte, maxKey []byte) Iterator {
+	s.checkReleased()
+	minRecordPath, maxRecordPath, ok, err := s.view.trySearchRange(makeBound(minKey), makeBound(maxKey))
+
+	if err != nil {
+		snapshotForwardIterator := new(snapshotForwardIterator).Init(&s.view, nil, 0, 0, true)
+		snapshotForwardIterator.err = err
+		return snapshotForwardIterator
+	}
+
+	if !ok {
+		return new(snapshotForwardIterator).Init(&s.view, nil, 0, 0, true)
+	}
+
+	maxLeafAddr, maxRecordIndex := maxRecordPath.LastComponent()
+	return new(snapshotForwardIterator).Init(&s.view, minRecordPath, maxLeafAddr, maxRecordIndex, false)
+}
+
+// SearchBackward searchs the the snapshot for records with
+// keys in the given range [minKey...maxKey].
+// It returns an iterator to iterate over the records found
+// in descending order.
+func (s *Snapshot) SearchBackward(minKey []byte, maxKey []byte) Iterator {
+	s.checkReleased()
+	minRecordPath, maxRecordPath, ok, err := s.view.trySearchRange(makeBound(minKey), makeBound(maxKey))
+
+	if err != nil {
+		snapshotBackwardIterator := new(snapshotBackwardIterator).Init(&s.view, nil, 0, 0, true)
+		snapshotBackwardIterator.err = err
+		return snapshotBackwardIterator
+	}
+
+	if !ok {
+		return new(snapshotBackwardIterator).Init(&s.view, nil, 0, 0, true)
+	}
+
+	minLeafAddr, minRecordIndex := minRecordPath.LastComponent()
+	return new(snapshotBackwardIterator).Init(&s.view, maxRecordPath, minLeafAddr, minRecordIndex, false)
+}
+
+// NumberOfRecords returns the number of records in the snapshot.
+func (s *Snapshot) NumberOfRecords() int {
+	return s.view.recordCount
+}
+
+// PayloadSize returns the payload size of the snapshot.
+func (s *Snapshot) PayloadSize() int {
+	return s.view.payloadSize
+}
+
+func (s *Snapshot) checkReleased() {
+	if s.isReleased {
+		panic(errSnapshotReleased)
+	}
+}
+
+func (bpt *BPTree) removeSnapshot(snapshot *Snapshot) {
+	for i, snapshot2 := range bpt.snapshots {
+		if snapshot2 == snapshot {
+			copy(bpt.snapshots[i:], bpt.snapshots[i+1:])
+			bpt.snapshots[len(bpt.snapshots)-1] = nil
+			bpt.snapshots = bpt.snapshots[:len(bpt.snapshots)-1]
+			break
+		}
+	}
+
+	pendingSpaces := bpt.pendingSpaces[:0]
+	var freeSpaces []pendingSpace
+
+	for _, pendingSpace := range bpt.pendingSpaces {
+		if bpt.isVisible(&pendingSpace) {
+			pendingSpaces = append(pendingSpaces, pendingSpace)
+		} else {
+			freeSpaces = append(freeSpaces, pendingSpace)
+		}
+	}
+
+	for i := len(pendingSpaces); i < len(bpt.pendingSpaces); i++ {
+		bpt.pendingSpaces[i] = pendingSpace{}
+	}
+
+	bpt.pendingSpaces = pendingSpaces
+	bpt.freePendingSpaces(freeSpaces)
+}
+
+// isShared indicates if a space of the given generation is visible
+// to any snapshot, a shared space mustn't be modified or freed.
+func (bpt *BPTree) isShared(generation int64) bool {
+	n := len(bpt.snapshots)
+	return n >= 1 && generation <= bpt.snapshots[n-1].generation
+}
+
+// isVisible indicates if the given space pending to be freed is
+// still visible to any snapshot.
+func (bpt *BPTree) isVisible(pendingSpace *pendingSpace) bool {
+	for _, snapshot := range bpt.snapshots {
+		if snapshot.generation >= pendingSpace.Generation && snapshot.generation < pendingSpace.FreeingGeneration {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (bpt *BPTree) addPendingSpace(addr int64, isAligned bool, generation int64) {
+	bpt.pendingSpaces = append(bpt.pendingSpaces, pendingSpace{
+		Addr:              addr,
+		IsAligned:         isAligned,
+		Generation:        generation,
+		FreeingGeneration: bpt.generation,
+	})
+}
+
+func (bpt *BPTree) freePendingSpaces(pendingSpaces []pendingSpace) {
+	for i := range pendingSpaces {
+		pendingSpace := &pendingSpaces[i]
+
+		if pendingSpace.IsAligned {
+			freeAlignedSpace(bpt.fileStorage, pendingSpace.Addr)
+		} else {
+			freeSpace(bpt.fileStorage, pendingSpace.Addr)
+		}
+	}
+}
+
+func (bpt *BPTree) storePendingSpaces() int64 {
+	if len(bpt.pendingSpaces) == 0 {
+		return -1
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	pendingSpaceInfos := make([]pendingSpaceInfo, len(bpt.pendingSpaces))
+
+	for i := range bpt.pendingSpaces {
+		pendingSpace := &bpt.pendingSpaces[i]
+		pendingSpaceInfos[i] = pendingSpaceInfo{pendingSpace.Addr, pendingSpace.IsAligned}
+	}
+
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(pendingSpaceInfos))); err != nil {
+		panic(err)
+	}
+
+	if err := binary.Write(buffer, binary.BigEndian, pendingSpaceInfos); err != nil {
+		panic(err)
+	}
+
+	pendingSpaceListAddr, buffer2 := bpt.fileStorage.AllocateSpace(buffer.Len())
+	copy(buffer2, buffer.Bytes())
+	return pendingSpaceListAddr
+}
+
+func (bpt *BPTree) loadPendingSpaces(pendingSpaceListAddr int64) []pendingSpace {
+	if pendingSpaceListAddr < 0 {
+		return nil
+	}
+
+	data := bytes.NewReader(accessSpace(bpt.fileStorage, pendingSpaceListAddr))
+	var numberOfPendingSpaces int64
+
+	if err := binary.Read(data, binary.BigEndian, &numberOfPendingSpaces); err != nil {
+		corruption.Panic(pendingSpaceListAddr)
+	}
+
+	if numberOfPendingSpaces < 0 || numberOfPendingSpaces > int64(data.Len()) {
+		corruption.Panic(pendingSpaceListAddr)
+	}
+
+	pendingSpaceInfos := make([]pendingSpaceInfo, numberOfPendingSpaces)
+
+	if err := binary.Read(data, binary.BigEndian, pendingSpaceInfos); err != nil {
+		corruption.Panic(pendingSpaceListAddr)
+	}
+
+	freeSpace(bpt.fileStorage, pendingSpaceListAddr)
+	pendingSpaces := make([]pendingSpace, len(pendingSpaceInfos))
+
+	for i := range pendingSpaceInfos {
+		pendingSpaceInfo := &pendingSpaceInfos[i]
+		pendingSpaces[i] = pendingSpace{Addr: pendingSpaceInfo.Addr, IsAligned: pendingSpaceInfo.IsAligned}
+	}
+
+	return pendingSpaces
+}
+
+func (bpt *BPTree) copyPathOnWrite(recordPath recordPath) {
+	if len(bpt.snapshots) == 0 {
+		return
+	}
+
+	n := len(recordPath)
+	nodeParentAddr := int64(-1)
+	nodeIndex := 0
+
+	for i := 0; i < n-1; i++ {
+		recordPath[i].NodeAddr = bpt.copyNonLeafOnWrite(nodeParentAddr, nodeIndex)
+		nodeParentAddr = recordPath[i].NodeAddr
+		nodeIndex = recordPath[i].RecordOrNonLeafChildIndex
+	}
+
+	recordPath[n-1].NodeAddr = bpt.copyLeafOnWrite(nodeParentAddr, nodeIndex)
+}
+
+// copyLeafOnWrite replaces the leaf at the given index of the given
+// parent (or the root if the parent address is negative) with a copy
+// of the leaf if the leaf is shared, and then returns the address of
+// the leaf which can be modified.
+func (bpt *BPTree) copyLeafOnWrite(leafParentAddr int64, leafIndex int) int64 {
+	var leafAddr int64
+
+	if leafParentAddr < 0 {
+		leafAddr = bpt.rootAddr
+	} else {
+		leafAddr = bpt.getNonLeafController(leafParentAddr).GetChildAddr(leafIndex)
+	}
+
+	if !bpt.isShared(leafHeader(bpt.getLeafController(leafAddr)).Generation()) {
+		return leafAddr
+	}
+
+	leafCopyAddr, leafCopyController := bpt.createLeaf()
+	copy(leafCopyController, bpt.getLeafController(leafAddr))
+	leafHeader(leafCopyController).SetGeneration(bpt.generation)
+	checksum.Update(leafCopyController)
+	bpt.leafList.ReplaceLeaf(leafFactory{bpt.fileStorage, bpt.pageSize}, leafCopyAddr, leafAddr)
+	bpt.destroyLeaf(leafAddr)
+
+	if leafParentAddr < 0 {
+		bpt.rootAddr = leafCopyAddr
+	} else {
+		bpt.getNonLeafController(leafParentAddr).SetChildAddr(leafIndex, leafCopyAddr)
+	}
+
+	return leafCopyAddr
+}
+
+// copyNonLeafOnWrite is the non-leaf version of copyLeafOnWrite.
+func (bpt *BPTree) copyNonLeafOnWrite(nonLeafParentAddr int64, nonLeafIndex int) int64 {
+	var nonLeafAddr int64
+
+	if nonLeafParentAddr < 0 {
+		nonLeafAddr = bpt.rootAddr
+	} else {
+		nonLeafAddr = bpt.getNonLeafController(nonLeafParentAddr).GetChildAddr(nonLeafIndex)
+	}
+
+	if !bpt.isShared(nonLeafHeader(bpt.getNonLeafController(nonLeafAddr)).Generation()) {
+		return nonLeafAddr
+	}
+
+	nonLeafCopyAddr, nonLeafCopyController := bpt.createNonLeaf()
+	copy(nonLeafCopyController, bpt.getNonLeafController(nonLeafAddr))
+	nonLeafHeader(nonLeafCopyController).SetGeneration(bpt.generation)
+	checksum.Update(nonLeafCopyController)
+	bpt.destroyNonLeaf(nonLeafAddr)
+
+	if nonLeafParentAddr < 0 {
+		bpt.rootAddr = nonLeafCopyAddr
+	} else {
+		bpt.getNonLeafController(nonLeafParentAddr).SetChildAddr(nonLeafIndex, nonLeafCopyAddr)
+	}
+
+	return nonLeafCopyAddr
+}
+
+// destroyKey destroys the given key, the overflow of the key, which
+// has no generation, is kept while there is any snapshot.
+func (bpt *BPTree) destroyKey(key key) int {
+	keyFactory := keyFactory{bpt.fileStorage, bpt.maxKeySize}
+
+	if !bpt.isShared(0) {
+		return keyFactory.DestroyKey(key)
+	}
+
+	if keyOverflowAddr, ok := keyFactory.GetKeyOverflowAddr(key); ok {
+		bpt.addPendingSpace(keyOverflowAddr, false, 0)
+	}
+
+	return keyFactory.GetRawKeySize(key)
+}
+
+// destroyValue is the value version of destroyKey.
+func (bpt *BPTree) destroyValue(value value) int {
+	valueFactory := valueFactory{bpt.fileStorage, bpt.maxValueSize}
+
+	if !bpt.isShared(0) {
+		return valueFactory.DestroyValue(value)
+	}
+
+	if valueOverflowAddr, ok := valueFactory.GetValueOverflowAddr(value); ok {
+		bpt.addPendingSpace(valueOverflowAddr, false, 0)
+	}
+
+	return valueFactory.GetRawValueSize(value)
+}
+
+type pendingSpace struct {
+	Addr              int64
+	IsAligned         bool
+	Generation        int64
+	FreeingGeneration int64
+}
+
+type pendingSpaceInfo struct {
+	Addr      int64
+	IsAligned bool
+}
@@ -0,0 +1,175 @@
+package bptree_test
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv/bptree"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	bpt, fs, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	allocatedSpaceSize := fs.Stats().AllocatedSpaceSize
+	state1 := SetRecords(bpt, map[string]string{}, 0, 20000, "a")
+	s1 := bpt.TakeSnapshot()
+	state2 := SetRecords(bpt, state1, 5000, 30000, "b")
+	state2 = DeleteRecords(bpt, state2, 0, 12000)
+	s2 := bpt.TakeSnapshot()
+	state3 := DeleteRecords(bpt, state2, 10000, 25000)
+	state3 = SetRecords(bpt, state3, 24000, 26000, "c")
+	AssertRecords(t, bpt, nil, state3)
+	assert.NoError(t, bpt.Verify())
+	AssertRecords(t, bpt, s1, state1)
+	AssertRecords(t, bpt, s2, state2)
+	s1.Release()
+	assert.True(t, s1.IsReleased())
+	AssertRecords(t, bpt, s2, state2)
+	AssertRecords(t, bpt, nil, state3)
+	s2.Release()
+	AssertRecords(t, bpt, nil, state3)
+	DeleteRecords(bpt, state3, 0, 30000)
+	assert.Equal(t, 0, bpt.NumberOfRecords())
+	assert.Equal(t, allocatedSpaceSize, fs.Stats().AllocatedSpaceSize)
+}
+
+func TestSnapshotStore(t *testing.T) {
+	bpt, fs, cleanup := MakeSmallBPTree(t)
+	defer cleanup()
+	allocatedSpaceSize := fs.Stats().AllocatedSpaceSize
+	state1 := SetRecords(bpt, map[string]string{}, 0, 10000, "a")
+	s := bpt.TakeSnapshot()
+	state2 := DeleteRecords(bpt, state1, 0, 5000)
+	bpt.Load(bpt.Store())
+	assert.True(t, s.IsReleased())
+	AssertRecords(t, bpt, nil, state2)
+	assert.NoError(t, bpt.Verify())
+	DeleteRecords(bpt, state2, 0, 10000)
+	assert.Equal(t, allocatedSpaceSize, fs.Stats().AllocatedSpaceSize)
+}
+
+func MakeSmallBPTree(t *testing.T) (*bptree.BPTree, *fsm.FileStorage, func()) {
+	const fn = "../testdata/snapshot.tmp"
+	fs := new(fsm.FileStorage).Init()
+	err := fs.Open(fn, true)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	bpt := new(bptree.BPTree).Init(fs)
+	bpt.Create()
+
+	return bpt, fs, func() {
+		bpt.Destroy()
+		fs.Close()
+		os.Remove(fn)
+	}
+}
+
+func SetRecords(bpt *bptree.BPTree, state map[string]string, i, j int, tag string) map[string]string {
+	state2 := CopyState(state)
+
+	for ; i < j; i++ {
+		k := strconv.Itoa(i)
+		v := tag + k
+
+		if i%100 == 0 {
+			v += string(bytes.Repeat([]byte{'.'}, 150))
+		}
+
+		bpt.AddOrUpdateRecord([]byte(k), []byte(v), false)
+		state2[k] = v
+	}
+
+	return state2
+}
+
+func DeleteRecords(bpt *bptree.BPTree, state map[string]string, i, j int) map[string]string {
+	state2 := CopyState(state)
+
+	for ; i < j; i++ {
+		k := strconv.Itoa(i)
+		bpt.DeleteRecord([]byte(k), false)
+		delete(state2, k)
+	}
+
+	return state2
+}
+
+func CopyState(state map[string]string) map[string]string {
+	state2 := make(map[string]string, len(state))
+
+	for k, v := range state {
+		state2[k] = v
+	}
+
+	return state2
+}
+
+func AssertRecords(t *testing.T, bpt *bptree.BPTree, s *bptree.Snapshot, state map[string]string) {
+	keys := make([]string, 0, len(state))
+
+	for k := range state {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	var it bptree.Iterator
+
+	if s == nil {
+		assert.Equal(t, len(state), bpt.NumberOfRecords())
+		it = bpt.SearchForward(bptree.MinKey, bptree.MaxKey)
+	} else {
+		assert.Equal(t, len(state), s.NumberOfRecords())
+		it = s.SearchForward(bptree.MinKey, bptree.MaxKey)
+	}
+
+	for _, k := range keys {
+		if !assert.False(t, it.IsAtEnd()) {
+			t.FailNow()
+		}
+
+		k2, v2, _ := it.ReadRecordAll()
+
+		if !assert.Equal(t, k, string(k2)) || !assert.Equal(t, state[k], string(v2)) {
+			t.FailNow()
+		}
+
+		it.Advance()
+	}
+
+	assert.True(t, it.IsAtEnd())
+
+	if s == nil {
+		return
+	}
+
+	var keys2, keys3 []string
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		if k := keys[i]; k >= "1" && k <= "2" {
+			keys2 = append(keys2, k)
+		}
+	}
+
+	for it := s.SearchBackward([]byte("1"), []byte("2")); !it.IsAtEnd(); it.Advance() {
+		k, _ := it.ReadKeyAll()
+		keys3 = append(keys3, string(k))
+	}
+
+	assert.Equal(t, keys2, keys3)
+
+	for k, v := range state {
+		v2, ok, _ := s.HasRecord([]byte(k), true)
+
+		if !assert.True(t, ok) || !assert.Equal(t, v, string(v2)) {
+			t.FailNow()
+		}
+	}
+}
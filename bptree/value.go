@@ -4,25 +4,28 @@ import (
 	"encoding/binary"
 
 	"github.com/roy2220/fsm"
-)
-
-const (
-	maxValueSize    = 129
-	valuePrefixSize = maxValueSize - 8
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
 )
 
 type value []byte
 
+// valueFactory creates and reads values. A value shorter than
+// MaxValueSize is stored as is, otherwise it's stored as its prefix
+// followed by the address of the rest, aka the value overflow, in
+// MaxValueSize bytes.
 type valueFactory struct {
-	FileStorage *fsm.FileStorage
+	FileStorage  *fsm.FileStorage
+	MaxValueSize int
 }
 
 func (vf valueFactory) CreateValue(rawValue []byte) value {
-	if len(rawValue) < maxValueSize {
+	if len(rawValue) < vf.MaxValueSize {
 		return rawValue
 	}
 
-	value := value(make([]byte, maxValueSize))
+	valuePrefixSize := vf.valuePrefixSize()
+	value := value(make([]byte, vf.MaxValueSize))
 	copy(value, rawValue[:valuePrefixSize])
 	valueOverflowAddr := vf.allocateValueOverflow(rawValue[valuePrefixSize:])
 	binary.BigEndian.PutUint64(value[valuePrefixSize:], uint64(valueOverflowAddr))
@@ -30,18 +33,18 @@ func (vf valueFactory) CreateValue(rawValue []byte) value {
 }
 
 func (vf valueFactory) DestroyValue(value value) int {
-	if n := len(value); n < maxValueSize {
+	if n := len(value); n < vf.MaxValueSize {
 		return n
 	}
 
 	valueOverflowAddr, valueOverflow := vf.getValueOverflow(value)
 	vf.freeValueOverflow(valueOverflowAddr)
-	valueSize := valuePrefixSize + len(valueOverflow)
+	valueSize := vf.valuePrefixSize() + len(valueOverflow)
 	return valueSize
 }
 
 func (vf valueFactory) ReadValue(value value, dataOffset int, buffer []byte) int {
-	if n := len(value); n < maxValueSize {
+	if n := len(value); n < vf.MaxValueSize {
 		if dataOffset >= n {
 			return 0
 		}
@@ -49,6 +52,8 @@ func (vf valueFactory) ReadValue(value value, dataOffset int, buffer []byte) int
 		return copy(buffer, value[dataOffset:])
 	}
 
+	valuePrefixSize := vf.valuePrefixSize()
+
 	if dataOffset+len(buffer) <= valuePrefixSize {
 		return copy(buffer, value[dataOffset:])
 	}
@@ -72,10 +77,11 @@ func (vf valueFactory) ReadValue(value value, dataOffset int, buffer []byte) int
 }
 
 func (vf valueFactory) ReadValueAll(value value) []byte {
-	if len(value) < maxValueSize {
+	if len(value) < vf.MaxValueSize {
 		return copyBytes(value)
 	}
 
+	valuePrefixSize := vf.valuePrefixSize()
 	_, valueOverflow := vf.getValueOverflow(value)
 	rawValue := make([]byte, valuePrefixSize+len(valueOverflow))
 	copy(rawValue, value[:valuePrefixSize])
@@ -84,37 +90,64 @@ func (vf valueFactory) ReadValueAll(value value) []byte {
 }
 
 func (vf valueFactory) GetRawValueSize(value value) int {
-	if n := len(value); n < maxValueSize {
+	if n := len(value); n < vf.MaxValueSize {
 		return n
 	}
 
 	_, valueOverflow := vf.getValueOverflow(value)
-	valueSize := valuePrefixSize + len(valueOverflow)
+	valueSize := vf.valuePrefixSize() + len(valueOverflow)
 	return valueSize
 }
 
+func (vf valueFactory) GetValueOverflowAddr(value value) (int64, bool) {
+	if len(value) < vf.MaxValueSize {
+		return 0, false
+	}
+
+	return int64(binary.BigEndian.Uint64(value[vf.valuePrefixSize():])), true
+}
+
+// valuePrefixSize returns the size of the prefix of a value stored
+// along with the address of the value overflow.
+func (vf valueFactory) valuePrefixSize() int {
+	return vf.MaxValueSize - 8
+}
+
 func (vf valueFactory) allocateValueOverflow(valueOverflow []byte) int64 {
 	valueOverflowRawSize := make([]byte, binary.MaxVarintLen64)
 	valueOverflowRawSize = valueOverflowRawSize[:binary.PutUvarint(valueOverflowRawSize, uint64(len(valueOverflow)))]
-	valueOverflowAddr, buffer := vf.FileStorage.AllocateSpace(len(valueOverflowRawSize) + len(valueOverflow))
-	i := copy(buffer, valueOverflowRawSize)
-	copy(buffer[i:], valueOverflow)
+	valueOverflowAddr, buffer := vf.FileStorage.AllocateSpace(checksum.Size + len(valueOverflowRawSize) + len(valueOverflow))
+	i := checksum.Size
+	i += copy(buffer[i:], valueOverflowRawSize)
+	i += copy(buffer[i:], valueOverflow)
+	checksum.Update(buffer[:i])
 	return valueOverflowAddr
 }
 
 func (vf valueFactory) freeValueOverflow(valueOverflowAddr int64) {
-	vf.FileStorage.FreeSpace(valueOverflowAddr)
+	freeSpace(vf.FileStorage, valueOverflowAddr)
 }
 
 func (vf valueFactory) getValueOverflow(value value) (int64, []byte) {
-	valueOverflowAddr := int64(binary.BigEndian.Uint64(value[valuePrefixSize:]))
-	data := vf.FileStorage.AccessSpace(valueOverflowAddr)
-	n, i := binary.Uvarint(data)
+	valueOverflowAddr := int64(binary.BigEndian.Uint64(value[vf.valuePrefixSize():]))
+	data := accessSpace(vf.FileStorage, valueOverflowAddr)
+
+	if len(data) < checksum.Size {
+		corruption.Panic(valueOverflowAddr)
+	}
+
+	n, i := binary.Uvarint(data[checksum.Size:])
 
-	if i <= 0 {
-		panic(errCorrupted)
+	if i <= 0 || n > uint64(len(data)-checksum.Size-i) {
+		corruption.Panic(valueOverflowAddr)
 	}
 
+	i += checksum.Size
 	valueOverflowSize := int(n)
+
+	if !checksum.Verify(data[:i+valueOverflowSize]) {
+		corruption.Panic(valueOverflowAddr)
+	}
+
 	return valueOverflowAddr, data[i : i+valueOverflowSize]
 }
@@ -0,0 +1,239 @@
+package bptree
+
+import (
+	"bytes"
+
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Verify walks through the whole B+ tree and checks the integrity of
+// it, that is:
+//
+//   - the keys are in ascending order within and across the nodes;
+//   - the key of each child of a non-leaf, except the first child,
+//     separates the child from the previous one, and is identical to
+//     the first key of the child if overflowed;
+//   - the record count of each child of a non-leaf matches the number
+//     of the records in the subtree of the child;
+//   - the load sizes of the nodes are within the thresholds;
+//   - the leaf list forms a ring matching the in-order traversal;
+//   - the numbers of the leaves, non-leaves and records, and the
+//     payload size match the counters.
+//
+// If a violation is found, it returns a CorruptedError holding the
+// address of the node in question along with the reason.
+func (bpt *BPTree) Verify() (err error) {
+	defer corruption.Recover(&err)
+	var verifier verifier
+	verifier.Init(bpt).Run()
+	return nil
+}
+
+type verifier struct {
+	bpTree       *BPTree
+	leafAddrs    []int64
+	nonLeafCount int
+	recordCount  int
+	payloadSize  int
+}
+
+func (v *verifier) Init(bpTree *BPTree) *verifier {
+	v.bpTree = bpTree
+	return v
+}
+
+func (v *verifier) Run() {
+	bpt := v.bpTree
+	v.verifyNode(bpt.rootAddr, 1, nil, nil)
+	v.verifyLeafList()
+
+	if n := len(v.leafAddrs); n != bpt.leafCount {
+		corruption.Panicf(bpt.rootAddr, "number of leaves %d, expected %d", n, bpt.leafCount)
+	}
+
+	if v.nonLeafCount != bpt.nonLeafCount {
+		corruption.Panicf(bpt.rootAddr, "number of non-leaves %d, expected %d", v.nonLeafCount, bpt.nonLeafCount)
+	}
+
+	if v.recordCount != bpt.recordCount {
+		corruption.Panicf(bpt.rootAddr, "number of records %d, expected %d", v.recordCount, bpt.recordCount)
+	}
+
+	if v.payloadSize != bpt.payloadSize {
+		corruption.Panicf(bpt.rootAddr, "payload size %d, expected %d", v.payloadSize, bpt.payloadSize)
+	}
+}
+
+// verifyNode verifies the subtree with the given root, whose keys
+// must be in the range [minKey, maxKey) (nil for no bound), and then
+// returns the first key of the subtree.
+func (v *verifier) verifyNode(nodeAddr int64, nodeDepth int, minKey []byte, maxKey []byte) []byte {
+	if nodeDepth == v.bpTree.height {
+		return v.verifyLeaf(nodeAddr, minKey, maxKey)
+	}
+
+	return v.verifyNonLeaf(nodeAddr, nodeDepth, minKey, maxKey)
+}
+
+func (v *verifier) verifyLeaf(leafAddr int64, minKey []byte, maxKey []byte) []byte {
+	defer corruption.Guard(leafAddr)
+	bpt := v.bpTree
+	leafController := bpt.getLeafController(leafAddr)
+
+	if !leafController.IsValid() {
+		corruption.Panicf(leafAddr, "malformed leaf")
+	}
+
+	isRoot := leafAddr == bpt.rootAddr
+	n := leafController.NumberOfRecords()
+
+	if n == 0 && !isRoot {
+		corruption.Panicf(leafAddr, "empty leaf")
+	}
+
+	overloadThreshold, underloadThreshold := leafController.OverloadThreshold(bpt.maxRecordSize()), leafController.UnderloadThreshold(bpt.maxRecordSize())
+
+	if loadSize := leafController.GetLoadSize(); loadSize > overloadThreshold || (!isRoot && loadSize < underloadThreshold) {
+		corruption.Panicf(leafAddr, "leaf load size %d out of range [%d, %d]", loadSize, underloadThreshold, overloadThreshold)
+	}
+
+	keyComparer := bpt.options.KeyComparer
+	keyFactory := keyFactory{bpt.fileStorage, bpt.maxKeySize}
+	valueFactory := valueFactory{bpt.fileStorage, bpt.maxValueSize}
+	var firstKey, prevKey []byte
+
+	for i := 0; i < n; i++ {
+		key := leafController.GetKey(i)
+		value := leafController.GetValue(i)
+
+		if len(key) > bpt.maxKeySize || len(value) > bpt.maxValueSize {
+			corruption.Panicf(leafAddr, "record #%d too large", i)
+		}
+
+		rawKey := keyFactory.ReadKeyAll(key)
+		rawValueSize := valueFactory.GetRawValueSize(value)
+
+		if (len(key) == bpt.maxKeySize) != (len(rawKey) >= bpt.maxKeySize) ||
+			(len(value) == bpt.maxValueSize) != (rawValueSize >= bpt.maxValueSize) {
+			corruption.Panicf(leafAddr, "record #%d with bad overflow", i)
+		}
+
+		if i == 0 {
+			firstKey = rawKey
+		} else if keyComparer.CompareKeys(prevKey, rawKey) >= 0 {
+			corruption.Panicf(leafAddr, "record #%d out of order", i)
+		}
+
+		if (minKey != nil && keyComparer.CompareKeys(rawKey, minKey) < 0) || (maxKey != nil && keyComparer.CompareKeys(rawKey, maxKey) >= 0) {
+			corruption.Panicf(leafAddr, "record #%d out of range of the leaf", i)
+		}
+
+		prevKey = rawKey
+		v.payloadSize += len(rawKey) + rawValueSize
+	}
+
+	v.leafAddrs = append(v.leafAddrs, leafAddr)
+	v.recordCount += n
+	return firstKey
+}
+
+func (v *verifier) verifyNonLeaf(nonLeafAddr int64, nonLeafDepth int, minKey []byte, maxKey []byte) []byte {
+	defer corruption.Guard(nonLeafAddr)
+	bpt := v.bpTree
+	nonLeafController := bpt.getNonLeafController(nonLeafAddr)
+
+	if !nonLeafController.IsValid() {
+		corruption.Panicf(nonLeafAddr, "malformed non-leaf")
+	}
+
+	isRoot := nonLeafAddr == bpt.rootAddr
+	n := nonLeafController.NumberOfChildren()
+
+	if n < 2 {
+		corruption.Panicf(nonLeafAddr, "non-leaf with %d children", n)
+	}
+
+	overloadThreshold, underloadThreshold := nonLeafController.OverloadThreshold(bpt.maxNonLeafChildSize()), nonLeafController.UnderloadThreshold(bpt.maxNonLeafChildSize())
+
+	if loadSize := nonLeafController.GetLoadSize(); loadSize > overloadThreshold || (!isRoot && loadSize < underloadThreshold) {
+		corruption.Panicf(nonLeafAddr, "non-leaf load size %d out of range [%d, %d]", loadSize, underloadThreshold, overloadThreshold)
+	}
+
+	if len(nonLeafController.GetKey(0)) != 0 {
+		corruption.Panicf(nonLeafAddr, "child #0 with key")
+	}
+
+	keyComparer := bpt.options.KeyComparer
+	keyFactory := keyFactory{bpt.fileStorage, bpt.maxKeySize}
+	keys := make([][]byte, n+1)
+	keys[0], keys[n] = minKey, maxKey
+	isKeyOverflowed := make([]bool, n)
+	childAddrs := make([]int64, n)
+	childRecordCounts := make([]int, n)
+
+	for i := 0; i < n; i++ {
+		if i >= 1 {
+			key := nonLeafController.GetKey(i)
+
+			if len(key) > bpt.maxKeySize {
+				corruption.Panicf(nonLeafAddr, "child #%d with too large key", i)
+			}
+
+			keys[i] = keyFactory.ReadKeyAll(key)
+			isKeyOverflowed[i] = len(key) == bpt.maxKeySize
+
+			if (keys[i-1] != nil && keyComparer.CompareKeys(keys[i-1], keys[i]) >= 0) || (maxKey != nil && keyComparer.CompareKeys(keys[i], maxKey) >= 0) {
+				corruption.Panicf(nonLeafAddr, "child #%d out of order", i)
+			}
+		}
+
+		childAddrs[i] = nonLeafController.GetChildAddr(i)
+		childRecordCounts[i] = nonLeafController.GetChildRecordCount(i)
+	}
+
+	var firstKey []byte
+
+	for i, childAddr := range childAddrs {
+		recordCount := v.recordCount
+		childFirstKey := v.verifyNode(childAddr, nonLeafDepth+1, keys[i], keys[i+1])
+
+		if recordCount = v.recordCount - recordCount; recordCount != childRecordCounts[i] {
+			corruption.Panicf(nonLeafAddr, "child #%d with record count %d, expected %d", i, childRecordCounts[i], recordCount)
+		}
+
+		if i == 0 {
+			firstKey = childFirstKey
+		} else if isKeyOverflowed[i] && !bytes.Equal(childFirstKey, keys[i]) {
+			// an overflowed key refers to the key overflow of the first record
+			corruption.Panicf(nonLeafAddr, "child #%d with overflowed key not matching its first key", i)
+		}
+	}
+
+	v.nonLeafCount++
+	return firstKey
+}
+
+func (v *verifier) verifyLeafList() {
+	bpt := v.bpTree
+	n := len(v.leafAddrs)
+
+	if bpt.leafList.HeadAddr() != v.leafAddrs[0] {
+		corruption.Panicf(v.leafAddrs[0], "leaf list with wrong head")
+	}
+
+	if bpt.leafList.TailAddr() != v.leafAddrs[n-1] {
+		corruption.Panicf(v.leafAddrs[n-1], "leaf list with wrong tail")
+	}
+
+	for i, leafAddr := range v.leafAddrs {
+		leafHeader := leafHeader(bpt.getLeafController(leafAddr))
+
+		if leafHeader.PrevAddr() != v.leafAddrs[(i+n-1)%n] {
+			corruption.Panicf(leafAddr, "leaf with wrong previous leaf")
+		}
+
+		if leafHeader.NextAddr() != v.leafAddrs[(i+1)%n] {
+			corruption.Panicf(leafAddr, "leaf with wrong next leaf")
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package plainkv
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv/internal/corruption"
+	"github.com/roy2220/plainkv/internal/format"
+	"github.com/roy2220/plainkv/internal/wal"
+)
+
+// dataFile represents the files of a dictionary:
+//
+//   - the data file <name>, holding the dictionary as of the last
+//     checkpoint and never modified in place;
+//   - the spare file <name>.spare, another copy of the dictionary as
+//     of the last checkpoint, from which the next checkpoint is made;
+//   - the working file <name>.work, a copy of the data file being
+//     modified;
+//   - the idle file <name>.idle, the working file kept by a clean
+//     close;
+//   - the write-ahead log <name>.wal, recording the changes since the
+//     last checkpoint;
+//   - the temporary file <name>.temp, a copy being made of another
+//     file, which is renamed once complete.
+//
+// The files go together: a data file replaced by hand, e.g. restored
+// from a backup, must come without the others, which are made again
+// from it.
+//
+// Each change is synced to the write-ahead log before being applied
+// to the working file, so it survives a crash once logged.
+// After a crash, the working file is discarded and the changes in
+// the write-ahead log are replayed on a fresh copy of the data file.
+// After a clean close, the working file is as of the last checkpoint
+// as well, so it's kept as the idle file and taken as the working file
+// again by the next open instead of copying the data file.
+//
+// A checkpoint applies the write-ahead log to the spare file, which
+// then replaces the data file, while the replaced data file becomes
+// the spare file and catches up by applying the log too. So the cost
+// of a checkpoint grows with the changes logged rather than with the
+// size of the dictionary, and the working file is left untouched.
+//
+// The checkpoints are numbered, the data file and the spare file hold
+// the numbers of their checkpoints and the write-ahead log holds the
+// number of the checkpoint it's based on. The log is replayed only if
+// the numbers match, otherwise the log is covered by the data file
+// already, as the process crashed after replacing the data file before
+// resetting the log. Likewise the spare file is used only if it's as
+// of the same checkpoint as the data file, otherwise it's copied from
+// the data file again.
+//
+// A change failing to be applied after being logged leaves the working
+// file partly written, so the files are poisoned: from then on logging
+// and checkpointing fail with the error, and closing discards the
+// working file, so the next open recovers the change in whole from
+// the write-ahead log.
+type dataFile struct {
+	fileName         string
+	fileStorage      fsm.FileStorage
+	wal              wal.Log
+	checkpointNumber uint64
+	infoAddr         int64
+	err              error
+}
+
+// logApplier applies the write-ahead log to a copy of the dictionary
+// on the given file storage with the info at the given address,
+// which is negative if the dictionary isn't created yet, and then
+// returns the address of the new info.
+type logApplier func(fileStorage *fsm.FileStorage, infoAddr int64) (int64, error)
+
+// dictBuilder builds a copy of the dictionary on the given file
+// storage and then returns the address of the info.
+type dictBuilder func(fileStorage *fsm.FileStorage) (int64, error)
+
+// Open opens the files of the dictionary on the data file with the
+// given name, the data file will be created if not exists and the
+// given flag is set.
+// After a clean close, it takes the idle file as the working file by
+// renaming, which costs O(1). Otherwise, e.g. after a crash, it copies
+// the data file to the working file, which costs O(size of the data
+// file), and the changes in the write-ahead log are then to be
+// replayed by the caller, which costs O(size of the log).
+// A crash while opening leaves the data file and the write-ahead log
+// as they were, so the next open starts over.
+func (df *dataFile) Open(fileName string, createFileIfNotExists bool) error {
+	if _, err := os.Stat(fileName); err != nil {
+		if !(createFileIfNotExists && os.IsNotExist(err)) {
+			return err
+		}
+
+		if err := createDataFile(fileName); err != nil {
+			return err
+		}
+	}
+
+	workFileName := makeWorkFileName(fileName)
+
+	if err := os.Remove(workFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// a temporary file is left by a crash while checkpointing
+	if err := os.Remove(makeTempFileName(fileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// the idle file is left by a clean close, which is renamed back
+	// before being modified, so it's never left half-modified
+	if err := os.Rename(makeIdleFileName(fileName), workFileName); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := copyFile(workFileName, fileName); err != nil {
+			return err
+		}
+	} else {
+		if err := syncDir(filepath.Dir(fileName)); err != nil {
+			return err
+		}
+	}
+
+	df.fileStorage.Init()
+
+	if err := df.fileStorage.Open(workFileName, false); err != nil {
+		return err
+	}
+
+	checkpointNumber, infoAddr, err := loadDataFileInfo(&df.fileStorage)
+
+	if err != nil {
+		df.fileStorage.Close()
+		os.Remove(workFileName)
+		return err
+	}
+
+	df.wal.Init()
+
+	if err := df.wal.Open(makeLogFileName(fileName)); err != nil {
+		df.fileStorage.Close()
+		os.Remove(workFileName)
+		return err
+	}
+
+	if df.wal.CheckpointNumber() != checkpointNumber {
+		if err := df.wal.Reset(checkpointNumber); err != nil {
+			df.fileStorage.Close()
+			df.wal.Close()
+			os.Remove(workFileName)
+			return err
+		}
+	}
+
+	df.fileName = fileName
+	df.checkpointNumber = checkpointNumber
+	df.infoAddr = infoAddr
+	df.err = nil
+	return nil
+}
+
+// InfoAddr returns the address of the info of the dictionary, which
+// is negative if the dictionary isn't created yet.
+func (df *dataFile) InfoAddr() int64 {
+	return df.infoAddr
+}
+
+// Close closes the files, which should be checkpointed beforehand.
+// The working file, holding the dictionary with the info at the given
+// address, is kept as the idle file for the next open. It costs a sync
+// of the working file, O(size of the pages dirtied since the open).
+// A crash before the working file is renamed to the idle file leaves
+// no idle file, so the next open copies the data file instead, and a
+// crash after that leaves the write-ahead log, which is empty as of
+// the checkpoint, to be reused by the next open.
+func (df *dataFile) Close(infoAddr int64) error {
+	storeDataFileInfo(&df.fileStorage, df.checkpointNumber, infoAddr)
+
+	if err := df.fileStorage.Close(); err != nil {
+		df.wal.Close()
+		return err
+	}
+
+	workFileName := makeWorkFileName(df.fileName)
+
+	if err := syncFile(workFileName); err != nil {
+		df.wal.Close()
+		return err
+	}
+
+	if err := os.Rename(workFileName, makeIdleFileName(df.fileName)); err != nil {
+		df.wal.Close()
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(df.fileName)); err != nil {
+		df.wal.Close()
+		return err
+	}
+
+	if err := df.wal.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(makeLogFileName(df.fileName))
+}
+
+// Poison poisons the files with the given error, for a change which
+// fails to be applied after being logged, and then returns the error.
+func (df *dataFile) Poison(err error) error {
+	if df.err == nil {
+		df.err = err
+	}
+
+	return err
+}
+
+// IsPoisoned indicates whether the files have been poisoned, in which
+// case they should be discarded rather than closed.
+func (df *dataFile) IsPoisoned() bool {
+	return df.err != nil
+}
+
+// Discard closes the files without checkpointing, the data file
+// and the write-ahead log are left as they were.
+func (df *dataFile) Discard() error {
+	if err := df.fileStorage.Close(); err != nil {
+		df.wal.Close()
+		return err
+	}
+
+	if err := df.wal.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(makeWorkFileName(df.fileName))
+}
+
+// Checkpoint makes a checkpoint by applying the write-ahead log with
+// the given log applier to the spare file.
+// The log is applied twice, to the spare file and then to the replaced
+// data file, so it costs O(size of the log), plus O(size of the data
+// file) to copy the data file if the spare file is missing or isn't as
+// of the last checkpoint, e.g. after a crash while checkpointing.
+// On an error, the working file and the write-ahead log are intact,
+// so the dictionary goes on as if not checkpointed.
+// A crash before the data file is replaced leaves the last checkpoint
+// and the log intact, and a crash after that leaves the log based on
+// the previous checkpoint, which the next open discards as covered by
+// the data file. Either way at most the spare file is lost, which is
+// copied from the data file again by the next checkpoint.
+func (df *dataFile) Checkpoint(applyLog logApplier) error {
+	if df.err != nil {
+		return df.err
+	}
+
+	if df.wal.Size() == 0 {
+		return nil
+	}
+
+	checkpointNumber := df.checkpointNumber + 1
+
+	if err := df.prepareTempFile(); err != nil {
+		return err
+	}
+
+	if err := df.applyLogToTempFile(checkpointNumber, applyLog); err != nil {
+		return err
+	}
+
+	spareFileName := makeSpareFileName(df.fileName)
+
+	if err := os.Remove(spareFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// the data file is kept as the spare file after being replaced
+	if err := os.Link(df.fileName, spareFileName); err != nil {
+		return err
+	}
+
+	if err := df.replaceDataFile(checkpointNumber); err != nil {
+		return err
+	}
+
+	// from now on the log is covered by the data file, which is reset
+	// even on an error, while the spare file catches up with the data
+	// file before that
+	err := syncDir(filepath.Dir(df.fileName))
+
+	if err == nil {
+		err = df.takeSpareFile()
+	}
+
+	if err == nil {
+		err = df.applyLogToTempFile(checkpointNumber, applyLog)
+	}
+
+	if err == nil {
+		err = df.restoreSpareFile()
+	}
+
+	if err2 := df.wal.Reset(checkpointNumber); err2 != nil {
+		return err2
+	}
+
+	return err
+}
+
+// Rebuild makes a checkpoint by building a copy of the dictionary
+// with the given dictionary builder, for the changes which aren't
+// logged.
+// It costs O(size of the dictionary) to build the copy and then to
+// copy it to the spare file.
+// On an error before the data file is replaced, the working file
+// and the write-ahead log are intact, so the dictionary goes on as
+// if not checkpointed.
+// As with Checkpoint, a crash at any point leaves either the last
+// checkpoint or the new one as the data file, with the log which
+// matches it, while the unlogged changes are lost on a crash before
+// the data file is replaced.
+func (df *dataFile) Rebuild(build dictBuilder) error {
+	if df.err != nil {
+		return df.err
+	}
+
+	checkpointNumber := df.checkpointNumber + 1
+	tempFileName := makeTempFileName(df.fileName)
+
+	if err := os.Remove(tempFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var fileStorage fsm.FileStorage
+	fileStorage.Init()
+
+	if err := fileStorage.Open(tempFileName, true); err != nil {
+		return err
+	}
+
+	infoAddr, err := build(&fileStorage)
+
+	if err != nil {
+		fileStorage.Close()
+		return err
+	}
+
+	storeDataFileInfo(&fileStorage, checkpointNumber, infoAddr)
+
+	if err := fileStorage.Close(); err != nil {
+		return err
+	}
+
+	if err := syncFile(tempFileName); err != nil {
+		return err
+	}
+
+	if err := df.replaceDataFile(checkpointNumber); err != nil {
+		return err
+	}
+
+	// the spare file is copied from the data file, as the changes to
+	// apply aren't logged, before the log is reset
+	err = syncDir(filepath.Dir(df.fileName))
+
+	if err == nil {
+		err = copyFile(tempFileName, df.fileName)
+	}
+
+	if err == nil {
+		err = df.restoreSpareFile()
+	}
+
+	if err2 := df.wal.Reset(checkpointNumber); err2 != nil {
+		return err2
+	}
+
+	return err
+}
+
+func (df *dataFile) ReplayLog(callback func(operation *wal.Operation) error) error {
+	return df.wal.Replay(func(entry wal.Entry) error {
+		for i := range entry {
+			if err := callback(&entry[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (df *dataFile) Log(entry wal.Entry) error {
+	if df.err != nil {
+		return df.err
+	}
+
+	return df.wal.Append(entry)
+}
+
+// prepareTempFile takes the spare file as the temporary file, to make
+// the next checkpoint from. If the spare file isn't as of the last
+// checkpoint, the data file is copied instead.
+func (df *dataFile) prepareTempFile() error {
+	if !checkSpareFile(makeSpareFileName(df.fileName), df.checkpointNumber) {
+		return copyFile(makeTempFileName(df.fileName), df.fileName)
+	}
+
+	return df.takeSpareFile()
+}
+
+// takeSpareFile renames the spare file to the temporary file before
+// the file is modified, so the spare file is never left half-modified.
+func (df *dataFile) takeSpareFile() error {
+	if err := os.Rename(makeSpareFileName(df.fileName), makeTempFileName(df.fileName)); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(df.fileName))
+}
+
+func (df *dataFile) restoreSpareFile() error {
+	if err := os.Rename(makeTempFileName(df.fileName), makeSpareFileName(df.fileName)); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(df.fileName))
+}
+
+func (df *dataFile) applyLogToTempFile(checkpointNumber uint64, applyLog logApplier) error {
+	tempFileName := makeTempFileName(df.fileName)
+	var fileStorage fsm.FileStorage
+	fileStorage.Init()
+
+	if err := fileStorage.Open(tempFileName, false); err != nil {
+		return err
+	}
+
+	_, infoAddr, err := loadDataFileInfo(&fileStorage)
+
+	if err == nil {
+		infoAddr, err = applyLog(&fileStorage, infoAddr)
+	}
+
+	if err != nil {
+		fileStorage.Close()
+		return err
+	}
+
+	storeDataFileInfo(&fileStorage, checkpointNumber, infoAddr)
+
+	if err := fileStorage.Close(); err != nil {
+		return err
+	}
+
+	return syncFile(tempFileName)
+}
+
+// replaceDataFile replaces the data file with the temporary file, from
+// then on the checkpoint of the given number is made.
+func (df *dataFile) replaceDataFile(checkpointNumber uint64) error {
+	if err := os.Rename(makeTempFileName(df.fileName), df.fileName); err != nil {
+		return err
+	}
+
+	df.checkpointNumber = checkpointNumber
+	return nil
+}
+
+func createDataFile(fileName string) error {
+	var fileStorage fsm.FileStorage
+	fileStorage.Init()
+
+	if err := fileStorage.Open(fileName, true); err != nil {
+		return err
+	}
+
+	storeDataFileInfo(&fileStorage, 0, -1)
+
+	if err := fileStorage.Close(); err != nil {
+		return err
+	}
+
+	if err := syncFile(fileName); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(fileName))
+}
+
+// checkSpareFile indicates whether the spare file with the given name
+// exists and is as of the checkpoint of the given number.
+func checkSpareFile(spareFileName string, checkpointNumber uint64) bool {
+	var fileStorage fsm.FileStorage
+	fileStorage.Init()
+
+	if err := fileStorage.Open(spareFileName, false); err != nil {
+		return false
+	}
+
+	checkpointNumber2, _, err := loadDataFileInfo(&fileStorage)
+	fileStorage.Close()
+	return err == nil && checkpointNumber2 == checkpointNumber
+}
+
+// loadDataFileInfo loads the info of the data file on the given file
+// storage at the primary space, and then returns the checkpoint number
+// and the address of the info of the dictionary. A data file without
+// the info is as of checkpoint number 0 with the dictionary not
+// created yet.
+func loadDataFileInfo(fileStorage *fsm.FileStorage) (_ uint64, _ int64, err error) {
+	defer corruption.Recover(&err)
+	dataFileInfoAddr := fileStorage.PrimarySpace()
+
+	if dataFileInfoAddr < 0 {
+		return 0, -1, nil
+	}
+
+	data := accessSpace(fileStorage, dataFileInfoAddr)
+
+	// the format version is checked ahead, as the info of another
+	// version may be of another layout
+	if len(data) < 4 {
+		corruption.Panic(dataFileInfoAddr)
+	}
+
+	if binary.BigEndian.Uint32(data[0:]) != dataFileFormatVersion {
+		return 0, -1, format.ErrUnsupportedVersion
+	}
+
+	if len(data) < dataFileInfoSize || crc32.Checksum(data[:dataFileInfoSize-4], crc32Table) != binary.BigEndian.Uint32(data[dataFileInfoSize-4:]) {
+		corruption.Panic(dataFileInfoAddr)
+	}
+
+	return binary.BigEndian.Uint64(data[4:]), int64(binary.BigEndian.Uint64(data[12:])), nil
+}
+
+func storeDataFileInfo(fileStorage *fsm.FileStorage, checkpointNumber uint64, infoAddr int64) {
+	dataFileInfoAddr := fileStorage.PrimarySpace()
+	var data []byte
+
+	if dataFileInfoAddr < 0 {
+		dataFileInfoAddr, data = fileStorage.AllocateSpace(dataFileInfoSize)
+		fileStorage.SetPrimarySpace(dataFileInfoAddr)
+	} else {
+		data = fileStorage.AccessSpace(dataFileInfoAddr)
+	}
+
+	binary.BigEndian.PutUint32(data[0:], dataFileFormatVersion)
+	binary.BigEndian.PutUint64(data[4:], checkpointNumber)
+	binary.BigEndian.PutUint64(data[12:], uint64(infoAddr))
+	binary.BigEndian.PutUint32(data[20:], crc32.Checksum(data[:20], crc32Table))
+}
+
+// dataFileFormatVersion is the version of the format of the info of
+// a data file.
+// The info of a data file is laid out as:
+//
+//   - the format version (4 bytes);
+//   - the checkpoint number (8 bytes);
+//   - the address of the info of the B+ tree or the hash map (8 bytes);
+//   - the CRC-32C checksum of the above (4 bytes).
+const dataFileFormatVersion = 1
+
+const dataFileInfoSize = 24
+
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+func accessSpace(fileStorage *fsm.FileStorage, addr int64) []byte {
+	defer corruption.Guard(addr)
+	return fileStorage.AccessSpace(addr)
+}
+
+func makeWorkFileName(fileName string) string {
+	return fileName + ".work"
+}
+
+func makeIdleFileName(fileName string) string {
+	return fileName + ".idle"
+}
+
+func makeSpareFileName(fileName string) string {
+	return fileName + ".spare"
+}
+
+func makeLogFileName(fileName string) string {
+	return fileName + ".wal"
+}
+
+func makeTempFileName(fileName string) string {
+	return fileName + ".temp"
+}
+
+func copyFile(dstFileName string, srcFileName string) error {
+	srcFile, err := os.Open(srcFileName)
+
+	if err != nil {
+		return err
+	}
+
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dstFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+
+	if err := dstFile.Sync(); err != nil {
+		dstFile.Close()
+		return err
+	}
+
+	return dstFile.Close()
+}
+
+func syncFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func syncDir(dirName string) error {
+	dir, err := os.Open(dirName)
+
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
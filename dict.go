@@ -1,58 +1,132 @@
 package plainkv
 
 import (
+	"sync"
+
 	"github.com/roy2220/fsm"
 	"github.com/roy2220/plainkv/hashmap"
+	"github.com/roy2220/plainkv/internal/wal"
 )
 
 // Dict represents a dictionary.
+// It is safe for concurrent use by multiple goroutines: reads run
+// in parallel while writes are serialized and exclude reads.
 type Dict struct {
-	fileStorage fsm.FileStorage
-	hashMap     hashmap.HashMap
+	mutex    sync.RWMutex
+	dataFile dataFile
+	hashMap  hashmap.HashMap
 }
 
 // OpenDict opens a dictionary on the given file.
+// The changes not checkpointed by a previous close, due to a crash,
+// are recovered from the write-ahead log.
+// If the file was written in a format of another version, it returns
+// ErrUnsupportedFormatVersion.
 func OpenDict(fileName string, createFileIfNotExists bool) (*Dict, error) {
 	var d Dict
-	d.fileStorage.Init()
 
-	if err := d.fileStorage.Open(fileName, createFileIfNotExists); err != nil {
+	if err := d.dataFile.Open(fileName, createFileIfNotExists); err != nil {
 		return nil, err
 	}
 
-	d.hashMap.Init(&d.fileStorage)
+	d.hashMap.Init(&d.dataFile.fileStorage)
 
-	if hashMapInfoAddr := d.fileStorage.PrimarySpace(); hashMapInfoAddr < 0 {
+	if hashMapInfoAddr := d.dataFile.InfoAddr(); hashMapInfoAddr < 0 {
 		d.hashMap.Create()
 	} else {
-		d.hashMap.Load(hashMapInfoAddr)
+		if err := d.hashMap.Load(hashMapInfoAddr); err != nil {
+			d.dataFile.Discard()
+			return nil, err
+		}
+	}
+
+	if err := d.dataFile.ReplayLog(d.applyOperation); err != nil {
+		d.dataFile.Discard()
+		return nil, err
 	}
 
 	return &d, nil
 }
 
-// Close closes the dictionary.
+// Close checkpoints and then closes the dictionary.
+// If it fails to checkpoint, the dictionary is left open.
+// If the dictionary has been poisoned by a write, it's closed without
+// checkpointing, and the next open recovers the logged writes.
 func (d *Dict) Close() error {
-	hashMapInfoAddr := d.hashMap.Store()
-	d.fileStorage.SetPrimarySpace(hashMapInfoAddr)
-	return d.fileStorage.Close()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.dataFile.IsPoisoned() {
+		return d.dataFile.Discard()
+	}
+
+	if err := d.dataFile.Checkpoint(d.applyLog); err != nil {
+		return err
+	}
+
+	return d.dataFile.Close(d.hashMap.Store())
+}
+
+// Sync checkpoints the dictionary without closing it: all changes
+// are made durable in the data file and the write-ahead log is
+// discarded.
+// The checkpoint is made from the write-ahead log, so its cost grows
+// with the changes since the last checkpoint rather than with the size
+// of the dictionary. If it fails, the dictionary goes on as if not
+// checkpointed.
+func (d *Dict) Sync() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dataFile.Checkpoint(d.applyLog)
 }
 
 // Set sets the value for the given key in the dictionary to the
 // given value.
 // If the key already exists it replaces the value and then
 // returns the replaced value (optional).
-func (d *Dict) Set(key []byte, value []byte, returnReplacedValue bool) []byte {
-	value, _ = d.hashMap.AddOrUpdateItem(key, value, returnReplacedValue)
-	return value
+// The change is durable once it returns without an error.
+func (d *Dict) Set(key []byte, value []byte, returnReplacedValue bool) ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.logPut(key, value); err != nil {
+		return nil, err
+	}
+
+	value2, _, err := d.hashMap.AddOrUpdateItem(key, value, returnReplacedValue)
+
+	if err != nil {
+		return nil, d.dataFile.Poison(err)
+	}
+
+	return value2, nil
 }
 
 // SetIfExists sets the value for the given key in the dictionary
 // to the given value.
 // If the key exists, it replaces the value and then returns true
 // and the replaced value (optional), otherwise it returns false.
-func (d *Dict) SetIfExists(key []byte, value []byte, returnReplacedValue bool) ([]byte, bool) {
-	return d.hashMap.UpdateItem(key, value, returnReplacedValue)
+// The change is durable once it returns without an error.
+func (d *Dict) SetIfExists(key []byte, value []byte, returnReplacedValue bool) ([]byte, bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, ok, err := d.hashMap.HasItem(key, false)
+
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if err := d.logPut(key, value); err != nil {
+		return nil, false, err
+	}
+
+	value2, _, err := d.hashMap.UpdateItem(key, value, returnReplacedValue)
+
+	if err != nil {
+		return nil, false, d.dataFile.Poison(err)
+	}
+
+	return value2, true, nil
 }
 
 // SetIfNotExists sets the value for the given key in the
@@ -60,21 +134,90 @@ func (d *Dict) SetIfExists(key []byte, value []byte, returnReplacedValue bool) (
 // If the key doesn't exists, it adds the key with the value and
 // then returns true, otherwise it returns false and the present
 // value (optional).
-func (d *Dict) SetIfNotExists(key []byte, value []byte, returnPresentValue bool) ([]byte, bool) {
-	return d.hashMap.AddItem(key, value, returnPresentValue)
+// The change is durable once it returns without an error.
+func (d *Dict) SetIfNotExists(key []byte, value []byte, returnPresentValue bool) ([]byte, bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	value2, ok, err := d.hashMap.HasItem(key, returnPresentValue)
+
+	if err != nil || ok {
+		return value2, false, err
+	}
+
+	if err := d.logPut(key, value); err != nil {
+		return nil, false, err
+	}
+
+	if _, _, err := d.hashMap.AddItem(key, value, false); err != nil {
+		return nil, false, d.dataFile.Poison(err)
+	}
+
+	return nil, true, nil
 }
 
 // Clear clears the given key in the dictionary.
 // If the key exists, it deletes the key and then returns true
 // and the removed value (optional), otherwise if returns false.
-func (d *Dict) Clear(key []byte, returnRemovedValue bool) ([]byte, bool) {
-	return d.hashMap.DeleteItem(key, returnRemovedValue)
+// The change is durable once it returns without an error.
+func (d *Dict) Clear(key []byte, returnRemovedValue bool) ([]byte, bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, ok, err := d.hashMap.HasItem(key, false)
+
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if err := d.logDelete(key); err != nil {
+		return nil, false, err
+	}
+
+	value, _, err := d.hashMap.DeleteItem(key, returnRemovedValue)
+
+	if err != nil {
+		return nil, false, d.dataFile.Poison(err)
+	}
+
+	return value, true, nil
+}
+
+// Apply applies the writes in the given batch to the dictionary
+// in order. The writes are all or nothing, even in the event of a
+// crash.
+// The changes are durable once it returns without an error.
+// The batch is logged before being applied, so if a write fails to be
+// applied, e.g. with a CorruptedError, the batch is left partly
+// applied and the dictionary is poisoned: further writes and syncs
+// fail with the error, and closing the dictionary discards the partly
+// applied batch, which the next open recovers in whole from the log.
+func (d *Dict) Apply(writeBatch *WriteBatch) error {
+	if writeBatch.Len() == 0 {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.dataFile.Log(writeBatch.operations); err != nil {
+		return err
+	}
+
+	for i := range writeBatch.operations {
+		if err := d.applyOperation(&writeBatch.operations[i]); err != nil {
+			// the batch is partly applied, but logged in whole
+			return d.dataFile.Poison(err)
+		}
+	}
+
+	return nil
 }
 
 // Test tests the given key in the dictionary.
 // If the key exists, it returns true and the present value (optional),
 // otherwise it returns false.
-func (d *Dict) Test(key []byte, returnPresentValue bool) ([]byte, bool) {
+func (d *Dict) Test(key []byte, returnPresentValue bool) ([]byte, bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	return d.hashMap.HasItem(key, returnPresentValue)
 }
 
@@ -83,14 +226,29 @@ func (d *Dict) Test(key []byte, returnPresentValue bool) ([]byte, bool) {
 // position.
 // It returns false if there are no more keys and values.
 // The initial cursor is of the zero value.
-func (d *Dict) Scan(cursor *DictCursor) ([]byte, []byte, bool) {
+// If the dictionary is modified between scans, the keys and values
+// may be missed or returned more than once.
+func (d *Dict) Scan(cursor *DictCursor) ([]byte, []byte, bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	return d.hashMap.FetchItem(cursor)
 }
 
+// Verify walks through the whole dictionary and checks the integrity
+// of the hash map.
+// If the hash map is broken, it returns a CorruptedError.
+func (d *Dict) Verify() error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.hashMap.Verify()
+}
+
 // Stats returns the stats of the dictionary.
 func (d *Dict) Stats() DictStats {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	return DictStats{
-		FSM:                  d.fileStorage.Stats(),
+		FSM:                  d.dataFile.fileStorage.Stats(),
 		NumberOfHashSlotDirs: d.hashMap.NumberOfSlotDirs(),
 		NumberOfHashSlots:    d.hashMap.NumberOfSlots(),
 		NumberOfHashItems:    d.hashMap.NumberOfItems(),
@@ -98,6 +256,54 @@ func (d *Dict) Stats() DictStats {
 	}
 }
 
+// applyLog applies the write-ahead log to the copy of the hash map on
+// the given file storage, for a checkpoint.
+func (d *Dict) applyLog(fileStorage *fsm.FileStorage, hashMapInfoAddr int64) (int64, error) {
+	var hashMap hashmap.HashMap
+	hashMap.Init(fileStorage)
+
+	if hashMapInfoAddr < 0 {
+		hashMap.Create()
+	} else {
+		if err := hashMap.Load(hashMapInfoAddr); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := d.dataFile.ReplayLog(func(operation *wal.Operation) error {
+		return applyHashMapOperation(&hashMap, operation)
+	}); err != nil {
+		return 0, err
+	}
+
+	return hashMap.Store(), nil
+}
+
+func (d *Dict) applyOperation(operation *wal.Operation) error {
+	return applyHashMapOperation(&d.hashMap, operation)
+}
+
+func applyHashMapOperation(hashMap *hashmap.HashMap, operation *wal.Operation) error {
+	var err error
+
+	switch operation.Type {
+	case wal.OperationPut:
+		_, _, err = hashMap.AddOrUpdateItem(operation.Key, operation.Value, false)
+	case wal.OperationDelete:
+		_, _, err = hashMap.DeleteItem(operation.Key, false)
+	}
+
+	return err
+}
+
+func (d *Dict) logPut(key []byte, value []byte) error {
+	return d.dataFile.Log(wal.Entry{{Type: wal.OperationPut, Key: key, Value: value}})
+}
+
+func (d *Dict) logDelete(key []byte) error {
+	return d.dataFile.Log(wal.Entry{{Type: wal.OperationDelete, Key: key}})
+}
+
 // DictCursor represents a cursor at a position in a dictionary.
 type DictCursor = hashmap.Cursor
 
@@ -1,9 +1,15 @@
 package plainkv_test
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
 
 	"github.com/roy2220/plainkv"
+	"github.com/stretchr/testify/assert"
 )
 
 func ExampleDict() {
@@ -14,12 +20,20 @@ func ExampleDict() {
 		}
 		defer d.Close()
 
-		d.Set([]byte("foo"), []byte("bar"), false /* don't return the replaced value */)
+		if _, err := d.Set([]byte("foo"), []byte("bar"), false /* don't return the replaced value */); err != nil {
+			panic(err)
+		}
 
-		_, ok := d.SetIfNotExists([]byte("hello"), []byte("w0rd"), false /* don't return the present value */)
+		_, ok, err := d.SetIfNotExists([]byte("hello"), []byte("w0rd"), false /* don't return the present value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v\n", ok)
 
-		v, ok := d.SetIfExists([]byte("hello"), []byte("world"), true /* return the replaced value */)
+		v, ok, err := d.SetIfExists([]byte("hello"), []byte("world"), true /* return the replaced value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v %q\n", ok, v)
 	}()
 
@@ -32,17 +46,26 @@ func ExampleDict() {
 
 		dc := plainkv.DictCursor{}
 		for {
-			k, v, ok := d.Scan(&dc)
+			k, v, ok, err := d.Scan(&dc)
+			if err != nil {
+				panic(err)
+			}
 			if !ok {
 				break
 			}
 			fmt.Printf("%q %q\n", k, v)
 		}
 
-		v, ok := d.Test([]byte("foo"), true /* return the present value */)
+		v, ok, err := d.Test([]byte("foo"), true /* return the present value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v %q\n", ok, v)
 
-		v, ok = d.Clear([]byte("hello"), true /* return the removed value */)
+		v, ok, err = d.Clear([]byte("hello"), true /* return the removed value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v %q\n", ok, v)
 	}()
 	// Output:
@@ -53,3 +76,187 @@ func ExampleDict() {
 	// true "bar"
 	// true "world"
 }
+
+func TestDictRecovery(t *testing.T) {
+	d, fn := MakeDict(t)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		_, err := d.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(i))
+		_, ok, err := d.Clear(k, false)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	for n := 0; n < 2; n++ {
+		// crash without closing the dictionary
+		assert.NoError(t, d.SimulateCrash())
+		d = ReopenDict(t, fn)
+
+		for i := 0; i < 1000; i++ {
+			k := []byte(strconv.Itoa(i))
+			v, ok, _ := d.Test(k, true)
+
+			if i%2 == 0 {
+				assert.False(t, ok)
+			} else if assert.True(t, ok) {
+				assert.Equal(t, k, v)
+			}
+		}
+
+		assert.Equal(t, 500, d.Stats().NumberOfHashItems)
+	}
+
+	assert.NoError(t, d.Close())
+	d = ReopenDict(t, fn)
+
+	assert.Equal(t, 500, d.Stats().NumberOfHashItems)
+	assert.NoError(t, d.Close())
+}
+
+func TestDictSync(t *testing.T) {
+	d, fn := MakeDict(t)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		_, err := d.Set(k, k, false)
+		assert.NoError(t, err)
+
+		if i%300 == 299 {
+			if !assert.NoError(t, d.Sync()) {
+				t.FailNow()
+			}
+
+			assert.Equal(t, int64(0), d.LogSize())
+		}
+	}
+
+	// crash without closing the dictionary
+	assert.NoError(t, d.SimulateCrash())
+	d = ReopenDict(t, fn)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		v, ok, _ := d.Test(k, true)
+
+		if assert.True(t, ok) {
+			assert.Equal(t, k, v)
+		}
+	}
+
+	assert.Equal(t, 1000, d.Stats().NumberOfHashItems)
+	assert.NoError(t, d.Close())
+}
+
+func TestDictConcurrency(t *testing.T) {
+	d, _ := MakeDict(t)
+	defer d.Close()
+
+	for i := 0; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(i))
+		d.Set(k, k, false)
+	}
+
+	var wg sync.WaitGroup
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for n := 0; n < 100; n++ {
+				for i := 0; i < 1000; i += 2 {
+					k := []byte(strconv.Itoa(i))
+					v, ok, _ := d.Test(k, true)
+
+					if assert.True(t, ok) {
+						assert.Equal(t, k, v)
+					}
+				}
+
+				var c plainkv.DictCursor
+
+				for k, v, ok, _ := d.Scan(&c); ok; k, v, ok, _ = d.Scan(&c) {
+					assert.Equal(t, k, v)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(i))
+		_, err := d.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(i))
+		_, _, err := d.Clear(k, false)
+		assert.NoError(t, err)
+	}
+
+	wg.Wait()
+	assert.Equal(t, 500, d.Stats().NumberOfHashItems)
+}
+
+func TestDictCorrupted(t *testing.T) {
+	d, fn := MakeDict(t)
+	_, err := d.Set([]byte("foo"), []byte("bar"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Close())
+	// the data file is read only if there's no idle file
+	assert.NoError(t, os.Remove(fn+".idle"))
+
+	for _, isDataFileInfo := range []bool{false, true} {
+		infoAddr, restore := CorruptInfo(t, fn, isDataFileInfo)
+		_, err = plainkv.OpenDict(fn, false)
+		var corruptedError *plainkv.CorruptedError
+
+		if assert.True(t, errors.Is(err, plainkv.ErrCorrupted)) && assert.True(t, errors.As(err, &corruptedError)) {
+			assert.Equal(t, infoAddr, corruptedError.Addr)
+		}
+
+		restore()
+		_, restore = ModifyInfo(t, fn, isDataFileInfo, func(info []byte) { info[3]++ })
+		_, err = plainkv.OpenDict(fn, false)
+		assert.Equal(t, plainkv.ErrUnsupportedFormatVersion, err)
+		restore()
+	}
+
+	d = ReopenDict(t, fn)
+
+	v, ok, err := d.Test([]byte("foo"), true)
+
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, []byte("bar"), v)
+	}
+
+	assert.NoError(t, d.Close())
+}
+
+func TestDictVerify(t *testing.T) {
+	d, fn := MakeDict(t)
+
+	for i := 0; i < 10000; i++ {
+		_, err := d.Set([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*i)), false)
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 10000; i += 2 {
+		_, _, err := d.Clear([]byte(strconv.Itoa(i)), false)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, d.Verify())
+	assert.NoError(t, d.Close())
+	d = ReopenDict(t, fn)
+
+	assert.NoError(t, d.Verify())
+	assert.NoError(t, d.Close())
+}
@@ -0,0 +1,64 @@
+package plainkv
+
+import "encoding/binary"
+
+// SimulateCrash closes the files of the dictionary without
+// checkpointing, as if the process crashed, so the next open
+// recovers the changes from the write-ahead log.
+func (od *OrderedDict) SimulateCrash() error {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	od.version++
+	return od.dataFile.Discard()
+}
+
+// SimulateCrash closes the files of the dictionary without
+// checkpointing, as if the process crashed, so the next open
+// recovers the changes from the write-ahead log.
+func (d *Dict) SimulateCrash() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dataFile.Discard()
+}
+
+// BreakLog closes the write-ahead log of the dictionary under it,
+// so the following writes fail to be logged.
+func (od *OrderedDict) BreakLog() error {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	return od.dataFile.wal.Close()
+}
+
+// CorruptRoot corrupts the root of the B+ tree of the dictionary in
+// the working file, so the following accesses to the B+ tree fail.
+func (od *OrderedDict) CorruptRoot() error {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	infoAddr := od.bpTree.Store()
+	// the info of the B+ tree holds the address of the root at [4:12]
+	rootAddr := int64(binary.BigEndian.Uint64(od.dataFile.fileStorage.AccessSpace(infoAddr)[4:]))
+
+	if err := od.bpTree.Load(infoAddr); err != nil {
+		return err
+	}
+
+	root := od.dataFile.fileStorage.AccessAlignedSpace(rootAddr)
+	root[len(root)-1]++
+	return nil
+}
+
+// LogSize returns the size of the entries in the write-ahead log of
+// the dictionary.
+func (od *OrderedDict) LogSize() int64 {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return od.dataFile.wal.Size()
+}
+
+// LogSize returns the size of the entries in the write-ahead log of
+// the dictionary.
+func (d *Dict) LogSize() int64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.dataFile.wal.Size()
+}
@@ -4,13 +4,15 @@ package hashmap
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"hash/fnv"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/roy2220/fsm"
 
 	"github.com/roy2220/plainkv/hashmap/internal/protocol"
+	"github.com/roy2220/plainkv/internal/checksum"
+	"github.com/roy2220/plainkv/internal/corruption"
+	"github.com/roy2220/plainkv/internal/format"
 )
 
 // HashMap represents a hash map on disk.
@@ -34,28 +36,30 @@ func (hm *HashMap) Init(fileStorage *fsm.FileStorage) *HashMap {
 
 // Create creates the hash map on the file storage.
 func (hm *HashMap) Create() {
-	slotDirsAddr, buffer1 := hm.fileStorage.AllocateSpace(8 << minMaxSlotDirCountShift)
-	slotDirAddr, buffer2 := hm.fileStorage.AllocateSpace(8 << slotDirLengthShift)
-	binary.BigEndian.PutUint64(buffer1, uint64(slotDirAddr))
-	binary.BigEndian.PutUint64(buffer2, ^uint64(0))
-	hm.slotDirsAddr = slotDirsAddr
+	hm.slotDirsAddr = allocateAddrArray(hm.fileStorage, 1<<minMaxSlotDirCountShift)
 	hm.maxSlotDirCountShift = minMaxSlotDirCountShift
+	hm.locateSlotDirAddr(0).Set(hm.fileStorage, allocateAddrArray(hm.fileStorage, slotDirLength))
+	hm.locateSlotAddr(0).Set(hm.fileStorage, -1)
 	hm.slotDirCount = 1
 	hm.slotCount = 1
 }
 
 // Destroy destroys the hash map on the file storage.
-func (hm *HashMap) Destroy() {
-	slotDirAddr := int64(binary.BigEndian.Uint64(hm.fileStorage.AccessSpace(hm.slotDirsAddr)))
-	hm.fileStorage.FreeSpace(hm.slotDirsAddr)
-	hm.fileStorage.FreeSpace(slotDirAddr)
+func (hm *HashMap) Destroy() (err error) {
+	defer corruption.Recover(&err)
+	slotDirAddr := hm.locateSlotDirAddr(0).Get(hm.fileStorage)
+	freeSpace(hm.fileStorage, hm.slotDirsAddr)
+	freeSpace(hm.fileStorage, slotDirAddr)
 	*hm = *new(HashMap).Init(hm.fileStorage)
+	return nil
 }
 
 // Store stores the hash map to the file storage and then returns
 // the info address.
 func (hm *HashMap) Store() int64 {
-	buffer := proto.NewBuffer(nil)
+	// the info is prefixed with the format version
+	buffer := proto.NewBuffer(make([]byte, 4, 64))
+	binary.BigEndian.PutUint32(buffer.Bytes(), formatVersion)
 
 	buffer.EncodeMessage(&protocol.HashMapInfo{
 		SlotDirsAddr:         hm.slotDirsAddr,
@@ -75,15 +79,35 @@ func (hm *HashMap) Store() int64 {
 
 // Load loads the hash map from the file storage with the
 // given info address.
-func (hm *HashMap) Load(infoAddr int64) {
-	buffer := proto.NewBuffer(hm.fileStorage.AccessSpace(infoAddr))
+// If the info is corrupted it returns a CorruptedError, or if the
+// hash map was stored in a format of another version it returns
+// ErrUnsupportedFormatVersion, and the hash map is left unloaded.
+func (hm *HashMap) Load(infoAddr int64) (err error) {
+	defer corruption.Recover(&err)
+	data := accessSpace(hm.fileStorage, infoAddr)
+
+	if len(data) < 4 {
+		corruption.Panic(infoAddr)
+	}
+
+	if binary.BigEndian.Uint32(data) != formatVersion {
+		return ErrUnsupportedFormatVersion
+	}
+
+	buffer := proto.NewBuffer(data[4:])
 	var info protocol.HashMapInfo
 
 	if err := buffer.DecodeMessage(&info); err != nil {
-		panic(errCorrupted)
+		corruption.Panic(infoAddr)
 	}
 
-	hm.fileStorage.FreeSpace(infoAddr)
+	if !isValidInfo(&info) {
+		corruption.Panic(infoAddr)
+	}
+
+	addrRef{info.SlotDirsAddr, 1 << info.MaxSlotDirCountShift, 0, false}.access(hm.fileStorage)
+
+	freeSpace(hm.fileStorage, infoAddr)
 	hm.slotDirsAddr = info.SlotDirsAddr
 	hm.maxSlotDirCountShift = int(info.MaxSlotDirCountShift)
 	hm.slotDirCount = int(info.SlotDirCount)
@@ -91,18 +115,20 @@ func (hm *HashMap) Load(infoAddr int64) {
 	hm.slotCount = int(info.SlotCount)
 	hm.itemCount = int(info.ItemCount)
 	hm.payloadSize = int(info.PayloadSize)
+	return nil
 }
 
 // AddItem adds the given item to the hash map.
 // If no item matched exists in the hash map, it adds the item
 // and then returns true, otherwise it returns false and the
 // present value (optional) of the item.
-func (hm *HashMap) AddItem(key []byte, value []byte, returnPresentValue bool) ([]byte, bool) {
+func (hm *HashMap) AddItem(key []byte, value []byte, returnPresentValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	keySum := sumKey(key)
 	items, i := hm.locateItem(key, keySum)
 
 	if i >= 0 {
-		return hm.getValue(items, i, returnPresentValue), false
+		return hm.getValue(items, i, returnPresentValue), false, nil
 	}
 
 	hm.appendItem(items, &hashItem{
@@ -111,7 +137,7 @@ func (hm *HashMap) AddItem(key []byte, value []byte, returnPresentValue bool) ([
 		Value:  value,
 	})
 
-	return nil, true
+	return nil, true, nil
 }
 
 // UpdateItem replaces the value of an item with the given key
@@ -119,15 +145,16 @@ func (hm *HashMap) AddItem(key []byte, value []byte, returnPresentValue bool) ([
 // If an item matched exists in the hash map, it updates the item
 // and then returns true and the replaced value (optional) of the
 // item, otherwise it returns false.
-func (hm *HashMap) UpdateItem(key []byte, value []byte, returnReplacedValue bool) ([]byte, bool) {
+func (hm *HashMap) UpdateItem(key []byte, value []byte, returnReplacedValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	keySum := sumKey(key)
 	items, i := hm.locateItem(key, keySum)
 
 	if i < 0 {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return hm.replaceValue(items, i, value, returnReplacedValue), true
+	return hm.replaceValue(items, i, value, returnReplacedValue), true, nil
 }
 
 // AddOrUpdateItem adds the given item to the hash map or replaces
@@ -135,12 +162,13 @@ func (hm *HashMap) UpdateItem(key []byte, value []byte, returnReplacedValue bool
 // If no item matched exists in the hash map, it adds the item and
 // then returns true, otherwise it updates the item and then returns
 // false and the replaced value (optional) of the item.
-func (hm *HashMap) AddOrUpdateItem(key []byte, value []byte, returnReplacedValue bool) ([]byte, bool) {
+func (hm *HashMap) AddOrUpdateItem(key []byte, value []byte, returnReplacedValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	keySum := sumKey(key)
 	items, i := hm.locateItem(key, keySum)
 
 	if i >= 0 {
-		return hm.replaceValue(items, i, value, returnReplacedValue), false
+		return hm.replaceValue(items, i, value, returnReplacedValue), false, nil
 	}
 
 	hm.appendItem(items, &hashItem{
@@ -149,22 +177,23 @@ func (hm *HashMap) AddOrUpdateItem(key []byte, value []byte, returnReplacedValue
 		Value:  value,
 	})
 
-	return nil, true
+	return nil, true, nil
 }
 
 // DeleteItem deletes an item with the given key in the hash map.
 // If an item matched exists in the hash map, it deletes the item
 // and then returns true and the removed value (optional) of the
 // item, otherwise it returns false.
-func (hm *HashMap) DeleteItem(key []byte, returnRemovedValue bool) ([]byte, bool) {
+func (hm *HashMap) DeleteItem(key []byte, returnRemovedValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	keySum := sumKey(key)
 	items, i := hm.locateItem(key, keySum)
 
 	if i < 0 {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return hm.removeItem(items, i, returnRemovedValue), true
+	return hm.removeItem(items, i, returnRemovedValue), true, nil
 }
 
 // HasItem checks whether an item with the given key in the
@@ -172,28 +201,31 @@ func (hm *HashMap) DeleteItem(key []byte, returnRemovedValue bool) ([]byte, bool
 // If an item matched exists in the hash map, it returns true
 // and the present value (optional) of the item, otherwise it
 // returns false.
-func (hm *HashMap) HasItem(key []byte, returnPresentValue bool) ([]byte, bool) {
+func (hm *HashMap) HasItem(key []byte, returnPresentValue bool) (_ []byte, _ bool, err error) {
+	defer corruption.Recover(&err)
 	keySum := sumKey(key)
 	items, i := hm.locateItem(key, keySum)
 
 	if i < 0 {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return hm.getValue(items, i, returnPresentValue), true
+	return hm.getValue(items, i, returnPresentValue), true, nil
 }
 
 // FetchItem fetches an item from the given cursor in the hash map,
 // and meanwhile advances the given cursor to the next position.
 // It returns false if there are no more items.
 // The initial cursor is of the zero value.
-func (hm *HashMap) FetchItem(cursor *Cursor) ([]byte, []byte, bool) {
+func (hm *HashMap) FetchItem(cursor *Cursor) (_ []byte, _ []byte, _ bool, err error) {
 	if cursor.itemIndex < len(cursor.items) {
 		item := &cursor.items[cursor.itemIndex]
 		cursor.itemIndex++
-		return item.Key, item.Value, true
+		return item.Key, item.Value, true, nil
 	}
 
+	defer corruption.Recover(&err)
+
 	for cursor.slotIndex < hm.slotCount {
 		slot := hm.loadSlot(hm.locateSlotAddr(cursor.slotIndex).Get(hm.fileStorage))
 		slot.Bin = copyBytes(slot.Bin)
@@ -203,11 +235,11 @@ func (hm *HashMap) FetchItem(cursor *Cursor) ([]byte, []byte, bool) {
 		if len(cursor.items) >= 1 {
 			item := &cursor.items[0]
 			cursor.itemIndex = 1
-			return item.Key, item.Value, true
+			return item.Key, item.Value, true, nil
 		}
 	}
 
-	return nil, nil, false
+	return nil, nil, false, nil
 }
 
 // MaxNumberOfSlotDirs returns the maximum number of the slot
@@ -341,15 +373,20 @@ func (hm *HashMap) calculateLowSlotIndex(highSlotIndex int) int {
 
 func (hm *HashMap) locateSlotAddr(slotIndex int) addrRef {
 	return addrRef{
-		ArrayAddr:    hm.locateSlotDirAddr(slotIndex >> slotDirLengthShift).Get(hm.fileStorage),
-		ElementIndex: slotIndex & ((1 << slotDirLengthShift) - 1),
+		ArrayAddr:    hm.locateSlotDirAddr(slotIndex / slotDirLength).Get(hm.fileStorage),
+		ArrayLength:  slotDirLength,
+		ElementIndex: slotIndex % slotDirLength,
 	}
 }
 
 func (hm *HashMap) locateSlotDirAddr(slotDirIndex int) addrRef {
+	// the slot directories array is accessed on every operation and may
+	// be large, so it's verified only on loading
 	return addrRef{
 		ArrayAddr:    hm.slotDirsAddr,
+		ArrayLength:  1 << hm.maxSlotDirCountShift,
 		ElementIndex: slotDirIndex,
+		IsVerified:   true,
 	}
 }
 
@@ -361,9 +398,12 @@ func (hm *HashMap) storeSlot(slot *protocol.HashSlot) int64 {
 	slotSize := slot.Size()
 	slotRawSize := make([]byte, binary.MaxVarintLen64)
 	slotRawSize = slotRawSize[:binary.PutUvarint(slotRawSize, uint64(slotSize))]
-	slotAddr, buffer := hm.fileStorage.AllocateSpace(len(slotRawSize) + slotSize)
-	i := copy(buffer, slotRawSize)
-	slot.MarshalTo(buffer[i:])
+	slotAddr, buffer := hm.fileStorage.AllocateSpace(checksum.Size + len(slotRawSize) + slotSize)
+	i := checksum.Size
+	i += copy(buffer[i:], slotRawSize)
+	i += slotSize
+	slot.MarshalTo(buffer[i-slotSize : i])
+	checksum.Update(buffer[:i])
 	return slotAddr
 }
 
@@ -372,7 +412,7 @@ func (hm *HashMap) eraseSlot(slotAddr int64) {
 		return
 	}
 
-	hm.fileStorage.FreeSpace(slotAddr)
+	freeSpace(hm.fileStorage, slotAddr)
 }
 
 func (hm *HashMap) restoreSlot(slotAddr int64, slot *protocol.HashSlot) int64 {
@@ -385,18 +425,33 @@ func (hm *HashMap) loadSlot(slotAddr int64) *protocol.HashSlot {
 		return &protocol.HashSlot{}
 	}
 
-	buffer := hm.fileStorage.AccessSpace(slotAddr)
-	n, i := binary.Uvarint(buffer)
+	buffer := accessSpace(hm.fileStorage, slotAddr)
+
+	if len(buffer) < checksum.Size {
+		corruption.Panic(slotAddr)
+	}
+
+	n, i := binary.Uvarint(buffer[checksum.Size:])
 
-	if i <= 0 {
-		panic(errCorrupted)
+	if i <= 0 || n > uint64(len(buffer)-checksum.Size-i) {
+		corruption.Panic(slotAddr)
 	}
 
+	i += checksum.Size
 	slotSize := int(n)
+
+	if !checksum.Verify(buffer[:i+slotSize]) {
+		corruption.Panic(slotAddr)
+	}
+
 	var slot protocol.HashSlot
 
 	if err := slot.Unmarshal(buffer[i : i+slotSize]); err != nil {
-		panic(errCorrupted)
+		corruption.Panic(slotAddr)
+	}
+
+	if !isValidSlot(&slot) {
+		corruption.Panic(slotAddr)
 	}
 
 	return &slot
@@ -436,7 +491,7 @@ func (hm *HashMap) maybeShrink() {
 }
 
 func (hm *HashMap) addSlot(slot *protocol.HashSlot) {
-	if hm.slotCount == hm.slotDirCount<<slotDirLengthShift {
+	if hm.slotCount == hm.slotDirCount*slotDirLength {
 		hm.addSlotDir()
 	}
 
@@ -459,7 +514,7 @@ func (hm *HashMap) removeSlot() *protocol.HashSlot {
 		hm.minSlotCountShift--
 	}
 
-	if hm.slotDirCount >= 2 && hm.slotCount == ((hm.slotDirCount-2)<<slotDirLengthShift)+1 {
+	if hm.slotDirCount >= 2 && hm.slotCount == (hm.slotDirCount-2)*slotDirLength+1 {
 		hm.removeSlotDir()
 	}
 
@@ -471,14 +526,14 @@ func (hm *HashMap) addSlotDir() {
 		hm.adjustSlotDirs(hm.maxSlotDirCountShift + 1)
 	}
 
-	slotDirAddr, _ := hm.fileStorage.AllocateSpace(8 << slotDirLengthShift)
+	slotDirAddr := allocateAddrArray(hm.fileStorage, slotDirLength)
 	hm.locateSlotDirAddr(hm.slotDirCount).Set(hm.fileStorage, slotDirAddr)
 	hm.slotDirCount++
 }
 
 func (hm *HashMap) removeSlotDir() {
 	slotDirAddr := hm.locateSlotDirAddr(hm.slotDirCount - 1).Get(hm.fileStorage)
-	hm.fileStorage.FreeSpace(slotDirAddr)
+	freeSpace(hm.fileStorage, slotDirAddr)
 	hm.slotDirCount--
 
 	if hm.maxSlotDirCountShift > minMaxSlotDirCountShift && hm.slotDirCount == 1<<(hm.maxSlotDirCountShift-2) {
@@ -487,13 +542,15 @@ func (hm *HashMap) removeSlotDir() {
 }
 
 func (hm *HashMap) adjustSlotDirs(maxSlotDirCountShift int) {
-	buffer1 := hm.fileStorage.AccessSpace(hm.slotDirsAddr)
+	buffer1 := hm.locateSlotDirAddr(0).access(hm.fileStorage)
 	buffer2 := make([]byte, len(buffer1))
 	copy(buffer2, buffer1)
-	hm.fileStorage.FreeSpace(hm.slotDirsAddr)
-	hm.slotDirsAddr, buffer1 = hm.fileStorage.AllocateSpace(8 << maxSlotDirCountShift)
-	copy(buffer1, buffer2)
+	freeSpace(hm.fileStorage, hm.slotDirsAddr)
+	hm.slotDirsAddr = allocateAddrArray(hm.fileStorage, 1<<maxSlotDirCountShift)
 	hm.maxSlotDirCountShift = maxSlotDirCountShift
+	buffer1 = hm.locateSlotDirAddr(0).access(hm.fileStorage)
+	copy(buffer1[checksum.Size:], buffer2[checksum.Size:])
+	checksum.Update(buffer1)
 }
 
 func (hm *HashMap) loadFactor() float64 {
@@ -517,25 +574,50 @@ type Cursor struct {
 
 const (
 	minMaxSlotDirCountShift = 3
-	slotDirLengthShift      = 12
+	slotDirLength           = (4<<10 - checksum.Size) / 8 // small enough to verify on every access
 	maxLoadFactor           = 1.61803398874989484820458683436563811772030917980576286213544862270526046281890244970720720418939113748475
 	minLoadFactor           = maxLoadFactor / 2
 	maxShortKeySize         = 24
 )
 
+// addrRef refers to an element of an address array, which is a space
+// of the addresses along with the checksum of them (see package checksum).
+// The checksum is verified on every access unless the array is known to
+// be verified.
 type addrRef struct {
 	ArrayAddr    int64
+	ArrayLength  int
 	ElementIndex int
+	IsVerified   bool
 }
 
 func (ar addrRef) Get(fileStorage *fsm.FileStorage) int64 {
-	buffer := fileStorage.AccessSpace(ar.ArrayAddr)[ar.ElementIndex<<3:]
-	return int64(binary.BigEndian.Uint64(buffer))
+	buffer := ar.access(fileStorage)
+	return int64(binary.BigEndian.Uint64(buffer[checksum.Size+ar.ElementIndex<<3:]))
 }
 
 func (ar addrRef) Set(fileStorage *fsm.FileStorage, value int64) {
-	buffer := fileStorage.AccessSpace(ar.ArrayAddr)[ar.ElementIndex<<3:]
-	binary.BigEndian.PutUint64(buffer, uint64(value))
+	buffer := ar.access(fileStorage)
+	binary.BigEndian.PutUint64(buffer[checksum.Size+ar.ElementIndex<<3:], uint64(value))
+	checksum.Update(buffer)
+}
+
+func (ar addrRef) access(fileStorage *fsm.FileStorage) []byte {
+	buffer := accessSpace(fileStorage, ar.ArrayAddr)
+	n := checksum.Size + ar.ArrayLength<<3
+
+	if n > len(buffer) || !(ar.IsVerified || checksum.Verify(buffer[:n])) {
+		corruption.Panic(ar.ArrayAddr)
+	}
+
+	return buffer[:n]
+}
+
+func allocateAddrArray(fileStorage *fsm.FileStorage, arrayLength int) int64 {
+	n := checksum.Size + arrayLength<<3
+	arrayAddr, buffer := fileStorage.AllocateSpace(n)
+	checksum.Update(buffer[:n])
+	return arrayAddr
 }
 
 type hashItem struct {
@@ -550,7 +632,70 @@ type items struct {
 	Value       []hashItem
 }
 
-var errCorrupted = errors.New("hashmap: corrupted")
+var (
+	// ErrCorrupted is the error which CorruptedError wraps, so
+	// errors.Is(err, ErrCorrupted) reports a corrupted hash map.
+	ErrCorrupted = corruption.ErrCorrupted
+
+	// ErrUnsupportedFormatVersion is returned when loading a hash map
+	// stored in a format of another version, e.g. by an older release.
+	ErrUnsupportedFormatVersion = format.ErrUnsupportedVersion
+)
+
+// formatVersion is the version of the format in which a hash map is
+// stored, which is bumped whenever the layout of the info, slot
+// directories or slots changes.
+const formatVersion = 1
+
+// CorruptedError is returned when corrupted data is found in a
+// hash map on the file storage, it holds the address of the space
+// where the corrupted data is.
+// The hash map may be left inconsistent by the operation failed.
+type CorruptedError = corruption.Error
+
+func accessSpace(fileStorage *fsm.FileStorage, addr int64) []byte {
+	defer corruption.Guard(addr)
+	return fileStorage.AccessSpace(addr)
+}
+
+func freeSpace(fileStorage *fsm.FileStorage, addr int64) {
+	defer corruption.Guard(addr)
+	fileStorage.FreeSpace(addr)
+}
+
+func isValidInfo(info *protocol.HashMapInfo) bool {
+	return info.SlotDirsAddr >= 0 &&
+		info.MaxSlotDirCountShift >= minMaxSlotDirCountShift &&
+		info.MaxSlotDirCountShift < 32 &&
+		info.SlotDirCount >= 1 &&
+		info.SlotDirCount <= 1<<info.MaxSlotDirCountShift &&
+		info.SlotCount >= 1 &&
+		info.SlotCount <= info.SlotDirCount*slotDirLength &&
+		info.MinSlotCountShift >= 0 &&
+		info.MinSlotCountShift < 63 &&
+		1<<info.MinSlotCountShift <= info.SlotCount &&
+		info.SlotCount < 2<<info.MinSlotCountShift &&
+		info.ItemCount >= 0 &&
+		info.PayloadSize >= 0
+}
+
+func isValidSlot(slot *protocol.HashSlot) bool {
+	n := int64(len(slot.Bin))
+
+	for i := range slot.ItemInfos {
+		itemInfo := &slot.ItemInfos[i]
+
+		if itemInfo.KeySize < 0 || itemInfo.ValueSize < 0 {
+			return false
+		}
+
+		if n -= itemInfo.KeySize + itemInfo.ValueSize; n < 0 {
+			return false
+		}
+	}
+
+	return true
+}
 
 func sumKey(key []byte) uint64 {
 	h := fnv.New64a()
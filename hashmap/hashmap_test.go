@@ -2,14 +2,18 @@ package hashmap_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/roy2220/fsm"
 	"github.com/roy2220/plainkv/hashmap"
+	"github.com/roy2220/plainkv/hashmap/internal/protocol"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,7 +28,7 @@ func TestHashMapStoreAndLoad(t *testing.T) {
 	for i := 0; i < n; i++ {
 		k := KVs[i]
 		v := KVs[len(KVs)/2+i]
-		v2, ok := hm.HasItem(k, true)
+		v2, ok, _ := hm.HasItem(k, true)
 
 		if assert.True(t, ok) {
 			assert.Equal(t, v, v2)
@@ -41,7 +45,7 @@ func TestHashMapUpdateItem(t *testing.T) {
 		k := KVs[i]
 		v := KVs[len(KVs)/2+i]
 		v2 := strconv.AppendInt(make([]byte, 0, 6), int64(i), 10)
-		v3, ok := hm.UpdateItem(k, v2, true)
+		v3, ok, _ := hm.UpdateItem(k, v2, true)
 
 		if assert.True(t, ok) {
 			assert.Equal(t, v, v3)
@@ -50,7 +54,7 @@ func TestHashMapUpdateItem(t *testing.T) {
 
 	for i := 0; i < n; i++ {
 		k := KVs[i]
-		v, ok := hm.HasItem(k, true)
+		v, ok, _ := hm.HasItem(k, true)
 
 		if assert.True(t, ok) {
 			j, err := strconv.ParseInt(string(v), 10, 32)
@@ -71,7 +75,7 @@ func TestHashMapAddOrUpdateItem(t *testing.T) {
 		k := KVs[i]
 		v := KVs[len(KVs)/2+i]
 		v2 := strconv.AppendInt(make([]byte, 0, 6), int64(i), 10)
-		v3, ok := hm.AddOrUpdateItem(k, v2, true)
+		v3, ok, _ := hm.AddOrUpdateItem(k, v2, true)
 
 		if assert.False(t, ok) {
 			assert.Equal(t, v, v3)
@@ -81,14 +85,14 @@ func TestHashMapAddOrUpdateItem(t *testing.T) {
 	for i := n; i < 2*n; i++ {
 		k := KVs[i]
 		v := strconv.AppendInt(make([]byte, 0, 6), int64(i), 10)
-		v2, ok := hm.AddOrUpdateItem(k, v, false)
+		v2, ok, _ := hm.AddOrUpdateItem(k, v, false)
 		assert.True(t, ok)
 		assert.Equal(t, []byte(nil), v2)
 	}
 
 	for i := 0; i < 2*n; i++ {
 		k := KVs[i]
-		v, ok := hm.HasItem(k, true)
+		v, ok, _ := hm.HasItem(k, true)
 
 		if assert.True(t, ok) {
 			j, err := strconv.ParseInt(string(v), 10, 32)
@@ -120,7 +124,7 @@ func TestHashMapDeleteItem(t *testing.T) {
 		j := int(tab[i])
 		k := KVs[j]
 		v := KVs[len(KVs)/2+j]
-		v2, ok := hm.DeleteItem(k, true)
+		v2, ok, _ := hm.DeleteItem(k, true)
 
 		if assert.True(t, ok) {
 			assert.Equal(t, v, v2)
@@ -131,7 +135,7 @@ func TestHashMapDeleteItem(t *testing.T) {
 		j := int(tab[i])
 		k := KVs[j]
 		v := KVs[len(KVs)/2+j]
-		v2, ok := hm.HasItem(k, true)
+		v2, ok, _ := hm.HasItem(k, true)
 
 		if assert.True(t, ok) {
 			assert.Equal(t, v, v2)
@@ -144,7 +148,7 @@ func TestHashMapDeleteItem(t *testing.T) {
 		j := int(tab[i])
 		k := KVs[j]
 		v := KVs[len(KVs)/2+j]
-		v2, ok := hm.DeleteItem(k, true)
+		v2, ok, _ := hm.DeleteItem(k, true)
 
 		if assert.True(t, ok) {
 			assert.Equal(t, v, v2)
@@ -153,7 +157,7 @@ func TestHashMapDeleteItem(t *testing.T) {
 
 	for i := 0; i < n; i++ {
 		k := KVs[i]
-		v, ok := hm.HasItem(k, false)
+		v, ok, _ := hm.HasItem(k, false)
 		assert.False(t, ok)
 		assert.Equal(t, []byte(nil), v)
 	}
@@ -190,7 +194,7 @@ func TestHashMapFetchItem(t *testing.T) {
 
 	c := hashmap.Cursor{}
 
-	for k, v, ok := hm.FetchItem(&c); ok; k, v, ok = hm.FetchItem(&c) {
+	for k, v, ok, _ := hm.FetchItem(&c); ok; k, v, ok, _ = hm.FetchItem(&c) {
 		sk := string(k)
 		sv, ok := m[sk]
 
@@ -203,6 +207,86 @@ func TestHashMapFetchItem(t *testing.T) {
 	assert.Equal(t, 0, len(m))
 }
 
+func TestHashMapCorrupted(t *testing.T) {
+	n := 1
+	hm, fs, cleanup := DoMakeHashMap(t, &n)
+	defer cleanup()
+	infoAddr := hm.Store()
+	info := append([]byte(nil), fs.AccessSpace(infoAddr)...)
+	// the format version comes first
+	copy(fs.AccessSpace(infoAddr)[4:], bytes.Repeat([]byte{0xff}, len(info)-4))
+	err := hm.Load(infoAddr)
+
+	if assert.True(t, errors.Is(err, hashmap.ErrCorrupted)) {
+		assert.Equal(t, &hashmap.CorruptedError{Addr: infoAddr}, err)
+	}
+
+	copy(fs.AccessSpace(infoAddr), info)
+	fs.AccessSpace(infoAddr)[3] = 0
+	assert.Equal(t, hashmap.ErrUnsupportedFormatVersion, hm.Load(infoAddr))
+	copy(fs.AccessSpace(infoAddr), info)
+	var info2 protocol.HashMapInfo
+
+	if !assert.NoError(t, proto.NewBuffer(info[4:]).DecodeMessage(&info2)) || !assert.NoError(t, hm.Load(infoAddr)) {
+		t.FailNow()
+	}
+
+	slotDirAddr := int64(binary.BigEndian.Uint64(fs.AccessSpace(info2.SlotDirsAddr)[4:]))
+	slotAddr := int64(binary.BigEndian.Uint64(fs.AccessSpace(slotDirAddr)[4:]))
+	slot := fs.AccessSpace(slotAddr)
+	slot[6] ^= 1 // bit rot in the slot
+	_, _, err = hm.HasItem(KVs[0], false)
+	assert.Equal(t, &hashmap.CorruptedError{Addr: slotAddr}, err)
+	_, _, _, err = hm.FetchItem(&hashmap.Cursor{})
+	assert.Equal(t, &hashmap.CorruptedError{Addr: slotAddr}, err)
+	slot[6] ^= 1
+	_, ok, err := hm.HasItem(KVs[0], false)
+
+	if assert.NoError(t, err) {
+		assert.True(t, ok)
+	}
+}
+
+func TestHashMapVerify(t *testing.T) {
+	n := 100000
+	hm, fs, cleanup := DoMakeHashMap(t, &n)
+	defer cleanup()
+
+	if !assert.NoError(t, hm.Verify()) {
+		t.FailNow()
+	}
+
+	for i := 0; i < n-10; i++ {
+		hm.DeleteItem(KVs[i], false)
+	}
+
+	if !assert.NoError(t, hm.Verify()) {
+		t.FailNow()
+	}
+
+	infoAddr := hm.Store()
+	var info protocol.HashMapInfo
+
+	if !assert.NoError(t, proto.NewBuffer(fs.AccessSpace(infoAddr)[4:]).DecodeMessage(&info)) {
+		t.FailNow()
+	}
+
+	info.ItemCount++
+	buffer := proto.NewBuffer(nil)
+	buffer.EncodeMessage(&info)
+	copy(fs.AccessSpace(infoAddr)[4:], buffer.Bytes())
+
+	if !assert.NoError(t, hm.Load(infoAddr)) {
+		t.FailNow()
+	}
+
+	err := hm.Verify()
+
+	if assert.True(t, errors.Is(err, hashmap.ErrCorrupted)) {
+		assert.Equal(t, &hashmap.CorruptedError{Addr: info.SlotDirsAddr, Reason: "number of items 10, expected 11"}, err)
+	}
+}
+
 func MakeHashMap(t *testing.T, numberOfHashItems *int) (*hashmap.HashMap, func()) {
 	hm, _, cleanup := DoMakeHashMap(t, numberOfHashItems)
 	return hm, cleanup
@@ -226,7 +310,7 @@ func DoMakeHashMap(t *testing.T, numberOfHashItems *int) (*hashmap.HashMap, *fsm
 	}
 
 	for i := 0; i < *numberOfHashItems; i++ {
-		_, ok := hm.AddItem(KVs[i], KVs[m+i], false)
+		_, ok, _ := hm.AddItem(KVs[i], KVs[m+i], false)
 
 		if !assert.True(t, ok) {
 			t.FailNow()
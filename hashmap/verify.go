@@ -0,0 +1,101 @@
+package hashmap
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Verify walks through the whole hash map and checks the integrity
+// of it, that is:
+//
+//   - the slot directories and the slots are intact;
+//   - each item is in the slot its key sum leads to, and the key sum
+//     of each long key is right;
+//   - the keys are unique;
+//   - the numbers of the slot directories, slots and items, and the
+//     payload size match the counters.
+//
+// If a violation is found, it returns a CorruptedError holding the
+// address of the space in question along with the reason.
+func (hm *HashMap) Verify() (err error) {
+	defer corruption.Recover(&err)
+	slotDirsAddrRef := hm.locateSlotDirAddr(0)
+	slotDirsAddrRef.IsVerified = false
+	slotDirsAddrRef.access(hm.fileStorage)
+	hm.verifyCounts()
+	itemCount := 0
+	payloadSize := 0
+
+	for slotIndex := 0; slotIndex < hm.slotCount; slotIndex++ {
+		slotAddr := hm.locateSlotAddr(slotIndex).Get(hm.fileStorage)
+		items := unpackSlot(hm.loadSlot(slotAddr))
+		keys := make(map[string]struct{}, len(items))
+
+		for i := range items {
+			item := &items[i]
+			keySum := sumKey(item.Key)
+
+			if len(item.Key) <= maxShortKeySize {
+				// key sums of short keys are omitted
+				if item.KeySum != 0 {
+					corruption.Panicf(slotAddr, "item #%d of slot #%d with key sum", i, slotIndex)
+				}
+			} else if item.KeySum != keySum {
+				corruption.Panicf(slotAddr, "item #%d of slot #%d with wrong key sum", i, slotIndex)
+			}
+
+			if hm.calculateSlotIndex(keySum) != slotIndex {
+				corruption.Panicf(slotAddr, "item #%d of slot #%d in wrong slot", i, slotIndex)
+			}
+
+			if _, ok := keys[string(item.Key)]; ok {
+				corruption.Panicf(slotAddr, "item #%d of slot #%d with duplicate key", i, slotIndex)
+			}
+
+			keys[string(item.Key)] = struct{}{}
+			payloadSize += len(item.Key) + len(item.Value)
+		}
+
+		itemCount += len(items)
+	}
+
+	if itemCount != hm.itemCount {
+		corruption.Panicf(hm.slotDirsAddr, "number of items %d, expected %d", itemCount, hm.itemCount)
+	}
+
+	if payloadSize != hm.payloadSize {
+		corruption.Panicf(hm.slotDirsAddr, "payload size %d, expected %d", payloadSize, hm.payloadSize)
+	}
+
+	return nil
+}
+
+func (hm *HashMap) verifyCounts() {
+	if hm.slotCount < hm.minSlotCount() || hm.slotCount >= hm.maxSlotCountPlusOne() {
+		corruption.Panicf(hm.slotDirsAddr, "number of slots %d out of range [%d, %d)",
+			hm.slotCount, hm.minSlotCount(), hm.maxSlotCountPlusOne())
+	}
+
+	// a spare slot directory is kept after the slots shrink
+	minSlotDirCount := (hm.slotCount + slotDirLength - 1) / slotDirLength
+	maxSlotDirCount := minSlotDirCount + 1
+
+	if maxSlotDirCount > hm.MaxNumberOfSlotDirs() {
+		maxSlotDirCount = hm.MaxNumberOfSlotDirs()
+	}
+
+	if hm.slotDirCount < minSlotDirCount || hm.slotDirCount > maxSlotDirCount {
+		corruption.Panicf(hm.slotDirsAddr, "number of slot directories %d out of range [%d, %d]",
+			hm.slotDirCount, minSlotDirCount, maxSlotDirCount)
+	}
+
+	if hm.maxSlotDirCountShift > minMaxSlotDirCountShift && hm.slotDirCount <= 1<<(hm.maxSlotDirCountShift-2) {
+		corruption.Panicf(hm.slotDirsAddr, "too few slot directories %d for %d", hm.slotDirCount, hm.MaxNumberOfSlotDirs())
+	}
+
+	for slotDirIndex := 0; slotDirIndex < hm.slotDirCount; slotDirIndex++ {
+		addrRef{
+			ArrayAddr:   hm.locateSlotDirAddr(slotDirIndex).Get(hm.fileStorage),
+			ArrayLength: slotDirLength,
+		}.access(hm.fileStorage)
+	}
+}
@@ -0,0 +1,147 @@
+package plainkv_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roy2220/fsm"
+	"github.com/roy2220/plainkv"
+	"github.com/stretchr/testify/assert"
+)
+
+// MakeOrderedDict creates an ordered dictionary on the file named
+// after the given test, which is removed on the test's cleanup.
+func MakeOrderedDict(t *testing.T, options ...plainkv.OrderedDictOption) (*plainkv.OrderedDict, string) {
+	fn := MakeDictFileName(t)
+	od, err := plainkv.OpenOrderedDict(fn, true, options...)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return od, fn
+}
+
+func ReopenOrderedDict(t *testing.T, fileName string, options ...plainkv.OrderedDictOption) *plainkv.OrderedDict {
+	od, err := plainkv.OpenOrderedDict(fileName, false, options...)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return od
+}
+
+// MakeDict creates a dictionary on the file named after the given
+// test, which is removed on the test's cleanup.
+func MakeDict(t *testing.T) (*plainkv.Dict, string) {
+	fn := MakeDictFileName(t)
+	d, err := plainkv.OpenDict(fn, true)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return d, fn
+}
+
+func ReopenDict(t *testing.T, fileName string) *plainkv.Dict {
+	d, err := plainkv.OpenDict(fileName, false)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return d
+}
+
+// MakeDictFileName returns the name of the data file for the given
+// test, and removes the files of the dictionary both now, as left by
+// a previous run, and on the test's cleanup.
+func MakeDictFileName(t *testing.T) string {
+	fn := "./testdata/" + strings.ReplaceAll(t.Name(), "/", "_") + ".tmp"
+	RemoveDictFiles(fn)
+	t.Cleanup(func() { RemoveDictFiles(fn) })
+	return fn
+}
+
+// RemoveDictFiles removes the data file of the given name and all the
+// companion files, i.e. the working, idle, spare and temporary files
+// and the write-ahead log.
+func RemoveDictFiles(fileName string) {
+	fns, _ := filepath.Glob(fileName + "*")
+
+	for _, fn := range fns {
+		os.Remove(fn)
+	}
+}
+
+func AssertNoDictFiles(t *testing.T, fileName string) {
+	fns, err := filepath.Glob(fileName + "*")
+
+	if assert.NoError(t, err) {
+		assert.Empty(t, fns)
+	}
+}
+
+// CorruptInfo corrupts the info of the B+ tree or the hash map in the
+// given data file, or the info of the data file itself, keeping the
+// format version.
+func CorruptInfo(t *testing.T, fileName string, isDataFileInfo bool) (int64, func()) {
+	return ModifyInfo(t, fileName, isDataFileInfo, func(info []byte) {
+		for i := 4; i < len(info); i++ {
+			info[i] = 0xff
+		}
+	})
+}
+
+func ModifyInfo(t *testing.T, fileName string, isDataFileInfo bool, modify func(info []byte)) (int64, func()) {
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fileName, false)) {
+		t.FailNow()
+	}
+
+	addr := fs.PrimarySpace()
+
+	if !isDataFileInfo {
+		// the info of the data file holds the address of the info at [12:20]
+		addr = int64(binary.BigEndian.Uint64(fs.AccessSpace(addr)[12:]))
+	}
+
+	info := fs.AccessSpace(addr)
+	data := append([]byte(nil), info...)
+	modify(info)
+
+	if !assert.NoError(t, fs.Close()) {
+		t.FailNow()
+	}
+
+	return addr, func() {
+		fs := new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.Open(fileName, false)) {
+			t.FailNow()
+		}
+
+		copy(fs.AccessSpace(addr), data)
+
+		if !assert.NoError(t, fs.Close()) {
+			t.FailNow()
+		}
+	}
+}
+
+func ReadKeys(it plainkv.OrderedDictIterator) []string {
+	var ks []string
+
+	for ; !it.IsAtEnd(); it.Advance() {
+		k, _ := it.ReadKeyAll()
+		ks = append(ks, string(k))
+	}
+
+	return ks
+}
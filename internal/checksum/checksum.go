@@ -0,0 +1,37 @@
+// Package checksum implements the CRC-32C checksums of the spaces on
+// a file storage, shared by the packages of the module.
+//
+// A space with a checksum is laid out as:
+//
+//	+----------+------+
+//	| checksum | data |
+//	+----------+------+
+//
+// where the checksum, of Size bytes, covers the data.
+package checksum
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Size is the size of a checksum.
+const Size = 4
+
+// Update computes the checksum of the data in the given space and
+// then stores the checksum to the space.
+func Update(space []byte) {
+	binary.BigEndian.PutUint32(space, crc32.Checksum(space[Size:], table))
+}
+
+// Verify reports whether the checksum stored in the given space
+// matches the data in the space.
+func Verify(space []byte) bool {
+	if len(space) < Size {
+		return false
+	}
+
+	return binary.BigEndian.Uint32(space) == crc32.Checksum(space[Size:], table)
+}
+
+var table = crc32.MakeTable(crc32.Castagnoli)
@@ -0,0 +1,75 @@
+// Package corruption implements the error of corrupted data on a file
+// storage, shared by the packages of the module.
+package corruption
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorrupted is the error which Error wraps.
+var ErrCorrupted = errors.New("plainkv: corrupted")
+
+// Error represents an error of corrupted data found on a file storage.
+type Error struct {
+	// Addr is the address of the space where the corrupted data is.
+	Addr int64
+
+	// Reason describes what is wrong with the data (optional).
+	Reason string
+}
+
+// Error implements error.Error.
+func (e *Error) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("plainkv: corrupted data at address %d", e.Addr)
+	}
+
+	return fmt.Sprintf("plainkv: corrupted data at address %d: %s", e.Addr, e.Reason)
+}
+
+// Unwrap returns ErrCorrupted.
+func (e *Error) Unwrap() error {
+	return ErrCorrupted
+}
+
+// Panic panics with an Error of the given address.
+// Internally corrupted data is reported by panicking, which is
+// recovered by Recover on the boundaries of the public methods.
+func Panic(addr int64) {
+	panic(&Error{Addr: addr})
+}
+
+// Panicf is the version of Panic with a reason formatted according
+// to the given format specifier.
+func Panicf(addr int64, format string, args ...interface{}) {
+	panic(&Error{addr, fmt.Sprintf(format, args...)})
+}
+
+// Guard converts a panic, raised from accessing the space at the
+// given address, to a panic with an Error of the address.
+// It must be deferred directly, e.g. defer corruption.Guard(addr).
+func Guard(addr int64) {
+	if r := recover(); r != nil {
+		if _, ok := r.(*Error); ok {
+			panic(r)
+		}
+
+		Panic(addr)
+	}
+}
+
+// Recover stops a panic with an Error and then stores the Error to
+// the given error, other panics are continued.
+// It must be deferred directly, e.g. defer corruption.Recover(&err).
+func Recover(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*Error)
+
+		if !ok {
+			panic(r)
+		}
+
+		*err = e
+	}
+}
@@ -0,0 +1,9 @@
+// Package format implements the error of unsupported on-disk formats,
+// shared by the packages of the module.
+package format
+
+import "errors"
+
+// ErrUnsupportedVersion is returned when loading data stored in a
+// format of another version, e.g. written by an older release.
+var ErrUnsupportedVersion = errors.New("plainkv: unsupported format version")
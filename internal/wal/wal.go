@@ -0,0 +1,393 @@
+// Package wal implements a write-ahead log.
+//
+// A log file starts with a header of 12 bytes:
+//
+//   - the number of the checkpoint which the log is based on (8 bytes);
+//   - the CRC-32C checksum of the above (4 bytes).
+//
+// The header is followed by the entries, each of which is:
+//
+//   - the size of the payload (4 bytes);
+//   - the CRC-32C checksum of the payload (4 bytes);
+//   - the payload, the operations in the entry one after another, each
+//     of which is the operation type (1 byte), the key size (uvarint)
+//     and the key, followed by the value size (uvarint) and the value
+//     unless the operation type is OperationDelete.
+//
+// An entry is appended and then synced as a whole, so a crash leaves
+// at most one torn entry at the end of the log, which is discarded on
+// replay. A log is reset by truncating it and then writing the header,
+// so a crash while resetting leaves a log without a valid header, which
+// is reset again on open.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/roy2220/plainkv/internal/corruption"
+)
+
+// Log represents a write-ahead log on a file.
+// The log starts with a header holding the number of the checkpoint
+// which the log is based on, i.e. the entries in the log are the
+// changes since that checkpoint.
+type Log struct {
+	file             *os.File
+	size             int64
+	checkpointNumber uint64
+}
+
+// Init initializes the log and returns it.
+func (l *Log) Init() *Log {
+	l.file = nil
+	l.size = 0
+	l.checkpointNumber = 0
+	return l
+}
+
+// Open opens the log on the given file, the file will be
+// created if not exists.
+// If the log has no valid header, as a log created newly or torn
+// by a crash while resetting, it's reset with checkpoint number 0.
+func (l *Log) Open(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = fileInfo.Size()
+
+	if err := l.readHeader(); err != nil {
+		if err != errCorrupted {
+			file.Close()
+			return err
+		}
+
+		if err := l.Reset(0); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// Replay reads the entries in the log in order and passes them
+// to the given callback.
+// A torn entry at the end of the log (left by a crash while
+// appending) is discarded, whereas a broken entry followed by others
+// can't be left by a crash, for which it returns a corruption.Error
+// of the offset of the entry in the log.
+func (l *Log) Replay(callback func(entry Entry) error) error {
+	if l.size < headerSize {
+		// the header failed to be written on resetting, the log is empty
+		return nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(l.file, headerSize, l.size-headerSize))
+	offset := int64(headerSize)
+
+	for {
+		entry, entrySize, err := readEntry(reader, l.size-offset)
+
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			if err == errCorrupted {
+				if offset+int64(entrySize) == l.size {
+					break
+				}
+
+				return &corruption.Error{Addr: offset, Reason: "broken write-ahead log entry"}
+			}
+
+			return err
+		}
+
+		if err := callback(entry); err != nil {
+			return err
+		}
+
+		offset += int64(entrySize)
+	}
+
+	if offset == l.size {
+		return nil
+	}
+
+	if err := l.file.Truncate(offset); err != nil {
+		return err
+	}
+
+	l.size = offset
+	return nil
+}
+
+// Append appends the given entry to the log and then commits it to
+// stable storage, so the entry survives a crash once it returns
+// without an error.
+func (l *Log) Append(entry Entry) error {
+	if l.size < headerSize {
+		// the header failed to be written on resetting
+		return errNoHeader
+	}
+
+	buffer := encodeEntry(entry)
+
+	if _, err := l.file.WriteAt(buffer, l.size); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+
+	l.size += int64(len(buffer))
+	return nil
+}
+
+// Reset discards all entries in the log and then bases the log on
+// the checkpoint of the given number.
+func (l *Log) Reset(checkpointNumber uint64) error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+
+	l.size = 0
+	var header [headerSize]byte
+	binary.BigEndian.PutUint64(header[0:], checkpointNumber)
+	binary.BigEndian.PutUint32(header[8:], crc32.Checksum(header[:8], crc32Table))
+
+	if _, err := l.file.WriteAt(header[:], 0); err != nil {
+		return err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.size = headerSize
+	l.checkpointNumber = checkpointNumber
+	return nil
+}
+
+// CheckpointNumber returns the number of the checkpoint which the log
+// is based on.
+func (l *Log) CheckpointNumber() uint64 {
+	return l.checkpointNumber
+}
+
+// Size returns the size of the entries in the log.
+func (l *Log) Size() int64 {
+	if l.size < headerSize {
+		return 0
+	}
+
+	return l.size - headerSize
+}
+
+func (l *Log) readHeader() error {
+	var header [headerSize]byte
+
+	if l.size < headerSize {
+		return errCorrupted
+	}
+
+	if _, err := l.file.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+
+	if crc32.Checksum(header[:8], crc32Table) != binary.BigEndian.Uint32(header[8:]) {
+		return errCorrupted
+	}
+
+	l.checkpointNumber = binary.BigEndian.Uint64(header[0:])
+	return nil
+}
+
+// Entry represents an entry in a log, the operations in which
+// are logged atomically.
+type Entry []Operation
+
+// Operation represents an operation on a dictionary.
+type Operation struct {
+	Type  OperationType
+	Key   []byte
+	Value []byte
+}
+
+// OperationType represents a type of operations.
+type OperationType uint8
+
+const (
+	// OperationPut puts a key with a value.
+	OperationPut = OperationType(1 + iota)
+
+	// OperationDelete deletes a key.
+	OperationDelete
+
+	// OperationDeleteRange deletes the keys in a range, from the
+	// key to the value.
+	OperationDeleteRange
+)
+
+const (
+	headerSize      = 12
+	entryHeaderSize = 8
+)
+
+var (
+	crc32Table   = crc32.MakeTable(crc32.Castagnoli)
+	errCorrupted = errors.New("wal: corrupted")
+	errNoHeader  = errors.New("wal: no header")
+)
+
+func encodeEntry(entry Entry) []byte {
+	payloadSize := 0
+
+	for i := range entry {
+		operation := &entry[i]
+		payloadSize += 1 + binary.MaxVarintLen64 + len(operation.Key)
+
+		if operation.Type.hasValue() {
+			payloadSize += binary.MaxVarintLen64 + len(operation.Value)
+		}
+	}
+
+	buffer := make([]byte, entryHeaderSize+payloadSize)
+	i := entryHeaderSize
+
+	for j := range entry {
+		operation := &entry[j]
+		buffer[i] = byte(operation.Type)
+		i++
+		i += binary.PutUvarint(buffer[i:], uint64(len(operation.Key)))
+		i += copy(buffer[i:], operation.Key)
+
+		if operation.Type.hasValue() {
+			i += binary.PutUvarint(buffer[i:], uint64(len(operation.Value)))
+			i += copy(buffer[i:], operation.Value)
+		}
+	}
+
+	buffer = buffer[:i]
+	payload := buffer[entryHeaderSize:]
+	binary.BigEndian.PutUint32(buffer[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buffer[4:], crc32.Checksum(payload, crc32Table))
+	return buffer
+}
+
+// readEntry reads an entry, of the given maximum size, from the given
+// reader. An entry whose size exceeds the maximum, i.e. going beyond
+// the end of the log, is taken as torn, without allocating the size.
+// On errCorrupted, it returns the size of the entry as well.
+func readEntry(reader io.Reader, maxEntrySize int64) (Entry, int, error) {
+	var header [entryHeaderSize]byte
+
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+
+	payloadSize := binary.BigEndian.Uint32(header[0:])
+
+	if int64(payloadSize) > maxEntrySize-entryHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, payloadSize)
+
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, 0, err
+	}
+
+	entrySize := entryHeaderSize + len(payload)
+
+	if crc32.Checksum(payload, crc32Table) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, entrySize, errCorrupted
+	}
+
+	entry, err := decodeEntry(payload)
+
+	if err != nil {
+		return nil, entrySize, err
+	}
+
+	return entry, entrySize, nil
+}
+
+func decodeEntry(payload []byte) (Entry, error) {
+	var entry Entry
+
+	for len(payload) >= 1 {
+		operation := Operation{Type: OperationType(payload[0])}
+		payload = payload[1:]
+
+		if operation.Type < OperationPut || operation.Type > OperationDeleteRange {
+			return nil, errCorrupted
+		}
+
+		key, payload2, ok := decodeBytes(payload)
+
+		if !ok {
+			return nil, errCorrupted
+		}
+
+		operation.Key, payload = key, payload2
+
+		if operation.Type.hasValue() {
+			value, payload2, ok := decodeBytes(payload)
+
+			if !ok {
+				return nil, errCorrupted
+			}
+
+			operation.Value, payload = value, payload2
+		}
+
+		entry = append(entry, operation)
+	}
+
+	return entry, nil
+}
+
+func (ot OperationType) hasValue() bool {
+	return ot == OperationPut || ot == OperationDeleteRange
+}
+
+func decodeBytes(data []byte) ([]byte, []byte, bool) {
+	n, i := binary.Uvarint(data)
+
+	if i <= 0 || n > uint64(len(data)-i) {
+		return nil, nil, false
+	}
+
+	j := i + int(n)
+	return data[i:j], data[j:], true
+}
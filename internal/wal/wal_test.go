@@ -0,0 +1,190 @@
+package wal_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/roy2220/plainkv/internal/corruption"
+	"github.com/roy2220/plainkv/internal/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogAppendAndReplay(t *testing.T) {
+	l := MakeLog(t)
+	entries := MakeEntries(100)
+
+	for _, e := range entries {
+		if !assert.NoError(t, l.Append(e)) {
+			t.FailNow()
+		}
+	}
+
+	l = ReopenLog(t, l)
+	assert.Equal(t, uint64(0), l.CheckpointNumber())
+	assert.Equal(t, entries, ReplayLog(t, l))
+	assert.NoError(t, l.Reset(7))
+	assert.Equal(t, int64(0), l.Size())
+	l = ReopenLog(t, l)
+	assert.Equal(t, uint64(7), l.CheckpointNumber())
+	assert.Equal(t, []wal.Entry(nil), ReplayLog(t, l))
+}
+
+func TestLogReplayTornEntry(t *testing.T) {
+	l := MakeLog(t)
+	entries := MakeEntries(10)
+
+	for _, e := range entries {
+		if !assert.NoError(t, l.Append(e)) {
+			t.FailNow()
+		}
+	}
+
+	size := l.Size()
+	l.Close()
+	fi, err := os.Stat(FileName)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = os.Truncate(FileName, fi.Size()-1)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	l = ReopenLog(t, l)
+	assert.Equal(t, entries[:len(entries)-1], ReplayLog(t, l))
+	assert.NoError(t, l.Append(entries[len(entries)-1]))
+	assert.Equal(t, size, l.Size())
+	l = ReopenLog(t, l)
+	assert.Equal(t, entries, ReplayLog(t, l))
+}
+
+func TestLogReplayBrokenEntry(t *testing.T) {
+	l := MakeLog(t)
+	entries := MakeEntries(10)
+
+	for _, e := range entries {
+		if !assert.NoError(t, l.Append(e)) {
+			t.FailNow()
+		}
+	}
+
+	l.Close()
+	data, err := ioutil.ReadFile(FileName)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// the payload of the first entry, which is followed by others
+	data[12+8]++
+	assert.NoError(t, ioutil.WriteFile(FileName, data, 0666))
+	l = ReopenLog(t, l)
+	err = l.Replay(func(wal.Entry) error { return nil })
+	var corruptedError *corruption.Error
+
+	if assert.True(t, errors.As(err, &corruptedError)) {
+		assert.Equal(t, int64(12), corruptedError.Addr)
+	}
+
+	// the size of the first entry, beyond the end of the log
+	data[12+8]--
+	binary.BigEndian.PutUint32(data[12:], math.MaxUint32)
+	assert.NoError(t, ioutil.WriteFile(FileName, data, 0666))
+	l = ReopenLog(t, l)
+	assert.Equal(t, []wal.Entry(nil), ReplayLog(t, l))
+	assert.Equal(t, int64(0), l.Size())
+}
+
+func TestLogTornHeader(t *testing.T) {
+	l := MakeLog(t)
+	assert.NoError(t, l.Reset(7))
+	assert.NoError(t, l.Append(MakeEntries(1)[0]))
+	l.Close()
+	err := os.Truncate(FileName, 5)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	l = ReopenLog(t, l)
+	assert.Equal(t, uint64(0), l.CheckpointNumber())
+	assert.Equal(t, int64(0), l.Size())
+	assert.Equal(t, []wal.Entry(nil), ReplayLog(t, l))
+}
+
+const FileName = "../../testdata/wal.tmp"
+
+func MakeLog(t *testing.T) *wal.Log {
+	os.Remove(FileName)
+	l := new(wal.Log).Init()
+	err := l.Open(FileName)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+		os.Remove(FileName)
+	})
+
+	return l
+}
+
+func ReopenLog(t *testing.T, l *wal.Log) *wal.Log {
+	l.Close()
+	err := l.Init().Open(FileName)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return l
+}
+
+func ReplayLog(t *testing.T, l *wal.Log) []wal.Entry {
+	var entries []wal.Entry
+
+	err := l.Replay(func(e wal.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return entries
+}
+
+func MakeEntries(n int) []wal.Entry {
+	entries := make([]wal.Entry, n)
+
+	for i := range entries {
+		e := wal.Entry{}
+
+		for j := 0; j <= i%4; j++ {
+			k := []byte(strconv.Itoa(i*10 + j))
+
+			if j == 1 {
+				e = append(e, wal.Operation{Type: wal.OperationDelete, Key: k})
+			} else if j == 3 {
+				e = append(e, wal.Operation{Type: wal.OperationDeleteRange, Key: k, Value: []byte(strconv.Itoa(i*10 + 9))})
+			} else {
+				e = append(e, wal.Operation{Type: wal.OperationPut, Key: k, Value: []byte(strconv.Itoa(i))})
+			}
+		}
+
+		entries[i] = e
+	}
+
+	return entries
+}
@@ -1,58 +1,152 @@
 package plainkv
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/roy2220/fsm"
 	"github.com/roy2220/plainkv/bptree"
+	"github.com/roy2220/plainkv/internal/wal"
 )
 
 // OrderedDict represents an ordered dictionary.
+// It is safe for concurrent use by multiple goroutines: reads run
+// in parallel while writes are serialized and exclude reads.
+// An iterator live while a write runs remains valid: it goes on from
+// the key it's at, so it sees the keys added after the key and not the
+// keys deleted. To read a consistent view while writes continue, take
+// a snapshot.
 type OrderedDict struct {
-	fileStorage fsm.FileStorage
-	bpTree      bptree.BPTree
+	mutex    sync.RWMutex
+	dataFile dataFile
+	bpTree   bptree.BPTree
+	version  int64 // increased on closing
 }
 
-// OpenOrderedDict opens an ordered dictionary on the given file.
-func OpenOrderedDict(fileName string, createFileIfNotExists bool) (*OrderedDict, error) {
+// OpenOrderedDict opens an ordered dictionary on the given file with
+// the given options.
+// The changes not checkpointed by a previous close, due to a crash,
+// are recovered from the write-ahead log.
+// If the options are invalid, e.g. with ErrInvalidPageSize, it returns
+// the error before touching any file.
+// If the file was written in a format of another version, it returns
+// ErrUnsupportedFormatVersion, or if the dictionary was created with
+// a key comparer of another name, it returns ErrKeyComparerMismatch.
+func OpenOrderedDict(fileName string, createFileIfNotExists bool, options ...OrderedDictOption) (*OrderedDict, error) {
+	if err := bptree.CheckOptions(options...); err != nil {
+		return nil, err
+	}
+
 	var od OrderedDict
-	od.fileStorage.Init()
 
-	if err := od.fileStorage.Open(fileName, createFileIfNotExists); err != nil {
+	if err := od.dataFile.Open(fileName, createFileIfNotExists); err != nil {
 		return nil, err
 	}
 
-	od.bpTree.Init(&od.fileStorage)
+	od.bpTree.Init(&od.dataFile.fileStorage, options...)
 
-	if bpTreeInfoAddr := od.fileStorage.PrimarySpace(); bpTreeInfoAddr < 0 {
-		od.bpTree.Create()
+	if bpTreeInfoAddr := od.dataFile.InfoAddr(); bpTreeInfoAddr < 0 {
+		if err := od.bpTree.Create(); err != nil {
+			od.dataFile.Discard()
+			return nil, err
+		}
 	} else {
-		od.bpTree.Load(bpTreeInfoAddr)
+		if err := od.bpTree.Load(bpTreeInfoAddr); err != nil {
+			od.dataFile.Discard()
+			return nil, err
+		}
+	}
+
+	if err := od.dataFile.ReplayLog(od.applyOperation); err != nil {
+		od.dataFile.Discard()
+		return nil, err
 	}
 
 	return &od, nil
 }
 
-// Close closes the dictionary.
+// Close checkpoints and then closes the dictionary.
+// If it fails to checkpoint, the dictionary is left open.
+// If the dictionary has been poisoned by a write, it's closed without
+// checkpointing, and the next open recovers the logged writes.
 func (od *OrderedDict) Close() error {
-	bpTreeInfoAddr := od.bpTree.Store()
-	od.fileStorage.SetPrimarySpace(bpTreeInfoAddr)
-	return od.fileStorage.Close()
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	if od.dataFile.IsPoisoned() {
+		od.version++
+		return od.dataFile.Discard()
+	}
+
+	if err := od.dataFile.Checkpoint(od.applyLog); err != nil {
+		return err
+	}
+
+	od.version++
+	return od.dataFile.Close(od.bpTree.Store())
+}
+
+// Sync checkpoints the dictionary without closing it: all changes
+// are made durable in the data file and the write-ahead log is
+// discarded.
+// The checkpoint is made from the write-ahead log, so its cost grows
+// with the changes since the last checkpoint rather than with the size
+// of the dictionary. If it fails, the dictionary goes on as if not
+// checkpointed.
+func (od *OrderedDict) Sync() error {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	return od.dataFile.Checkpoint(od.applyLog)
 }
 
 // Set sets the value for the given key in the dictionary to the
 // given value.
 // If the key already exists it replaces the value and then
 // returns the replaced value (optional).
-func (od *OrderedDict) Set(key []byte, value []byte, returnReplacedValue bool) []byte {
-	value, _ = od.bpTree.AddOrUpdateRecord(key, value, returnReplacedValue)
-	return value
+// The change is durable once it returns without an error.
+func (od *OrderedDict) Set(key []byte, value []byte, returnReplacedValue bool) ([]byte, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	if err := od.logPut(key, value); err != nil {
+		return nil, err
+	}
+
+	value2, _, err := od.bpTree.AddOrUpdateRecord(key, value, returnReplacedValue)
+
+	if err != nil {
+		return nil, od.dataFile.Poison(err)
+	}
+
+	return value2, nil
 }
 
 // SetIfExists sets the value for the given key in the dictionary
 // to the given value.
 // If the key exists, it replaces the value and then returns true
 // and the replaced value (optional), otherwise it returns false.
-func (od *OrderedDict) SetIfExists(key []byte, value []byte, returnReplacedValue bool) ([]byte, bool) {
-	return od.bpTree.UpdateRecord(key, value, returnReplacedValue)
+// The change is durable once it returns without an error.
+func (od *OrderedDict) SetIfExists(key []byte, value []byte, returnReplacedValue bool) ([]byte, bool, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	_, ok, err := od.bpTree.HasRecord(key, false)
+
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if err := od.logPut(key, value); err != nil {
+		return nil, false, err
+	}
+
+	value2, _, err := od.bpTree.UpdateRecord(key, value, returnReplacedValue)
+
+	if err != nil {
+		return nil, false, od.dataFile.Poison(err)
+	}
+
+	return value2, true, nil
 }
 
 // SetIfNotExists sets the value for the given key in the
@@ -60,30 +154,228 @@ func (od *OrderedDict) SetIfExists(key []byte, value []byte, returnReplacedValue
 // If the key doesn't exists, it adds the key with the value and
 // then returns true, otherwise it returns false and the present
 // value (optional).
-func (od *OrderedDict) SetIfNotExists(key []byte, value []byte, returnPresentValue bool) ([]byte, bool) {
-	return od.bpTree.AddRecord(key, value, returnPresentValue)
+// The change is durable once it returns without an error.
+func (od *OrderedDict) SetIfNotExists(key []byte, value []byte, returnPresentValue bool) ([]byte, bool, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	value2, ok, err := od.bpTree.HasRecord(key, returnPresentValue)
+
+	if err != nil || ok {
+		return value2, false, err
+	}
+
+	if err := od.logPut(key, value); err != nil {
+		return nil, false, err
+	}
+
+	if _, _, err := od.bpTree.AddRecord(key, value, false); err != nil {
+		return nil, false, od.dataFile.Poison(err)
+	}
+
+	return nil, true, nil
 }
 
 // Clear clears the given key in the dictionary.
 // If the key exists, it deletes the key and then returns true
 // and the removed value (optional), otherwise if returns false.
-func (od *OrderedDict) Clear(key []byte, returnRemovedValue bool) ([]byte, bool) {
-	return od.bpTree.DeleteRecord(key, returnRemovedValue)
+// The change is durable once it returns without an error.
+func (od *OrderedDict) Clear(key []byte, returnRemovedValue bool) ([]byte, bool, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	_, ok, err := od.bpTree.HasRecord(key, false)
+
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if err := od.logDelete(key); err != nil {
+		return nil, false, err
+	}
+
+	value, _, err := od.bpTree.DeleteRecord(key, returnRemovedValue)
+
+	if err != nil {
+		return nil, false, od.dataFile.Poison(err)
+	}
+
+	return value, true, nil
+}
+
+// ClearRange clears the keys in the range between the given bounds
+// in the dictionary, each of which may be inclusive, exclusive or
+// unbounded, and then returns the number of the keys cleared.
+// Rather than one by one, the keys are cleared a whole leaf or subtree
+// of the B+ tree at a time, so clearing a large range is fast.
+// The change is durable once it returns without an error.
+func (od *OrderedDict) ClearRange(minBound Bound, maxBound Bound) (int, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	n, err := od.bpTree.CountRange(minBound, maxBound)
+
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	if err := od.logDeleteRange(minBound, maxBound); err != nil {
+		return 0, err
+	}
+
+	if n, err = od.bpTree.DeleteRange(minBound, maxBound); err != nil {
+		return 0, od.dataFile.Poison(err)
+	}
+
+	return n, nil
+}
+
+// BulkLoad loads the keys/values in the given source, in strictly
+// ascending order of keys, into the dictionary, which must be empty,
+// and then returns the number of the keys loaded.
+// Rather than setting the keys one by one, it builds the B+ tree
+// bottom-up with packed leaves and non-leaves, so loading a large
+// sorted data set is fast and makes a dense file. The keys loaded
+// aren't logged, instead the dictionary is checkpointed afterwards by
+// building a copy of the B+ tree in the same way.
+// If the dictionary isn't empty, it returns ErrNotEmpty, and if the
+// keys aren't in strictly ascending order, it returns ErrKeyOutOfOrder.
+// The keys are loaded all or nothing.
+// The change is durable once it returns without an error.
+func (od *OrderedDict) BulkLoad(recordSource OrderedDictRecordSource) (int, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	n, err := od.bpTree.Build(recordSource)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if n >= 1 {
+		if err := od.dataFile.Rebuild(od.buildCopy); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// IngestSorted sets the keys/values in the given source, in strictly
+// ascending order of keys, in the dictionary, and then returns the
+// number of the keys added, the values of the keys present are
+// replaced.
+// Rather than setting the keys one by one from the root of the B+
+// tree, it merges them into the leaves in order, so ingesting a large
+// sorted stream overlapping a narrow key range is fast. The keys are
+// read, logged and then set in chunks of about 1 MiB.
+// If the keys aren't in strictly ascending order, it returns
+// ErrKeyOutOfOrder. On such an error or an error from the source, the
+// keys before are kept set.
+// The change is durable once it returns without an error.
+func (od *OrderedDict) IngestSorted(recordSource OrderedDictRecordSource) (int, error) {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	keyComparer := od.bpTree.KeyComparer()
+	var lastKey []byte
+	n := 0
+
+	for {
+		entry, err := readIngestEntry(recordSource, keyComparer, lastKey)
+
+		if len(entry) >= 1 {
+			if err2 := od.dataFile.Log(entry); err2 != nil {
+				return n, err2
+			}
+
+			m, err2 := od.bpTree.Ingest(&ingestEntrySource{entry})
+			n += m
+
+			if err2 != nil {
+				return n, od.dataFile.Poison(err2)
+			}
+
+			lastKey = entry[len(entry)-1].Key
+		}
+
+		if err != nil || len(entry) == 0 {
+			return n, err
+		}
+	}
+}
+
+// Apply applies the writes in the given batch to the dictionary
+// in order. The writes are all or nothing, even in the event of a
+// crash.
+// The changes are durable once it returns without an error.
+// The batch is logged before being applied, so if a write fails to be
+// applied, e.g. with a CorruptedError, the batch is left partly
+// applied and the dictionary is poisoned: further writes and syncs
+// fail with the error, and closing the dictionary discards the partly
+// applied batch, which the next open recovers in whole from the log.
+func (od *OrderedDict) Apply(writeBatch *WriteBatch) error {
+	if writeBatch.Len() == 0 {
+		return nil
+	}
+
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	if err := od.dataFile.Log(writeBatch.operations); err != nil {
+		return err
+	}
+
+	for i := range writeBatch.operations {
+		if err := od.applyOperation(&writeBatch.operations[i]); err != nil {
+			// the batch is partly applied, but logged in whole
+			return od.dataFile.Poison(err)
+		}
+	}
+
+	return nil
 }
 
 // Test tests the given key in the dictionary.
 // If the key exists, it returns true and the present value (optional),
 // otherwise it returns false.
-func (od *OrderedDict) Test(key []byte, returnPresentValue bool) ([]byte, bool) {
+func (od *OrderedDict) Test(key []byte, returnPresentValue bool) ([]byte, bool, error) {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
 	return od.bpTree.HasRecord(key, returnPresentValue)
 }
 
+// Rank returns the number of the keys less than the given key in
+// the dictionary, and whether the key exists, in which case the number
+// is the rank of the key (starting from 0).
+func (od *OrderedDict) Rank(key []byte) (int, bool, error) {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return od.bpTree.Rank(key)
+}
+
+// Select returns the key with the given rank (starting from 0) in
+// the dictionary.
+// If the rank is within [0, n) where n is the number of the keys,
+// it returns the key and true, otherwise it returns false.
+func (od *OrderedDict) Select(rank int) ([]byte, bool, error) {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return od.bpTree.Select(rank)
+}
+
+// CountRange returns the number of the keys in the range between the
+// given bounds in the dictionary, each of which may be inclusive,
+// exclusive or unbounded, without iterating over the keys.
+func (od *OrderedDict) CountRange(minBound Bound, maxBound Bound) (int, error) {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return od.bpTree.CountRange(minBound, maxBound)
+}
+
 // RangeAsc looks up the the dictionary for keys in the given range
 // [minKey...maxKey] and keys' values.
 // It returns an iterator to iterate over the keys/values found
 // in ascending order.
 func (od *OrderedDict) RangeAsc(minKey []byte, maxKey []byte) OrderedDictIterator {
-	return od.bpTree.SearchForward(minKey, maxKey)
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return new(orderedDictIterator).Init(od, nil, od.bpTree.SearchForward(minKey, maxKey))
 }
 
 // RangeDesc looks up the the dictionary for keys in the given range
@@ -91,14 +383,65 @@ func (od *OrderedDict) RangeAsc(minKey []byte, maxKey []byte) OrderedDictIterato
 // It returns an iterator to iterate over the keys/values found
 // in descending order.
 func (od *OrderedDict) RangeDesc(minKey []byte, maxKey []byte) OrderedDictIterator {
-	return od.bpTree.SearchBackward(minKey, maxKey)
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return new(orderedDictIterator).Init(od, nil, od.bpTree.SearchBackward(minKey, maxKey))
+}
+
+// Range looks up the dictionary for keys in the range between
+// the given bounds, each of which may be inclusive, exclusive or
+// unbounded, and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in ascending order, or in descending order if desc is true.
+func (od *OrderedDict) Range(minBound Bound, maxBound Bound, desc bool) OrderedDictIterator {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return new(orderedDictIterator).Init(od, nil, od.bpTree.SearchRange(minBound, maxBound, desc))
+}
+
+// RangePrefix looks up the dictionary for keys starting with the
+// given prefix and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in ascending order, or in descending order if desc is true.
+// With a key comparer which isn't a PrefixKeyComparer, all the keys
+// are looked through and filtered by the prefix, which takes O(n)
+// time however few keys match.
+func (od *OrderedDict) RangePrefix(prefix []byte, desc bool) OrderedDictIterator {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return new(orderedDictIterator).Init(od, nil, od.bpTree.SearchPrefix(prefix, desc))
+}
+
+// Cursor returns a cursor over the dictionary, which is not valid
+// until moved to a key. The cursor can be moved to any key and then
+// along the keys in either direction. Once the dictionary is closed,
+// the cursor is no longer valid and the reads return
+// ErrIteratorInvalidated.
+func (od *OrderedDict) Cursor() OrderedDictCursor {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return new(orderedDictCursor).Init(od, od.bpTree.NewCursor())
+}
+
+// Verify walks through the whole dictionary and checks the integrity
+// of the B+ tree.
+// If the B+ tree is broken, it returns a CorruptedError.
+func (od *OrderedDict) Verify() error {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
+	return od.bpTree.Verify()
 }
 
 // Stats returns the stats of the dictionary.
 func (od *OrderedDict) Stats() OrderedDictStats {
+	od.mutex.RLock()
+	defer od.mutex.RUnlock()
 	return OrderedDictStats{
-		FSM:                    od.fileStorage.Stats(),
+		FSM:                    od.dataFile.fileStorage.Stats(),
 		BPTreeHeight:           od.bpTree.Height(),
+		BPTreePageSize:         od.bpTree.PageSize(),
+		BPTreeMaxKeySize:       od.bpTree.MaxKeySize(),
+		BPTreeMaxValueSize:     od.bpTree.MaxValueSize(),
 		NumberOfBPTreeLeafs:    od.bpTree.NumberOfLeafs(),
 		NumberOfBPTreeNonLeafs: od.bpTree.NumberOfNonLeafs(),
 		NumberOfBPTreeRecords:  od.bpTree.NumberOfRecords(),
@@ -106,10 +449,267 @@ func (od *OrderedDict) Stats() OrderedDictStats {
 	}
 }
 
+// applyLog applies the write-ahead log to the copy of the B+ tree on
+// the given file storage, for a checkpoint.
+func (od *OrderedDict) applyLog(fileStorage *fsm.FileStorage, bpTreeInfoAddr int64) (int64, error) {
+	var bpTree bptree.BPTree
+	bpTree.Init(fileStorage, od.bpTreeOptions()...)
+
+	if bpTreeInfoAddr < 0 {
+		if err := bpTree.Create(); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := bpTree.Load(bpTreeInfoAddr); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := od.dataFile.ReplayLog(func(operation *wal.Operation) error {
+		return applyBPTreeOperation(&bpTree, operation)
+	}); err != nil {
+		return 0, err
+	}
+
+	return bpTree.Store(), nil
+}
+
+// buildCopy builds a copy of the B+ tree on the given file storage
+// from the records in order, for a checkpoint.
+func (od *OrderedDict) buildCopy(fileStorage *fsm.FileStorage) (int64, error) {
+	var bpTree bptree.BPTree
+	bpTree.Init(fileStorage, od.bpTreeOptions()...)
+
+	if err := bpTree.Create(); err != nil {
+		return 0, err
+	}
+
+	if _, err := bpTree.Build(&iteratorRecordSource{od.bpTree.SearchRange(Unbounded, Unbounded, false)}); err != nil {
+		return 0, err
+	}
+
+	return bpTree.Store(), nil
+}
+
+// bpTreeOptions returns the options for a copy of the B+ tree, which
+// is of the same key comparer, page size and maximum key and value
+// sizes.
+func (od *OrderedDict) bpTreeOptions() []bptree.Option {
+	return []bptree.Option{
+		bptree.WithKeyComparer(od.bpTree.KeyComparer()),
+		bptree.WithPageSize(od.bpTree.PageSize()),
+		bptree.WithMaxKeySize(od.bpTree.MaxKeySize()),
+		bptree.WithMaxValueSize(od.bpTree.MaxValueSize()),
+	}
+}
+
+func (od *OrderedDict) applyOperation(operation *wal.Operation) error {
+	return applyBPTreeOperation(&od.bpTree, operation)
+}
+
+func applyBPTreeOperation(bpTree *bptree.BPTree, operation *wal.Operation) error {
+	var err error
+
+	switch operation.Type {
+	case wal.OperationPut:
+		_, _, err = bpTree.AddOrUpdateRecord(operation.Key, operation.Value, false)
+	case wal.OperationDelete:
+		_, _, err = bpTree.DeleteRecord(operation.Key, false)
+	case wal.OperationDeleteRange:
+		var minBound, maxBound Bound
+
+		if minBound, err = decodeBound(operation.Key); err != nil {
+			return err
+		}
+
+		if maxBound, err = decodeBound(operation.Value); err != nil {
+			return err
+		}
+
+		_, err = bpTree.DeleteRange(minBound, maxBound)
+	}
+
+	return err
+}
+
+// readIngestEntry reads the records from the given source, whose keys
+// must be greater than the given last key (if any), into an entry to be
+// logged, until the entry reaches maxIngestEntrySize or the source has
+// no more records.
+// On an error, it returns the entry of the records before as well.
+func readIngestEntry(recordSource OrderedDictRecordSource, keyComparer KeyComparer, lastKey []byte) (wal.Entry, error) {
+	var entry wal.Entry
+	entrySize := 0
+
+	for entrySize < maxIngestEntrySize {
+		key, value, ok, err := recordSource.ReadRecord()
+
+		if err != nil {
+			return entry, err
+		}
+
+		if !ok {
+			break
+		}
+
+		if lastKey != nil && keyComparer.CompareKeys(lastKey, key) >= 0 {
+			return entry, ErrKeyOutOfOrder
+		}
+
+		// the source may reuse the key and the value, and the key copied
+		// is never nil, even if empty, to tell it from no last key
+		key = append(make([]byte, 0, len(key)), key...)
+		value = append([]byte(nil), value...)
+		entry = append(entry, wal.Operation{Type: wal.OperationPut, Key: key, Value: value})
+		entrySize += len(key) + len(value)
+		lastKey = key
+	}
+
+	return entry, nil
+}
+
+const maxIngestEntrySize = 1 << 20
+
+type iteratorRecordSource struct {
+	iterator bptree.Iterator
+}
+
+func (irs *iteratorRecordSource) ReadRecord() ([]byte, []byte, bool, error) {
+	if irs.iterator.IsAtEnd() {
+		return nil, nil, false, nil
+	}
+
+	key, value, err := irs.iterator.ReadRecordAll()
+
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	irs.iterator.Advance()
+	return key, value, true, nil
+}
+
+type ingestEntrySource struct {
+	entry wal.Entry
+}
+
+func (ies *ingestEntrySource) ReadRecord() ([]byte, []byte, bool, error) {
+	if len(ies.entry) == 0 {
+		return nil, nil, false, nil
+	}
+
+	operation := &ies.entry[0]
+	ies.entry = ies.entry[1:]
+	return operation.Key, operation.Value, true, nil
+}
+
+func (od *OrderedDict) logPut(key []byte, value []byte) error {
+	return od.dataFile.Log(wal.Entry{{Type: wal.OperationPut, Key: key, Value: value}})
+}
+
+func (od *OrderedDict) logDelete(key []byte) error {
+	return od.dataFile.Log(wal.Entry{{Type: wal.OperationDelete, Key: key}})
+}
+
+func (od *OrderedDict) logDeleteRange(minBound Bound, maxBound Bound) error {
+	return od.dataFile.Log(wal.Entry{{Type: wal.OperationDeleteRange, Key: encodeBound(minBound), Value: encodeBound(maxBound)}})
+}
+
+// OrderedDictOption represents an option for opening an ordered
+// dictionary.
+type OrderedDictOption = bptree.Option
+
+// WithKeyComparer returns an option which sets the key comparer
+// defining the order of the keys in an ordered dictionary,
+// BytewiseKeyComparer by default.
+// An ordered dictionary must always be opened with a key comparer
+// of the same name.
+func WithKeyComparer(keyComparer KeyComparer) OrderedDictOption {
+	return bptree.WithKeyComparer(keyComparer)
+}
+
+// WithPageSize returns an option which sets the page size of the B+
+// tree of an ordered dictionary, 8 KiB by default, which must be a
+// power of 2 from 4 KiB to 64 KiB, otherwise opening the dictionary
+// fails with ErrInvalidPageSize.
+// It takes effect when the dictionary is created, an ordered
+// dictionary opened keeps the page size it was created with.
+func WithPageSize(pageSize int) OrderedDictOption {
+	return bptree.WithPageSize(pageSize)
+}
+
+// WithMaxKeySize returns an option which sets the maximum key size of
+// the B+ tree of an ordered dictionary, 257 bytes by default.
+// The keys shorter than it are stored in the pages as is, while the
+// others spill partly to the overflow spaces, costing an extra read.
+// If a page can't hold 8 keys or records of the maximum sizes, opening
+// the dictionary fails with ErrInvalidMaxKeySize.
+// It takes effect when the dictionary is created, as WithPageSize does.
+func WithMaxKeySize(maxKeySize int) OrderedDictOption {
+	return bptree.WithMaxKeySize(maxKeySize)
+}
+
+// WithMaxValueSize returns an option which sets the maximum value size
+// of the B+ tree of an ordered dictionary, 129 bytes by default.
+// The values shorter than it are stored in the pages as is, while the
+// others spill partly to the overflow spaces, costing an extra read.
+// If a page can't hold 8 records of the maximum sizes, opening the
+// dictionary fails with ErrInvalidMaxValueSize.
+// It takes effect when the dictionary is created, as WithPageSize does.
+func WithMaxValueSize(maxValueSize int) OrderedDictOption {
+	return bptree.WithMaxValueSize(maxValueSize)
+}
+
+// KeyComparer defines the order of the keys in an ordered dictionary.
+type KeyComparer = bptree.KeyComparer
+
+// PrefixKeyComparer is a KeyComparer which orders the keys starting
+// with any prefix in a row, so that RangePrefix looks through them only.
+type PrefixKeyComparer = bptree.PrefixKeyComparer
+
+// BytewiseKeyComparer orders the keys lexicographically by bytes,
+// as bytes.Compare does, which is the default key comparer.
+var BytewiseKeyComparer = bptree.BytewiseKeyComparer
+
+// ErrKeyComparerMismatch is returned when opening an ordered
+// dictionary created with a key comparer of another name.
+var ErrKeyComparerMismatch = bptree.ErrKeyComparerMismatch
+
+// ErrKeyComparerNameTooLong is returned when opening an ordered
+// dictionary with a key comparer whose name is over 255 bytes.
+var ErrKeyComparerNameTooLong = bptree.ErrKeyComparerNameTooLong
+
+// ErrInvalidPageSize is returned when opening an ordered dictionary
+// with the page size set to an invalid one.
+var ErrInvalidPageSize = bptree.ErrInvalidPageSize
+
+// ErrInvalidMaxKeySize is returned when opening an ordered dictionary
+// with the maximum key size set to an invalid one.
+var ErrInvalidMaxKeySize = bptree.ErrInvalidMaxKeySize
+
+// ErrInvalidMaxValueSize is returned when opening an ordered
+// dictionary with the maximum value size set to an invalid one.
+var ErrInvalidMaxValueSize = bptree.ErrInvalidMaxValueSize
+
+// OrderedDictRecordSource represents a source of keys/values in
+// ascending order of keys, to load into an ordered dictionary.
+type OrderedDictRecordSource = bptree.RecordSource
+
+// ErrNotEmpty is returned when bulk loading into an ordered
+// dictionary which isn't empty.
+var ErrNotEmpty = bptree.ErrNotEmpty
+
+// ErrKeyOutOfOrder is returned when bulk loading keys which aren't
+// in strictly ascending order into an ordered dictionary.
+var ErrKeyOutOfOrder = bptree.ErrKeyOutOfOrder
+
 // OrderedDictStats represents the stats of an ordered dictionary
 type OrderedDictStats struct {
 	FSM                    fsm.Stats
 	BPTreeHeight           int
+	BPTreePageSize         int
+	BPTreeMaxKeySize       int
+	BPTreeMaxValueSize     int
 	NumberOfBPTreeLeafs    int
 	NumberOfBPTreeNonLeafs int
 	NumberOfBPTreeRecords  int
@@ -119,10 +719,461 @@ type OrderedDictStats struct {
 // OrderedDictIterator represents an iteration over keys/values in an ordered dictionary.
 type OrderedDictIterator = bptree.Iterator
 
+// OrderedDictCursor represents a position at a key in an ordered dictionary.
+type OrderedDictCursor = bptree.Cursor
+
+// ErrIteratorReadOnly is returned when deleting or updating a key
+// through an iterator over a snapshot or a transaction.
+var ErrIteratorReadOnly = bptree.ErrIteratorReadOnly
+
+// ErrIteratorInvalidated is returned when reading from an iterator
+// over an ordered dictionary which has been closed since the iterator
+// was created, or from an iterator over a snapshot which has been
+// released. Such an iterator is at the end.
+// The same goes for a cursor, which can't be moved any more.
+var ErrIteratorInvalidated = errors.New("plainkv: iterator invalidated")
+
 var (
-	// MinKey presents the minimum key in an ordered dictionary.
+	// MinKey presents the minimum key in an ordered dictionary, when
+	// passed to RangeAsc or RangeDesc as is. It's told apart from the
+	// key "MIN_KEY" by identity, so it must not be copied.
+	// Range with Unbounded is preferred.
 	MinKey = bptree.MinKey
 
-	// MaxKey presents the maximum key in an ordered dictionary.
+	// MaxKey presents the maximum key in an ordered dictionary, when
+	// passed to RangeAsc or RangeDesc as is. It's told apart from the
+	// key "MAX_KEY" by identity, so it must not be copied.
+	// Range with Unbounded is preferred.
 	MaxKey = bptree.MaxKey
 )
+
+// Bound represents a bound of a range of keys in an ordered
+// dictionary, which is either inclusive, exclusive or unbounded.
+type Bound = bptree.Bound
+
+// Unbounded presents the bound not limiting the range of keys.
+var Unbounded = bptree.Unbounded
+
+// Inclusive returns the bound at the given key, which includes
+// the key in the range.
+func Inclusive(key []byte) Bound {
+	return bptree.Inclusive(key)
+}
+
+// Exclusive returns the bound at the given key, which excludes
+// the key from the range.
+func Exclusive(key []byte) Bound {
+	return bptree.Exclusive(key)
+}
+
+const (
+	boundTagUnbounded = iota
+	boundTagInclusive
+	boundTagExclusive
+)
+
+// encodeBound encodes the given bound of a range to be logged, with
+// the kind of the bound tagged explicitly.
+func encodeBound(bound Bound) []byte {
+	switch {
+	case bound.IsInclusive():
+		return append([]byte{boundTagInclusive}, bound.Key()...)
+	case bound.IsExclusive():
+		return append([]byte{boundTagExclusive}, bound.Key()...)
+	default:
+		return []byte{boundTagUnbounded}
+	}
+}
+
+func decodeBound(data []byte) (Bound, error) {
+	if len(data) == 0 {
+		return Bound{}, errInvalidLogEntry
+	}
+
+	switch data[0] {
+	case boundTagUnbounded:
+		return Unbounded, nil
+	case boundTagInclusive:
+		return Inclusive(data[1:]), nil
+	case boundTagExclusive:
+		return Exclusive(data[1:]), nil
+	default:
+		return Bound{}, errInvalidLogEntry
+	}
+}
+
+var errInvalidLogEntry = fmt.Errorf("%w: invalid log entry", ErrCorrupted)
+
+type orderedDictIterator struct {
+	orderedDict    *OrderedDict
+	snapshot       *bptree.Snapshot
+	recordIterator bptree.Iterator
+	version        int64
+	isInvalidated  bool
+}
+
+var _ = OrderedDictIterator((*orderedDictIterator)(nil))
+
+func (odi *orderedDictIterator) Init(orderedDict *OrderedDict, snapshot *bptree.Snapshot, recordIterator bptree.Iterator) *orderedDictIterator {
+	odi.orderedDict = orderedDict
+	odi.snapshot = snapshot
+	odi.recordIterator = recordIterator
+	odi.version = orderedDict.version
+	return odi
+}
+
+func (odi *orderedDictIterator) IsAtEnd() bool {
+	odi.lock()
+	defer odi.unlock()
+	return odi.isInvalidated || odi.recordIterator.IsAtEnd()
+}
+
+func (odi *orderedDictIterator) Advance() OrderedDictIterator {
+	odi.lock()
+	defer odi.unlock()
+
+	if !odi.isInvalidated {
+		odi.recordIterator.Advance()
+	}
+
+	return odi
+}
+
+func (odi *orderedDictIterator) GetKeySize() (int, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.GetKeySize()
+}
+
+func (odi *orderedDictIterator) ReadKey(dataOffset int, buffer []byte) (int, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.ReadKey(dataOffset, buffer)
+}
+
+func (odi *orderedDictIterator) ReadKeyAll() ([]byte, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return nil, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.ReadKeyAll()
+}
+
+func (odi *orderedDictIterator) GetValueSize() (int, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.GetValueSize()
+}
+
+func (odi *orderedDictIterator) ReadValue(dataOffset int, buffer []byte) (int, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.ReadValue(dataOffset, buffer)
+}
+
+func (odi *orderedDictIterator) ReadValueAll() ([]byte, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return nil, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.ReadValueAll()
+}
+
+func (odi *orderedDictIterator) ReadRecordAll() ([]byte, []byte, error) {
+	odi.lock()
+	defer odi.unlock()
+
+	if odi.isInvalidated {
+		return nil, nil, ErrIteratorInvalidated
+	}
+
+	return odi.recordIterator.ReadRecordAll()
+}
+
+func (odi *orderedDictIterator) Delete() error {
+	odi.lockForWriting()
+	defer odi.unlockForWriting()
+
+	if odi.isInvalidated {
+		return ErrIteratorInvalidated
+	}
+
+	if odi.snapshot != nil {
+		return ErrIteratorReadOnly
+	}
+
+	key, err := odi.recordIterator.ReadKeyAll()
+
+	if err != nil {
+		return err
+	}
+
+	if err := odi.orderedDict.logDelete(key); err != nil {
+		return err
+	}
+
+	if err := odi.recordIterator.Delete(); err != nil {
+		return odi.orderedDict.dataFile.Poison(err)
+	}
+
+	return nil
+}
+
+func (odi *orderedDictIterator) SetValue(value []byte) error {
+	odi.lockForWriting()
+	defer odi.unlockForWriting()
+
+	if odi.isInvalidated {
+		return ErrIteratorInvalidated
+	}
+
+	if odi.snapshot != nil {
+		return ErrIteratorReadOnly
+	}
+
+	key, err := odi.recordIterator.ReadKeyAll()
+
+	if err != nil {
+		return err
+	}
+
+	if err := odi.orderedDict.logPut(key, value); err != nil {
+		return err
+	}
+
+	if err := odi.recordIterator.SetValue(value); err != nil {
+		return odi.orderedDict.dataFile.Poison(err)
+	}
+
+	return nil
+}
+
+// lock locks the dictionary for reading and then checks if
+// the dictionary has been closed since the iterator was created
+// (or the snapshot has been released for an iterator over a snapshot),
+// the pages which the iterator refers to may have been freed in
+// that case.
+func (odi *orderedDictIterator) lock() {
+	odi.orderedDict.mutex.RLock()
+	odi.checkInvalidated()
+}
+
+func (odi *orderedDictIterator) unlock() {
+	odi.orderedDict.mutex.RUnlock()
+}
+
+func (odi *orderedDictIterator) lockForWriting() {
+	odi.orderedDict.mutex.Lock()
+	odi.checkInvalidated()
+}
+
+func (odi *orderedDictIterator) unlockForWriting() {
+	odi.orderedDict.mutex.Unlock()
+}
+
+func (odi *orderedDictIterator) checkInvalidated() {
+	if odi.isInvalidated {
+		return
+	}
+
+	if odi.snapshot == nil && odi.orderedDict.version != odi.version || odi.snapshot != nil && odi.snapshot.IsReleased() {
+		odi.isInvalidated = true
+		odi.recordIterator = nil
+	}
+}
+
+type orderedDictCursor struct {
+	orderedDict   *OrderedDict
+	recordCursor  bptree.Cursor
+	version       int64
+	isInvalidated bool
+}
+
+var _ = OrderedDictCursor((*orderedDictCursor)(nil))
+
+func (odc *orderedDictCursor) Init(orderedDict *OrderedDict, recordCursor bptree.Cursor) *orderedDictCursor {
+	odc.orderedDict = orderedDict
+	odc.recordCursor = recordCursor
+	odc.version = orderedDict.version
+	return odc
+}
+
+func (odc *orderedDictCursor) IsValid() bool {
+	odc.lock()
+	defer odc.unlock()
+	return !odc.isInvalidated && odc.recordCursor.IsValid()
+}
+
+func (odc *orderedDictCursor) First() OrderedDictCursor {
+	odc.lock()
+	defer odc.unlock()
+
+	if !odc.isInvalidated {
+		odc.recordCursor.First()
+	}
+
+	return odc
+}
+
+func (odc *orderedDictCursor) Last() OrderedDictCursor {
+	odc.lock()
+	defer odc.unlock()
+
+	if !odc.isInvalidated {
+		odc.recordCursor.Last()
+	}
+
+	return odc
+}
+
+func (odc *orderedDictCursor) Seek(key []byte) OrderedDictCursor {
+	odc.lock()
+	defer odc.unlock()
+
+	if !odc.isInvalidated {
+		odc.recordCursor.Seek(key)
+	}
+
+	return odc
+}
+
+func (odc *orderedDictCursor) Next() OrderedDictCursor {
+	odc.lock()
+	defer odc.unlock()
+
+	if !odc.isInvalidated {
+		odc.recordCursor.Next()
+	}
+
+	return odc
+}
+
+func (odc *orderedDictCursor) Prev() OrderedDictCursor {
+	odc.lock()
+	defer odc.unlock()
+
+	if !odc.isInvalidated {
+		odc.recordCursor.Prev()
+	}
+
+	return odc
+}
+
+func (odc *orderedDictCursor) GetKeySize() (int, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.GetKeySize()
+}
+
+func (odc *orderedDictCursor) ReadKey(dataOffset int, buffer []byte) (int, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.ReadKey(dataOffset, buffer)
+}
+
+func (odc *orderedDictCursor) ReadKeyAll() ([]byte, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return nil, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.ReadKeyAll()
+}
+
+func (odc *orderedDictCursor) GetValueSize() (int, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.GetValueSize()
+}
+
+func (odc *orderedDictCursor) ReadValue(dataOffset int, buffer []byte) (int, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return 0, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.ReadValue(dataOffset, buffer)
+}
+
+func (odc *orderedDictCursor) ReadValueAll() ([]byte, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return nil, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.ReadValueAll()
+}
+
+func (odc *orderedDictCursor) ReadRecordAll() ([]byte, []byte, error) {
+	odc.lock()
+	defer odc.unlock()
+
+	if odc.isInvalidated {
+		return nil, nil, ErrIteratorInvalidated
+	}
+
+	return odc.recordCursor.ReadRecordAll()
+}
+
+// lock locks the dictionary for reading and then checks if
+// the dictionary has been closed since the cursor was created,
+// the pages which the cursor refers to may have been freed in
+// that case.
+func (odc *orderedDictCursor) lock() {
+	odc.orderedDict.mutex.RLock()
+
+	if !odc.isInvalidated && odc.orderedDict.version != odc.version {
+		odc.isInvalidated = true
+	}
+}
+
+func (odc *orderedDictCursor) unlock() {
+	odc.orderedDict.mutex.RUnlock()
+}
@@ -1,9 +1,18 @@
 package plainkv_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
 
 	"github.com/roy2220/plainkv"
+	"github.com/stretchr/testify/assert"
 )
 
 func ExampleOrderedDict() {
@@ -14,12 +23,20 @@ func ExampleOrderedDict() {
 		}
 		defer od.Close()
 
-		od.Set([]byte("foo"), []byte("bar"), false /* don't return the replaced value */)
+		if _, err := od.Set([]byte("foo"), []byte("bar"), false /* don't return the replaced value */); err != nil {
+			panic(err)
+		}
 
-		_, ok := od.SetIfNotExists([]byte("hello"), []byte("w0rd"), false /* don't return the present value */)
+		_, ok, err := od.SetIfNotExists([]byte("hello"), []byte("w0rd"), false /* don't return the present value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v\n", ok)
 
-		v, ok := od.SetIfExists([]byte("hello"), []byte("world"), true /* return the replaced value */)
+		v, ok, err := od.SetIfExists([]byte("hello"), []byte("world"), true /* return the replaced value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v %q\n", ok, v)
 	}()
 
@@ -44,10 +61,16 @@ func ExampleOrderedDict() {
 		maxKey, _ := od.RangeDesc(plainkv.MaxKey, plainkv.MaxKey).ReadKeyAll()
 		fmt.Printf("%q...%q\n", minKey, maxKey)
 
-		v, ok := od.Test([]byte("foo"), true /* return the present value */)
+		v, ok, err := od.Test([]byte("foo"), true /* return the present value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v %q\n", ok, v)
 
-		v, ok = od.Clear([]byte("hello"), true /* return the removed value */)
+		v, ok, err = od.Clear([]byte("hello"), true /* return the removed value */)
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("%v %q\n", ok, v)
 	}()
 	// Output:
@@ -61,3 +84,1041 @@ func ExampleOrderedDict() {
 	// true "bar"
 	// true "world"
 }
+
+func TestOrderedDictRecovery(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(i))
+		_, ok, err := od.Clear(k, false)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	for n := 0; n < 2; n++ {
+		// crash without closing the dictionary
+		assert.NoError(t, od.SimulateCrash())
+		od = ReopenOrderedDict(t, fn)
+
+		for i := 0; i < 1000; i++ {
+			k := []byte(strconv.Itoa(i))
+			v, ok, _ := od.Test(k, true)
+
+			if i%2 == 0 {
+				assert.False(t, ok)
+			} else if assert.True(t, ok) {
+				assert.Equal(t, k, v)
+			}
+		}
+
+		assert.Equal(t, 500, od.Stats().NumberOfBPTreeRecords)
+	}
+
+	assert.NoError(t, od.Close())
+	od = ReopenOrderedDict(t, fn)
+
+	assert.Equal(t, 500, od.Stats().NumberOfBPTreeRecords)
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictReopen(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	allocatedSpaceSize := -1
+
+	for n := 0; n < 2; n++ {
+		assert.NoError(t, od.Close())
+		// the working file is kept for the next open
+		_, err := os.Stat(fn + ".idle")
+		assert.NoError(t, err)
+		_, err = os.Stat(fn + ".work")
+		assert.True(t, os.IsNotExist(err))
+		od = ReopenOrderedDict(t, fn)
+		_, err = os.Stat(fn + ".idle")
+		assert.True(t, os.IsNotExist(err))
+
+		if n == 0 {
+			allocatedSpaceSize = od.Stats().FSM.AllocatedSpaceSize
+		} else {
+			assert.Equal(t, allocatedSpaceSize, od.Stats().FSM.AllocatedSpaceSize)
+		}
+	}
+
+	_, err := od.Set([]byte("1000"), []byte("1000"), false)
+	assert.NoError(t, err)
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+
+	for i := 0; i < 1001; i++ {
+		k := []byte(strconv.Itoa(i))
+		v, ok, _ := od.Test(k, true)
+
+		if assert.True(t, ok) {
+			assert.Equal(t, k, v)
+		}
+	}
+
+	assert.Equal(t, 1001, od.Stats().NumberOfBPTreeRecords)
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictSync(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+
+		if i%300 == 299 {
+			if !assert.NoError(t, od.Sync()) {
+				t.FailNow()
+			}
+
+			assert.Equal(t, int64(0), od.LogSize())
+		}
+	}
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(i))
+		v, ok, _ := od.Test(k, true)
+
+		if assert.True(t, ok) {
+			assert.Equal(t, k, v)
+		}
+	}
+
+	assert.Equal(t, 1000, od.Stats().NumberOfBPTreeRecords)
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictSyncFailure(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 100; i++ {
+		k := []byte(strconv.Itoa(i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	if !assert.NoError(t, od.Sync()) {
+		t.FailNow()
+	}
+
+	// block the temporary file the checkpoint is made in
+	if !assert.NoError(t, os.Mkdir(fn+".temp", 0755)) {
+		t.FailNow()
+	}
+
+	_, err := od.Set([]byte("100"), []byte("100"), false)
+	assert.NoError(t, err)
+	assert.Error(t, od.Sync())
+	// the dictionary must go on after the failure
+	_, err = od.Set([]byte("101"), []byte("101"), false)
+	assert.NoError(t, err)
+	v, ok, _ := od.Test([]byte("100"), true)
+
+	if assert.True(t, ok) {
+		assert.Equal(t, []byte("100"), v)
+	}
+
+	assert.NoError(t, os.Remove(fn+".temp"))
+	assert.NoError(t, od.Sync())
+	_, err = od.Set([]byte("102"), []byte("102"), false)
+	assert.NoError(t, err)
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+
+	for i := 0; i < 103; i++ {
+		k := []byte(strconv.Itoa(i))
+		v, ok, _ := od.Test(k, true)
+
+		if assert.True(t, ok) {
+			assert.Equal(t, k, v)
+		}
+	}
+
+	assert.Equal(t, 103, od.Stats().NumberOfBPTreeRecords)
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictLogFailure(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_, err := od.Set([]byte(k), []byte(k), false)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, od.BreakLog())
+	_, err := od.Set([]byte("d"), []byte("d"), false)
+	assert.Error(t, err)
+	_, _, err = od.SetIfExists([]byte("a"), []byte("A"), false)
+	assert.Error(t, err)
+	_, _, err = od.SetIfNotExists([]byte("e"), []byte("e"), false)
+	assert.Error(t, err)
+	_, _, err = od.Clear([]byte("b"), false)
+	assert.Error(t, err)
+	_, err = od.ClearRange(plainkv.Unbounded, plainkv.Unbounded)
+	assert.Error(t, err)
+	it := od.Range(plainkv.Unbounded, plainkv.Unbounded, false)
+	assert.Error(t, it.SetValue([]byte("A")))
+	assert.Error(t, it.Delete())
+	// the writes failing to be logged mustn't be applied
+	assert.Equal(t, []string{"a", "b", "c"}, ReadKeys(od.Range(plainkv.Unbounded, plainkv.Unbounded, false)))
+	v, _, _ := od.Test([]byte("a"), true)
+	assert.Equal(t, []byte("a"), v)
+
+	// crash without closing the dictionary, whose log is closed already
+	assert.Error(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	assert.Equal(t, []string{"a", "b", "c"}, ReadKeys(od.Range(plainkv.Unbounded, plainkv.Unbounded, false)))
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictConcurrency(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+
+	for i := 0; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(10000 + i))
+		od.Set(k, k, false)
+	}
+
+	var wg sync.WaitGroup
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for n := 0; n < 100; n++ {
+				for i := 0; i < 1000; i += 2 {
+					k := []byte(strconv.Itoa(10000 + i))
+					v, ok, _ := od.Test(k, true)
+
+					if assert.True(t, ok) {
+						assert.Equal(t, k, v)
+					}
+				}
+
+				for it := od.RangeAsc(plainkv.MinKey, plainkv.MaxKey); !it.IsAtEnd(); it.Advance() {
+					k, v, err := it.ReadRecordAll()
+
+					if !assert.NoError(t, err) {
+						break
+					}
+
+					assert.Equal(t, k, v)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(10000 + i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		k := []byte(strconv.Itoa(10000 + i))
+		_, _, err := od.Clear(k, false)
+		assert.NoError(t, err)
+	}
+
+	wg.Wait()
+	assert.Equal(t, 500, od.Stats().NumberOfBPTreeRecords)
+}
+
+func TestOrderedDictIteratorInvalidated(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+
+	for i := 0; i < 10; i++ {
+		k := []byte(strconv.Itoa(i))
+		od.Set(k, k, false)
+	}
+
+	it := od.RangeAsc(plainkv.MinKey, plainkv.MaxKey)
+	k, err := it.ReadKeyAll()
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("0"), k)
+	}
+
+	od.Test([]byte("1"), false)
+	assert.False(t, it.Advance().IsAtEnd())
+	// the iterator goes on from the current key after a write
+	od.Set([]byte("10"), nil, false)
+	od.Clear([]byte("2"), false)
+	assert.Equal(t, []string{"1", "10", "3", "4", "5", "6", "7", "8", "9"}, ReadKeys(it))
+	assert.Equal(t, 10, len(ReadKeys(od.RangeAsc(plainkv.MinKey, plainkv.MaxKey))))
+	it = od.RangeDesc(plainkv.MinKey, plainkv.MaxKey)
+	od.Clear([]byte("9"), false)
+	assert.Equal(t, []string{"8", "7", "6", "5", "4", "3", "10", "1", "0"}, ReadKeys(it))
+	it = od.RangeAsc(plainkv.MinKey, plainkv.MaxKey)
+	assert.NoError(t, od.Close())
+	assert.True(t, it.IsAtEnd())
+	_, err = it.ReadKeyAll()
+	assert.Equal(t, plainkv.ErrIteratorInvalidated, err)
+}
+
+func TestOrderedDictSnapshot(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+
+	var keys []string
+
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(10000 + i)
+		od.Set([]byte(k), []byte(k), false)
+		keys = append(keys, k)
+	}
+
+	allocatedSpaceSize := od.Stats().FSM.AllocatedSpaceSize
+	s := od.Snapshot()
+	it, err := s.RangeAsc(plainkv.MinKey, plainkv.MaxKey)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(10000 + i))
+
+		if i%2 == 0 {
+			od.Clear(k, false)
+		} else {
+			od.Set(k, nil, false)
+		}
+
+		if i%300 == 299 {
+			if !assert.NoError(t, od.Sync()) {
+				t.FailNow()
+			}
+		}
+	}
+
+	assert.Equal(t, keys, ReadKeys(it))
+	it, err = s.RangeDesc([]byte("10100"), []byte("10109"))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"10109", "10108", "10107", "10106", "10105", "10104", "10103", "10102", "10101", "10100"}, ReadKeys(it))
+	}
+
+	v, ok, err := s.Test([]byte("10100"), true)
+
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, []byte("10100"), v)
+	}
+
+	_, ok, _ = od.Test([]byte("10100"), false)
+	assert.False(t, ok)
+	it, err = s.RangeAsc(plainkv.MinKey, plainkv.MaxKey)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	s.Release()
+	assert.True(t, it.IsAtEnd())
+	_, err = it.ReadKeyAll()
+	assert.Equal(t, plainkv.ErrIteratorInvalidated, err)
+	_, _, err = s.Test([]byte("10100"), false)
+	assert.Equal(t, plainkv.ErrSnapshotReleased, err)
+	_, err = s.RangeDesc(plainkv.MinKey, plainkv.MaxKey)
+	assert.Equal(t, plainkv.ErrSnapshotReleased, err)
+
+	for i := 1; i < 1000; i += 2 {
+		od.Clear([]byte(strconv.Itoa(10000+i)), false)
+	}
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(strconv.Itoa(10000 + i))
+		od.Set(k, k, false)
+	}
+
+	assert.Equal(t, allocatedSpaceSize, od.Stats().FSM.AllocatedSpaceSize)
+	s = od.Snapshot()
+	assert.NoError(t, od.Close())
+	_, _, err = s.Test([]byte("10100"), false)
+	assert.Equal(t, plainkv.ErrSnapshotReleased, err)
+}
+
+func TestOrderedDictCorrupted(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+	_, err := od.Set([]byte("foo"), []byte("bar"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, od.Close())
+	// the data file is read only if there's no idle file
+	assert.NoError(t, os.Remove(fn+".idle"))
+
+	for _, isDataFileInfo := range []bool{false, true} {
+		infoAddr, restore := CorruptInfo(t, fn, isDataFileInfo)
+		_, err = plainkv.OpenOrderedDict(fn, false)
+		var corruptedError *plainkv.CorruptedError
+
+		if assert.True(t, errors.Is(err, plainkv.ErrCorrupted)) && assert.True(t, errors.As(err, &corruptedError)) {
+			assert.Equal(t, infoAddr, corruptedError.Addr)
+		}
+
+		restore()
+		_, restore = ModifyInfo(t, fn, isDataFileInfo, func(info []byte) { info[3]++ })
+		_, err = plainkv.OpenOrderedDict(fn, false)
+		assert.Equal(t, plainkv.ErrUnsupportedFormatVersion, err)
+		restore()
+	}
+
+	od = ReopenOrderedDict(t, fn)
+
+	v, ok, err := od.Test([]byte("foo"), true)
+
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, []byte("bar"), v)
+	}
+
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictPoisoned(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for _, k := range []string{"a", "b"} {
+		_, err := od.Set([]byte(k), []byte(k), false)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, od.CorruptRoot())
+	err := od.Apply(new(plainkv.WriteBatch).Put([]byte("c"), []byte("c")).Delete([]byte("a")))
+
+	if !assert.True(t, errors.Is(err, plainkv.ErrCorrupted)) {
+		t.FailNow()
+	}
+
+	_, err2 := od.Set([]byte("d"), []byte("d"), false)
+	assert.Equal(t, err, err2)
+	assert.Equal(t, err, od.Sync())
+	// the partly applied batch is discarded and then recovered in whole
+	assert.NoError(t, od.Close())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+	assert.Equal(t, []string{"b", "c"}, ReadKeys(od.Range(plainkv.Unbounded, plainkv.Unbounded, false)))
+	assert.NoError(t, od.Verify())
+}
+
+func TestOrderedDictVerify(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 10000; i++ {
+		_, err := od.Set([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*i)), false)
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 10000; i += 2 {
+		_, _, err := od.Clear([]byte(strconv.Itoa(i)), false)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, od.Verify())
+	assert.NoError(t, od.Close())
+	od = ReopenOrderedDict(t, fn)
+
+	assert.NoError(t, od.Verify())
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictRange(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+	assert.True(t, od.Range(plainkv.Unbounded, plainkv.Unbounded, false).IsAtEnd())
+
+	for _, k := range []string{"MAX_KEY", "a", "b", "c", "d", "e"} {
+		_, err := od.Set([]byte(k), nil, false)
+		assert.NoError(t, err)
+	}
+
+	var pages [][]string
+	lastBound := plainkv.Unbounded
+
+	for {
+		it := od.Range(lastBound, plainkv.Unbounded, false)
+		var page []string
+
+		for ; !it.IsAtEnd() && len(page) < 4; it.Advance() {
+			k, _ := it.ReadKeyAll()
+			page = append(page, string(k))
+		}
+
+		if len(page) == 0 {
+			break
+		}
+
+		pages = append(pages, page)
+		lastBound = plainkv.Exclusive([]byte(page[len(page)-1]))
+	}
+
+	assert.Equal(t, [][]string{{"MAX_KEY", "a", "b", "c"}, {"d", "e"}}, pages)
+	assert.Equal(t, []string{"d", "c"}, ReadKeys(od.Range(plainkv.Exclusive([]byte("b")), plainkv.Inclusive([]byte("d")), true)))
+	assert.Equal(t, []string{"b", "c"}, ReadKeys(od.Range(plainkv.Inclusive([]byte("b")), plainkv.Exclusive([]byte("d")), false)))
+	assert.Equal(t, []string{"MAX_KEY"}, ReadKeys(od.Range(plainkv.Unbounded, plainkv.Exclusive([]byte("a")), false)))
+	assert.Nil(t, ReadKeys(od.Range(plainkv.Exclusive([]byte("b")), plainkv.Exclusive([]byte("c")), false)))
+	assert.Nil(t, ReadKeys(od.Range(plainkv.Inclusive([]byte("d")), plainkv.Inclusive([]byte("b")), false)))
+}
+
+func TestOrderedDictRangePrefix(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+
+	for _, k := range []string{"MAX_KEY", "MAX_KEZ", "MAX", "foo", "foo\xff", "foo\xff\xff", "fop", "\xff", "\xff\xff"} {
+		_, err := od.Set([]byte(k), nil, false)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"MAX", "MAX_KEY", "MAX_KEZ"}, ReadKeys(od.RangePrefix([]byte("MAX"), false)))
+	assert.Equal(t, []string{"MAX_KEY"}, ReadKeys(od.RangePrefix([]byte("MAX_KEY"), false)))
+	assert.Equal(t, []string{"foo\xff\xff", "foo\xff", "foo"}, ReadKeys(od.RangePrefix([]byte("foo"), true)))
+	assert.Equal(t, []string{"\xff", "\xff\xff"}, ReadKeys(od.RangePrefix([]byte("\xff"), false)))
+	assert.Equal(t, []string{"\xff\xff"}, ReadKeys(od.RangePrefix([]byte("\xff\xff"), true)))
+	assert.Nil(t, ReadKeys(od.RangePrefix([]byte("fooo"), false)))
+	assert.Len(t, ReadKeys(od.RangePrefix(nil, false)), 9)
+}
+
+func TestOrderedDictCursor(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+
+	for _, k := range []string{"a", "c", "e", "g"} {
+		_, err := od.Set([]byte(k), []byte(k), false)
+		assert.NoError(t, err)
+	}
+
+	readKey := func(c plainkv.OrderedDictCursor) string {
+		k, err := c.ReadKeyAll()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(k)
+	}
+
+	c := od.Cursor()
+	assert.False(t, c.IsValid())
+	assert.Equal(t, "a", readKey(c.First()))
+	assert.Equal(t, "c", readKey(c.Next()))
+	assert.Equal(t, "a", readKey(c.Prev()))
+	assert.False(t, c.Prev().IsValid())
+	assert.Equal(t, "g", readKey(c.Last()))
+	assert.False(t, c.Next().IsValid())
+	assert.Equal(t, "e", readKey(c.Seek([]byte("d"))))
+	assert.Equal(t, "c", readKey(c.Prev()))
+	assert.False(t, c.Seek([]byte("h")).IsValid())
+	assert.Equal(t, "e", readKey(c.Seek([]byte("e"))))
+	od.Set([]byte("f"), nil, false)
+	assert.Equal(t, "f", readKey(c.Next()))
+	od.Clear([]byte("f"), false)
+	assert.Equal(t, "g", readKey(c))
+	od.Clear([]byte("e"), false)
+	assert.Equal(t, "c", readKey(c.Prev()))
+	assert.NoError(t, od.Close())
+	assert.False(t, c.IsValid())
+	assert.Equal(t, plainkv.ErrIteratorInvalidated.Error(), readKey(c))
+	assert.False(t, c.First().IsValid())
+	assert.Equal(t, plainkv.ErrIteratorInvalidated.Error(), readKey(c.Seek([]byte("a"))))
+}
+
+func TestOrderedDictIteratorDelete(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	ods := od.Snapshot()
+	it, err := ods.RangeAsc(plainkv.MinKey, plainkv.MaxKey)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, plainkv.ErrIteratorReadOnly, it.Delete())
+		assert.Equal(t, plainkv.ErrIteratorReadOnly, it.SetValue(nil))
+	}
+
+	ods.Release()
+	tx := od.Begin(false)
+	it, err = tx.Range(plainkv.Unbounded, plainkv.Unbounded, false)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, plainkv.ErrIteratorReadOnly, it.Delete())
+		assert.Equal(t, plainkv.ErrIteratorReadOnly, it.SetValue(nil))
+	}
+
+	assert.NoError(t, tx.Commit())
+
+	for it := od.RangeAsc([]byte("100"), []byte("899")); !it.IsAtEnd(); it.Advance() {
+		k, err := it.ReadKeyAll()
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		if k[2]%2 == 0 {
+			assert.NoError(t, it.Delete())
+		} else {
+			assert.NoError(t, it.SetValue([]byte("x")))
+		}
+	}
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		v, ok, _ := od.Test(k, true)
+
+		if i < 100 || i > 899 {
+			assert.True(t, ok)
+			assert.Equal(t, k, v)
+		} else if i%2 == 0 {
+			assert.False(t, ok, string(k))
+		} else if assert.True(t, ok) {
+			assert.Equal(t, "x", string(v))
+		}
+	}
+
+	assert.Equal(t, 600, od.Stats().NumberOfBPTreeRecords)
+}
+
+func TestOrderedDictClearRange(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	for _, r := range []struct {
+		MinBound, MaxBound plainkv.Bound
+		N                  int
+	}{
+		{plainkv.Unbounded, plainkv.Inclusive([]byte("0999")), 1000},
+		{plainkv.Inclusive([]byte("3000")), plainkv.Exclusive([]byte("4000")), 1000},
+		{plainkv.Inclusive([]byte("4000")), plainkv.Inclusive([]byte("5000")), 1001},
+		{plainkv.Exclusive([]byte("8999")), plainkv.Unbounded, 1000},
+		{plainkv.Inclusive([]byte("b")), plainkv.Inclusive([]byte("a")), 0},
+	} {
+		n, err := od.ClearRange(r.MinBound, r.MaxBound)
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, r.N, n)
+		}
+	}
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		_, ok, _ := od.Test(k, false)
+		assert.Equal(t, i >= 1000 && i < 3000 || i > 5000 && i < 9000, ok, string(k))
+	}
+
+	assert.Equal(t, 5999, od.Stats().NumberOfBPTreeRecords)
+	assert.NoError(t, od.Verify())
+}
+
+func TestOrderedDictRankAndSelect(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+
+	for i := 0; i < 10000; i += 2 {
+		k := []byte(fmt.Sprintf("%04d", i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 10000; i += 100 {
+		r, ok, err := od.Rank([]byte(fmt.Sprintf("%04d", i)))
+
+		if assert.NoError(t, err) && assert.True(t, ok) {
+			assert.Equal(t, i/2, r)
+		}
+
+		r, ok, err = od.Rank([]byte(fmt.Sprintf("%04d", i+1)))
+
+		if assert.NoError(t, err) && assert.False(t, ok) {
+			assert.Equal(t, i/2+1, r)
+		}
+
+		k, ok, err := od.Select(i / 2)
+
+		if assert.NoError(t, err) && assert.True(t, ok) {
+			assert.Equal(t, fmt.Sprintf("%04d", i), string(k))
+		}
+	}
+
+	_, ok, err := od.Select(5000)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for _, r := range []struct {
+		MinBound, MaxBound plainkv.Bound
+		N                  int
+	}{
+		{plainkv.Unbounded, plainkv.Unbounded, 5000},
+		{plainkv.Inclusive([]byte("1000")), plainkv.Exclusive([]byte("2000")), 500},
+		{plainkv.Exclusive([]byte("1000")), plainkv.Inclusive([]byte("2000")), 500},
+		{plainkv.Inclusive([]byte("1001")), plainkv.Inclusive([]byte("1001")), 0},
+		{plainkv.Inclusive([]byte("9")), plainkv.Unbounded, 500},
+	} {
+		n, err := od.CountRange(r.MinBound, r.MaxBound)
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, r.N, n)
+		}
+	}
+
+	n, err := od.ClearRange(plainkv.Inclusive([]byte("1000")), plainkv.Inclusive([]byte("2999")))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1000, n)
+	}
+
+	n, err = od.CountRange(plainkv.Inclusive([]byte("0")), plainkv.Exclusive([]byte("4")))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1000, n)
+	}
+
+	assert.NoError(t, od.Verify())
+}
+
+func TestOrderedDictBulkLoad(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+	_, err := od.BulkLoad(&KeySequence{N: 100, Step: 2, OutOfOrderAt: 50})
+	assert.Equal(t, plainkv.ErrKeyOutOfOrder, err)
+	assert.Equal(t, 0, od.Stats().NumberOfBPTreeRecords)
+	n, err := od.BulkLoad(&KeySequence{N: 100000, Step: 2, OutOfOrderAt: -1})
+
+	if !assert.NoError(t, err) || !assert.Equal(t, 100000, n) {
+		t.FailNow()
+	}
+
+	_, err = od.BulkLoad(&KeySequence{N: 1, Step: 1, OutOfOrderAt: -1})
+	assert.Equal(t, plainkv.ErrNotEmpty, err)
+	_, err = od.Set([]byte("x"), []byte("x"), false)
+	assert.NoError(t, err)
+	assert.NoError(t, od.Sync())
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+	assert.Equal(t, 100001, od.Stats().NumberOfBPTreeRecords)
+	assert.NoError(t, od.Verify())
+	_, ok, _ := od.Test([]byte("x"), false)
+	assert.True(t, ok)
+
+	for i := 0; i < 200000; i += 1000 {
+		k := []byte(fmt.Sprintf("%08d", i))
+		v, ok, err := od.Test(k, true)
+
+		if assert.NoError(t, err) && assert.True(t, ok, string(k)) {
+			assert.Equal(t, k, v)
+		}
+
+		_, ok, _ = od.Test([]byte(fmt.Sprintf("%08d", i+1)), false)
+		assert.False(t, ok)
+	}
+}
+
+func TestOrderedDictBulkLoadInterrupted(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_, err := od.Set([]byte(k), []byte(k), false)
+		assert.NoError(t, err)
+	}
+
+	_, err := od.ClearRange(plainkv.Unbounded, plainkv.Unbounded)
+	assert.NoError(t, err)
+	log, err := ioutil.ReadFile(fn + ".wal")
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	n, err := od.BulkLoad(&KeySequence{N: 2, Step: 1, OutOfOrderAt: -1})
+
+	if !assert.NoError(t, err) || !assert.Equal(t, 2, n) {
+		t.FailNow()
+	}
+
+	// crash after replacing the data file before resetting the log on checkpointing
+	assert.NoError(t, od.SimulateCrash())
+	assert.NoError(t, ioutil.WriteFile(fn+".wal", log, 0666))
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+	assert.Equal(t, []string{"00000000", "00000001"}, ReadKeys(od.RangeAsc(plainkv.MinKey, plainkv.MaxKey)))
+}
+
+func TestOrderedDictIngestSorted(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	for i := 0; i < 100000; i += 5 {
+		k := []byte(fmt.Sprintf("%08d", i))
+		_, err := od.Set(k, []byte("x"), false)
+		assert.NoError(t, err)
+	}
+
+	// keys multiple of 2 or 5
+	n, err := od.IngestSorted(&KeySequence{N: 50000, Step: 2, OutOfOrderAt: -1})
+
+	if !assert.NoError(t, err) || !assert.Equal(t, 40000, n) {
+		t.FailNow()
+	}
+
+	// keys multiple of 3 up to 1497, and then 1503 before 1500 out of order
+	_, err = od.IngestSorted(&KeySequence{N: 1000, Step: 3, OutOfOrderAt: 500})
+	assert.Equal(t, plainkv.ErrKeyOutOfOrder, err)
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+	assert.NoError(t, od.Verify())
+	n = 0
+
+	for i := 0; i < 100000; i++ {
+		k := []byte(fmt.Sprintf("%08d", i))
+		v, ok, err := od.Test(k, true)
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		switch {
+		case i%2 == 0 || (i%3 == 0 && i < 1500) || i == 1503:
+			assert.True(t, ok, string(k))
+			assert.Equal(t, k, v)
+		case i%5 == 0:
+			assert.True(t, ok, string(k))
+			assert.Equal(t, []byte("x"), v)
+		default:
+			assert.False(t, ok, string(k))
+		}
+
+		if ok {
+			n++
+		}
+	}
+
+	assert.Equal(t, n, od.Stats().NumberOfBPTreeRecords)
+}
+
+func TestOrderedDictIngestSortedLogged(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+	// the keys span chunks, and 199982 comes before 199980 out of order in the last chunk
+	n, err := od.IngestSorted(&KeySequence{N: 100000, Step: 2, OutOfOrderAt: 99990})
+	assert.Equal(t, plainkv.ErrKeyOutOfOrder, err)
+	assert.Equal(t, 99991, n)
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+	assert.NoError(t, od.Verify())
+	assert.Equal(t, 99991, od.Stats().NumberOfBPTreeRecords)
+	_, ok, _ := od.Test([]byte("00199978"), false)
+	assert.True(t, ok)
+	_, ok, _ = od.Test([]byte("00199980"), false)
+	assert.False(t, ok)
+	_, ok, _ = od.Test([]byte("00199982"), false)
+	assert.True(t, ok)
+}
+
+func TestOrderedDictKeyComparer(t *testing.T) {
+	fn := MakeDictFileName(t)
+	_, err := plainkv.OpenOrderedDict(fn, true, plainkv.WithKeyComparer(LongNameKeyComparer{}))
+	assert.Equal(t, plainkv.ErrKeyComparerNameTooLong, err)
+	AssertNoDictFiles(t, fn)
+	od, err := plainkv.OpenOrderedDict(fn, true, plainkv.WithKeyComparer(CaseInsensitiveKeyComparer{}))
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for _, k := range []string{"b", "C", "a", "D"} {
+		_, err := od.Set([]byte(k), []byte(k), false)
+		assert.NoError(t, err)
+	}
+
+	v, err := od.Set([]byte("A"), []byte("A"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	assert.Equal(t, []string{"a", "b", "C", "D"}, ReadKeys(od.RangeAsc(plainkv.MinKey, plainkv.MaxKey)))
+	assert.Equal(t, []string{"C", "b"}, ReadKeys(od.RangeDesc([]byte("B"), []byte("c"))))
+	assert.NoError(t, od.Close())
+	_, err = plainkv.OpenOrderedDict(fn, false)
+	assert.Equal(t, plainkv.ErrKeyComparerMismatch, err)
+	od = ReopenOrderedDict(t, fn, plainkv.WithKeyComparer(CaseInsensitiveKeyComparer{}))
+
+	v, ok, err := od.Test([]byte("d"), true)
+
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, []byte("D"), v)
+	}
+
+	assert.NoError(t, od.Verify())
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictPageSize(t *testing.T) {
+	fn := MakeDictFileName(t)
+	_, err := plainkv.OpenOrderedDict(fn, true, plainkv.WithPageSize(3000))
+	assert.Equal(t, plainkv.ErrInvalidPageSize, err)
+	AssertNoDictFiles(t, fn)
+	od, err := plainkv.OpenOrderedDict(fn, true, plainkv.WithPageSize(1<<16))
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("%08d", i))
+		_, err := od.Set(k, k, false)
+		assert.NoError(t, err)
+	}
+
+	stats := od.Stats()
+	assert.Equal(t, 1<<16, stats.BPTreePageSize)
+	assert.NoError(t, od.Close())
+	od = ReopenOrderedDict(t, fn)
+
+	assert.Equal(t, stats.BPTreePageSize, od.Stats().BPTreePageSize)
+	assert.Equal(t, stats.NumberOfBPTreeLeafs, od.Stats().NumberOfBPTreeLeafs)
+	v, ok, err := od.Test([]byte("00005000"), true)
+
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, []byte("00005000"), v)
+	}
+
+	assert.NoError(t, od.Verify())
+	assert.NoError(t, od.Close())
+}
+
+func TestOrderedDictMaxKeyAndValueSizes(t *testing.T) {
+	fn := MakeDictFileName(t)
+	_, err := plainkv.OpenOrderedDict(fn, true, plainkv.WithMaxKeySize(15))
+	assert.Equal(t, plainkv.ErrInvalidMaxKeySize, err)
+	_, err = plainkv.OpenOrderedDict(fn, true, plainkv.WithPageSize(1<<12), plainkv.WithMaxValueSize(1024))
+	assert.Equal(t, plainkv.ErrInvalidMaxValueSize, err)
+	AssertNoDictFiles(t, fn)
+	od, err := plainkv.OpenOrderedDict(fn, true, plainkv.WithMaxKeySize(64), plainkv.WithMaxValueSize(513))
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("%08d", i))
+		v := bytes.Repeat(k, 25+i%25)
+		_, err := od.Set(k, v, false)
+		assert.NoError(t, err)
+	}
+
+	stats := od.Stats()
+	assert.Equal(t, 64, stats.BPTreeMaxKeySize)
+	assert.Equal(t, 513, stats.BPTreeMaxValueSize)
+	assert.NoError(t, od.Close())
+	od = ReopenOrderedDict(t, fn)
+
+	assert.Equal(t, stats.BPTreeMaxKeySize, od.Stats().BPTreeMaxKeySize)
+	assert.Equal(t, stats.BPTreeMaxValueSize, od.Stats().BPTreeMaxValueSize)
+
+	for i := 0; i < 10000; i += 100 {
+		k := []byte(fmt.Sprintf("%08d", i))
+		v, ok, err := od.Test(k, true)
+
+		if assert.NoError(t, err) && assert.True(t, ok) {
+			assert.Equal(t, bytes.Repeat(k, 25+i%25), v)
+		}
+	}
+
+	assert.NoError(t, od.Verify())
+	assert.NoError(t, od.Close())
+}
+
+// KeySequence is a record source of N keys "%08d" from 0 by Step,
+// with the values same as the keys, and with the keys #OutOfOrderAt
+// and #OutOfOrderAt+1 swapped unless OutOfOrderAt is negative.
+type KeySequence struct {
+	N            int
+	Step         int
+	OutOfOrderAt int
+	i            int
+}
+
+func (ks *KeySequence) ReadRecord() ([]byte, []byte, bool, error) {
+	if ks.i == ks.N {
+		return nil, nil, false, nil
+	}
+
+	i := ks.i
+
+	if ks.OutOfOrderAt >= 0 {
+		if i == ks.OutOfOrderAt {
+			i++
+		} else if i == ks.OutOfOrderAt+1 {
+			i--
+		}
+	}
+
+	ks.i++
+	k := []byte(fmt.Sprintf("%08d", i*ks.Step))
+	return k, k, true, nil
+}
+
+type CaseInsensitiveKeyComparer struct{}
+
+func (CaseInsensitiveKeyComparer) Name() string {
+	return "case-insensitive"
+}
+
+func (CaseInsensitiveKeyComparer) CompareKeys(key1 []byte, key2 []byte) int {
+	return bytes.Compare(bytes.ToLower(key1), bytes.ToLower(key2))
+}
+
+type LongNameKeyComparer struct{}
+
+func (LongNameKeyComparer) Name() string {
+	return strings.Repeat("x", 256)
+}
+
+func (LongNameKeyComparer) CompareKeys(key1 []byte, key2 []byte) int {
+	return bytes.Compare(key1, key2)
+}
@@ -1,2 +1,29 @@
 // Package plainkv implements a key/value storage.
 package plainkv
+
+import (
+	"github.com/roy2220/plainkv/internal/corruption"
+	"github.com/roy2220/plainkv/internal/format"
+)
+
+// ErrCorrupted is the error which CorruptedError wraps, so
+// errors.Is(err, ErrCorrupted) reports a corrupted dictionary file.
+var ErrCorrupted = corruption.ErrCorrupted
+
+// CorruptedError is returned when corrupted data is found in a
+// dictionary file, it holds the address of the space where the
+// corrupted data is.
+// A dictionary which has returned a CorruptedError from a write
+// may be left inconsistent, in which case it's poisoned: further
+// writes fail with the error, and closing it discards the changes not
+// checkpointed yet, which the next open recovers from the write-ahead
+// log.
+type CorruptedError = corruption.Error
+
+// ErrUnsupportedFormatVersion is returned when opening a dictionary
+// file written in a format of another version, e.g. by an older
+// release, including a file written before the format was versioned.
+// To migrate such a file, read the keys out with the release which
+// wrote it, and then load them into a new file, e.g. with
+// OrderedDict.BulkLoad.
+var ErrUnsupportedFormatVersion = format.ErrUnsupportedVersion
@@ -0,0 +1,87 @@
+package plainkv
+
+import (
+	"errors"
+
+	"github.com/roy2220/plainkv/bptree"
+)
+
+// OrderedDictSnapshot represents a read-only view of an ordered
+// dictionary at a point in time.
+// The dictionary can be modified while the snapshot lives, which
+// doesn't affect the snapshot. The spaces the snapshot refers to
+// are kept until the snapshot is released, so a snapshot should
+// be released once it's no longer needed.
+// It is safe for concurrent use by multiple goroutines.
+type OrderedDictSnapshot struct {
+	orderedDict *OrderedDict
+	snapshot    *bptree.Snapshot
+}
+
+// Snapshot takes a snapshot of the dictionary.
+func (od *OrderedDict) Snapshot() *OrderedDictSnapshot {
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+	return &OrderedDictSnapshot{
+		orderedDict: od,
+		snapshot:    od.bpTree.TakeSnapshot(),
+	}
+}
+
+// Release releases the snapshot.
+// The iterators over the snapshot are invalidated.
+// If the snapshot has been released it does nothing.
+func (ods *OrderedDictSnapshot) Release() {
+	ods.orderedDict.mutex.Lock()
+	defer ods.orderedDict.mutex.Unlock()
+	ods.snapshot.Release()
+}
+
+// Test tests the given key in the snapshot.
+// If the key exists, it returns true and the present value (optional),
+// otherwise it returns false.
+func (ods *OrderedDictSnapshot) Test(key []byte, returnPresentValue bool) ([]byte, bool, error) {
+	ods.orderedDict.mutex.RLock()
+	defer ods.orderedDict.mutex.RUnlock()
+
+	if ods.snapshot.IsReleased() {
+		return nil, false, ErrSnapshotReleased
+	}
+
+	return ods.snapshot.HasRecord(key, returnPresentValue)
+}
+
+// RangeAsc looks up the the snapshot for keys in the given range
+// [minKey...maxKey] and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in ascending order.
+func (ods *OrderedDictSnapshot) RangeAsc(minKey []byte, maxKey []byte) (OrderedDictIterator, error) {
+	ods.orderedDict.mutex.RLock()
+	defer ods.orderedDict.mutex.RUnlock()
+
+	if ods.snapshot.IsReleased() {
+		return nil, ErrSnapshotReleased
+	}
+
+	return new(orderedDictIterator).Init(ods.orderedDict, ods.snapshot, ods.snapshot.SearchForward(minKey, maxKey)), nil
+}
+
+// RangeDesc looks up the the snapshot for keys in the given range
+// [minKey...maxKey] and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in descending order.
+func (ods *OrderedDictSnapshot) RangeDesc(minKey []byte, maxKey []byte) (OrderedDictIterator, error) {
+	ods.orderedDict.mutex.RLock()
+	defer ods.orderedDict.mutex.RUnlock()
+
+	if ods.snapshot.IsReleased() {
+		return nil, ErrSnapshotReleased
+	}
+
+	return new(orderedDictIterator).Init(ods.orderedDict, ods.snapshot, ods.snapshot.SearchBackward(minKey, maxKey)), nil
+}
+
+// ErrSnapshotReleased is returned when reading from a snapshot
+// which has been released, either explicitly or by closing the
+// dictionary.
+var ErrSnapshotReleased = errors.New("plainkv: snapshot released")
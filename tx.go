@@ -0,0 +1,564 @@
+package plainkv
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/roy2220/plainkv/bptree"
+)
+
+// Tx represents a transaction on an ordered dictionary.
+// The writes in a transaction are buffered in memory, they are
+// visible inside the transaction only and get applied to the
+// dictionary all or nothing on committing.
+// A transaction is merely a buffered write batch with no isolation:
+// its reads see the writes committed by others since it began, and
+// committing doesn't check for conflicts with them, e.g. a value read
+// and then replaced in a transaction may have been replaced by others
+// in between, whose write is then lost.
+// A transaction must not be used by multiple goroutines at the same
+// time.
+type Tx struct {
+	orderedDict *OrderedDict
+	isWritable  bool
+	isDone      bool
+	writes      []txWrite
+}
+
+// Begin begins a transaction on the dictionary.
+func (od *OrderedDict) Begin(writable bool) *Tx {
+	return &Tx{
+		orderedDict: od,
+		isWritable:  writable,
+	}
+}
+
+// Set sets the value for the given key in the transaction to the
+// given value.
+// If the key already exists it replaces the value and then
+// returns the replaced value (optional).
+func (tx *Tx) Set(key []byte, value []byte, returnReplacedValue bool) ([]byte, error) {
+	if err := tx.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	replacedValue, _, err := tx.test(key, returnReplacedValue)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tx.putWrite(txWrite{copyBytes(key), copyBytes(value), false})
+	return replacedValue, nil
+}
+
+// Clear clears the given key in the transaction.
+// If the key exists, it deletes the key and then returns true
+// and the removed value (optional), otherwise if returns false.
+func (tx *Tx) Clear(key []byte, returnRemovedValue bool) ([]byte, bool, error) {
+	if err := tx.checkWritable(); err != nil {
+		return nil, false, err
+	}
+
+	removedValue, ok, err := tx.test(key, returnRemovedValue)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	tx.putWrite(txWrite{copyBytes(key), nil, true})
+	return removedValue, true, nil
+}
+
+// Test tests the given key in the transaction.
+// If the key exists, it returns true and the present value (optional),
+// otherwise it returns false.
+func (tx *Tx) Test(key []byte, returnPresentValue bool) ([]byte, bool, error) {
+	if tx.isDone {
+		return nil, false, ErrTxDone
+	}
+
+	return tx.test(key, returnPresentValue)
+}
+
+// RangeAsc looks up the the transaction for keys in the given range
+// [minKey...maxKey] and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in ascending order.
+// Range with Unbounded is preferred.
+func (tx *Tx) RangeAsc(minKey []byte, maxKey []byte) (OrderedDictIterator, error) {
+	if tx.isDone {
+		return nil, ErrTxDone
+	}
+
+	i, j := tx.rangeKeyWrites(minKey, maxKey)
+	return tx.newIterator(tx.orderedDict.RangeAsc(minKey, maxKey), i, j, false), nil
+}
+
+// RangeDesc looks up the the transaction for keys in the given range
+// [minKey...maxKey] and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in descending order.
+// Range with Unbounded is preferred.
+func (tx *Tx) RangeDesc(minKey []byte, maxKey []byte) (OrderedDictIterator, error) {
+	if tx.isDone {
+		return nil, ErrTxDone
+	}
+
+	i, j := tx.rangeKeyWrites(minKey, maxKey)
+	return tx.newIterator(tx.orderedDict.RangeDesc(minKey, maxKey), i, j, true), nil
+}
+
+// Range looks up the transaction for keys in the range between
+// the given bounds, each of which may be inclusive, exclusive or
+// unbounded, and keys' values.
+// It returns an iterator to iterate over the keys/values found
+// in ascending order, or in descending order if desc is true.
+func (tx *Tx) Range(minBound Bound, maxBound Bound, desc bool) (OrderedDictIterator, error) {
+	if tx.isDone {
+		return nil, ErrTxDone
+	}
+
+	i, j := tx.rangeWrites(minBound, maxBound)
+	return tx.newIterator(tx.orderedDict.Range(minBound, maxBound, desc), i, j, desc), nil
+}
+
+// Commit applies the writes in the transaction to the dictionary
+// and then ends the transaction.
+func (tx *Tx) Commit() error {
+	if tx.isDone {
+		return ErrTxDone
+	}
+
+	if !tx.isWritable {
+		tx.isDone = true
+		return nil
+	}
+
+	var writeBatch WriteBatch
+
+	for i := range tx.writes {
+		write := &tx.writes[i]
+
+		if write.IsDeleted {
+			writeBatch.Delete(write.Key)
+		} else {
+			writeBatch.Put(write.Key, write.Value)
+		}
+	}
+
+	if err := tx.orderedDict.Apply(&writeBatch); err != nil {
+		return err
+	}
+
+	tx.isDone = true
+	tx.writes = nil
+	return nil
+}
+
+// Rollback discards the writes in the transaction and then ends
+// the transaction.
+func (tx *Tx) Rollback() error {
+	if tx.isDone {
+		return ErrTxDone
+	}
+
+	tx.isDone = true
+	tx.writes = nil
+	return nil
+}
+
+func (tx *Tx) checkWritable() error {
+	if tx.isDone {
+		return ErrTxDone
+	}
+
+	if !tx.isWritable {
+		return ErrTxNotWritable
+	}
+
+	return nil
+}
+
+func (tx *Tx) test(key []byte, returnValue bool) ([]byte, bool, error) {
+	if i, ok := tx.locateWrite(key); ok {
+		write := &tx.writes[i]
+
+		if write.IsDeleted {
+			return nil, false, nil
+		}
+
+		if !returnValue {
+			return nil, true, nil
+		}
+
+		return copyBytes(write.Value), true, nil
+	}
+
+	return tx.orderedDict.Test(key, returnValue)
+}
+
+func (tx *Tx) putWrite(write txWrite) {
+	i, ok := tx.locateWrite(write.Key)
+
+	if ok {
+		tx.writes[i] = write
+		return
+	}
+
+	tx.writes = append(tx.writes, txWrite{})
+	copy(tx.writes[i+1:], tx.writes[i:])
+	tx.writes[i] = write
+}
+
+func (tx *Tx) locateWrite(key []byte) (int, bool) {
+	keyComparer := tx.orderedDict.bpTree.KeyComparer()
+
+	i := sort.Search(len(tx.writes), func(i int) bool {
+		return keyComparer.CompareKeys(tx.writes[i].Key, key) >= 0
+	})
+
+	return i, i < len(tx.writes) && keyComparer.CompareKeys(tx.writes[i].Key, key) == 0
+}
+
+// newIterator returns an iterator merging the given record iterator
+// with the writes [i, j).
+func (tx *Tx) newIterator(recordIterator bptree.Iterator, i int, j int, isBackward bool) OrderedDictIterator {
+	return new(txIterator).Init(recordIterator, tx.orderedDict.bpTree.KeyComparer(), tx.copyWrites(i, j), isBackward)
+}
+
+func (tx *Tx) copyWrites(i int, j int) []txWrite {
+	if i == j {
+		return nil
+	}
+
+	// the writes get shifted in place on putting, so an iterator
+	// must not share them.
+	return append([]txWrite(nil), tx.writes[i:j]...)
+}
+
+func (tx *Tx) rangeWrites(minBound Bound, maxBound Bound) (int, int) {
+	var i, j int
+
+	switch {
+	case minBound.IsInclusive():
+		i, _ = tx.locateWrite(minBound.Key())
+	case minBound.IsExclusive():
+		var ok bool
+		i, ok = tx.locateWrite(minBound.Key())
+
+		if ok {
+			i++
+		}
+	default:
+		i = 0
+	}
+
+	switch {
+	case maxBound.IsInclusive():
+		var ok bool
+		j, ok = tx.locateWrite(maxBound.Key())
+
+		if ok {
+			j++
+		}
+	case maxBound.IsExclusive():
+		j, _ = tx.locateWrite(maxBound.Key())
+	default:
+		j = len(tx.writes)
+	}
+
+	if i > j {
+		return 0, 0
+	}
+
+	return i, j
+}
+
+// rangeKeyWrites is the version of rangeWrites for the given range
+// [minKey...maxKey], either of which may be MinKey or MaxKey.
+func (tx *Tx) rangeKeyWrites(minKey []byte, maxKey []byte) (int, int) {
+	if isSameBytes(minKey, MaxKey) || isSameBytes(maxKey, MinKey) {
+		return 0, 0
+	}
+
+	minBound, maxBound := Inclusive(minKey), Inclusive(maxKey)
+
+	if isSameBytes(minKey, MinKey) {
+		minBound = Unbounded
+	}
+
+	if isSameBytes(maxKey, MaxKey) {
+		maxBound = Unbounded
+	}
+
+	return tx.rangeWrites(minBound, maxBound)
+}
+
+var (
+	// ErrTxDone is returned when operating on a transaction which
+	// has been committed or rolled back.
+	ErrTxDone = errors.New("plainkv: transaction done")
+
+	// ErrTxNotWritable is returned when writing in a read-only
+	// transaction.
+	ErrTxNotWritable = errors.New("plainkv: transaction not writable")
+)
+
+type txWrite struct {
+	Key       []byte
+	Value     []byte
+	IsDeleted bool
+}
+
+type txIterator struct {
+	recordIterator   bptree.Iterator
+	keyComparer      KeyComparer
+	recordKey        []byte
+	hasRecord        bool
+	err              error
+	writes           []txWrite
+	isBackward       bool
+	isAtWrite        bool
+	isAtRecordToo    bool
+	hasNoMoreRecords bool
+}
+
+var _ = OrderedDictIterator((*txIterator)(nil))
+
+func (ti *txIterator) Init(recordIterator bptree.Iterator, keyComparer KeyComparer, writes []txWrite, isBackward bool) *txIterator {
+	ti.recordIterator = recordIterator
+	ti.keyComparer = keyComparer
+	ti.writes = writes
+	ti.isBackward = isBackward
+	ti.loadRecordKey()
+	ti.settle()
+	return ti
+}
+
+func (ti *txIterator) IsAtEnd() bool {
+	return ti.hasNoMoreRecords
+}
+
+func (ti *txIterator) Advance() OrderedDictIterator {
+	if ti.hasNoMoreRecords {
+		return ti
+	}
+
+	if ti.isAtWrite {
+		ti.skipWrite()
+
+		if ti.isAtRecordToo {
+			ti.skipRecord()
+		}
+	} else {
+		ti.skipRecord()
+	}
+
+	ti.settle()
+	return ti
+}
+
+func (ti *txIterator) GetKeySize() (int, error) {
+	if ti.hasNoMoreRecords {
+		return 0, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		return len(ti.currentWrite().Key), nil
+	}
+
+	return ti.recordIterator.GetKeySize()
+}
+
+func (ti *txIterator) ReadKey(dataOffset int, buffer []byte) (int, error) {
+	if ti.hasNoMoreRecords {
+		return 0, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		return readBytes(ti.currentWrite().Key, dataOffset, buffer), nil
+	}
+
+	return ti.recordIterator.ReadKey(dataOffset, buffer)
+}
+
+func (ti *txIterator) ReadKeyAll() ([]byte, error) {
+	if ti.hasNoMoreRecords {
+		return nil, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		return copyBytes(ti.currentWrite().Key), nil
+	}
+
+	return ti.recordIterator.ReadKeyAll()
+}
+
+func (ti *txIterator) GetValueSize() (int, error) {
+	if ti.hasNoMoreRecords {
+		return 0, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		return len(ti.currentWrite().Value), nil
+	}
+
+	return ti.recordIterator.GetValueSize()
+}
+
+func (ti *txIterator) ReadValue(dataOffset int, buffer []byte) (int, error) {
+	if ti.hasNoMoreRecords {
+		return 0, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		return readBytes(ti.currentWrite().Value, dataOffset, buffer), nil
+	}
+
+	return ti.recordIterator.ReadValue(dataOffset, buffer)
+}
+
+func (ti *txIterator) ReadValueAll() ([]byte, error) {
+	if ti.hasNoMoreRecords {
+		return nil, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		return copyBytes(ti.currentWrite().Value), nil
+	}
+
+	return ti.recordIterator.ReadValueAll()
+}
+
+func (ti *txIterator) ReadRecordAll() ([]byte, []byte, error) {
+	if ti.hasNoMoreRecords {
+		return nil, nil, ti.endOfIteration()
+	}
+
+	if ti.isAtWrite {
+		write := ti.currentWrite()
+		return copyBytes(write.Key), copyBytes(write.Value), nil
+	}
+
+	return ti.recordIterator.ReadRecordAll()
+}
+
+func (ti *txIterator) Delete() error {
+	return ErrIteratorReadOnly
+}
+
+func (ti *txIterator) SetValue([]byte) error {
+	return ErrIteratorReadOnly
+}
+
+func (ti *txIterator) settle() {
+	for {
+		if ti.err != nil {
+			ti.hasNoMoreRecords = true
+			return
+		}
+
+		hasRecord := ti.hasRecord
+		hasWrite := len(ti.writes) >= 1
+
+		if !hasWrite {
+			ti.isAtWrite = false
+			ti.hasNoMoreRecords = !hasRecord
+			return
+		}
+
+		write := ti.currentWrite()
+		ti.isAtWrite = true
+		ti.isAtRecordToo = false
+
+		if hasRecord {
+			d := ti.keyComparer.CompareKeys(ti.recordKey, write.Key)
+
+			if ti.isBackward {
+				d = -d
+			}
+
+			if d < 0 {
+				ti.isAtWrite = false
+				ti.hasNoMoreRecords = false
+				return
+			}
+
+			ti.isAtRecordToo = d == 0
+		}
+
+		if !write.IsDeleted {
+			ti.hasNoMoreRecords = false
+			return
+		}
+
+		ti.skipWrite()
+
+		if ti.isAtRecordToo {
+			ti.skipRecord()
+		}
+	}
+}
+
+func (ti *txIterator) skipWrite() {
+	if ti.isBackward {
+		ti.writes = ti.writes[:len(ti.writes)-1]
+	} else {
+		ti.writes = ti.writes[1:]
+	}
+}
+
+func (ti *txIterator) skipRecord() {
+	ti.recordIterator.Advance()
+	ti.loadRecordKey()
+}
+
+func (ti *txIterator) loadRecordKey() {
+	recordKey, err := ti.recordIterator.ReadKeyAll()
+
+	if err != nil {
+		if err == ErrIteratorInvalidated || errors.Is(err, ErrCorrupted) {
+			ti.err = err
+		}
+
+		ti.recordKey, ti.hasRecord = nil, false
+		return
+	}
+
+	ti.recordKey, ti.hasRecord = recordKey, true
+}
+
+func (ti *txIterator) endOfIteration() error {
+	if ti.err != nil {
+		return ti.err
+	}
+
+	return errEndOfIteration
+}
+
+func (ti *txIterator) currentWrite() *txWrite {
+	if ti.isBackward {
+		return &ti.writes[len(ti.writes)-1]
+	}
+
+	return &ti.writes[0]
+}
+
+var errEndOfIteration = errors.New("plainkv: end of iteration")
+
+func readBytes(data []byte, dataOffset int, buffer []byte) int {
+	if dataOffset >= len(data) {
+		return 0
+	}
+
+	return copy(buffer, data[dataOffset:])
+}
+
+func isSameBytes(data1 []byte, data2 []byte) bool {
+	return len(data1) >= 1 && len(data2) >= 1 && &data1[0] == &data2[0]
+}
@@ -0,0 +1,184 @@
+package plainkv_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/roy2220/plainkv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxCommitAndRollback(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+
+	for i := 0; i < 100; i += 2 {
+		k := []byte(strconv.Itoa(1000 + i))
+		od.Set(k, k, false)
+	}
+
+	stats := od.Stats()
+
+	for _, commit := range []bool{false, true} {
+		tx := od.Begin(true)
+
+		for i := 0; i < 100; i++ {
+			k := []byte(strconv.Itoa(1000 + i))
+
+			if i%4 == 0 {
+				_, ok, err := tx.Clear(k, false)
+				assert.NoError(t, err)
+				assert.True(t, ok)
+			} else if i%2 == 1 {
+				_, err := tx.Set(k, []byte("x"), false)
+				assert.NoError(t, err)
+			}
+		}
+
+		_, ok, err := tx.Test([]byte("1000"), false)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		_, ok, _ = od.Test([]byte("1000"), false)
+		assert.True(t, ok)
+		v, ok, err := tx.Test([]byte("1001"), true)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("x"), v)
+
+		it, err := tx.Range(plainkv.Unbounded, plainkv.Unbounded, false)
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, ExpectedTxKeys(false), ReadKeys(it))
+		it, err = tx.Range(plainkv.Inclusive([]byte("1010")), plainkv.Inclusive([]byte("1020")), true)
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, []string{"1019", "1018", "1017", "1015", "1014", "1013", "1011", "1010"}, ReadKeys(it))
+		it, err = tx.Range(plainkv.Exclusive([]byte("1010")), plainkv.Exclusive([]byte("1019")), false)
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, []string{"1011", "1013", "1014", "1015", "1017", "1018"}, ReadKeys(it))
+		it, err = tx.RangeAsc(plainkv.MinKey, plainkv.MaxKey)
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, ExpectedTxKeys(false), ReadKeys(it))
+		it, err = tx.RangeDesc([]byte("1010"), []byte("1020"))
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, []string{"1019", "1018", "1017", "1015", "1014", "1013", "1011", "1010"}, ReadKeys(it))
+
+		if commit {
+			assert.NoError(t, tx.Commit())
+			assert.Equal(t, ExpectedTxKeys(false), ReadKeys(od.RangeAsc(plainkv.MinKey, plainkv.MaxKey)))
+			assert.Equal(t, ExpectedTxKeys(true), ReadKeys(od.RangeDesc(plainkv.MinKey, plainkv.MaxKey)))
+		} else {
+			assert.NoError(t, tx.Rollback())
+			assert.Equal(t, stats, od.Stats())
+		}
+
+		assert.Equal(t, plainkv.ErrTxDone, tx.Rollback())
+	}
+}
+
+func TestTxNotWritable(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+	tx := od.Begin(false)
+	_, err := tx.Set([]byte("foo"), []byte("bar"), false)
+	assert.Equal(t, plainkv.ErrTxNotWritable, err)
+	assert.NoError(t, tx.Commit())
+	_, _, err = tx.Test([]byte("foo"), false)
+	assert.Equal(t, plainkv.ErrTxDone, err)
+}
+
+func TestTxKeyComparer(t *testing.T) {
+	od, _ := MakeOrderedDict(t, plainkv.WithKeyComparer(CaseInsensitiveKeyComparer{}))
+	defer od.Close()
+	od.Set([]byte("a"), []byte("a"), false)
+	od.Set([]byte("C"), []byte("C"), false)
+	tx := od.Begin(true)
+	v, err := tx.Set([]byte("A"), []byte("A"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	tx.Set([]byte("b"), []byte("b"), false)
+	tx.Set([]byte("B"), []byte("B"), false)
+	_, ok, err := tx.Clear([]byte("c"), false)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	it, err := tx.Range(plainkv.Unbounded, plainkv.Unbounded, false)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, []string{"A", "B"}, ReadKeys(it))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, []string{"a", "B"}, ReadKeys(od.RangeAsc(plainkv.MinKey, plainkv.MaxKey)))
+}
+
+func TestTxWriteDuringIteration(t *testing.T) {
+	od, _ := MakeOrderedDict(t)
+	defer od.Close()
+	tx := od.Begin(true)
+	tx.Set([]byte("b"), []byte("b"), false)
+	tx.Set([]byte("d"), []byte("d"), false)
+	tx.Set([]byte("f"), []byte("f"), false)
+	it, err := tx.Range(plainkv.Unbounded, plainkv.Unbounded, false)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tx.Set([]byte("a"), []byte("a"), false)
+	tx.Set([]byte("d"), []byte("x"), false)
+	tx.Clear([]byte("f"), false)
+	var kvs []string
+
+	for ; !it.IsAtEnd(); it.Advance() {
+		k, v, err := it.ReadRecordAll()
+		assert.NoError(t, err)
+		kvs = append(kvs, string(k)+"="+string(v))
+	}
+
+	assert.Equal(t, []string{"b=b", "d=d", "f=f"}, kvs)
+	it, err = tx.Range(plainkv.Unbounded, plainkv.Unbounded, false)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, []string{"a", "b", "d"}, ReadKeys(it))
+	assert.NoError(t, tx.Rollback())
+}
+
+func ExpectedTxKeys(desc bool) []string {
+	var ks []string
+
+	for i := 0; i < 100; i++ {
+		if i%4 != 0 {
+			ks = append(ks, strconv.Itoa(1000+i))
+		}
+	}
+
+	if desc {
+		for i, j := 0, len(ks)-1; i < j; i, j = i+1, j-1 {
+			ks[i], ks[j] = ks[j], ks[i]
+		}
+	}
+
+	return ks
+}
@@ -0,0 +1,48 @@
+package plainkv
+
+import "github.com/roy2220/plainkv/internal/wal"
+
+// WriteBatch represents a batch of writes to a dictionary, which
+// are applied all or nothing.
+type WriteBatch struct {
+	operations wal.Entry
+}
+
+// Put adds a write to the batch which sets the value for the
+// given key to the given value, and then returns the batch.
+func (wb *WriteBatch) Put(key []byte, value []byte) *WriteBatch {
+	wb.operations = append(wb.operations, wal.Operation{
+		Type:  wal.OperationPut,
+		Key:   copyBytes(key),
+		Value: copyBytes(value),
+	})
+
+	return wb
+}
+
+// Delete adds a write to the batch which clears the given key,
+// and then returns the batch.
+func (wb *WriteBatch) Delete(key []byte) *WriteBatch {
+	wb.operations = append(wb.operations, wal.Operation{
+		Type: wal.OperationDelete,
+		Key:  copyBytes(key),
+	})
+
+	return wb
+}
+
+// Len returns the number of the writes in the batch.
+func (wb *WriteBatch) Len() int {
+	return len(wb.operations)
+}
+
+// Reset removes all the writes in the batch.
+func (wb *WriteBatch) Reset() {
+	wb.operations = nil
+}
+
+func copyBytes(data []byte) []byte {
+	buffer := make([]byte, len(data))
+	copy(buffer, data)
+	return buffer
+}
@@ -0,0 +1,78 @@
+package plainkv_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/roy2220/plainkv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderedDictApply(t *testing.T) {
+	od, fn := MakeOrderedDict(t)
+
+	if !assert.NoError(t, od.Apply(MakeWriteBatch())) {
+		t.FailNow()
+	}
+
+	// crash without closing the dictionary
+	assert.NoError(t, od.SimulateCrash())
+	od = ReopenOrderedDict(t, fn)
+	defer od.Close()
+
+	for i := 0; i < 100; i++ {
+		k := []byte(strconv.Itoa(i))
+		v, ok, _ := od.Test(k, true)
+
+		if i%3 == 0 {
+			assert.False(t, ok)
+		} else if assert.True(t, ok) {
+			assert.Equal(t, []byte(strconv.Itoa(-i)), v)
+		}
+	}
+}
+
+func TestDictApply(t *testing.T) {
+	d, fn := MakeDict(t)
+
+	if !assert.NoError(t, d.Apply(MakeWriteBatch())) {
+		t.FailNow()
+	}
+
+	// crash without closing the dictionary
+	assert.NoError(t, d.SimulateCrash())
+	d = ReopenDict(t, fn)
+	defer d.Close()
+
+	for i := 0; i < 100; i++ {
+		k := []byte(strconv.Itoa(i))
+		v, ok, _ := d.Test(k, true)
+
+		if i%3 == 0 {
+			assert.False(t, ok)
+		} else if assert.True(t, ok) {
+			assert.Equal(t, []byte(strconv.Itoa(-i)), v)
+		}
+	}
+}
+
+func MakeWriteBatch() *plainkv.WriteBatch {
+	var wb plainkv.WriteBatch
+
+	for i := 0; i < 100; i++ {
+		k := []byte(strconv.Itoa(i))
+		wb.Put(k, k)
+	}
+
+	for i := 0; i < 100; i++ {
+		k := []byte(strconv.Itoa(i))
+
+		if i%3 == 0 {
+			wb.Delete(k)
+		} else {
+			wb.Put(k, []byte(strconv.Itoa(-i)))
+		}
+	}
+
+	return &wb
+}